@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/sandbox"
+)
+
+func denoCommand() *cobra.Command {
+	cfg := config.NewConfig()
+	var cmd = &cobra.Command{
+		Use:   "deno",
+		Short: "Manage the deno versions installed in the data directory",
+	}
+	cmd.PersistentFlags().StringVar(&cfg.DataDir, "data", "./mls-data", "Path to keep Matterless state")
+	cmd.PersistentFlags().StringVar(&cfg.DenoVersion, "deno-version", sandbox.DefaultDenoVersion, "Deno version Matterless is configured to run")
+	cmd.AddCommand(denoListCommand(cfg), denoInstallCommand(cfg), denoPruneCommand(cfg))
+	return cmd
+}
+
+func denoListCommand(cfg *config.Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List installed deno versions",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			installs, err := sandbox.ListDenoInstalls(cfg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, install := range installs {
+				marker := " "
+				if install.Version == cfg.DenoVersion {
+					marker = "*"
+				}
+				fmt.Printf("%s %-10s sha256:%s\n", marker, install.Version, install.SHA256)
+			}
+		},
+	}
+}
+
+func denoInstallCommand(cfg *config.Config) *cobra.Command {
+	var archive string
+	var cmd = &cobra.Command{
+		Use:   "install [version]",
+		Short: "Install a deno version (the configured one by default) from the mirror or a local archive",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			version := cfg.DenoVersion
+			if len(args) > 0 {
+				version = args[0]
+			}
+			var err error
+			if archive == "" {
+				if archive, err = sandbox.DenoArchiveLocation(cfg.DenoMirror, version); err != nil {
+					log.Fatal(err)
+				}
+			}
+			install, err := sandbox.InstallDeno(cfg, version, archive, cfg.DenoSHA256)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Installed deno %s (sha256:%s) to %s\n", install.Version, install.SHA256, install.Path)
+		},
+	}
+	cmd.Flags().StringVar(&archive, "archive", "", "Path or URL of the zip archive to install from, rather than the mirror")
+	cmd.Flags().StringVar(&cfg.DenoMirror, "deno-mirror", "", "URL or directory to download deno archives from (default GitHub releases)")
+	cmd.Flags().StringVar(&cfg.DenoSHA256, "sha256", "", "Expected SHA-256 checksum of the archive")
+	cmd.Flags().BoolVar(&cfg.DenoAllowUnverified, "allow-unverified", false, "Install the archive even when no checksum is known for it")
+	return cmd
+}
+
+func denoPruneCommand(cfg *config.Config) *cobra.Command {
+	var keep []string
+	var cmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Remove all installed deno versions but the configured one",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			removed, err := sandbox.PruneDenoInstalls(cfg, keep)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, version := range removed {
+				fmt.Printf("Removed deno %s\n", version)
+			}
+		},
+	}
+	cmd.Flags().StringSliceVar(&keep, "keep", []string{}, "Other versions to keep, e.g. those functions ask for")
+	return cmd
+}
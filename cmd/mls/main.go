@@ -4,9 +4,13 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
+	"github.com/mitchellh/mapstructure"
+	"github.com/zefhemel/matterless/pkg/cluster"
 	"github.com/zefhemel/matterless/pkg/definition"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,15 +19,24 @@ import (
 	"github.com/zefhemel/matterless/pkg/application"
 	"github.com/zefhemel/matterless/pkg/client"
 	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/sandbox"
 	"github.com/zefhemel/matterless/pkg/util"
 )
 
+// Environment variables to pass the NATS and MQTT passwords in, so that they don't show up in process listings
+const (
+	natsPasswordEnv = "MLS_NATS_PASSWORD"
+	mqttPasswordEnv = "MLS_MQTT_PASSWORD"
+)
+
 func runCommand() *cobra.Command {
 	var (
 		watch  bool
 		attach bool
 	)
 	cfg := config.NewConfig()
+	cfg.ClusterNatsPassword = os.Getenv(natsPasswordEnv)
+	cfg.MQTTPassword = os.Getenv(mqttPasswordEnv)
 	var cmd = &cobra.Command{
 		Use:   "run [file.md]",
 		Short: "Run matterless in ad-hoc mode for specified markdown definition file",
@@ -64,6 +77,29 @@ func runCommand() *cobra.Command {
 	cmd.Flags().StringVarP(&cfg.AdminToken, "token", "t", "", "Admin API token")
 	cmd.Flags().StringVar(&cfg.DataDir, "data", "./mls-data", "Path to keep Matterless state")
 	cmd.Flags().StringVarP(&cfg.ClusterNatsUrl, "nats", "n", "nats://localhost:4222", "NATS server to connect to")
+	cmd.Flags().StringToStringVar(&cfg.NodeLabels, "label", map[string]string{}, "Label to advertise for this node, used for placement (key=value)")
+	cmd.Flags().StringVar(&cfg.ClusterListen, "cluster-listen", "", "Address (host:port) for the embedded NATS server to accept cluster routes on")
+	cmd.Flags().StringSliceVar(&cfg.ClusterPeers, "cluster-peers", []string{}, "Cluster route addresses (host:port) of the embedded NATS servers of other nodes")
+	cmd.Flags().StringVar(&cfg.ClusterServerName, "cluster-server-name", "", "Unique name of the embedded NATS server (default: hostname-port)")
+	cmd.Flags().IntVar(&cfg.ClusterReplicas, "replicas", 1, "Number of JetStream replicas to keep of all state")
+	cmd.Flags().BoolVar(&cfg.ClusterLegacySubjects, "legacy-subjects", false, "Also publish events on the NATS subjects used by older versions")
+	cmd.Flags().StringVar(&cfg.MQTTListen, "mqtt-listen", "", "Address (host:port) for the embedded NATS server to accept MQTT connections on")
+	cmd.Flags().StringVar(&cfg.MQTTUser, "mqtt-user", "", "Username MQTT clients authenticate with")
+	cmd.Flags().StringVar(&cfg.MQTTPasswordFile, "mqtt-password-file", "", "Path to a file holding the MQTT password (default: $"+mqttPasswordEnv+")")
+	cmd.Flags().StringVar(&cfg.ClusterNatsUser, "nats-user", "", "NATS username")
+	cmd.Flags().StringVar(&cfg.ClusterNatsPasswordFile, "nats-password-file", "", "Path to a file holding the NATS password (default: $"+natsPasswordEnv+")")
+	cmd.Flags().StringVar(&cfg.ClusterNatsNKeySeedFile, "nats-nkey", "", "Path to NATS nkey seed file")
+	cmd.Flags().StringVar(&cfg.ClusterNatsCredsFile, "nats-creds", "", "Path to NATS user credentials file")
+	cmd.Flags().StringVar(&cfg.ClusterNatsTLSCert, "nats-tls-cert", "", "Path to NATS TLS certificate")
+	cmd.Flags().StringVar(&cfg.ClusterNatsTLSKey, "nats-tls-key", "", "Path to NATS TLS key")
+	cmd.Flags().StringVar(&cfg.ClusterNatsTLSCA, "nats-tls-ca", "", "Path to NATS TLS CA certificate")
+	cmd.Flags().StringVar(&cfg.DenoVersion, "deno-version", sandbox.DefaultDenoVersion, "Deno version to run functions with, unless they ask for a specific one")
+	cmd.Flags().StringVar(&cfg.DenoMirror, "deno-mirror", "", "URL or directory to download deno archives from (default GitHub releases)")
+	cmd.Flags().StringVar(&cfg.DenoSHA256, "deno-sha256", "", "Expected SHA-256 checksum of the deno archive")
+	cmd.Flags().StringToStringVar(&cfg.DenoChecksums, "deno-checksum", map[string]string{}, "Expected SHA-256 checksum of the deno archive of another version functions ask for (version=sha256)")
+	cmd.Flags().BoolVar(&cfg.DenoAllowUnverified, "deno-allow-unverified", false, "Install deno archives no checksum is known for")
+	cmd.Flags().BoolVar(&cfg.DenoVendor, "deno-vendor", false, "Vendor the modules deno code imports into the cluster on deploy, and never fetch them at run time")
+	cmd.Flags().BoolVar(&cfg.EnableExecRuntime, "enable-exec-runtime", false, "Allow functions and jobs to use the exec runtime, which runs any command on the node")
 
 	return cmd
 }
@@ -200,10 +236,14 @@ func receiveLogs(mlsClient *client.MatterlessClient, appName string) {
 
 	go func() {
 		for message := range ch {
-			data, ok := message.Data.(map[string]interface{})
-			if ok {
-				fmt.Printf("[LOG] %s: %s", data["function"], data["message"])
+			var lm cluster.LogMessage
+			if err := mapstructure.Decode(message.Data, &lm); err != nil {
+				continue
+			}
+			if !lm.Level.AtLeast(promptContext.logLevel) {
+				continue
 			}
+			fmt.Printf("[%s] %s: %s\n", strings.ToUpper(string(lm.Level)), lm.Function, lm.Message)
 		}
 	}()
 	if err := mlsClient.SubscribeEvent("*.log"); err != nil {
@@ -252,16 +292,132 @@ func infoCommand() *cobra.Command {
 				return
 			}
 			fmt.Println(util.MustJsonString(info))
+			for _, nodeID := range info.Unresponsive {
+				fmt.Printf("Warning: node %d is alive, but did not respond\n", nodeID)
+			}
+			for _, nodeID := range info.Down {
+				if member, ok := info.Members[nodeID]; ok {
+					fmt.Printf("Warning: node %d (%s) is down, last seen %s\n", nodeID, member.Address, member.LastSeen.Format(time.RFC3339))
+				} else {
+					fmt.Printf("Warning: node %d is down\n", nodeID)
+				}
+			}
+			for _, sub := range info.CrossApp {
+				fmt.Printf("App %s: %s listen to %s events of app %s\n", sub.App, strings.Join(sub.Functions, ", "), sub.Pattern, sub.SourceApp)
+				if len(sub.Grants) == 0 {
+					fmt.Printf("Warning: app %s does not export any events to app %s\n", sub.SourceApp, sub.App)
+				}
+			}
+			for nodeID, nodeInfo := range info.Nodes {
+				for appName, appInfo := range nodeInfo.Apps {
+					for jobName, states := range appInfo.JobStates {
+						for _, state := range states {
+							if state == cluster.JobStateCrashLoop {
+								fmt.Printf("Warning: job %s of app %s is crash looping on node %d\n", jobName, appName, nodeID)
+							}
+						}
+					}
+				}
+			}
+		},
+	}
+	cmd.Flags().StringVar(&url, "url", "http://localhost:8222", "URL of matterless server to connect to")
+	cmd.Flags().StringVarP(&adminToken, "token", "t", "", "Root token for Matterless server")
+
+	return cmd
+}
+
+func clusterCommand() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "cluster",
+		Short: "Manage the Matterless cluster",
+	}
+	cmd.AddCommand(rebalanceCommand())
+	return cmd
+}
+
+func nodeCommand() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "node",
+		Short: "Manage individual cluster nodes",
+	}
+	cmd.AddCommand(
+		nodeActionCommand("cordon", "Stop placing new jobs on a node"),
+		nodeActionCommand("uncordon", "Allow job placements on a node again, and stop draining it"),
+		nodeActionCommand("drain", "Cordon a node, move its jobs elsewhere and stop its function workers"),
+	)
+	return cmd
+}
+
+func nodeActionCommand(action string, short string) *cobra.Command {
+	var (
+		url        string
+		adminToken string
+	)
+	var cmd = &cobra.Command{
+		Use:   fmt.Sprintf("%s [id]", action),
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			nodeID, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				fmt.Printf("Invalid node ID: %s\n", args[0])
+				os.Exit(1)
+			}
+			mlsClient := client.NewMatterlessClient(url, adminToken)
+			if err := mlsClient.NodeAction(nodeID, action); err != nil {
+				fmt.Printf("Error: %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Node %d: %s OK\n", nodeID, action)
+		},
+	}
+	cmd.Flags().StringVar(&url, "url", "http://localhost:8222", "URL of matterless server to connect to")
+	cmd.Flags().StringVarP(&adminToken, "token", "t", "", "Root token for Matterless server")
+
+	return cmd
+}
+
+func rebalanceCommand() *cobra.Command {
+	var (
+		url        string
+		adminToken string
+		dryRun     bool
+	)
+	var cmd = &cobra.Command{
+		Use:   "rebalance",
+		Short: "Rebalance job instances across cluster nodes",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			mlsClient := client.NewMatterlessClient(url, adminToken)
+			moves, err := mlsClient.Rebalance(dryRun)
+			if err != nil {
+				fmt.Printf("Error rebalancing: %s\n", err)
+				return
+			}
+			if len(moves) == 0 {
+				fmt.Println("Cluster is balanced, nothing to move")
+				return
+			}
+			for _, move := range moves {
+				fmt.Printf("Move job %s of app %s from node %d to node %d\n", move.Job, move.App, move.From, move.To)
+			}
+			if !dryRun {
+				fmt.Println("Moves will be performed gradually by the cluster leader")
+			}
 		},
 	}
 	cmd.Flags().StringVar(&url, "url", "http://localhost:8222", "URL of matterless server to connect to")
 	cmd.Flags().StringVarP(&adminToken, "token", "t", "", "Root token for Matterless server")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only show the moves that would be made")
 
 	return cmd
 }
 
 func rootCommand() *cobra.Command {
 	cfg := config.NewConfig()
+	cfg.ClusterNatsPassword = os.Getenv(natsPasswordEnv)
+	cfg.MQTTPassword = os.Getenv(mqttPasswordEnv)
 
 	var cmd = &cobra.Command{
 		Use:   "mls",
@@ -276,6 +432,29 @@ func rootCommand() *cobra.Command {
 	cmd.Flags().StringVarP(&cfg.AdminToken, "token", "t", "", "Admin API token")
 	cmd.Flags().StringVar(&cfg.DataDir, "data", "./mls-data", "location to keep Matterless state")
 	cmd.Flags().StringVarP(&cfg.ClusterNatsUrl, "nats", "n", "nats://localhost:4222", "NATS server to connect to")
+	cmd.Flags().StringToStringVar(&cfg.NodeLabels, "label", map[string]string{}, "Label to advertise for this node, used for placement (key=value)")
+	cmd.Flags().StringVar(&cfg.ClusterListen, "cluster-listen", "", "Address (host:port) for the embedded NATS server to accept cluster routes on")
+	cmd.Flags().StringSliceVar(&cfg.ClusterPeers, "cluster-peers", []string{}, "Cluster route addresses (host:port) of the embedded NATS servers of other nodes")
+	cmd.Flags().StringVar(&cfg.ClusterServerName, "cluster-server-name", "", "Unique name of the embedded NATS server (default: hostname-port)")
+	cmd.Flags().IntVar(&cfg.ClusterReplicas, "replicas", 1, "Number of JetStream replicas to keep of all state")
+	cmd.Flags().BoolVar(&cfg.ClusterLegacySubjects, "legacy-subjects", false, "Also publish events on the NATS subjects used by older versions")
+	cmd.Flags().StringVar(&cfg.MQTTListen, "mqtt-listen", "", "Address (host:port) for the embedded NATS server to accept MQTT connections on")
+	cmd.Flags().StringVar(&cfg.MQTTUser, "mqtt-user", "", "Username MQTT clients authenticate with")
+	cmd.Flags().StringVar(&cfg.MQTTPasswordFile, "mqtt-password-file", "", "Path to a file holding the MQTT password (default: $"+mqttPasswordEnv+")")
+	cmd.Flags().StringVar(&cfg.ClusterNatsUser, "nats-user", "", "NATS username")
+	cmd.Flags().StringVar(&cfg.ClusterNatsPasswordFile, "nats-password-file", "", "Path to a file holding the NATS password (default: $"+natsPasswordEnv+")")
+	cmd.Flags().StringVar(&cfg.ClusterNatsNKeySeedFile, "nats-nkey", "", "Path to NATS nkey seed file")
+	cmd.Flags().StringVar(&cfg.ClusterNatsCredsFile, "nats-creds", "", "Path to NATS user credentials file")
+	cmd.Flags().StringVar(&cfg.ClusterNatsTLSCert, "nats-tls-cert", "", "Path to NATS TLS certificate")
+	cmd.Flags().StringVar(&cfg.ClusterNatsTLSKey, "nats-tls-key", "", "Path to NATS TLS key")
+	cmd.Flags().StringVar(&cfg.ClusterNatsTLSCA, "nats-tls-ca", "", "Path to NATS TLS CA certificate")
+	cmd.Flags().StringVar(&cfg.DenoVersion, "deno-version", sandbox.DefaultDenoVersion, "Deno version to run functions with, unless they ask for a specific one")
+	cmd.Flags().StringVar(&cfg.DenoMirror, "deno-mirror", "", "URL or directory to download deno archives from (default GitHub releases)")
+	cmd.Flags().StringVar(&cfg.DenoSHA256, "deno-sha256", "", "Expected SHA-256 checksum of the deno archive")
+	cmd.Flags().StringToStringVar(&cfg.DenoChecksums, "deno-checksum", map[string]string{}, "Expected SHA-256 checksum of the deno archive of another version functions ask for (version=sha256)")
+	cmd.Flags().BoolVar(&cfg.DenoAllowUnverified, "deno-allow-unverified", false, "Install deno archives no checksum is known for")
+	cmd.Flags().BoolVar(&cfg.DenoVendor, "deno-vendor", false, "Vendor the modules deno code imports into the cluster on deploy, and never fetch them at run time")
+	cmd.Flags().BoolVar(&cfg.EnableExecRuntime, "enable-exec-runtime", false, "Allow functions and jobs to use the exec runtime, which runs any command on the node")
 
 	return cmd
 }
@@ -284,7 +463,7 @@ func main() {
 	log.SetLevel(log.DebugLevel)
 
 	cmd := rootCommand()
-	cmd.AddCommand(runCommand(), deployCommand(), attachCommand(), infoCommand(), ppCommand())
+	cmd.AddCommand(runCommand(), deployCommand(), attachCommand(), infoCommand(), ppCommand(), checkCommand(), clusterCommand(), nodeCommand(), denoCommand())
 	cmd.Execute()
 }
 
@@ -295,8 +474,22 @@ func runServer(cfg *config.Config) *application.Container {
 	}
 
 	// Subscribe to all logs and write to stdout
-	appContainer.ClusterEventBus().SubscribeContainerLogs(func(appName, funcName, message string) {
-		log.Infof("LOG [%s | %s]: %s", appName, funcName, message)
+	appContainer.ClusterEventBus().SubscribeContainerLogs(func(appName, funcName string, message cluster.LogMessage) {
+		entry := log.WithField("app", appName).WithField("function", funcName)
+		if message.InvocationID != "" {
+			entry = entry.WithField("invocation", message.InvocationID)
+		}
+		entry = entry.WithFields(message.Fields)
+		switch message.Level {
+		case cluster.LogLevelDebug:
+			entry.Debug(message.Message)
+		case cluster.LogLevelWarn:
+			entry.Warn(message.Message)
+		case cluster.LogLevelError:
+			entry.Error(message.Message)
+		default:
+			entry.Info(message.Message)
+		}
 	})
 
 	if err := appContainer.Start(); err != nil {
@@ -9,6 +9,7 @@ import (
 	"github.com/c-bata/go-prompt"
 	log "github.com/sirupsen/logrus"
 	"github.com/zefhemel/matterless/pkg/client"
+	"github.com/zefhemel/matterless/pkg/cluster"
 	"github.com/zefhemel/matterless/pkg/definition"
 	"github.com/zefhemel/matterless/pkg/util"
 )
@@ -27,6 +28,7 @@ func completer(in prompt.Document) []prompt.Suggest {
 		{Text: "keys", Description: "[key-prefix] — query keys from the store"},
 		{Text: "trigger", Description: "[eventName] [evenData] — trigger an event"},
 		{Text: "invoke", Description: "[functionName] [evenData] — invoke a function"},
+		{Text: "log-level", Description: "[debug|info|warn|error] — only show logs at this level or above"},
 		{Text: "exit", Description: "Exit"},
 	}
 	w := in.GetWordBeforeCursor()
@@ -74,6 +76,17 @@ func executor(cmd string) {
 	switch blocks[0] {
 	case "reload", "r":
 		promptContext.reloadCallback()
+	case "log-level":
+		if len(blocks) != 2 {
+			fmt.Printf("Current log level: %s\n", promptContext.logLevel)
+			return
+		}
+		switch level := cluster.LogLevel(blocks[1]); level {
+		case cluster.LogLevelDebug, cluster.LogLevelInfo, cluster.LogLevelWarn, cluster.LogLevelError:
+			promptContext.logLevel = level
+		default:
+			fmt.Println("Invalid log level, use one of: debug, info, warn, error")
+		}
 	case "exit":
 		fmt.Println("Bye!")
 		promptContext.exitCallback()
@@ -238,11 +251,14 @@ type PromptContext struct {
 	client         *client.MatterlessClient
 	allAppNames    []string
 	defs           *definition.Definitions
+	logLevel       cluster.LogLevel
 	reloadCallback func()
 	exitCallback   func()
 }
 
-var promptContext = &PromptContext{}
+var promptContext = &PromptContext{
+	logLevel: cluster.LogLevelDebug,
+}
 
 func livePrefix() (string, bool) {
 	if promptContext.appName == "" {
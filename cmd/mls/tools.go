@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/zefhemel/matterless/pkg/config"
 	"github.com/zefhemel/matterless/pkg/definition"
+	"github.com/zefhemel/matterless/pkg/sandbox"
 	"os"
 	"strings"
 )
@@ -16,7 +19,7 @@ func ppCommand() *cobra.Command {
 	)
 	var cmd = &cobra.Command{
 		Use:   "pp file.md",
-		Short: "Preprocesses (includes all imports, expands macros) for a file",
+		Short: "Preprocesses (includes all imports, expands macros, shows effective permissions) for a file",
 		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			path := args[0]
@@ -45,9 +48,49 @@ func prerenderFile(path string, dataDir string) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	defs.ExpandPermissions()
 	outPath := strings.Replace(path, ".md", ".pp.md", 1)
 	if err := os.WriteFile(outPath, []byte(defs.Markdown()), 0600); err != nil {
 		log.Fatal(err)
 	}
 	fmt.Println("Output in ", outPath)
 }
+
+func checkCommand() *cobra.Command {
+	cfg := config.NewConfig()
+	var types bool
+	var cmd = &cobra.Command{
+		Use:   "check file.md",
+		Short: "Checks a file for errors, optionally type checking its typescript functions, jobs and libraries",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			path := args[0]
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defs, err := definition.Check(path, string(buf), "")
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := sandbox.ValidateDefinitions(defs); err != nil {
+				log.Fatal(err)
+			}
+			if types {
+				if err := sandbox.CheckDenoTypes(context.Background(), cfg, defs); err != nil {
+					log.Fatalf("Type errors:\n%s", err)
+				}
+			}
+			fmt.Println("No errors found in", path)
+		},
+	}
+	cmd.Flags().StringVar(&cfg.DataDir, "data", "./mls-data", "Path to keep Matterless state")
+	cmd.Flags().BoolVar(&types, "types", false, "Type check typescript functions, jobs and libraries with deno")
+	cmd.Flags().StringVar(&cfg.DenoVersion, "deno-version", sandbox.DefaultDenoVersion, "Deno version to type check with, unless functions ask for a specific one")
+	cmd.Flags().StringVar(&cfg.DenoMirror, "deno-mirror", "", "URL or directory to download deno archives from (default GitHub releases)")
+	cmd.Flags().StringVar(&cfg.DenoSHA256, "deno-sha256", "", "Expected SHA-256 checksum of the deno archive")
+	cmd.Flags().StringToStringVar(&cfg.DenoChecksums, "deno-checksum", map[string]string{}, "Expected SHA-256 checksum of the deno archive of another version functions ask for (version=sha256)")
+	cmd.Flags().BoolVar(&cfg.DenoAllowUnverified, "deno-allow-unverified", false, "Install deno archives no checksum is known for")
+
+	return cmd
+}
@@ -1,6 +1,6 @@
 module github.com/zefhemel/matterless
 
-go 1.17
+go 1.18
 
 require (
 	github.com/c-bata/go-prompt v0.2.5
@@ -13,11 +13,13 @@ require (
 	github.com/mitchellh/mapstructure v1.4.1
 	github.com/nats-io/nats-server/v2 v2.4.0
 	github.com/nats-io/nats.go v1.12.0
+	github.com/nats-io/nkeys v0.3.0
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.8.0
 	github.com/spf13/cobra v1.1.3
 	github.com/stretchr/testify v1.7.0
 	github.com/syndtr/goleveldb v1.0.0
+	github.com/tetratelabs/wazero v1.0.1
 	github.com/yuin/goldmark v1.3.2
 	github.com/zefhemel/yamlschema v0.0.0-20210331100236-6d05c787ad8c
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
@@ -36,7 +38,6 @@ require (
 	github.com/minio/highwayhash v1.0.1 // indirect
 	github.com/mitchellh/reflectwalk v1.0.2 // indirect
 	github.com/nats-io/jwt/v2 v2.0.3 // indirect
-	github.com/nats-io/nkeys v0.3.0 // indirect
 	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/pkg/term v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
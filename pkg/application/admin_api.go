@@ -5,10 +5,12 @@ import (
 	"io"
 	"net/http"
 	"path/filepath"
-	"time"
+	"strconv"
 
 	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
 	"github.com/zefhemel/matterless/pkg/definition"
+	"github.com/zefhemel/matterless/pkg/sandbox"
 	"github.com/zefhemel/matterless/pkg/util"
 )
 
@@ -39,6 +41,12 @@ func (ag *APIGateway) exposeAdminAPI() {
 			return
 		}
 
+		// Reject definitions asking for runtimes (or runtime capabilities) not registered, rather than failing on first invocation
+		if err := sandbox.ValidateDefinitions(defs); err != nil {
+			util.HTTPWriteJSONError(w, http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+
 		// Check if all required configuration area already present in the data store, if not
 		existingApp, err := ag.container.GetOrCreate(appName)
 		if err != nil {
@@ -49,6 +57,19 @@ func (ag *APIGateway) exposeAdminAPI() {
 			return
 		}
 
+		// Fetch all remote modules deno code imports now, rather than on first invocation, failing on import errors
+		modulePaths, err := sandbox.CacheDenoDefinitions(r.Context(), ag.config, defs)
+		if err != nil {
+			util.HTTPWriteJSONError(w, http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+		if ag.config.DenoVendor {
+			if err := vendorDenoModules(ag.config, ag.container.Store(), appName, modulePaths); err != nil {
+				util.HTTPWriteJSONError(w, http.StatusInternalServerError, "could-not-vendor", err.Error())
+				return
+			}
+		}
+
 		// Rather than applying this locally, we'll store it just in the store, which in turn will lead to the app
 		// being loaded
 		if err := ag.container.Store().Put(fmt.Sprintf("app:%s", appName), defs); err != nil {
@@ -74,7 +95,7 @@ func (ag *APIGateway) exposeAdminAPI() {
 		if !ag.authAdmin(w, r) {
 			return
 		}
-		info, err := ag.container.ClusterEventBus().FetchClusterInfo(1 * time.Second)
+		info, err := ag.container.FetchClusterInfo()
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprint(w, err.Error())
@@ -83,6 +104,53 @@ func (ag *APIGateway) exposeAdminAPI() {
 		fmt.Fprint(w, util.MustJsonString(info))
 	}).Methods("GET")
 
+	ag.rootRouter.HandleFunc("/_node/{id}/{action:cordon|uncordon|drain}", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		vars := mux.Vars(r)
+		if !ag.authAdmin(w, r) {
+			return
+		}
+		nodeID, err := strconv.ParseUint(vars["id"], 10, 64)
+		if err != nil {
+			util.HTTPWriteJSONError(w, http.StatusBadRequest, "invalid node id", nil)
+			return
+		}
+		ceb := ag.container.ClusterEventBus()
+		switch vars["action"] {
+		case "cordon":
+			err = ceb.CordonNode(nodeID, true, ag.config.ClusterFetchInfoTimeout)
+		case "uncordon":
+			err = ceb.CordonNode(nodeID, false, ag.config.ClusterFetchInfoTimeout)
+		case "drain":
+			err = ceb.DrainNode(nodeID, ag.config.ClusterFetchInfoTimeout)
+		}
+		if err != nil {
+			util.HTTPWriteJSONError(w, http.StatusInternalServerError, fmt.Sprintf("could not reach node %d: %s", nodeID, err), nil)
+			return
+		}
+		fmt.Fprint(w, "OK")
+	}).Methods("POST")
+
+	ag.rootRouter.HandleFunc("/_rebalance", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if !ag.authAdmin(w, r) {
+			return
+		}
+		moves, err := ag.container.PlanRebalance()
+		if err != nil {
+			util.HTTPWriteJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+			return
+		}
+		if r.URL.Query().Get("dry_run") != "true" {
+			// The leader does the actual work
+			if err := ag.container.ClusterEventBus().RequestRebalance(); err != nil {
+				util.HTTPWriteJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+				return
+			}
+		}
+		fmt.Fprint(w, util.MustJsonString(moves))
+	}).Methods("POST")
+
 	ag.rootRouter.HandleFunc("/{app}", func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 		vars := mux.Vars(r)
@@ -121,6 +189,9 @@ func (ag *APIGateway) exposeAdminAPI() {
 			fmt.Fprint(w, err.Error())
 			return
 		}
+		if err := unvendorDenoModules(ag.container.Store(), appName); err != nil {
+			log.Errorf("Could not remove vendored deno modules of app %s: %s", appName, err)
+		}
 
 		fmt.Fprint(w, "OK")
 	}).Methods("DELETE")
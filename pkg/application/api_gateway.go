@@ -101,6 +101,7 @@ func (ag *APIGateway) buildRouter(config *config.Config) {
 
 	// Expose internal API routes
 	ag.exposeEventAPI()
+	ag.exposeHealthAPI()
 	ag.exposeAdminAPI()
 	ag.exposeStoreAPI()
 	ag.exposeFunctionAPI()
@@ -1,9 +1,15 @@
 package application
 
 import (
+	"context"
+	"crypto/sha1"
 	"fmt"
 	"github.com/mitchellh/copystructure"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
@@ -21,20 +27,30 @@ type Application struct {
 	appName                string
 	definitions            *definition.Definitions
 	unprocessedDefinitions *definition.Definitions
+	revision               string
 
 	// Runtime
 	config                  *config.Config
 	eventBus                *cluster.ClusterEventBus
 	eventsSubscription      cluster.Subscription
 	startWorkerSubscription cluster.Subscription
+	jobExitedSubscription   cluster.Subscription
+	stopWorkerSubscription  cluster.Subscription
+	mqttSubscriptions       []cluster.Subscription
+	natsSubscriptions       []cluster.Subscription
+	wildcardListeners       []wildcardListener
 	sandbox                 *sandbox.Sandbox
+	leaderElection          *cluster.LeaderElection
+	nodeLabels              map[string]string
+	drainingLock            sync.Mutex
+	draining                bool // Don't run function workers on this node
 
 	// API
 	apiToken  string
 	dataStore store.Store
 }
 
-func NewApplication(cfg *config.Config, appName string, s store.Store, ceb *cluster.ClusterEventBus) (*Application, error) {
+func NewApplication(cfg *config.Config, appName string, s store.Store, ceb *cluster.ClusterEventBus, le *cluster.LeaderElection, nodeLabels map[string]string) (*Application, error) {
 	apiURL := fmt.Sprintf("http://%s:%d/%s", "%s", cfg.APIBindPort, appName)
 	apiToken := util.TokenGenerator()
 	sb, err := sandbox.NewSandbox(cfg, apiURL, apiToken, ceb)
@@ -42,31 +58,43 @@ func NewApplication(cfg *config.Config, appName string, s store.Store, ceb *clus
 		return nil, errors.Wrap(err, "sandbox create")
 	}
 	app := &Application{
-		config:      cfg,
-		appName:     appName,
-		eventBus:    ceb,
-		apiToken:    apiToken,
-		sandbox:     sb,
-		definitions: definition.NewDefinitions(),
+		config:         cfg,
+		appName:        appName,
+		eventBus:       ceb,
+		apiToken:       apiToken,
+		sandbox:        sb,
+		leaderElection: le,
+		definitions:    definition.NewDefinitions(),
+		nodeLabels:     nodeLabels,
 	}
 
-	app.dataStore = store.NewEventedStore(s, func(key string, val interface{}) {
+	app.dataStore = store.NewEventedStore(s, func(key string, oldVal, newVal interface{}) {
 		if err := app.PublishAppEvent(fmt.Sprintf("store:put:%s", key), map[string]interface{}{
 			"key":       key,
-			"new_value": val,
+			"new_value": newVal,
 		}); err != nil {
 			log.Errorf("Could not publish store:put event: %s", err)
 		}
+		if _, ok := app.definitions.Config[key]; ok && !reflect.DeepEqual(oldVal, newVal) {
+			app.publishConfigChanged(key, oldVal, newVal)
+		}
 	}, func(key string) {
 		if err := app.PublishAppEvent(fmt.Sprintf("store:del.%s", key), map[string]interface{}{
 			"key": key,
 		}); err != nil {
 			log.Errorf("Could not publish store:del event: %s", err)
 		}
+		if _, ok := app.definitions.Config[key]; ok {
+			app.publishConfigChanged(key, nil, nil)
+		}
+	}).WithOldValues(func(key string) bool {
+		// Only config keys need their old value, to detect changes
+		_, ok := app.definitions.Config[key]
+		return ok
 	})
 
 	app.eventsSubscription, err = app.eventBus.QueueSubscribeEvent("*", func(name string, data interface{}, msg *nats.Msg) {
-		if funcsToInvoke, ok := app.definitions.Events[name]; ok {
+		if funcsToInvoke := app.listenersFor(name); len(funcsToInvoke) > 0 {
 			for _, funcToInvoke := range funcsToInvoke {
 				resp, err := app.InvokeFunction(string(funcToInvoke), data)
 				if err != nil {
@@ -78,19 +106,55 @@ func NewApplication(cfg *config.Config, appName string, s store.Store, ceb *clus
 					}
 				}
 			}
+			if name == definition.EventShutdown && msg.Reply != "" {
+				// Let the leader know the handlers are done
+				if err := msg.Respond(util.MustJsonByteSlice(struct{}{})); err != nil {
+					log.Error("Could not respond to event")
+				}
+			}
 		}
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "event subscribe")
 	}
 
-	app.startWorkerSubscription, err = app.eventBus.SubscribeRequestJobWorker(func(jobName string) {
-		job := app.definitions.Jobs[definition.FunctionID(jobName)]
+	app.startWorkerSubscription, err = app.eventBus.SubscribeRequestJobWorker(le.ID, func(jobName string, fencingToken uint64) error {
+		if err := le.CheckFencingToken(fencingToken); err != nil {
+			log.Errorf("Rejecting request to start job %s: %s", jobName, err)
+			return err
+		}
+		job, ok := app.definitions.Jobs[definition.FunctionID(jobName)]
+		if !ok {
+			return fmt.Errorf("no such job: %s", jobName)
+		}
 		log.Info("Starting job worker ", jobName)
 		if err := app.sandbox.StartJobWorker(definition.FunctionID(jobName), job.Config, job.Code, app.definitions.Libraries); err != nil {
 			log.Errorf("Could not start job %s: %s", jobName, err)
+			return err
 		}
+		return nil
 	})
+	if err != nil {
+		return nil, errors.Wrap(err, "start worker subscribe")
+	}
+
+	app.stopWorkerSubscription, err = app.eventBus.SubscribeStopJobWorker(le.ID, func(jobName string, n int, fencingToken uint64) error {
+		if err := le.CheckFencingToken(fencingToken); err != nil {
+			log.Errorf("Rejecting request to stop job %s: %s", jobName, err)
+			return err
+		}
+		log.Infof("Stopping %d job worker(s) for %s", n, jobName)
+		app.sandbox.StopJobWorkers(definition.FunctionID(jobName), n)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "stop worker subscribe")
+	}
+
+	app.jobExitedSubscription, err = app.eventBus.SubscribeJobExited(app.jobExited)
+	if err != nil {
+		return nil, errors.Wrap(err, "job exited subscribe")
+	}
 
 	return app, nil
 }
@@ -116,21 +180,132 @@ func (app *Application) PublishAppEvent(name string, event interface{}) error {
 	return app.eventBus.PublishEvent(name, event)
 }
 
+func (app *Application) publishConfigChanged(key string, oldVal, newVal interface{}) {
+	if err := app.PublishAppEvent(definition.EventConfigChanged, map[string]interface{}{
+		"key":       key,
+		"old_value": oldVal,
+		"new_value": newVal,
+	}); err != nil {
+		log.Errorf("Could not publish %s event: %s", definition.EventConfigChanged, err)
+	}
+}
+
+// jobExited turns job exit reports from sandboxes into job:exited app events, on the leader
+func (app *Application) jobExited(jobExit cluster.JobExit) {
+	if !app.leaderElection.IsLeader() {
+		return
+	}
+	if jobExit.State == cluster.JobStateCrashLoop {
+		log.Warnf("Job %s in app %s is crash looping after %d restarts, giving up", jobExit.Name, app.appName, jobExit.Restarts)
+	}
+	if err := app.PublishAppEvent(definition.EventJobExited, map[string]interface{}{
+		"job":       jobExit.Name,
+		"exit_code": jobExit.ExitCode,
+		"stderr":    jobExit.Stderr,
+		"restarts":  jobExit.Restarts,
+		"state":     jobExit.State,
+	}); err != nil {
+		log.Errorf("Could not publish %s event: %s", definition.EventJobExited, err)
+	}
+}
+
+// ListensTo returns whether any function is subscribed to the given event name
+func (app *Application) ListensTo(eventName string) bool {
+	return len(app.listenersFor(eventName)) > 0
+}
+
+// listenersFor returns the functions subscribed to the given event name, either directly or through a wildcard pattern
+func (app *Application) listenersFor(eventName string) []definition.FunctionID {
+	listeners := append([]definition.FunctionID{}, app.definitions.Events[eventName]...)
+	for _, wl := range app.wildcardListeners {
+		if wl.name != eventName && wl.pattern.Matches(eventName) {
+			listeners = append(listeners, wl.functions...)
+		}
+	}
+	return listeners
+}
+
+// wildcardListener holds the functions subscribed to a pattern containing *, with the pattern compiled once per deploy
+type wildcardListener struct {
+	name      string
+	pattern   cluster.EventPattern
+	functions []definition.FunctionID
+}
+
+func compileWildcardListeners(events map[string][]definition.FunctionID) []wildcardListener {
+	names := []string{}
+	for name := range events {
+		if strings.Contains(name, "*") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	listeners := make([]wildcardListener, 0, len(names))
+	for _, name := range names {
+		listeners = append(listeners, wildcardListener{
+			name:      name,
+			pattern:   cluster.NewEventPattern(name),
+			functions: events[name],
+		})
+	}
+	return listeners
+}
+
+// Shutdown gives the app's shutdown event handlers up to a grace period to finish before the app is stopped or
+// reloaded. Only the leader sends the actual event and waits for its handlers, other nodes wait for the invocations in
+// flight on them, since handlers may run on any node
+func (app *Application) Shutdown(leader bool, reason string) {
+	if !app.ListensTo(definition.EventShutdown) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.AppShutdownGracePeriod)
+	defer cancel()
+	if leader {
+		// Shutdown requests are answered once all handlers have run
+		if _, err := app.eventBus.RequestEvent(definition.EventShutdown, map[string]interface{}{
+			"reason":   reason,
+			"revision": app.revision,
+		}, app.config.AppShutdownGracePeriod); err != nil {
+			log.Errorf("Shutdown event handlers did not finish: %s", err)
+		}
+	}
+	app.sandbox.WaitForInvocations(ctx)
+}
+
 func (app *Application) Eval(defs *definition.Definitions) error {
 	defsCopy, err := copystructure.Copy(defs)
 	if err != nil {
 		return errors.Wrap(err, "deep copy of defs")
 	}
 	app.unprocessedDefinitions = defs
+	app.revision = definitionsRevision(defs)
 	app.definitions = defsCopy.(*definition.Definitions)
 	app.definitions.InterpolateStoreValues(app.dataStore)
+	app.wildcardListeners = compileWildcardListeners(app.definitions.Events)
 
 	// fmt.Println(app.definitions.Markdown())
 
 	app.reset()
 
 	log.Info("Loading functions...")
+	app.startFunctionWorkers()
+	app.subscribeMQTT()
+	app.subscribeNATSTriggers()
+
+	log.Info("Ready to go.")
+	return nil
+}
+
+func (app *Application) startFunctionWorkers() {
+	if app.isDraining() {
+		log.Info("Node is draining, not starting function workers")
+		return
+	}
 	for name, def := range app.definitions.Functions {
+		if !definition.MatchesNodeSelector(def.Config.NodeSelector, app.nodeLabels) {
+			log.Infof("Not starting function workers for %s on this node: node selector does not match", name)
+			continue
+		}
 		for i := 0; i < def.Config.Instances; i++ {
 			log.Infof("Starting function worker for %s", name)
 			if err := app.sandbox.StartFunctionWorker(string(name), def.Config, def.Code, app.definitions.Libraries); err != nil {
@@ -138,9 +313,32 @@ func (app *Application) Eval(defs *definition.Definitions) error {
 			}
 		}
 	}
+}
 
-	log.Info("Ready to go.")
-	return nil
+func (app *Application) isDraining() bool {
+	app.drainingLock.Lock()
+	defer app.drainingLock.Unlock()
+	return app.draining
+}
+
+// Drain stops all function workers of the app on this node after their in-flight invocations finish
+func (app *Application) Drain() {
+	app.drainingLock.Lock()
+	app.draining = true
+	app.drainingLock.Unlock()
+	app.sandbox.DrainFunctionWorkers()
+}
+
+// Undrain restarts function workers on this node after a drain
+func (app *Application) Undrain() {
+	app.drainingLock.Lock()
+	if !app.draining {
+		app.drainingLock.Unlock()
+		return
+	}
+	app.draining = false
+	app.drainingLock.Unlock()
+	app.startFunctionWorkers()
 }
 
 func (app *Application) EvalString(code string) error {
@@ -164,6 +362,14 @@ func (app *Application) Close() error {
 	if err := app.startWorkerSubscription.Unsubscribe(); err != nil {
 		return err
 	}
+	if err := app.stopWorkerSubscription.Unsubscribe(); err != nil {
+		return err
+	}
+	if err := app.jobExitedSubscription.Unsubscribe(); err != nil {
+		return err
+	}
+	app.unsubscribeMQTT()
+	app.unsubscribeNATSTriggers()
 	app.reset()
 	return app.dataStore.Close()
 }
@@ -180,6 +386,17 @@ func (app *Application) Sandbox() *sandbox.Sandbox {
 	return app.sandbox
 }
 
+// Revision returns a content-based identifier of the currently loaded definitions
+func (app *Application) Revision() string {
+	return app.revision
+}
+
+func definitionsRevision(defs *definition.Definitions) string {
+	h := sha1.New()
+	h.Write(util.MustJsonByteSlice(defs))
+	return fmt.Sprintf("%x", h.Sum(nil))[:12]
+}
+
 func (app *Application) Name() string {
 	return app.appName
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/zefhemel/matterless/pkg/definition"
 	"os"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -14,6 +15,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/zefhemel/matterless/pkg/cluster"
 	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/sandbox"
 	"github.com/zefhemel/matterless/pkg/store"
 	"github.com/zefhemel/matterless/pkg/util"
 )
@@ -23,13 +25,38 @@ type Container struct {
 	clusterConn           *nats.Conn
 	clusterEventBus       *cluster.ClusterEventBus
 	clusterLeaderElection *cluster.LeaderElection
+	clusterMembership     *cluster.Membership
 	clusterStore          *store.JetstreamStore
+	appsLock              sync.RWMutex
 	apps                  map[string]*Application
 	apiGateway            *APIGateway
 	done                  chan struct{}
 	desiredStateLock      sync.Mutex
+	nodeLabels            map[string]string
+
+	// Cordon and drain state of this node
+	nodeStateLock sync.Mutex
+	cordoned      bool
+	draining      bool
+
+	// Rebalancing state, protected by desiredStateLock
+	knownNodes       map[cluster.NodeID]bool
+	rebalancePending bool
+
+	// Cross-app event wiring, with the subscriptions to events of apps other apps subscribe to, per source app
+	crossAppLock          sync.Mutex
+	crossAppWiring        []*cluster.CrossAppSubscription
+	crossAppRoutes        map[string][]crossAppRoute
+	crossAppSubscriptions map[string]cluster.Subscription
+
+	// Queues of (re)deploys, restarts and deletes per app, run off the subscription callbacks
+	appTasksLock sync.Mutex
+	appTasks     map[string]chan func()
 }
 
+// Number of app tasks that can be queued before the subscription callback blocks
+const appTaskQueueSize = 16
+
 const (
 	AdminTokenKey = "AdminToken"
 )
@@ -38,8 +65,15 @@ func NewContainer(config *config.Config) (*Container, error) {
 	var err error
 	appMap := map[string]*Application{}
 	c := &Container{
-		config: config,
-		apps:   appMap,
+		config:     config,
+		apps:       appMap,
+		nodeLabels: nodeLabels(config),
+		knownNodes: map[cluster.NodeID]bool{},
+
+		crossAppWiring:        []*cluster.CrossAppSubscription{},
+		crossAppSubscriptions: map[string]cluster.Subscription{},
+		appTasks:              map[string]chan func(){},
+		done:                  make(chan struct{}),
 	}
 
 	if err = os.MkdirAll(config.DataDir, 0700); err != nil {
@@ -51,19 +85,31 @@ func NewContainer(config *config.Config) (*Container, error) {
 		return nil, errors.Wrap(err, "create container nats")
 	}
 
-	c.clusterLeaderElection, err = cluster.NewLeaderElection(c.clusterConn, fmt.Sprintf("%s.currentLeader", config.ClusterNatsPrefix), fmt.Sprintf("%s.heartbeat", config.ClusterNatsPrefix), 2*time.Second)
+	c.clusterLeaderElection, err = cluster.NewLeaderElection(c.clusterConn, fmt.Sprintf("%s_leader", config.ClusterNatsPrefix), config.ClusterLeaderLeaseTTL, config.ClusterReplicas)
 	if err != nil {
 		return nil, errors.Wrap(err, "leader election")
 	}
 
-	c.clusterEventBus = cluster.NewClusterEventBus(c.clusterConn, config.ClusterNatsPrefix)
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	c.clusterMembership, err = cluster.NewMembership(c.clusterConn, fmt.Sprintf("%s.heartbeat", config.ClusterNatsPrefix), config.ClusterHeartbeatInterval, cluster.MemberInfo{
+		ID:      c.clusterLeaderElection.ID,
+		Address: fmt.Sprintf("%s:%d", hostname, config.APIBindPort),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "membership")
+	}
+
+	c.clusterEventBus = cluster.NewClusterEventBus(c.clusterConn, config.ClusterNatsPrefix).WithLegacySubjects(config.ClusterLegacySubjects)
 
 	clusterWrappedStore, err := store.NewLevelDBStore(fmt.Sprintf("%s/.cluster_store", config.DataDir))
 	if err != nil {
 		return nil, errors.Wrap(err, "create cluster leveldb store")
 	}
 
-	c.clusterStore, err = store.NewJetstreamStore(c.clusterConn, fmt.Sprintf("%s_cluster", config.ClusterNatsPrefix), clusterWrappedStore)
+	c.clusterStore, err = store.NewJetstreamStore(c.clusterConn, fmt.Sprintf("%s_cluster", config.ClusterNatsPrefix), clusterWrappedStore, config.ClusterReplicas)
 	if err != nil {
 		return nil, errors.Wrap(err, "create cluster store")
 	}
@@ -105,7 +151,6 @@ func (c *Container) Start() error {
 			return err
 		}
 	}
-	c.done = make(chan struct{})
 	go c.monitorCluster()
 
 	return nil
@@ -115,34 +160,57 @@ func (c *Container) subscribeToEvents() {
 
 	c.clusterStore.SubscribePuts(func(event store.PutMessage) {
 		if strings.HasPrefix(event.Key, "app:") {
-			var err error
 			appName := event.Key[len("app:"):]
-			log.Infof("Loading app %s...", appName)
-			app, err := c.GetOrCreate(appName)
-			if err != nil {
-				log.Errorf("Could not create app: %s", appName)
-				return
-			}
+			// Shutdown handlers may take a while, don't hold up the subscription
+			c.runAppTask(appName, func() {
+				var err error
+				log.Infof("Loading app %s...", appName)
+				app, err := c.GetOrCreate(appName)
+				if err != nil {
+					log.Errorf("Could not create app: %s", appName)
+					return
+				}
 
-			var defs definition.Definitions
-			if err := json.Unmarshal(util.MustJsonByteSlice(event.Value), &defs); err != nil {
-				log.Errorf("Could not unmarshall definitions: %s", err)
-				return
-			}
+				var defs definition.Definitions
+				if err := json.Unmarshal(util.MustJsonByteSlice(event.Value), &defs); err != nil {
+					log.Errorf("Could not unmarshall definitions: %s", err)
+					return
+				}
 
-			if err := app.Eval(&defs); err != nil {
-				log.Errorf("Could not evaluate app: %s", err)
-				return
-			}
+				if c.config.DenoVendor {
+					// Like on boot, the app isn't evaluated without its modules, a running version of it keeps running
+					if err := restoreDenoModules(c.config, c.clusterStore, appName); err != nil {
+						log.Errorf("Could not restore vendored deno modules of app %s, not deploying it: %s", appName, err)
+						return
+					}
+				}
 
-			if c.clusterLeaderElection.IsLeader() {
-				if err := c.bringToDesiredState(); err != nil {
-					log.Errorf("Could not bring cluster to desired state: %s", err)
+				oldRevision := app.Revision()
+				app.Shutdown(c.clusterLeaderElection.IsLeader(), "redeploy")
+
+				if err := app.Eval(&defs); err != nil {
+					log.Errorf("Could not evaluate app: %s", err)
+					return
 				}
-				if err := app.PublishAppEvent("init", struct{}{}); err != nil {
-					log.Errorf("could not send init event: %s", err)
+				c.wireCrossAppEvents()
+
+				if c.clusterLeaderElection.IsLeader() {
+					if err := c.bringToDesiredState(); err != nil {
+						log.Errorf("Could not bring cluster to desired state: %s", err)
+					}
+					if err := app.PublishAppEvent(definition.EventInit, struct{}{}); err != nil {
+						log.Errorf("could not send init event: %s", err)
+					}
+					if oldRevision != app.Revision() {
+						if err := app.PublishAppEvent(definition.EventDeployed, map[string]interface{}{
+							"old_revision": oldRevision,
+							"new_revision": app.Revision(),
+						}); err != nil {
+							log.Errorf("could not send deployed event: %s", err)
+						}
+					}
 				}
-			}
+			})
 		}
 	})
 
@@ -150,10 +218,13 @@ func (c *Container) subscribeToEvents() {
 		if strings.HasPrefix(event.Key, "app:") {
 			appName := event.Key[len("app:"):]
 
-			log.Infof("Deleting app %s...", appName)
-			if err := c.DeleteApp(appName); err != nil {
-				log.Errorf("Could not delete app: %s", err)
-			}
+			c.runAppTask(appName, func() {
+				log.Infof("Deleting app %s...", appName)
+				if err := c.DeleteApp(appName); err != nil {
+					log.Errorf("Could not delete app: %s", err)
+				}
+				c.wireCrossAppEvents()
+			})
 		}
 	})
 
@@ -161,26 +232,100 @@ func (c *Container) subscribeToEvents() {
 		return c.NodeInfo()
 	})
 
+	c.clusterEventBus.SubscribeCordonNode(c.clusterLeaderElection.ID, func(cordoned bool) {
+		c.nodeStateLock.Lock()
+		defer c.nodeStateLock.Unlock()
+		c.cordoned = cordoned
+		if !cordoned && c.draining {
+			log.Info("Stopped draining this node")
+			c.draining = false
+			for _, app := range c.appSnapshot() {
+				app.Undrain()
+			}
+		}
+		log.Infof("Node cordoned: %t", cordoned)
+	})
+
+	c.clusterEventBus.SubscribeDrainNode(c.clusterLeaderElection.ID, func() {
+		c.nodeStateLock.Lock()
+		c.cordoned = true
+		c.draining = true
+		c.nodeStateLock.Unlock()
+		log.Info("Draining this node")
+		// The leader moves jobs away, function workers are stopped once their in-flight work finishes
+		go func() {
+			for _, app := range c.appSnapshot() {
+				app.Drain()
+			}
+			log.Info("Stopped all function workers")
+		}()
+	})
+
+	c.clusterEventBus.SubscribeRebalance(func() {
+		if !c.clusterLeaderElection.IsLeader() {
+			return
+		}
+		c.desiredStateLock.Lock()
+		c.rebalancePending = true
+		c.desiredStateLock.Unlock()
+		if err := c.bringToDesiredState(); err != nil {
+			log.Errorf("Could not bring cluster to desired state: %s", err)
+		}
+	})
+
 	c.clusterEventBus.SubscribeRestartApp(func(appName string) {
 		app := c.Get(appName)
 		if app == nil {
 			log.Errorf("Asked to restart non-existing app: %s", appName)
 			return
 		}
-		if err := app.Eval(app.unprocessedDefinitions); err != nil {
-			log.Errorf("Error starting app: %s", err)
-		}
-		if c.clusterLeaderElection.IsLeader() {
-			if err := c.bringToDesiredState(); err != nil {
-				log.Errorf("Could not bring cluster to desired state: %s", err)
+		c.runAppTask(appName, func() {
+			app.Shutdown(c.clusterLeaderElection.IsLeader(), "restart")
+			if err := app.Eval(app.unprocessedDefinitions); err != nil {
+				log.Errorf("Error starting app: %s", err)
 			}
-			if err := app.PublishAppEvent("init", struct{}{}); err != nil {
-				log.Errorf("could not send init event: %s", err)
+			if c.clusterLeaderElection.IsLeader() {
+				if err := c.bringToDesiredState(); err != nil {
+					log.Errorf("Could not bring cluster to desired state: %s", err)
+				}
+				if err := app.PublishAppEvent(definition.EventInit, struct{}{}); err != nil {
+					log.Errorf("could not send init event: %s", err)
+				}
 			}
-		}
+		})
 	})
 }
 
+// runAppTask runs task in the background, tasks of the same app run one at a time in the order they were queued.
+// Tasks queued once the container is closing are dropped
+func (c *Container) runAppTask(appName string, task func()) {
+	c.appTasksLock.Lock()
+	tasks, ok := c.appTasks[appName]
+	if !ok {
+		tasks = make(chan func(), appTaskQueueSize)
+		c.appTasks[appName] = tasks
+		go c.appTaskRunner(tasks)
+	}
+	c.appTasksLock.Unlock()
+	select {
+	case tasks <- task:
+	case <-c.done:
+		// The runner is gone once the container is closing
+		log.Debugf("Dropping task for app %s, shutting down", appName)
+	}
+}
+
+func (c *Container) appTaskRunner(tasks chan func()) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case task := <-tasks:
+			task()
+		}
+	}
+}
+
 func (c *Container) loadApps() error {
 	results, err := c.clusterStore.QueryPrefix("app:")
 	if err != nil {
@@ -196,10 +341,16 @@ func (c *Container) loadApps() error {
 		if err != nil {
 			return errors.Wrap(err, "create app")
 		}
+		if c.config.DenoVendor {
+			if err := restoreDenoModules(c.config, c.clusterStore, appName); err != nil {
+				return errors.Wrap(err, "restore vendored deno modules")
+			}
+		}
 		if err := app.Eval(&defs); err != nil {
 			return errors.Wrap(err, "eval app")
 		}
 	}
+	c.wireCrossAppEvents()
 	if c.clusterLeaderElection.IsLeader() {
 		if err := c.bringToDesiredState(); err != nil {
 			return errors.Wrap(err, "desired state")
@@ -225,19 +376,117 @@ func (c *Container) monitorCluster() {
 func (c *Container) bringToDesiredState() error {
 	c.desiredStateLock.Lock()
 	defer c.desiredStateLock.Unlock()
-	clusterInfo, err := c.clusterEventBus.FetchClusterInfo(c.config.ClusterFetchInfoTimeout)
+	clusterInfo, err := c.FetchClusterInfo()
 	if err != nil {
 		return errors.Wrap(err, "fetch cluster info")
 	}
 	// Iterate over all apps
-	for _, app := range c.apps {
-		c.bringAppToDesiredState(app, clusterInfo)
+	changed := false
+	for _, app := range c.appSnapshot() {
+		if c.bringAppToDesiredState(app, clusterInfo) {
+			changed = true
+		}
+	}
+
+	if c.drainJobs(clusterInfo) {
+		changed = true
+	}
+
+	if c.membershipChanged(clusterInfo) {
+		log.Info("Cluster membership changed, rebalancing jobs")
+		c.rebalancePending = true
+	}
+	// Only rebalance based on up to date cluster info
+	if c.rebalancePending && !changed {
+		c.rebalance(clusterInfo)
 	}
 
 	return nil
 }
 
-func (c *Container) bringAppToDesiredState(app *Application, clusterInfo *cluster.ClusterInfo) {
+// membershipChanged returns whether the set of nodes in clusterInfo differs from the one seen last time
+func (c *Container) membershipChanged(clusterInfo *cluster.ClusterInfo) bool {
+	changed := len(clusterInfo.Nodes) != len(c.knownNodes)
+	for nodeID := range clusterInfo.Nodes {
+		if !c.knownNodes[nodeID] {
+			changed = true
+		}
+	}
+	c.knownNodes = map[cluster.NodeID]bool{}
+	for nodeID := range clusterInfo.Nodes {
+		c.knownNodes[nodeID] = true
+	}
+	return changed
+}
+
+// rebalance moves up to ClusterRebalanceMaxMoves job instances to even out the load across nodes, the remaining moves
+// are left for the next round
+func (c *Container) rebalance(clusterInfo *cluster.ClusterInfo) {
+	moves := PlanRebalance(c.appDefinitions(), clusterInfo)
+	for i, move := range moves {
+		if i == c.config.ClusterRebalanceMaxMoves {
+			return
+		}
+		if err := c.moveJob(move); err != nil {
+			log.Errorf("Could not move job %s of app %s from node %d to %d: %s", move.Job, move.App, move.From, move.To, err)
+			return
+		}
+	}
+	c.rebalancePending = false
+}
+
+// moveJob starts a new instance of a job on the target node, and only once that succeeded stops one on the source node
+func (c *Container) moveJob(move JobMove) error {
+	app := c.Get(move.App)
+	if app == nil {
+		return errors.New("app not found")
+	}
+	log.Infof("Moving job %s of app %s from node %d to %d", move.Job, move.App, move.From, move.To)
+	if err := app.eventBus.RequestJobWorkers(move.To, move.Job, 1, c.clusterLeaderElection.FencingToken(), c.config.SandboxJobStartTimeout); err != nil {
+		return errors.Wrap(err, "start replacement")
+	}
+	if err := app.eventBus.RequestStopJobWorkers(move.From, move.Job, 1, c.clusterLeaderElection.FencingToken(), c.config.SandboxJobStopTimeout); err != nil {
+		return errors.Wrap(err, "stop original")
+	}
+	return nil
+}
+
+// drainJobs moves all job instances away from draining nodes, returns whether any moves were made
+func (c *Container) drainJobs(clusterInfo *cluster.ClusterInfo) bool {
+	moved := false
+	for _, move := range PlanDrain(c.appDefinitions(), clusterInfo) {
+		if move.To == 0 {
+			log.Warnf("Cannot drain job %s of app %s from node %d: no other eligible node", move.Job, move.App, move.From)
+			continue
+		}
+		if err := c.moveJob(move); err != nil {
+			log.Errorf("Could not move job %s of app %s from node %d to %d: %s", move.Job, move.App, move.From, move.To, err)
+			continue
+		}
+		moved = true
+	}
+	return moved
+}
+
+// PlanRebalance computes the job moves a rebalance of the cluster would currently make
+func (c *Container) PlanRebalance() ([]JobMove, error) {
+	clusterInfo, err := c.FetchClusterInfo()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch cluster info")
+	}
+	return PlanRebalance(c.appDefinitions(), clusterInfo), nil
+}
+
+func (c *Container) appDefinitions() map[string]*definition.Definitions {
+	defs := map[string]*definition.Definitions{}
+	for appName, app := range c.appSnapshot() {
+		defs[appName] = app.Definitions()
+	}
+	return defs
+}
+
+// bringAppToDesiredState starts missing and stops surplus job instances, returns whether any changes were requested
+func (c *Container) bringAppToDesiredState(app *Application, clusterInfo *cluster.ClusterInfo) bool {
 	//functionInstancesToStart := map[definition.FunctionID]int{}
 	jobInstancesToStart := map[definition.FunctionID]int{}
 
@@ -255,18 +504,46 @@ func (c *Container) bringAppToDesiredState(app *Application, clusterInfo *cluste
 			continue
 		}
 		for jobName, runningInstances := range appInfo.JobWorkers {
+			// Jobs no longer defined end up with a negative count, and will be stopped
 			jobInstancesToStart[definition.FunctionID(jobName)] -= runningInstances
 		}
 	}
 
-	// We're now left with a map with not running jobs, let's kick those off
+	// We're now left with a map with not running jobs (positive) and surplus jobs (negative), let's reconcile those
+	changed := false
 	for jobName, toStart := range jobInstancesToStart {
-		if toStart <= 0 {
-			continue
+		switch {
+		case toStart > 0:
+			placement := PlaceJobInstances(app.Name(), app.definitions, clusterInfo, jobName, toStart)
+			placed := 0
+			for nodeID, nodeToStart := range placement {
+				placed += nodeToStart
+				log.Infof("Now requesting %d instances of %s on node %d", nodeToStart, jobName, nodeID)
+				if err := app.eventBus.RequestJobWorkers(nodeID, string(jobName), nodeToStart, c.clusterLeaderElection.FencingToken(), c.config.SandboxJobStartTimeout); err != nil {
+					log.Errorf("Could not start workers: %s", err)
+				}
+			}
+			if placed > 0 {
+				changed = true
+			}
+			if placed < toStart {
+				log.Warnf("Could only place %d out of %d instances of %s: no nodes match its placement constraints", placed, toStart, jobName)
+			}
+		case toStart < 0:
+			c.stopSurplusJobWorkers(app, clusterInfo, jobName, -toStart)
+			changed = true
 		}
-		log.Infof("Now requesting %d instances of %s", toStart, jobName)
-		if err := app.eventBus.RequestJobWorkers(string(jobName), toStart, c.config.SandboxJobStartTimeout); err != nil {
-			log.Errorf("Could not start workers: %s", err)
+	}
+	return changed
+}
+
+// stopSurplusJobWorkers stops n workers of a job, taking them from the most loaded nodes first
+func (c *Container) stopSurplusJobWorkers(app *Application, clusterInfo *cluster.ClusterInfo, jobName definition.FunctionID, n int) {
+	toStop := PlanJobWorkerStops(app.Name(), clusterInfo, jobName, n)
+	for nodeID, stopCount := range toStop {
+		log.Infof("Now requesting node %d to stop %d instances of %s", nodeID, stopCount, jobName)
+		if err := app.eventBus.RequestStopJobWorkers(nodeID, string(jobName), stopCount, c.clusterLeaderElection.FencingToken(), c.config.SandboxJobStopTimeout); err != nil {
+			log.Errorf("Could not stop workers: %s", err)
 		}
 	}
 }
@@ -283,7 +560,7 @@ func (c *Container) CreateApp(appName string) (*Application, error) {
 		return nil, errors.Wrap(err, "create data store dir")
 	}
 
-	jsStore, err := store.NewJetstreamStore(c.clusterConn, fmt.Sprintf("%s_%s", c.config.ClusterNatsPrefix, appName), levelDBStore)
+	jsStore, err := store.NewJetstreamStore(c.clusterConn, fmt.Sprintf("%s_%s", c.config.ClusterNatsPrefix, appName), levelDBStore, c.config.ClusterReplicas)
 	if err != nil {
 		return nil, errors.Wrap(err, "create jetstream store")
 	}
@@ -292,12 +569,17 @@ func (c *Container) CreateApp(appName string) (*Application, error) {
 		return nil, errors.Wrap(err, "jetstream store connect")
 	}
 
-	app, err := NewApplication(c.config, appName, jsStore, cluster.NewClusterEventBus(c.clusterConn, fmt.Sprintf("%s.%s", c.config.ClusterNatsPrefix, appName)))
+	app, err := NewApplication(c.config, appName, jsStore, cluster.NewClusterEventBus(c.clusterConn, fmt.Sprintf("%s.%s", c.config.ClusterNatsPrefix, appName)).WithLegacySubjects(c.config.ClusterLegacySubjects), c.clusterLeaderElection, c.nodeLabels)
 	if err != nil {
 		return nil, err
 	}
+	c.nodeStateLock.Lock()
+	app.draining = c.draining // Not shared yet, no need to lock
+	c.nodeStateLock.Unlock()
 
+	c.appsLock.Lock()
 	c.apps[appName] = app
+	c.appsLock.Unlock()
 
 	return app, nil
 }
@@ -312,14 +594,17 @@ func (c *Container) GetOrCreate(name string) (*Application, error) {
 }
 
 func (c *Container) DeleteApp(name string) error {
-	if app, ok := c.apps[name]; ok {
+	if app := c.Get(name); app != nil {
+		app.Shutdown(c.clusterLeaderElection.IsLeader(), "delete")
 		if err := app.Close(); err != nil {
 			return errors.Wrap(err, "closing app")
 		}
 		if err := app.dataStore.DeleteStore(); err != nil {
 			return errors.Wrap(err, "delete store")
 		}
+		c.appsLock.Lock()
 		delete(c.apps, name)
+		c.appsLock.Unlock()
 		return nil
 	} else {
 		return errors.New("app not found")
@@ -328,12 +613,52 @@ func (c *Container) DeleteApp(name string) error {
 
 func (c *Container) Close() {
 	close(c.done)
-	for _, app := range c.apps {
-		if err := app.Close(); err != nil {
-			log.Errorf("Failed to cleanly shut down application %s: %s", app.appName, err)
-		}
+	// Shut down apps in parallel, so their grace periods overlap
+	var wg sync.WaitGroup
+	for _, app := range c.appSnapshot() {
+		wg.Add(1)
+		go func(app *Application) {
+			defer wg.Done()
+			app.Shutdown(c.clusterLeaderElection.IsLeader(), "node-shutdown")
+			if err := app.Close(); err != nil {
+				log.Errorf("Failed to cleanly shut down application %s: %s", app.appName, err)
+			}
+		}(app)
 	}
+	wg.Wait()
 	c.apiGateway.Stop()
+	c.crossAppLock.Lock()
+	for _, sub := range c.crossAppSubscriptions {
+		if err := sub.Unsubscribe(); err != nil {
+			log.Errorf("Could not unsubscribe from cross-app events: %s", err)
+		}
+	}
+	c.crossAppLock.Unlock()
+	if err := c.clusterLeaderElection.Close(); err != nil {
+		log.Errorf("Could not cleanly leave leader election: %s", err)
+	}
+	if err := c.clusterMembership.Close(); err != nil {
+		log.Errorf("Could not cleanly leave cluster: %s", err)
+	}
+}
+
+// FetchClusterInfo collects info from all live nodes, annotated with what the membership registry knows about them,
+// including the nodes that went down
+func (c *Container) FetchClusterInfo() (*cluster.ClusterInfo, error) {
+	clusterInfo, err := c.clusterEventBus.FetchClusterInfo(c.config.ClusterFetchInfoTimeout, c.clusterMembership.LiveNodes())
+	if err != nil {
+		return nil, err
+	}
+	clusterInfo.Members = c.clusterMembership.Members()
+	clusterInfo.Down = c.clusterMembership.DownNodes()
+	clusterInfo.CrossApp = c.CrossAppSubscriptions()
+	for _, nodeID := range clusterInfo.Unresponsive {
+		log.Warnf("Node %d is alive, but did not respond to cluster info request", nodeID)
+	}
+	for _, nodeID := range clusterInfo.Down {
+		log.Warnf("Node %d stopped sending heartbeats", nodeID)
+	}
+	return clusterInfo, nil
 }
 
 func (c *Container) ClusterEventBus() *cluster.ClusterEventBus {
@@ -341,14 +666,29 @@ func (c *Container) ClusterEventBus() *cluster.ClusterEventBus {
 }
 
 func (c *Container) Get(name string) *Application {
+	c.appsLock.RLock()
+	defer c.appsLock.RUnlock()
 	return c.apps[name]
 }
 
+// appSnapshot returns a copy of the apps map, to iterate over without holding the lock
+func (c *Container) appSnapshot() map[string]*Application {
+	c.appsLock.RLock()
+	defer c.appsLock.RUnlock()
+	apps := make(map[string]*Application, len(c.apps))
+	for name, app := range c.apps {
+		apps[name] = app
+	}
+	return apps
+}
+
 func (c *Container) Store() *store.JetstreamStore {
 	return c.clusterStore
 }
 
 func (c *Container) List() []string {
+	c.appsLock.RLock()
+	defer c.appsLock.RUnlock()
 	appNames := make([]string, 0, len(c.apps))
 	for name := range c.apps {
 		appNames = append(appNames, name)
@@ -358,11 +698,32 @@ func (c *Container) List() []string {
 
 func (c *Container) NodeInfo() *cluster.NodeInfo {
 	ni := &cluster.NodeInfo{
-		ID:   c.clusterLeaderElection.ID,
-		Apps: map[string]*cluster.AppInfo{},
+		ID:         c.clusterLeaderElection.ID,
+		Apps:       map[string]*cluster.AppInfo{},
+		Labels:     c.nodeLabels,
+		FreeMemory: util.FreeMemory(),
 	}
-	for appName, app := range c.apps {
+	c.nodeStateLock.Lock()
+	ni.Cordoned = c.cordoned
+	ni.Draining = c.draining
+	c.nodeStateLock.Unlock()
+	for appName, app := range c.appSnapshot() {
 		ni.Apps[appName] = app.Sandbox().AppInfo()
 	}
 	return ni
 }
+
+// nodeLabels determines the labels this node advertises: its platform, available runtimes and configured labels
+func nodeLabels(cfg *config.Config) map[string]string {
+	labels := map[string]string{
+		"arch": runtime.GOARCH,
+		"os":   runtime.GOOS,
+	}
+	for _, runtimeName := range sandbox.AvailableRuntimes(cfg) {
+		labels[fmt.Sprintf("runtime.%s", runtimeName)] = "true"
+	}
+	for key, value := range cfg.NodeLabels {
+		labels[key] = value
+	}
+	return labels
+}
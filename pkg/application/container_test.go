@@ -12,6 +12,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/zefhemel/matterless/pkg/application"
+	"github.com/zefhemel/matterless/pkg/cluster"
 	"github.com/zefhemel/matterless/pkg/config"
 )
 
@@ -31,8 +32,8 @@ func TestEventHTTP(t *testing.T) {
 	container, err := application.NewContainer(cfg)
 	a.NoError(err)
 	defer container.Close()
-	container.ClusterEventBus().SubscribeLogs("*.*", func(funcName, message string) {
-		log.Infof("[%s] %s", funcName, message)
+	container.ClusterEventBus().SubscribeContainerLogs(func(appName, funcName string, message cluster.LogMessage) {
+		log.Infof("[%s] %s", funcName, message.Message)
 	})
 	if err := container.Start(); err != nil {
 		log.Fatalf("Could not start container: %s", err)
@@ -0,0 +1,142 @@
+package application
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/definition"
+	"github.com/zefhemel/matterless/pkg/util"
+)
+
+// CrossAppWiring lists, per app, the subscriptions to events of other (existing) apps in its events definitions
+func CrossAppWiring(apps map[string]*definition.Definitions) []*cluster.CrossAppSubscription {
+	subscriptions := []*cluster.CrossAppSubscription{}
+	for appName, defs := range apps {
+		for key, fns := range defs.Events {
+			sourceApp, pattern, ok := definition.SplitCrossAppEvent(key)
+			if !ok || sourceApp == appName {
+				continue
+			}
+			sourceDefs, ok := apps[sourceApp]
+			if !ok {
+				// Not an app (yet), so just a local event name with a colon in it
+				continue
+			}
+			sub := &cluster.CrossAppSubscription{
+				App:       appName,
+				SourceApp: sourceApp,
+				Pattern:   pattern,
+				Functions: make([]string, 0, len(fns)),
+				Grants:    []string{},
+			}
+			for _, fn := range fns {
+				sub.Functions = append(sub.Functions, string(fn))
+			}
+			for _, export := range sourceDefs.Exports {
+				if len(export.Apps) == 0 || containsString(export.Apps, appName) {
+					sub.Grants = append(sub.Grants, export.Pattern)
+				}
+			}
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if subscriptions[i].App != subscriptions[j].App {
+			return subscriptions[i].App < subscriptions[j].App
+		}
+		return subscriptions[i].SourceApp+":"+subscriptions[i].Pattern < subscriptions[j].SourceApp+":"+subscriptions[j].Pattern
+	})
+	return subscriptions
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// crossAppRoute is a cross-app subscription with its compiled pattern
+type crossAppRoute struct {
+	*cluster.CrossAppSubscription
+	matcher *regexp.Regexp
+}
+
+// CrossAppSubscriptions returns the cross-app event wiring of all apps, along with the grants for them
+func (c *Container) CrossAppSubscriptions() []*cluster.CrossAppSubscription {
+	c.crossAppLock.Lock()
+	defer c.crossAppLock.Unlock()
+	return c.crossAppWiring
+}
+
+// wireCrossAppEvents computes the cross-app event wiring and makes sure we're subscribed to the events of all apps
+// other apps subscribe to, needs to be called whenever app definitions change
+func (c *Container) wireCrossAppEvents() {
+	c.crossAppLock.Lock()
+	defer c.crossAppLock.Unlock()
+	wiring := CrossAppWiring(c.appDefinitions())
+	routes := map[string][]crossAppRoute{}
+	for _, sub := range wiring {
+		routes[sub.SourceApp] = append(routes[sub.SourceApp], crossAppRoute{sub, util.GlobRegexp(sub.Pattern)})
+	}
+	c.crossAppWiring = wiring
+	c.crossAppRoutes = routes
+	for sourceApp := range routes {
+		if _, ok := c.crossAppSubscriptions[sourceApp]; ok {
+			continue
+		}
+		sourceApp := sourceApp
+		sub, err := c.clusterEventBus.QueueSubscribeAppEvents(sourceApp, fmt.Sprintf("crossapp.%s", sourceApp), func(name string, data interface{}, msg *nats.Msg) {
+			c.routeCrossAppEvent(sourceApp, name, data)
+		})
+		if err != nil {
+			log.Errorf("Could not subscribe to events of app %s: %s", sourceApp, err)
+			continue
+		}
+		c.crossAppSubscriptions[sourceApp] = sub
+	}
+	for sourceApp, sub := range c.crossAppSubscriptions {
+		if _, ok := routes[sourceApp]; ok {
+			continue
+		}
+		if err := sub.Unsubscribe(); err != nil {
+			log.Errorf("Could not unsubscribe from events of app %s: %s", sourceApp, err)
+		}
+		delete(c.crossAppSubscriptions, sourceApp)
+	}
+}
+
+// routeCrossAppEvent invokes the functions of all apps subscribed to the event, if the source app exports it to them
+func (c *Container) routeCrossAppEvent(sourceApp string, name string, data interface{}) {
+	source := c.Get(sourceApp)
+	if source == nil {
+		return
+	}
+	c.crossAppLock.Lock()
+	routes := c.crossAppRoutes[sourceApp]
+	c.crossAppLock.Unlock()
+	for _, route := range routes {
+		if !route.matcher.MatchString(name) {
+			continue
+		}
+		if !source.Definitions().ExportsEvent(name, route.App) {
+			log.Debugf("Not delivering event %s of app %s to app %s: not exported", name, sourceApp, route.App)
+			continue
+		}
+		app := c.Get(route.App)
+		if app == nil {
+			continue
+		}
+		for _, fn := range route.Functions {
+			if _, err := app.InvokeFunction(fn, data); err != nil {
+				log.Errorf("Error invoking %s of app %s for event %s of app %s: %s", fn, route.App, name, sourceApp, err)
+			}
+		}
+	}
+}
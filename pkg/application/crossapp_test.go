@@ -0,0 +1,50 @@
+package application_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/application"
+	"github.com/zefhemel/matterless/pkg/definition"
+)
+
+func TestCrossAppWiring(t *testing.T) {
+	a := assert.New(t)
+	apps := map[string]*definition.Definitions{
+		"shop": {
+			Events: map[string][]definition.FunctionID{},
+			Exports: []*definition.ExportDef{
+				{Pattern: "order:*"},
+				{Pattern: "payment:*", Apps: []string{"billing"}},
+			},
+		},
+		"billing": {
+			Events: map[string][]definition.FunctionID{
+				"shop:payment:received": {"BookPayment"},
+				"user:created":          {"NotAnApp"},
+			},
+		},
+		"newsletter": {
+			Events: map[string][]definition.FunctionID{
+				"shop:order:*": {"ThankCustomer"},
+				"billing:*":    {"Spy"},
+			},
+		},
+	}
+	wiring := application.CrossAppWiring(apps)
+	a.Len(wiring, 3)
+
+	a.Equal("billing", wiring[0].App)
+	a.Equal("shop", wiring[0].SourceApp)
+	a.Equal("payment:received", wiring[0].Pattern)
+	a.Equal([]string{"BookPayment"}, wiring[0].Functions)
+	a.Equal([]string{"order:*", "payment:*"}, wiring[0].Grants)
+
+	a.Equal("newsletter", wiring[1].App)
+	a.Equal("billing", wiring[1].SourceApp)
+	a.Empty(wiring[1].Grants)
+
+	a.Equal("newsletter", wiring[2].App)
+	a.Equal("shop", wiring[2].SourceApp)
+	a.Equal([]string{"order:*"}, wiring[2].Grants)
+}
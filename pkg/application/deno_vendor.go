@@ -0,0 +1,190 @@
+package application
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/sandbox"
+	"github.com/zefhemel/matterless/pkg/store"
+)
+
+// Cluster store keys of vendored deno modules: per module file (by its path in the deno cache) the number of chunks
+// its content is split into, the chunks themselves, and per app the list of module files its code needs
+const (
+	denoModuleKeyPrefix = "deno:module:"
+	denoChunkKeyPrefix  = "deno:chunk:"
+	denoVendorKeyPrefix = "deno:vendor:"
+)
+
+// Module files are stored in chunks of at most this many bytes, to stay well within the NATS max payload once encoded
+const denoModuleChunkSize = 256 * 1024
+
+// Serializes vendoring and pruning on this node
+var denoVendorLock sync.Mutex
+
+func denoChunkKey(path string, i int) string {
+	return fmt.Sprintf("%s%s#%d", denoChunkKeyPrefix, path, i)
+}
+
+// vendorDenoModules stores the module files at paths (relative to the local deno cache) in the cluster store, and
+// records them as the modules of appName. Modules no app needs anymore are removed
+func vendorDenoModules(cfg *config.Config, s store.Store, appName string, paths []string) error {
+	denoVendorLock.Lock()
+	defer denoVendorLock.Unlock()
+
+	// Recorded first, so that pruning by concurrent deploys leaves these modules alone
+	if err := s.Put(fmt.Sprintf("%s%s", denoVendorKeyPrefix, appName), paths); err != nil {
+		return errors.Wrap(err, "store vendored module list")
+	}
+	if err := storeDenoModules(cfg, s, paths); err != nil {
+		return err
+	}
+	if err := pruneDenoModules(s); err != nil {
+		return err
+	}
+	// A deploy on another node may have pruned based on the module lists from before this one was recorded, removing
+	// modules skipped above as already vendored, those are stored again
+	return storeDenoModules(cfg, s, paths)
+}
+
+// storeDenoModules stores the module files at paths not vendored yet
+func storeDenoModules(cfg *config.Config, s store.Store, paths []string) error {
+	for _, path := range paths {
+		key := fmt.Sprintf("%s%s", denoModuleKeyPrefix, path)
+		// Files in the deno cache are named after the URL they were fetched from, so these are shared between apps
+		existing, err := s.Get(key)
+		if err != nil {
+			return errors.Wrap(err, "lookup module")
+		}
+		if _, ok := existing.(float64); ok {
+			continue
+		}
+		content, err := sandbox.ReadDenoCacheFile(cfg, path)
+		if err != nil {
+			return errors.Wrap(err, "read module")
+		}
+		chunks := 0
+		for offset := 0; offset < len(content) || chunks == 0; offset += denoModuleChunkSize {
+			end := offset + denoModuleChunkSize
+			if end > len(content) {
+				end = len(content)
+			}
+			if err := s.Put(denoChunkKey(path, chunks), base64.StdEncoding.EncodeToString(content[offset:end])); err != nil {
+				return errors.Wrapf(err, "store module %s", path)
+			}
+			chunks++
+		}
+		// Stored last, so the module is only considered vendored once all of its chunks are
+		if err := s.Put(key, chunks); err != nil {
+			return errors.Wrapf(err, "store module %s", path)
+		}
+	}
+	return nil
+}
+
+// unvendorDenoModules forgets the modules of appName, removing those no other app needs
+func unvendorDenoModules(s store.Store, appName string) error {
+	denoVendorLock.Lock()
+	defer denoVendorLock.Unlock()
+
+	if err := s.Delete(fmt.Sprintf("%s%s", denoVendorKeyPrefix, appName)); err != nil {
+		return errors.Wrap(err, "delete vendored module list")
+	}
+	return pruneDenoModules(s)
+}
+
+// pruneDenoModules removes the vendored modules no app needs, callers hold denoVendorLock
+func pruneDenoModules(s store.Store) error {
+	vendored, err := s.QueryPrefix(denoVendorKeyPrefix)
+	if err != nil {
+		return errors.Wrap(err, "query vendored module lists")
+	}
+	needed := map[string]bool{}
+	for _, result := range vendored {
+		paths, _ := result.Value.([]interface{})
+		for _, path := range paths {
+			if path, ok := path.(string); ok {
+				needed[path] = true
+			}
+		}
+	}
+	modules, err := s.QueryPrefix(denoModuleKeyPrefix)
+	if err != nil {
+		return errors.Wrap(err, "query vendored modules")
+	}
+	for _, result := range modules {
+		path := strings.TrimPrefix(result.Key, denoModuleKeyPrefix)
+		if needed[path] {
+			continue
+		}
+		log.Infof("Removing vendored deno module %s, no app uses it anymore", path)
+		// Removed first, so the module isn't considered vendored while its chunks are being removed
+		if err := s.Delete(result.Key); err != nil {
+			return errors.Wrapf(err, "delete module %s", path)
+		}
+		chunks, _ := result.Value.(float64)
+		for i := 0; i < int(chunks); i++ {
+			if err := s.Delete(denoChunkKey(path, i)); err != nil {
+				return errors.Wrapf(err, "delete module %s", path)
+			}
+		}
+	}
+	return nil
+}
+
+// restoreDenoModules writes the module files vendored for appName missing from the local deno cache
+func restoreDenoModules(cfg *config.Config, s store.Store, appName string) error {
+	pathsValue, err := s.Get(fmt.Sprintf("%s%s", denoVendorKeyPrefix, appName))
+	if err != nil {
+		return errors.Wrap(err, "lookup vendored modules")
+	}
+	paths, _ := pathsValue.([]interface{})
+	for _, pathValue := range paths {
+		path, ok := pathValue.(string)
+		if !ok || sandbox.HasDenoCacheFile(cfg, path) {
+			continue
+		}
+		content, err := readDenoModule(s, path)
+		if err != nil {
+			return err
+		}
+		if err := sandbox.WriteDenoCacheFile(cfg, path, content); err != nil {
+			return errors.Wrapf(err, "write module %s", path)
+		}
+	}
+	return nil
+}
+
+// readDenoModule reassembles the content of a vendored module from its chunks
+func readDenoModule(s store.Store, path string) ([]byte, error) {
+	chunksValue, err := s.Get(fmt.Sprintf("%s%s", denoModuleKeyPrefix, path))
+	if err != nil {
+		return nil, errors.Wrap(err, "lookup module")
+	}
+	chunks, ok := chunksValue.(float64)
+	if !ok {
+		return nil, fmt.Errorf("vendored module %s missing", path)
+	}
+	var content []byte
+	for i := 0; i < int(chunks); i++ {
+		chunkValue, err := s.Get(denoChunkKey(path, i))
+		if err != nil {
+			return nil, errors.Wrap(err, "lookup module chunk")
+		}
+		encoded, ok := chunkValue.(string)
+		if !ok {
+			return nil, fmt.Errorf("chunk %d of vendored module %s missing", i, path)
+		}
+		chunk, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode module %s", path)
+		}
+		content = append(content, chunk...)
+	}
+	return content, nil
+}
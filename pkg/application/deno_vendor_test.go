@@ -0,0 +1,91 @@
+package application
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/sandbox"
+	"github.com/zefhemel/matterless/pkg/store"
+)
+
+func TestVendorDenoModules(t *testing.T) {
+	a := assert.New(t)
+	s, err := store.NewLevelDBStore(filepath.Join(t.TempDir(), "store"))
+	a.NoError(err)
+	defer s.Close()
+
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	big := bytes.Repeat([]byte("0123456789"), denoModuleChunkSize/4)
+	a.NoError(sandbox.WriteDenoCacheFile(cfg, "deps/https/example.com/big", big))
+	a.NoError(sandbox.WriteDenoCacheFile(cfg, "deps/https/example.com/empty", []byte{}))
+	a.NoError(sandbox.WriteDenoCacheFile(cfg, "deps/https/example.com/shared", []byte("shared")))
+
+	a.NoError(vendorDenoModules(cfg, s, "app1", []string{"deps/https/example.com/big", "deps/https/example.com/empty", "deps/https/example.com/shared"}))
+	a.NoError(vendorDenoModules(cfg, s, "app2", []string{"deps/https/example.com/shared"}))
+
+	// Large modules are split into chunks, and reassembled on restore
+	chunks, err := s.Get(denoModuleKeyPrefix + "deps/https/example.com/big")
+	a.NoError(err)
+	a.Equal(float64(3), chunks)
+	restoreCfg := config.NewConfig()
+	restoreCfg.DataDir = t.TempDir()
+	a.NoError(restoreDenoModules(restoreCfg, s, "app1"))
+	content, err := sandbox.ReadDenoCacheFile(restoreCfg, "deps/https/example.com/big")
+	a.NoError(err)
+	a.Equal(big, content)
+	content, err = sandbox.ReadDenoCacheFile(restoreCfg, "deps/https/example.com/empty")
+	a.NoError(err)
+	a.Empty(content)
+
+	// Modules only app1 used are removed along with it, shared ones are kept
+	a.NoError(unvendorDenoModules(s, "app1"))
+	modules, err := s.QueryPrefix(denoModuleKeyPrefix)
+	a.NoError(err)
+	a.Len(modules, 1)
+	a.Equal(denoModuleKeyPrefix+"deps/https/example.com/shared", modules[0].Key)
+	chunkResults, err := s.QueryPrefix(denoChunkKeyPrefix)
+	a.NoError(err)
+	a.Len(chunkResults, 1)
+}
+
+// stalePruneStore removes a module right after it's looked up, like a prune on another node working from the module
+// lists from before the lookup would
+type stalePruneStore struct {
+	store.Store
+	path string
+}
+
+func (s *stalePruneStore) Get(key string) (interface{}, error) {
+	value, err := s.Store.Get(key)
+	if key == denoModuleKeyPrefix+s.path && value != nil {
+		s.Store.Delete(key)
+		s.Store.Delete(denoChunkKey(s.path, 0))
+		s.path = ""
+	}
+	return value, err
+}
+
+func TestVendorDenoModulesConcurrentPrune(t *testing.T) {
+	a := assert.New(t)
+	s, err := store.NewLevelDBStore(filepath.Join(t.TempDir(), "store"))
+	a.NoError(err)
+	defer s.Close()
+
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	a.NoError(sandbox.WriteDenoCacheFile(cfg, "deps/https/example.com/shared", []byte("shared")))
+	a.NoError(vendorDenoModules(cfg, s, "app1", []string{"deps/https/example.com/shared"}))
+
+	// The module app2 finds vendored already is removed before app2 is done deploying, it's stored again
+	a.NoError(vendorDenoModules(cfg, &stalePruneStore{Store: s, path: "deps/https/example.com/shared"}, "app2", []string{"deps/https/example.com/shared"}))
+	restoreCfg := config.NewConfig()
+	restoreCfg.DataDir = t.TempDir()
+	a.NoError(restoreDenoModules(restoreCfg, s, "app2"))
+	content, err := sandbox.ReadDenoCacheFile(restoreCfg, "deps/https/example.com/shared")
+	a.NoError(err)
+	a.Equal([]byte("shared"), content)
+}
@@ -0,0 +1,176 @@
+package application
+
+import (
+	"time"
+
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/definition"
+)
+
+type AppHealth struct {
+	Healthy   bool                       `json:"healthy"`
+	Functions map[string]*FunctionHealth `json:"functions"`
+	Jobs      map[string]*JobHealth      `json:"jobs"`
+	Config    *ConfigHealth              `json:"config"`
+}
+
+type FunctionHealth struct {
+	DesiredWorkers int                `json:"desired_workers"`
+	RunningWorkers int                `json:"running_workers"`
+	LastError      *cluster.ErrorInfo `json:"last_error,omitempty"`
+}
+
+type JobHealth struct {
+	DesiredInstances int                `json:"desired_instances"`
+	RunningInstances int                `json:"running_instances"`
+	Exits            int                `json:"exits"`
+	Restarts         int                `json:"restarts"`
+	States           []cluster.JobState `json:"states"`
+}
+
+type ConfigHealth struct {
+	Satisfied bool              `json:"satisfied"`
+	Issues    map[string]string `json:"issues,omitempty"`
+}
+
+type ContainerHealth struct {
+	Healthy           bool                  `json:"healthy"`
+	NodeID            cluster.NodeID        `json:"node_id"`
+	Leader            cluster.NodeID        `json:"leader"`
+	IsLeader          bool                  `json:"is_leader"`
+	NatsConnected     bool                  `json:"nats_connected"`
+	StoreSynced       bool                  `json:"store_synced"`
+	StoreSyncError    string                `json:"store_sync_error,omitempty"`
+	UnresponsiveNodes []cluster.NodeID      `json:"unresponsive_nodes,omitempty"`
+	Apps              map[string]*AppHealth `json:"apps"`
+}
+
+// How long to wait for the cluster store to sync when checking container health
+const healthStoreSyncTimeout = 2 * time.Second
+
+// AppHealth computes the health of app based on the state of all nodes in the cluster
+func (c *Container) AppHealth(app *Application, clusterInfo *cluster.ClusterInfo) *AppHealth {
+	defs := app.Definitions()
+	ah := &AppHealth{
+		Healthy:   true,
+		Functions: map[string]*FunctionHealth{},
+		Jobs:      map[string]*JobHealth{},
+		Config: &ConfigHealth{
+			Satisfied: true,
+		},
+	}
+
+	for name, def := range defs.Functions {
+		ah.Functions[string(name)] = &FunctionHealth{}
+		for _, nodeInfo := range clusterInfo.Nodes {
+			if _, ok := nodeInfo.Apps[app.Name()]; ok && definition.MatchesNodeSelector(def.Config.NodeSelector, nodeInfo.Labels) {
+				// Functions run the configured number of instances on every node that runs the app and matches
+				ah.Functions[string(name)].DesiredWorkers += def.Config.Instances
+			}
+		}
+	}
+	for name, def := range defs.Jobs {
+		ah.Jobs[string(name)] = &JobHealth{
+			DesiredInstances: def.Config.Instances,
+			States:           []cluster.JobState{},
+		}
+	}
+
+	for _, nodeInfo := range clusterInfo.Nodes {
+		appInfo, ok := nodeInfo.Apps[app.Name()]
+		if !ok {
+			continue
+		}
+		for name, running := range appInfo.FunctionWorkers {
+			if fh, ok := ah.Functions[name]; ok {
+				fh.RunningWorkers += running
+			}
+		}
+		for name, errorInfo := range appInfo.FunctionErrors {
+			if fh, ok := ah.Functions[name]; ok {
+				if fh.LastError == nil || fh.LastError.Time.Before(errorInfo.Time) {
+					fh.LastError = errorInfo
+				}
+			}
+		}
+		for name, states := range appInfo.JobStates {
+			if jh, ok := ah.Jobs[name]; ok {
+				jh.States = append(jh.States, states...)
+				for _, state := range states {
+					if state == cluster.JobStateRunning {
+						jh.RunningInstances++
+					}
+				}
+			}
+		}
+		for name, exits := range appInfo.JobExits {
+			if jh, ok := ah.Jobs[name]; ok {
+				jh.Exits += exits
+			}
+		}
+		for name, restarts := range appInfo.JobRestarts {
+			if jh, ok := ah.Jobs[name]; ok {
+				jh.Restarts += restarts
+			}
+		}
+	}
+
+	for _, fh := range ah.Functions {
+		// No desired workers means no node in the cluster knows about this app (yet)
+		if fh.RunningWorkers < fh.DesiredWorkers || fh.DesiredWorkers == 0 {
+			ah.Healthy = false
+		}
+	}
+	for _, jh := range ah.Jobs {
+		if jh.RunningInstances < jh.DesiredInstances {
+			ah.Healthy = false
+		}
+	}
+
+	if issues := defs.CheckConfig(app.Store()); len(issues) > 0 {
+		ah.Config.Satisfied = false
+		ah.Config.Issues = issues
+		ah.Healthy = false
+	}
+
+	return ah
+}
+
+// Health computes the health of this node and all apps it runs
+func (c *Container) Health() (*ContainerHealth, error) {
+	ch := &ContainerHealth{
+		Healthy:       true,
+		NodeID:        c.clusterLeaderElection.ID,
+		Leader:        c.clusterLeaderElection.Leader(),
+		IsLeader:      c.clusterLeaderElection.IsLeader(),
+		NatsConnected: c.clusterConn.IsConnected(),
+		StoreSynced:   true,
+		Apps:          map[string]*AppHealth{},
+	}
+	if !ch.NatsConnected {
+		ch.Healthy = false
+		// Without a connection there's no point in checking anything else
+		return ch, nil
+	}
+	if err := c.clusterStore.Sync(healthStoreSyncTimeout); err != nil {
+		ch.StoreSynced = false
+		ch.StoreSyncError = err.Error()
+		ch.Healthy = false
+	}
+
+	clusterInfo, err := c.FetchClusterInfo()
+	if err != nil {
+		return nil, err
+	}
+	if len(clusterInfo.Unresponsive) > 0 {
+		ch.UnresponsiveNodes = clusterInfo.Unresponsive
+		ch.Healthy = false
+	}
+	for appName, app := range c.appSnapshot() {
+		ch.Apps[appName] = c.AppHealth(app, clusterInfo)
+		if !ch.Apps[appName].Healthy {
+			ch.Healthy = false
+		}
+	}
+	return ch, nil
+}
@@ -0,0 +1,50 @@
+package application
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/zefhemel/matterless/pkg/util"
+)
+
+// Health endpoints are intentionally unauthenticated so that load balancers and uptime checkers can use them
+func (ag *APIGateway) exposeHealthAPI() {
+	ag.rootRouter.HandleFunc("/_health", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		health, err := ag.container.Health()
+		if err != nil {
+			util.HTTPWriteJSONError(w, http.StatusServiceUnavailable, err.Error(), nil)
+			return
+		}
+		writeHealthResponse(w, health.Healthy, health)
+	}).Methods("GET")
+
+	ag.rootRouter.HandleFunc("/{app}/_health", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		vars := mux.Vars(r)
+		appName := vars["app"]
+		app := ag.container.Get(appName)
+		if app == nil {
+			http.NotFound(w, r)
+			return
+		}
+		clusterInfo, err := ag.container.FetchClusterInfo()
+		if err != nil {
+			util.HTTPWriteJSONError(w, http.StatusServiceUnavailable, err.Error(), nil)
+			return
+		}
+		health := ag.container.AppHealth(app, clusterInfo)
+		writeHealthResponse(w, health.Healthy, health)
+	}).Methods("GET")
+}
+
+func writeHealthResponse(w http.ResponseWriter, healthy bool, health interface{}) {
+	w.Header().Set("content-type", "application/json")
+	if healthy {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(w, util.MustJsonString(health))
+}
@@ -0,0 +1,120 @@
+package application_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/application"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/util"
+)
+
+func TestHealth(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available")
+	}
+	a := assert.New(t)
+	cfg := config.NewConfig()
+	cfg.APIBindPort = util.FindFreePort(8000)
+	cfg.ClusterNatsUrl = "nats://localhost:4332"
+	// The embedded NATS server outlives the container
+	dataDir, err := os.MkdirTemp("", "mls-health-test")
+	a.NoError(err)
+	cfg.DataDir = dataDir
+	cfg.LoadApps = false
+	cfg.UseSystemDeno = true
+
+	container, err := application.NewContainer(cfg)
+	a.NoError(err)
+	defer container.Close()
+	a.NoError(container.Start())
+
+	app, err := container.CreateApp("test")
+	a.NoError(err)
+	a.NoError(app.EvalString(strings.ReplaceAll(`
+# function Greet
+|||yaml
+runtime: python
+|||
+|||python
+def handle(event):
+    return {"greeting": "hello"}
+|||
+
+# function Fail
+|||yaml
+runtime: python
+|||
+|||python
+def handle(event):
+    raise ValueError("no greeting")
+|||
+`, "|||", "```")))
+
+	// All functions run their workers
+	var appHealth application.AppHealth
+	a.Equal(http.StatusOK, getHealth(t, fmt.Sprintf("http://localhost:%d/test/_health", cfg.APIBindPort), &appHealth))
+	a.True(appHealth.Healthy)
+	a.Equal(1, appHealth.Functions["Greet"].DesiredWorkers)
+	a.Equal(1, appHealth.Functions["Greet"].RunningWorkers)
+	a.Nil(appHealth.Functions["Fail"].LastError)
+
+	// The last error of a function is reported
+	_, err = app.InvokeFunction("Fail", map[string]interface{}{})
+	a.Error(err)
+	a.Equal(http.StatusOK, getHealth(t, fmt.Sprintf("http://localhost:%d/test/_health", cfg.APIBindPort), &appHealth))
+	if a.NotNil(appHealth.Functions["Fail"].LastError) {
+		a.Contains(appHealth.Functions["Fail"].LastError.Message, "no greeting")
+	}
+	var containerHealth application.ContainerHealth
+	a.Equal(http.StatusOK, getHealth(t, fmt.Sprintf("http://localhost:%d/_health", cfg.APIBindPort), &containerHealth))
+	a.True(containerHealth.Healthy)
+	a.True(containerHealth.NatsConnected)
+	a.True(containerHealth.StoreSynced)
+	a.True(containerHealth.IsLeader)
+	a.Contains(containerHealth.Apps, "test")
+
+	// A function no node can run makes the app, and so the container, unhealthy
+	a.NoError(app.EvalString(strings.ReplaceAll(`
+# function Greet
+|||yaml
+runtime: python
+node_selector:
+  gpu: "true"
+|||
+|||python
+def handle(event):
+    return {"greeting": "hello"}
+|||
+`, "|||", "```")))
+	a.Equal(http.StatusServiceUnavailable, getHealth(t, fmt.Sprintf("http://localhost:%d/test/_health", cfg.APIBindPort), &appHealth))
+	a.False(appHealth.Healthy)
+	a.Equal(0, appHealth.Functions["Greet"].DesiredWorkers)
+	a.Equal(http.StatusServiceUnavailable, getHealth(t, fmt.Sprintf("http://localhost:%d/_health", cfg.APIBindPort), &containerHealth))
+	a.False(containerHealth.Healthy)
+	a.False(containerHealth.Apps["test"].Healthy)
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/unknown/_health", cfg.APIBindPort))
+	a.NoError(err)
+	resp.Body.Close()
+	a.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+// getHealth fetches a health endpoint, decoding its response into health
+func getHealth(t *testing.T, url string, health interface{}) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(health); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
@@ -0,0 +1,77 @@
+package application
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/definition"
+)
+
+// mqttTopicPrefix is the MQTT topic levels all topics of the app live under, isolating them from those of other apps
+func (app *Application) mqttTopicPrefix() string {
+	return fmt.Sprintf("%s/%s/", cluster.MQTTAppsTopic, app.appName)
+}
+
+// mqttSubject returns the NATS subject an MQTT topic (filter) of the app maps to
+func (app *Application) mqttSubject(topic string) string {
+	return definition.MQTTTopicSubject(app.mqttTopicPrefix() + topic)
+}
+
+// subscribeMQTT sets up the mapping between app events and MQTT topics, replacing any earlier one
+func (app *Application) subscribeMQTT() {
+	app.unsubscribeMQTT()
+	mqttDef := app.definitions.MQTT
+	if mqttDef == nil {
+		return
+	}
+	for i, pub := range mqttDef.Publish {
+		subject := app.mqttSubject(pub.Topic)
+		if app.reservedSubject(subject) {
+			log.Errorf("Not publishing %s events to MQTT topic %s: reserved topic", pub.Event, pub.Topic)
+			continue
+		}
+		sub, err := app.eventBus.QueueSubscribeEventGroup(pub.Event, fmt.Sprintf("mqtt.publish.%d", i), func(name string, data interface{}, msg *nats.Msg) {
+			if err := app.eventBus.PublishMQTT(subject, encodeRawPayload(data)); err != nil {
+				log.Errorf("Could not publish event %s to MQTT: %s", name, err)
+			}
+		})
+		if err != nil {
+			log.Errorf("Could not subscribe to %s events for MQTT: %s", pub.Event, err)
+			continue
+		}
+		app.mqttSubscriptions = append(app.mqttSubscriptions, sub)
+	}
+	for i, mqttSub := range mqttDef.Subscribe {
+		subject := app.mqttSubject(mqttSub.Topic)
+		if app.reservedSubject(subject) {
+			log.Errorf("Not subscribing to MQTT topic %s: reserved topic", mqttSub.Topic)
+			continue
+		}
+		eventName := mqttSub.Event
+		sub, err := app.eventBus.QueueSubscribeMQTT(subject, fmt.Sprintf("mqtt.subscribe.%d", i), func(subject string, payload []byte) {
+			if err := app.PublishAppEvent(eventName, map[string]interface{}{
+				"topic":   strings.TrimPrefix(definition.SubjectMQTTTopic(subject), app.mqttTopicPrefix()),
+				"payload": decodeRawPayload(payload),
+			}); err != nil {
+				log.Errorf("Could not publish MQTT message as %s event: %s", eventName, err)
+			}
+		})
+		if err != nil {
+			log.Errorf("Could not subscribe to MQTT topic %s: %s", mqttSub.Topic, err)
+			continue
+		}
+		app.mqttSubscriptions = append(app.mqttSubscriptions, sub)
+	}
+}
+
+func (app *Application) unsubscribeMQTT() {
+	for _, sub := range app.mqttSubscriptions {
+		if err := sub.Unsubscribe(); err != nil {
+			log.Errorf("Could not unsubscribe MQTT mapping: %s", err)
+		}
+	}
+	app.mqttSubscriptions = []cluster.Subscription{}
+}
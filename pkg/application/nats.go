@@ -0,0 +1,107 @@
+package application
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/definition"
+	"github.com/zefhemel/matterless/pkg/util"
+)
+
+// reservedSubject checks if a NATS subject (or one of the subjects a wildcard subject matches) is used by Matterless,
+// NATS itself or the MQTT topics of other apps, apps cannot subscribe or publish to these directly
+func (app *Application) reservedSubject(subject string) bool {
+	token := strings.SplitN(subject, ".", 2)[0]
+	// Streams are named after the prefix, e.g. mls_cluster
+	if token == app.config.ClusterNatsPrefix || strings.HasPrefix(token, fmt.Sprintf("%s_", app.config.ClusterNatsPrefix)) {
+		return true
+	}
+	if token == cluster.MQTTAppsTopic {
+		return !strings.HasPrefix(subject, definition.MQTTTopicSubject(app.mqttTopicPrefix()))
+	}
+	for _, prefix := range []string{"$", "_INBOX", "*", ">"} {
+		if strings.HasPrefix(token, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribeNATSTriggers subscribes to the raw NATS subjects of nats:<subject> keys in the events definitions,
+// replacing earlier subscriptions
+func (app *Application) subscribeNATSTriggers() {
+	app.unsubscribeNATSTriggers()
+	for key, funcsToInvoke := range app.definitions.Events {
+		subject, ok := definition.NATSTriggerSubject(key)
+		if !ok {
+			continue
+		}
+		if app.reservedSubject(subject) {
+			log.Errorf("Not subscribing to NATS subject %s: reserved subject", subject)
+			continue
+		}
+		funcsToInvoke := funcsToInvoke
+		// Named after the subject, so that nodes running different versions of the app share the group
+		sub, err := app.eventBus.QueueSubscribeNATS(subject, fmt.Sprintf("nats.%s", subject), func(msg *nats.Msg) {
+			app.handleNATSMessage(msg, funcsToInvoke)
+		})
+		if err != nil {
+			log.Errorf("Could not subscribe to NATS subject %s: %s", subject, err)
+			continue
+		}
+		app.natsSubscriptions = append(app.natsSubscriptions, sub)
+	}
+}
+
+// handleNATSMessage invokes the functions subscribed to a raw NATS subject, the first result becomes the reply
+func (app *Application) handleNATSMessage(msg *nats.Msg, funcsToInvoke []definition.FunctionID) {
+	event := map[string]interface{}{
+		"subject": msg.Subject,
+		"payload": decodeRawPayload(msg.Data),
+		"headers": util.FlatStringMap(msg.Header),
+	}
+	replied := false
+	for _, funcToInvoke := range funcsToInvoke {
+		resp, err := app.InvokeFunction(string(funcToInvoke), event)
+		if err != nil {
+			log.Errorf("Error invoking %s for NATS message on %s: %s", funcToInvoke, msg.Subject, err)
+			continue
+		}
+		if resp != nil && msg.Reply != "" && !replied {
+			if err := msg.Respond(encodeRawPayload(resp)); err != nil {
+				log.Errorf("Could not reply to NATS message on %s: %s", msg.Subject, err)
+			}
+			replied = true
+		}
+	}
+}
+
+func (app *Application) unsubscribeNATSTriggers() {
+	for _, sub := range app.natsSubscriptions {
+		if err := sub.Unsubscribe(); err != nil {
+			log.Errorf("Could not unsubscribe from NATS subject: %s", err)
+		}
+	}
+	app.natsSubscriptions = []cluster.Subscription{}
+}
+
+// encodeRawPayload sends strings as is, and everything else JSON encoded
+func encodeRawPayload(data interface{}) []byte {
+	if s, ok := data.(string); ok {
+		return []byte(s)
+	}
+	return util.MustJsonByteSlice(data)
+}
+
+// decodeRawPayload decodes JSON payloads, and passes on anything else as a string
+func decodeRawPayload(payload []byte) interface{} {
+	var data interface{}
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return string(payload)
+	}
+	return data
+}
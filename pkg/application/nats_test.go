@@ -0,0 +1,70 @@
+package application
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/definition"
+)
+
+func TestReservedSubject(t *testing.T) {
+	a := assert.New(t)
+	app := &Application{config: config.NewConfig(), appName: "home"}
+	for _, subject := range []string{"mls.home.light", "mls_cluster.put", "mls_home.*", "$JS.API.>", "_INBOX.abc", "*.light", ">", "apps.other.light", "apps.*.light", "apps.>"} {
+		a.True(app.reservedSubject(subject), subject)
+	}
+	for _, subject := range []string{"sensors.kitchen", "mlsx.light", "apps.home.light", "apps.home.>"} {
+		a.False(app.reservedSubject(subject), subject)
+	}
+}
+
+func TestNATSTriggers(t *testing.T) {
+	a := assert.New(t)
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.ClusterNatsUrl = "nats://localhost:4330"
+	conn, err := cluster.ConnectOrBoot(cfg)
+	a.NoError(err)
+	defer conn.Close()
+	ceb := cluster.NewClusterEventBus(conn, "mls.home")
+
+	invoked := make(chan string, 10)
+	for name, result := range map[string]interface{}{"Log": nil, "Answer": "pong", "AnswerToo": "ignored"} {
+		name, result := name, result
+		_, err := ceb.SubscribeInvokeFunction(name, func(event interface{}) (interface{}, error) {
+			invoked <- name
+			return result, nil
+		})
+		a.NoError(err)
+	}
+
+	app := &Application{config: cfg, appName: "home", eventBus: ceb, definitions: definition.NewDefinitions()}
+	app.definitions.Events = map[string][]definition.FunctionID{
+		"nats:sensors.*":     {"Log", "Answer", "AnswerToo"},
+		"nats:mls_cluster.>": {"Log"},
+		"nats:apps.other.>":  {"Log"},
+	}
+	app.subscribeNATSTriggers()
+	defer app.unsubscribeNATSTriggers()
+	// Reserved subjects are not subscribed to
+	a.Len(app.natsSubscriptions, 1)
+
+	// The first non-nil function result is the reply
+	msg, err := conn.Request("sensors.kitchen", []byte("ping"), 5*time.Second)
+	a.NoError(err)
+	a.Equal("pong", string(msg.Data))
+	a.Equal("Log", <-invoked)
+	a.Equal("Answer", <-invoked)
+	a.Equal("AnswerToo", <-invoked)
+
+	a.NoError(conn.Publish("mls_cluster.put", []byte("{}")))
+	a.NoError(conn.Publish("apps.other.light", []byte("on")))
+	select {
+	case name := <-invoked:
+		a.Fail("invoked for reserved subject", name)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,295 @@
+package application
+
+import (
+	"sort"
+
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/definition"
+)
+
+// PlaceJobInstances decides on which nodes to start n new instances of a job, honoring its node selector and
+// anti-affinity rules. Instances go to the least loaded eligible node first, with ties broken by free memory.
+// Returns the number of instances to start per node, which may add up to less than n if not enough nodes are eligible
+func PlaceJobInstances(appName string, defs *definition.Definitions, clusterInfo *cluster.ClusterInfo, jobName definition.FunctionID, n int) map[cluster.NodeID]int {
+	placement := map[cluster.NodeID]int{}
+	jobDef, ok := defs.Jobs[jobName]
+	if !ok {
+		return placement
+	}
+	nodeLoad := nodeJobLoad(clusterInfo)
+
+	// Job workers per node for this app, including the ones we're placing now
+	appJobWorkers := map[cluster.NodeID]map[string]int{}
+	for nodeID, nodeInfo := range clusterInfo.Nodes {
+		appInfo, ok := nodeInfo.Apps[appName]
+		if !ok {
+			// Node doesn't run this app (yet), so it can't start any of its jobs
+			continue
+		}
+		appJobWorkers[nodeID] = map[string]int{}
+		for name, workers := range appInfo.JobWorkers {
+			appJobWorkers[nodeID][name] = workers
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		var (
+			best  cluster.NodeID
+			found bool
+		)
+		for nodeID, jobWorkers := range appJobWorkers {
+			nodeInfo := clusterInfo.Nodes[nodeID]
+			if !eligibleForJob(jobDef, nodeInfo, jobWorkers) {
+				continue
+			}
+			if !found || betterPlacement(nodeInfo, nodeLoad[nodeID], clusterInfo.Nodes[best], nodeLoad[best]) {
+				best = nodeID
+				found = true
+			}
+		}
+		if !found {
+			break
+		}
+		placement[best]++
+		nodeLoad[best]++
+		appJobWorkers[best][string(jobName)]++
+	}
+	return placement
+}
+
+// betterPlacement returns whether node a is a better candidate to place a job instance than node b
+func betterPlacement(a *cluster.NodeInfo, aLoad int, b *cluster.NodeInfo, bLoad int) bool {
+	if aLoad != bLoad {
+		return aLoad < bLoad
+	}
+	if a.FreeMemory != b.FreeMemory {
+		return a.FreeMemory > b.FreeMemory
+	}
+	// Break remaining ties on node ID to make this deterministic
+	return a.ID < b.ID
+}
+
+// eligibleForJob returns whether an instance of a job may be placed on a node currently running jobWorkers of its app
+func eligibleForJob(jobDef *definition.JobDef, nodeInfo *cluster.NodeInfo, jobWorkers map[string]int) bool {
+	return !nodeInfo.Cordoned && definition.MatchesNodeSelector(jobDef.Config.NodeSelector, nodeInfo.Labels) && !violatesAntiAffinity(jobDef.Config.AntiAffinity, jobWorkers)
+}
+
+func violatesAntiAffinity(antiAffinity []string, jobWorkers map[string]int) bool {
+	for _, name := range antiAffinity {
+		if jobWorkers[name] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// PlanJobWorkerStops decides on which nodes to stop n workers of a job, taking them from the most loaded nodes running
+// the job first, with ties broken on node ID. Returns the number of workers to stop per node
+func PlanJobWorkerStops(appName string, clusterInfo *cluster.ClusterInfo, jobName definition.FunctionID, n int) map[cluster.NodeID]int {
+	nodeLoad := nodeJobLoad(clusterInfo)
+	nodeJobWorkers := map[cluster.NodeID]int{}
+	for nodeID, nodeInfo := range clusterInfo.Nodes {
+		if appInfo, ok := nodeInfo.Apps[appName]; ok && appInfo.JobWorkers[string(jobName)] > 0 {
+			nodeJobWorkers[nodeID] = appInfo.JobWorkers[string(jobName)]
+		}
+	}
+
+	toStop := map[cluster.NodeID]int{}
+	for i := 0; i < n; i++ {
+		var (
+			mostLoaded cluster.NodeID
+			found      bool
+		)
+		for nodeID, workers := range nodeJobWorkers {
+			if workers == 0 {
+				continue
+			}
+			if !found || nodeLoad[nodeID] > nodeLoad[mostLoaded] || (nodeLoad[nodeID] == nodeLoad[mostLoaded] && nodeID < mostLoaded) {
+				mostLoaded = nodeID
+				found = true
+			}
+		}
+		if !found {
+			break
+		}
+		toStop[mostLoaded]++
+		nodeJobWorkers[mostLoaded]--
+		nodeLoad[mostLoaded]--
+	}
+	return toStop
+}
+
+// nodeJobLoad counts the number of job workers running on every node across all apps
+func nodeJobLoad(clusterInfo *cluster.ClusterInfo) map[cluster.NodeID]int {
+	load := map[cluster.NodeID]int{}
+	for nodeID, nodeInfo := range clusterInfo.Nodes {
+		for _, appInfo := range nodeInfo.Apps {
+			for _, workers := range appInfo.JobWorkers {
+				load[nodeID] += workers
+			}
+		}
+	}
+	return load
+}
+
+// JobMove describes moving one instance of a job from one node to another
+type JobMove struct {
+	App  string         `json:"app"`
+	Job  string         `json:"job"`
+	From cluster.NodeID `json:"from"`
+	To   cluster.NodeID `json:"to"`
+}
+
+// PlanRebalance computes the job instance moves needed to even out the number of job workers across nodes, honoring
+// placement constraints. Instances are only moved when that reduces the load difference between two nodes.
+func PlanRebalance(apps map[string]*definition.Definitions, clusterInfo *cluster.ClusterInfo) []JobMove {
+	moves := []JobMove{}
+	nodeLoad := nodeJobLoad(clusterInfo)
+
+	// Job workers per node per app, updated as moves are planned
+	appJobWorkers := map[cluster.NodeID]map[string]map[string]int{}
+	nodeIDs := make([]cluster.NodeID, 0, len(clusterInfo.Nodes))
+	for nodeID, nodeInfo := range clusterInfo.Nodes {
+		nodeIDs = append(nodeIDs, nodeID)
+		appJobWorkers[nodeID] = map[string]map[string]int{}
+		for appName, appInfo := range nodeInfo.Apps {
+			appJobWorkers[nodeID][appName] = map[string]int{}
+			for jobName, workers := range appInfo.JobWorkers {
+				appJobWorkers[nodeID][appName][jobName] = workers
+			}
+		}
+	}
+	appNames := make([]string, 0, len(apps))
+	for appName := range apps {
+		appNames = append(appNames, appName)
+	}
+	sort.Strings(appNames)
+
+	// Every move strictly reduces the spread of load across nodes, so this terminates
+	for {
+		// Consider the most loaded nodes first
+		sort.Slice(nodeIDs, func(i, j int) bool {
+			if nodeLoad[nodeIDs[i]] != nodeLoad[nodeIDs[j]] {
+				return nodeLoad[nodeIDs[i]] > nodeLoad[nodeIDs[j]]
+			}
+			return nodeIDs[i] < nodeIDs[j]
+		})
+		move, found := findJobMove(apps, appNames, clusterInfo, nodeIDs, nodeLoad, appJobWorkers)
+		if !found {
+			return moves
+		}
+		moves = append(moves, move)
+		appJobWorkers[move.From][move.App][move.Job]--
+		appJobWorkers[move.To][move.App][move.Job]++
+		nodeLoad[move.From]--
+		nodeLoad[move.To]++
+	}
+}
+
+func findJobMove(apps map[string]*definition.Definitions, appNames []string, clusterInfo *cluster.ClusterInfo, nodeIDs []cluster.NodeID, nodeLoad map[cluster.NodeID]int, appJobWorkers map[cluster.NodeID]map[string]map[string]int) (JobMove, bool) {
+	for _, from := range nodeIDs {
+		for _, appName := range appNames {
+			defs := apps[appName]
+			jobNames := make([]string, 0, len(defs.Jobs))
+			for jobName := range defs.Jobs {
+				jobNames = append(jobNames, string(jobName))
+			}
+			sort.Strings(jobNames)
+			for _, jobName := range jobNames {
+				if appJobWorkers[from][appName][jobName] == 0 {
+					continue
+				}
+				jobDef := defs.Jobs[definition.FunctionID(jobName)]
+				var (
+					best  cluster.NodeID
+					found bool
+				)
+				for _, to := range nodeIDs {
+					jobWorkers, ok := appJobWorkers[to][appName]
+					// Only move if this actually evens things out
+					if !ok || to == from || nodeLoad[from]-nodeLoad[to] < 2 || !eligibleForJob(jobDef, clusterInfo.Nodes[to], jobWorkers) {
+						continue
+					}
+					if !found || betterPlacement(clusterInfo.Nodes[to], nodeLoad[to], clusterInfo.Nodes[best], nodeLoad[best]) {
+						best = to
+						found = true
+					}
+				}
+				if found {
+					return JobMove{
+						App:  appName,
+						Job:  jobName,
+						From: from,
+						To:   best,
+					}, true
+				}
+			}
+		}
+	}
+	return JobMove{}, false
+}
+
+// PlanDrain computes moves for all job instances running on draining nodes, moves for which no eligible target node
+// exists have To set to 0
+func PlanDrain(apps map[string]*definition.Definitions, clusterInfo *cluster.ClusterInfo) []JobMove {
+	moves := []JobMove{}
+	// Work on a copy of the job worker counts, so that every placement takes the previous ones into account
+	plannedInfo := &cluster.ClusterInfo{
+		Nodes: map[cluster.NodeID]*cluster.NodeInfo{},
+	}
+	drainingNodes := []cluster.NodeID{}
+	for nodeID, nodeInfo := range clusterInfo.Nodes {
+		nodeCopy := *nodeInfo
+		nodeCopy.Apps = map[string]*cluster.AppInfo{}
+		for appName, appInfo := range nodeInfo.Apps {
+			jobWorkers := map[string]int{}
+			for jobName, workers := range appInfo.JobWorkers {
+				jobWorkers[jobName] = workers
+			}
+			nodeCopy.Apps[appName] = &cluster.AppInfo{JobWorkers: jobWorkers}
+		}
+		plannedInfo.Nodes[nodeID] = &nodeCopy
+		if nodeInfo.Draining {
+			drainingNodes = append(drainingNodes, nodeID)
+		}
+	}
+	sort.Slice(drainingNodes, func(i, j int) bool {
+		return drainingNodes[i] < drainingNodes[j]
+	})
+	appNames := make([]string, 0, len(apps))
+	for appName := range apps {
+		appNames = append(appNames, appName)
+	}
+	sort.Strings(appNames)
+
+	for _, from := range drainingNodes {
+		for _, appName := range appNames {
+			appInfo, ok := clusterInfo.Nodes[from].Apps[appName]
+			if !ok {
+				continue
+			}
+			jobNames := make([]string, 0, len(appInfo.JobWorkers))
+			for jobName := range appInfo.JobWorkers {
+				jobNames = append(jobNames, jobName)
+			}
+			sort.Strings(jobNames)
+			for _, jobName := range jobNames {
+				workers := appInfo.JobWorkers[jobName]
+				placement := PlaceJobInstances(appName, apps[appName], plannedInfo, definition.FunctionID(jobName), workers)
+				placed := 0
+				for to, n := range placement {
+					for i := 0; i < n; i++ {
+						moves = append(moves, JobMove{App: appName, Job: jobName, From: from, To: to})
+					}
+					plannedInfo.Nodes[to].Apps[appName].JobWorkers[jobName] += n
+					plannedInfo.Nodes[from].Apps[appName].JobWorkers[jobName] -= n
+					placed += n
+				}
+				for ; placed < workers; placed++ {
+					moves = append(moves, JobMove{App: appName, Job: jobName, From: from})
+				}
+			}
+		}
+	}
+	return moves
+}
@@ -0,0 +1,169 @@
+package application_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/application"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/definition"
+)
+
+func TestPlaceJobInstances(t *testing.T) {
+	defs := &definition.Definitions{
+		Jobs: map[definition.FunctionID]*definition.JobDef{
+			"Spread": {
+				Config: &definition.JobConfig{
+					AntiAffinity: []string{"Spread"},
+				},
+			},
+			"Docker": {
+				Config: &definition.JobConfig{
+					NodeSelector: map[string]string{"runtime.docker": "true"},
+				},
+			},
+		},
+	}
+	newNode := func(id cluster.NodeID, labels map[string]string, jobWorkers map[string]int) *cluster.NodeInfo {
+		return &cluster.NodeInfo{
+			ID:     id,
+			Labels: labels,
+			Apps: map[string]*cluster.AppInfo{
+				"test": {JobWorkers: jobWorkers},
+			},
+		}
+	}
+	clusterInfo := &cluster.ClusterInfo{
+		Nodes: map[cluster.NodeID]*cluster.NodeInfo{
+			1: newNode(1, map[string]string{"runtime.docker": "true"}, map[string]int{"Spread": 1}),
+			2: newNode(2, map[string]string{}, map[string]int{}),
+			3: newNode(3, map[string]string{"runtime.docker": "true"}, map[string]int{}),
+		},
+	}
+
+	// Only nodes 2 and 3 don't run Spread yet
+	assert.Equal(t, map[cluster.NodeID]int{2: 1, 3: 1}, application.PlaceJobInstances("test", defs, clusterInfo, "Spread", 5))
+
+	// Node 3 is docker enabled and less loaded than node 1
+	assert.Equal(t, map[cluster.NodeID]int{3: 1}, application.PlaceJobInstances("test", defs, clusterInfo, "Docker", 1))
+	assert.Equal(t, map[cluster.NodeID]int{1: 1, 3: 2}, application.PlaceJobInstances("test", defs, clusterInfo, "Docker", 3))
+
+	// Unknown jobs are not placed at all
+	assert.Empty(t, application.PlaceJobInstances("test", defs, clusterInfo, "Unknown", 1))
+}
+
+func TestPlanJobWorkerStops(t *testing.T) {
+	newNode := func(id cluster.NodeID, apps map[string]map[string]int) *cluster.NodeInfo {
+		nodeInfo := &cluster.NodeInfo{ID: id, Apps: map[string]*cluster.AppInfo{}}
+		for appName, jobWorkers := range apps {
+			nodeInfo.Apps[appName] = &cluster.AppInfo{JobWorkers: jobWorkers}
+		}
+		return nodeInfo
+	}
+	clusterInfo := &cluster.ClusterInfo{
+		Nodes: map[cluster.NodeID]*cluster.NodeInfo{
+			// Node 1 runs the most jobs in total, mostly of another app
+			1: newNode(1, map[string]map[string]int{"test": {"Worker": 1}, "other": {"Worker": 3}}),
+			2: newNode(2, map[string]map[string]int{"test": {"Worker": 2}}),
+			3: newNode(3, map[string]map[string]int{"test": {"Worker": 2}}),
+			4: newNode(4, map[string]map[string]int{"test": {"Other": 1}}),
+		},
+	}
+
+	// Workers are taken from the most loaded node running the job, nodes 2 and 3 tie on load
+	assert.Equal(t, map[cluster.NodeID]int{1: 1}, application.PlanJobWorkerStops("test", clusterInfo, "Worker", 1))
+	assert.Equal(t, map[cluster.NodeID]int{1: 1, 2: 1}, application.PlanJobWorkerStops("test", clusterInfo, "Worker", 2))
+	assert.Equal(t, map[cluster.NodeID]int{1: 1, 2: 1, 3: 1}, application.PlanJobWorkerStops("test", clusterInfo, "Worker", 3))
+
+	// No more workers are stopped than are running, nodes not running the job are left alone
+	assert.Equal(t, map[cluster.NodeID]int{1: 1, 2: 2, 3: 2}, application.PlanJobWorkerStops("test", clusterInfo, "Worker", 10))
+	assert.Empty(t, application.PlanJobWorkerStops("test", clusterInfo, "Unknown", 1))
+}
+
+func TestPlanRebalance(t *testing.T) {
+	apps := map[string]*definition.Definitions{
+		"test": {
+			Jobs: map[definition.FunctionID]*definition.JobDef{
+				"Worker": {Config: &definition.JobConfig{}},
+				"Docker": {
+					Config: &definition.JobConfig{
+						NodeSelector: map[string]string{"runtime.docker": "true"},
+					},
+				},
+			},
+		},
+	}
+	newNode := func(id cluster.NodeID, labels map[string]string, jobWorkers map[string]int) *cluster.NodeInfo {
+		return &cluster.NodeInfo{
+			ID:     id,
+			Labels: labels,
+			Apps: map[string]*cluster.AppInfo{
+				"test": {JobWorkers: jobWorkers},
+			},
+		}
+	}
+	clusterInfo := &cluster.ClusterInfo{
+		Nodes: map[cluster.NodeID]*cluster.NodeInfo{
+			1: newNode(1, map[string]string{"runtime.docker": "true"}, map[string]int{"Worker": 3, "Docker": 1}),
+			2: newNode(2, map[string]string{}, map[string]int{}),
+		},
+	}
+
+	// Docker can't move, so two Workers move to the new node
+	assert.Equal(t, []application.JobMove{
+		{App: "test", Job: "Worker", From: 1, To: 2},
+		{App: "test", Job: "Worker", From: 1, To: 2},
+	}, application.PlanRebalance(apps, clusterInfo))
+
+	clusterInfo.Nodes[1].Apps["test"].JobWorkers["Worker"] = 1
+	clusterInfo.Nodes[2].Apps["test"].JobWorkers["Worker"] = 1
+	assert.Empty(t, application.PlanRebalance(apps, clusterInfo))
+}
+
+func TestPlanDrain(t *testing.T) {
+	apps := map[string]*definition.Definitions{
+		"test": {
+			Jobs: map[definition.FunctionID]*definition.JobDef{
+				"Worker": {Config: &definition.JobConfig{}},
+				"Docker": {
+					Config: &definition.JobConfig{
+						NodeSelector: map[string]string{"runtime.docker": "true"},
+					},
+				},
+			},
+		},
+	}
+	clusterInfo := &cluster.ClusterInfo{
+		Nodes: map[cluster.NodeID]*cluster.NodeInfo{
+			1: {
+				ID:       1,
+				Labels:   map[string]string{"runtime.docker": "true"},
+				Cordoned: true,
+				Draining: true,
+				Apps: map[string]*cluster.AppInfo{
+					"test": {JobWorkers: map[string]int{"Worker": 2, "Docker": 1}},
+				},
+			},
+			2: {
+				ID: 2,
+				Apps: map[string]*cluster.AppInfo{
+					"test": {JobWorkers: map[string]int{}},
+				},
+			},
+			3: {
+				ID:       3,
+				Cordoned: true,
+				Apps: map[string]*cluster.AppInfo{
+					"test": {JobWorkers: map[string]int{}},
+				},
+			},
+		},
+	}
+
+	// Docker has nowhere to go, cordoned node 3 is not a target
+	assert.ElementsMatch(t, []application.JobMove{
+		{App: "test", Job: "Docker", From: 1},
+		{App: "test", Job: "Worker", From: 1, To: 2},
+		{App: "test", Job: "Worker", From: 1, To: 2},
+	}, application.PlanDrain(apps, clusterInfo))
+}
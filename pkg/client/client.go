@@ -145,6 +145,52 @@ func (client *MatterlessClient) ClusterInfo() (*cluster.ClusterInfo, error) {
 	return &clusterInfo, nil
 }
 
+// NodeAction performs a cordon, uncordon or drain action on the node with the given ID
+func (client *MatterlessClient) NodeAction(nodeID cluster.NodeID, action string) error {
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/_node/%d/%s", client.URL, nodeID, action), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("bearer %s", client.Token))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	bodyData, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP Error (%d) %s", resp.StatusCode, bodyData)
+	}
+	return nil
+}
+
+// Rebalance asks the cluster to rebalance its jobs, returning the planned moves, with dryRun nothing is actually moved
+func (client *MatterlessClient) Rebalance(dryRun bool) ([]application.JobMove, error) {
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/_rebalance?dry_run=%t", client.URL, dryRun), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "request failed")
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("bearer %s", client.Token))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request failed")
+	}
+
+	defer resp.Body.Close()
+
+	bodyData, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP Error (%d) %s", resp.StatusCode, bodyData)
+	}
+
+	var moves []application.JobMove
+	if err := json.Unmarshal(bodyData, &moves); err != nil {
+		return nil, err
+	}
+	return moves, nil
+}
+
 func (client *MatterlessClient) storeOp(appName string, op []interface{}) (interface{}, error) {
 	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/%s/_store", client.URL, appName), strings.NewReader(util.MustJsonString([][]interface{}{
 		op,
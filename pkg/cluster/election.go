@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,26 +14,37 @@ import (
 	"github.com/zefhemel/matterless/pkg/util"
 )
 
-type LeaderElection struct {
-	conn                         *nats.Conn
-	currentLeaderRPCSubject      string
-	heartbeatSubject             string
-	heartbeatSubscription        *nats.Subscription
-	currentLeaderRPCSubscription *nats.Subscription
+var StaleFencingTokenErr = errors.New("stale fencing token")
 
-	startTime         time.Time
-	broadcastInterval time.Duration
-	timeoutDuration   time.Duration
+// LeaderElection elects a leader using a lease stored in a JetStream key (a stream keeping only the last message for its
+// subject). The lease is acquired and renewed using compare-and-swap on the key's revision (its stream sequence number).
+// Followers consider the lease expired when its revision didn't change for a full TTL, the leader itself steps down when
+// it couldn't renew for half a TTL, so that there's never a moment two nodes consider themselves leader.
+// The revision at which a leader acquired its lease serves as fencing token, increasing with every new term
+type LeaderElection struct {
+	conn       *nats.Conn
+	js         nats.JetStreamContext
+	streamName string
+	subject    string
+	ttl        time.Duration
 
 	ID   NodeID
-	done bool
+	done chan struct{}
 
-	mutex     sync.Mutex
-	hearbeats map[NodeID]time.Time
+	mutex sync.Mutex
+	// Last observed state of the lease
+	holder         NodeID
+	revision       uint64
+	revisionSeenAt time.Time
+	// Our own term, if we hold the lease
+	term        uint64
+	renewedAt   time.Time
+	highestTerm uint64 // Highest fencing token seen, used to reject requests from stale leaders
 }
 
-type heartbeatMessage struct {
-	NodeID NodeID
+type lease struct {
+	Holder NodeID `json:"holder"`
+	Term   uint64 `json:"term"` // The revision at which the lease was acquired
 }
 
 var r *rand.Rand
@@ -41,118 +53,244 @@ func init() {
 	r = rand.New(rand.NewSource(time.Now().UnixNano()))
 }
 
-func NewLeaderElection(conn *nats.Conn, currentLeaderRPCSubject string, hearthbeatSubject string, broadcastInterval time.Duration) (*LeaderElection, error) {
+func NewLeaderElection(conn *nats.Conn, streamName string, ttl time.Duration, replicas int) (*LeaderElection, error) {
 	var err error
 	le := &LeaderElection{
-		currentLeaderRPCSubject: currentLeaderRPCSubject,
-		heartbeatSubject:        hearthbeatSubject,
-		hearbeats:               make(map[NodeID]time.Time),
-		startTime:               time.Now(),
-		broadcastInterval:       broadcastInterval,
-		timeoutDuration:         broadcastInterval * 3,
-		conn:                    conn,
-	}
-
-	// Let's make a quick getLeader call to the bus and see if somebody got a response
-	resp, err := conn.Request(currentLeaderRPCSubject, []byte{}, 2*time.Second)
-	if err == nil {
-		// Got answer, great
-		var msg heartbeatMessage
-		if err := json.Unmarshal(resp.Data, &msg); err != nil {
-			return nil, errors.Wrap(err, "unmarshall getLeader")
+		conn:       conn,
+		streamName: streamName,
+		subject:    fmt.Sprintf("%s.lease", streamName),
+		ttl:        ttl,
+		ID:         generateNodeID(),
+		done:       make(chan struct{}),
+	}
+
+	le.js, err = conn.JetStream()
+	if err != nil {
+		return nil, errors.Wrap(err, "jetstream")
+	}
+
+	if info, err := le.js.StreamInfo(streamName); err != nil {
+		// Likely does not exist yet, let's create it
+		if _, err := le.js.AddStream(&nats.StreamConfig{
+			Name:              streamName,
+			Subjects:          []string{le.subject},
+			Storage:           nats.FileStorage,
+			MaxMsgsPerSubject: 1,
+			Replicas:          replicas,
+		}); err != nil && !strings.Contains(err.Error(), "already in use") {
+			return nil, errors.Wrap(err, "lease stream create")
+		}
+	} else if info.Config.Replicas != replicas {
+		log.Infof("Changing replicas of stream %s from %d to %d", streamName, info.Config.Replicas, replicas)
+		streamConfig := info.Config
+		streamConfig.Replicas = replicas
+		if _, err := le.js.UpdateStream(&streamConfig); err != nil {
+			log.Warnf("Could not change replicas of stream %s from %d to %d, keeping %d: %s", streamName, info.Config.Replicas, replicas, info.Config.Replicas, err)
+		}
+	}
+
+	// Make sure the key exists, so that everybody can compare-and-swap on its revision. The message ID makes JetStream
+	// drop duplicates, so concurrently starting nodes cannot overwrite a lease that was just acquired
+	if _, _, err := le.get(); err == errLeaseNotFound {
+		if _, err := le.js.Publish(le.subject, util.MustJsonByteSlice(lease{}), nats.MsgId(fmt.Sprintf("%s-init", streamName))); err != nil {
+			return nil, errors.Wrap(err, "lease init")
 		}
-		// Let's persist it
-		le.hearbeats[msg.NodeID] = time.Now()
-		// And generate an ID > the current leader's ID
-		le.ID = generateNodeID(msg.NodeID)
-	} else if err == nats.ErrNoResponders || err == nats.ErrTimeout {
-		// Either no responders or timeout => We're the first!
-		// log.Infof("Got RPC error: %s", err)
-		// Generate a random ID
-		le.ID = generateNodeID(0)
-		// Let's persist it
-		le.hearbeats[le.ID] = time.Now()
-	} else {
-		return nil, errors.Wrap(err, "getLeader call")
-	}
-	// And let's start broadcasting
-	go le.broadcaster()
-
-	le.currentLeaderRPCSubscription, err = conn.QueueSubscribe(currentLeaderRPCSubject, fmt.Sprintf("%s.workers", currentLeaderRPCSubject), func(msg *nats.Msg) {
-		msg.Respond(util.MustJsonByteSlice(heartbeatMessage{le.Leader()}))
-	})
+	} else if err != nil {
+		return nil, errors.Wrap(err, "lease get")
+	}
+
+	le.refresh()
+	go le.loop()
+
+	return le, nil
+}
+
+var errLeaseNotFound = errors.New("lease not found")
+
+type msgGetRequest struct {
+	LastFor string `json:"last_by_subj"`
+}
+
+type msgGetResponse struct {
+	Error *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error,omitempty"`
+	Message *struct {
+		Sequence uint64 `json:"seq"`
+		Data     []byte `json:"data"`
+	} `json:"message,omitempty"`
+}
+
+// get fetches the current lease along with its revision
+// the nats.go version we use has no key-value API yet, so this talks to the JetStream API directly
+func (le *LeaderElection) get() (*lease, uint64, error) {
+	resp, err := le.conn.Request(fmt.Sprintf("$JS.API.STREAM.MSG.GET.%s", le.streamName), util.MustJsonByteSlice(msgGetRequest{le.subject}), le.ttl/3)
 	if err != nil {
-		return nil, errors.Wrap(err, "getLeader subscription")
+		return nil, 0, err
+	}
+	var mgr msgGetResponse
+	if err := json.Unmarshal(resp.Data, &mgr); err != nil {
+		return nil, 0, err
+	}
+	if mgr.Error != nil {
+		if mgr.Error.Code == 404 {
+			return nil, 0, errLeaseNotFound
+		}
+		return nil, 0, errors.New(mgr.Error.Description)
 	}
+	var l lease
+	if err := json.Unmarshal(mgr.Message.Data, &l); err != nil {
+		return nil, 0, err
+	}
+	return &l, mgr.Message.Sequence, nil
+}
 
-	le.heartbeatSubscription, err = conn.Subscribe(hearthbeatSubject, func(msg *nats.Msg) {
-		var hm heartbeatMessage
-		if err := json.Unmarshal(msg.Data, &hm); err != nil {
-			log.Errorf("Could not unmarshal heartbeat message")
+// swap writes a new lease only if the current revision is still expectedRevision, returns the new revision
+func (le *LeaderElection) swap(l lease, expectedRevision uint64) (uint64, error) {
+	ack, err := le.js.Publish(le.subject, util.MustJsonByteSlice(l), nats.ExpectLastSequencePerSubject(expectedRevision))
+	if err != nil {
+		return 0, err
+	}
+	return ack.Sequence, nil
+}
+
+func (le *LeaderElection) loop() {
+	for {
+		select {
+		case <-le.done:
+			return
+		case <-time.After(le.ttl / 3):
+			le.refresh()
 		}
-		// log.Infof("Got heartbeat %d", hm.NodeID)
-		le.mutex.Lock()
-		defer le.mutex.Unlock()
-		le.hearbeats[hm.NodeID] = time.Now()
-	})
+	}
+}
 
+// refresh observes the current lease, renews it when we hold it and tries to acquire it when it expired
+func (le *LeaderElection) refresh() {
+	l, revision, err := le.get()
 	if err != nil {
-		return nil, errors.Wrap(err, "heartbeat subscription")
+		log.Errorf("Could not fetch leader lease: %s", err)
+		return
 	}
+	now := time.Now()
 
-	return le, nil
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	if revision != le.revision {
+		le.holder = l.Holder
+		le.revision = revision
+		le.revisionSeenAt = now
+		le.observeTerm(l.Term)
+	}
+
+	switch {
+	case l.Holder == le.ID && le.term != 0:
+		// Renew
+		newRevision, err := le.swap(lease{Holder: le.ID, Term: le.term}, revision)
+		if err != nil {
+			log.Errorf("Could not renew leader lease, stepping down: %s", err)
+			le.term = 0
+			return
+		}
+		le.revision = newRevision
+		le.revisionSeenAt = now
+		le.renewedAt = now
+	case l.Holder == 0 || now.Sub(le.revisionSeenAt) > le.ttl:
+		// Lease released or expired, let's try to grab it. The stream only holds this one subject, so the new
+		// revision will be the next sequence number
+		newRevision, err := le.swap(lease{Holder: le.ID, Term: revision + 1}, revision)
+		if err != nil {
+			// Somebody else beat us to it
+			return
+		}
+		log.Infof("Node %d acquired leadership (term %d)", le.ID, newRevision)
+		le.holder = le.ID
+		le.revision = newRevision
+		le.revisionSeenAt = now
+		le.term = newRevision
+		le.renewedAt = now
+		le.observeTerm(newRevision)
+	default:
+		if le.term != 0 {
+			log.Infof("Node %d lost leadership", le.ID)
+			le.term = 0
+		}
+	}
 }
 
+// Leader returns the ID of the node currently holding the lease, or 0 when there is none
 func (le *LeaderElection) Leader() NodeID {
 	le.mutex.Lock()
 	defer le.mutex.Unlock()
-	// Iterate over all heartbeats
-	now := time.Now()
-	currentLeaderID := NodeID(0)
-	for id, t := range le.hearbeats {
-		if now.Sub(t) > le.timeoutDuration {
-			log.Infof("Ejecting %d", id)
-			delete(le.hearbeats, id)
-			continue
-		}
-		if currentLeaderID == 0 || currentLeaderID > id {
-			currentLeaderID = id
+	if le.holder == le.ID {
+		if le.isLeader() {
+			return le.ID
 		}
+		return 0
 	}
-	return currentLeaderID
+	if time.Since(le.revisionSeenAt) > le.ttl {
+		return 0
+	}
+	return le.holder
 }
 
 func (le *LeaderElection) IsLeader() bool {
-	if le.done {
-		// Short circuit
-		return false
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	return le.isLeader()
+}
+
+func (le *LeaderElection) isLeader() bool {
+	return le.term != 0 && time.Since(le.renewedAt) < le.ttl/2
+}
+
+// FencingToken returns the token to attach to requests made as leader, 0 when not the leader
+func (le *LeaderElection) FencingToken() uint64 {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	if !le.isLeader() {
+		return 0
 	}
-	return le.Leader() == le.ID
+	return le.term
 }
 
-func generateNodeID(min NodeID) NodeID {
-	id := r.Uint64()
-	for id <= min {
-		id = r.Uint64()
+// CheckFencingToken rejects tokens of leaders older than the newest one seen
+func (le *LeaderElection) CheckFencingToken(token uint64) error {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	if token == 0 || token < le.highestTerm {
+		return StaleFencingTokenErr
 	}
-	return id
+	le.observeTerm(token)
+	return nil
 }
 
-func (le *LeaderElection) broadcaster() {
-	for {
-		if le.done {
-			log.Infof("Disconnected %d", le.ID)
-			return
-		}
-		// log.Infof("Broadcasting my ID %d", le.ID)
-		if err := le.conn.Publish(le.heartbeatSubject, util.MustJsonByteSlice(heartbeatMessage{le.ID})); err != nil {
-			log.Errorf("Could not broadcast heartbeat: %s", err)
-		}
-		time.Sleep(le.broadcastInterval)
+func (le *LeaderElection) observeTerm(term uint64) {
+	if term > le.highestTerm {
+		le.highestTerm = term
 	}
 }
 
+func generateNodeID() NodeID {
+	id := r.Uint64()
+	for id == 0 {
+		id = r.Uint64()
+	}
+	return id
+}
+
+// Close stops participating in the election, releasing the lease if we hold it
 func (le *LeaderElection) Close() error {
-	le.done = true
-	return le.heartbeatSubscription.Unsubscribe()
+	close(le.done)
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	if le.term == 0 {
+		return nil
+	}
+	le.term = 0
+	if _, err := le.swap(lease{}, le.revision); err != nil {
+		return errors.Wrap(err, "release lease")
+	}
+	return nil
 }
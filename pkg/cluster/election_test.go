@@ -15,25 +15,27 @@ func TestMasterElection(t *testing.T) {
 	log.SetLevel(log.DebugLevel)
 	a := assert.New(t)
 	conn, err := cluster.ConnectOrBoot(&config.Config{
-		DataDir:        "nats-data",
+		DataDir:        t.TempDir(),
 		ClusterNatsUrl: "nats://localhost:4222",
 	})
 	a.Nil(err)
 	defer conn.Close()
 
-	nodes := make([]*cluster.LeaderElection, 50)
+	nodes := make([]*cluster.LeaderElection, 10)
 	var wg sync.WaitGroup
 	for i := 0; i < len(nodes); i++ {
 		j := i
 		wg.Add(1)
 		go func() {
-			nodes[j], err = cluster.NewLeaderElection(conn, "election.heartbeat", "election.getLeader", 500*time.Millisecond)
+			var err error
+			nodes[j], err = cluster.NewLeaderElection(conn, "election", 1500*time.Millisecond, 1)
 			a.NoError(err)
 			wg.Done()
 		}()
 	}
 	wg.Wait()
 
+	// Wait for all nodes to observe the lease
 	time.Sleep(600 * time.Millisecond)
 
 	leaders := 0
@@ -46,11 +48,16 @@ func TestMasterElection(t *testing.T) {
 		}
 	}
 	a.Equal(1, leaders)
+	for _, node := range nodes {
+		a.Equal(leader.ID, node.Leader())
+	}
+	oldToken := leader.FencingToken()
+	a.NotZero(oldToken)
 
 	log.Info("Now kicking out current leader")
-	leader.Close()
+	a.NoError(leader.Close())
 
-	time.Sleep(3 * time.Second)
+	time.Sleep(1500 * time.Millisecond)
 	leaders = 0
 	oldLeader := leader
 	for _, node := range nodes {
@@ -63,5 +70,8 @@ func TestMasterElection(t *testing.T) {
 	a.Equal(1, leaders)
 	a.NotEqual(leader.ID, oldLeader.ID)
 
-	// t.Fail()
+	// Requests from the old leader are now rejected
+	a.Greater(leader.FencingToken(), oldToken)
+	a.NoError(leader.CheckFencingToken(leader.FencingToken()))
+	a.ErrorIs(leader.CheckFencingToken(oldToken), cluster.StaleFencingTokenErr)
 }
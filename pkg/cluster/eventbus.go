@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"github.com/mitchellh/mapstructure"
 	"github.com/zefhemel/matterless/pkg/config"
+	"net"
 	"net/url"
+	"os"
 	"path"
 	"strconv"
 	"strings"
@@ -20,45 +22,140 @@ import (
 	"github.com/zefhemel/matterless/pkg/util"
 )
 
+// Name of the NATS cluster formed by embedded servers
+const natsClusterName = "matterless"
+
 // Checks if a NATS port is running at the given hostName and port, if not and if
 // the hostname is localhost/127.0.0.1 will boot a new NATS server
+// When clustering is configured, an embedded server is always booted, routing to the configured peers
 func ConnectOrBoot(config *config.Config) (*nats.Conn, error) {
-	nc, err := nats.Connect(config.ClusterNatsUrl)
+	clustered := config.ClusterListen != ""
+	connectOpts, err := natsConnectOptions(config)
 	if err != nil {
+		return nil, errors.Wrap(err, "nats options")
+	}
+	var nc *nats.Conn
+	if !clustered {
+		nc, err = nats.Connect(config.ClusterNatsUrl, connectOpts...)
+	}
+	if clustered || err != nil {
 		parsedUrl, err := url.Parse(config.ClusterNatsUrl)
 		if err != nil {
 			return nil, err
 		}
-		if parsedUrl.Hostname() == "localhost" || parsedUrl.Hostname() == "127.0.0.1" {
+		if clustered || parsedUrl.Hostname() == "localhost" || parsedUrl.Hostname() == "127.0.0.1" {
 			// Attempt to boot it locally
 			log.Debug("Booting NATS server")
 			p, err := strconv.Atoi(parsedUrl.Port())
 			if err != nil {
 				return nil, errors.Wrap(err, "parsing port")
 			}
-			err = spawnNatsServer(path.Join(config.DataDir, ".nats"), p)
+			opts, err := natsServerOptions(config, p)
+			if err != nil {
+				return nil, errors.Wrap(err, "nats options")
+			}
+			err = spawnNatsServer(opts)
 			if err != nil {
 				return nil, errors.Wrap(err, "nats spawn")
 			}
 		}
-		nc, err = nats.Connect(config.ClusterNatsUrl)
+		nc, err = nats.Connect(config.ClusterNatsUrl, connectOpts...)
 		if err != nil {
 			return nil, errors.Wrap(err, "after nats server boot")
 		}
 	}
+	if clustered {
+		if err := waitForJetStream(nc, config.ClusterJetStreamTimeout); err != nil {
+			return nil, errors.Wrap(err, "jetstream cluster")
+		}
+	}
 	return nc, nil
 }
 
-func spawnNatsServer(dataDir string, port int) error {
+func natsServerOptions(config *config.Config, port int) (*server.Options, error) {
 	opts := &server.Options{
-		Host: "0.0.0.0",
 		Port: port,
 
 		// Jetstream
 		JetStream: true,
-		StoreDir:  dataDir,
+		StoreDir:  path.Join(config.DataDir, ".nats"),
+	}
+
+	if config.MQTTListen != "" {
+		host, port, err := splitListenAddress(config.MQTTListen)
+		if err != nil {
+			return nil, errors.Wrap(err, "mqtt listen address")
+		}
+		opts.MQTT.Host = host
+		opts.MQTT.Port = port
+		// MQTT requires a stable server name, even without clustering
+		opts.ServerName, err = serverName(config, port)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ClusterListen == "" {
+		return opts, configureServerSecurity(config, opts)
+	}
+
+	host, clusterPort, err := splitListenAddress(config.ClusterListen)
+	if err != nil {
+		return nil, errors.Wrap(err, "cluster listen address")
+	}
+	opts.Cluster = server.ClusterOpts{
+		Name: natsClusterName,
+		Host: host,
+		Port: clusterPort,
+	}
+
+	// JetStream clustering requires a server name that is stable across restarts
+	opts.ServerName, err = serverName(config, clusterPort)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]string, 0, len(config.ClusterPeers))
+	for _, peer := range config.ClusterPeers {
+		if !strings.Contains(peer, "://") {
+			peer = fmt.Sprintf("nats-route://%s", peer)
+		}
+		routes = append(routes, peer)
 	}
+	opts.Routes = server.RoutesFromStr(strings.Join(routes, ","))
+
+	return opts, configureServerSecurity(config, opts)
+}
 
+// splitListenAddress splits a host:port address, listening on all interfaces when the host is left out
+func splitListenAddress(address string) (string, int, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "port")
+	}
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return host, port, nil
+}
+
+// serverName returns the configured name of the embedded server, or one derived from the hostname and given port
+func serverName(config *config.Config, port int) (string, error) {
+	if config.ClusterServerName != "" {
+		return config.ClusterServerName, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", errors.Wrap(err, "hostname")
+	}
+	return fmt.Sprintf("%s-%d", hostname, port), nil
+}
+
+func spawnNatsServer(opts *server.Options) error {
 	s, err := server.NewServer(opts)
 	if err != nil {
 		return err
@@ -74,15 +171,39 @@ func spawnNatsServer(dataDir string, port int) error {
 	return nil
 }
 
+// waitForJetStream waits until JetStream is usable, in a cluster this requires a quorum of peers to have elected a meta leader
+func waitForJetStream(nc *nats.Conn, timeout time.Duration) error {
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := js.AccountInfo()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Wrap(err, "timeout waiting for jetstream")
+		}
+		log.Infof("Waiting for JetStream cluster to become available: %s", err)
+		time.Sleep(time.Second)
+	}
+}
+
 type Subscription interface {
 	Unsubscribe() error
 }
 
 type ClusterEventBus struct {
-	conn   *nats.Conn
-	prefix string
+	conn           *nats.Conn
+	prefix         string
+	legacySubjects bool
 }
 
+// Header set on copies of events published on legacy subjects, so that subscribers to encoded subjects can skip them
+const legacySubjectHeader = "Mls-Legacy-Subject"
+
 func NewClusterEventBus(conn *nats.Conn, prefix string) *ClusterEventBus {
 	return &ClusterEventBus{
 		conn:   conn,
@@ -90,6 +211,13 @@ func NewClusterEventBus(conn *nats.Conn, prefix string) *ClusterEventBus {
 	}
 }
 
+// WithLegacySubjects makes the event bus publish events on their legacy subject (see SafeNATSSubject) as well, and
+// invoke functions on theirs
+func (eb *ClusterEventBus) WithLegacySubjects(enabled bool) *ClusterEventBus {
+	eb.legacySubjects = enabled
+	return eb
+}
+
 func (eb *ClusterEventBus) publish(name string, data []byte) error {
 	return eb.conn.Publish(fmt.Sprintf("%s.%s", eb.prefix, name), data)
 }
@@ -106,8 +234,17 @@ func (eb *ClusterEventBus) queueSubscribe(name string, queue string, callback fu
 	return eb.conn.QueueSubscribe(fmt.Sprintf("%s.%s", eb.prefix, name), fmt.Sprintf("%s.%s", eb.prefix, queue), callback)
 }
 
+// functionSubject returns the subject invocations of the given function are sent on, in legacy mode the one older
+// versions use, so that old and new nodes can invoke each other's functions
+func (eb *ClusterEventBus) functionSubject(name string) string {
+	if eb.legacySubjects {
+		return fmt.Sprintf("function.%s", SafeNATSSubject(name))
+	}
+	return fmt.Sprintf("function.%s", EncodeSubjectToken(name))
+}
+
 func (eb *ClusterEventBus) InvokeFunction(name string, event interface{}) (interface{}, error) {
-	resp, err := eb.request(fmt.Sprintf("function.%s", SafeNATSSubject(name)), util.MustJsonByteSlice(functionInvoke{
+	resp, err := eb.request(eb.functionSubject(name), util.MustJsonByteSlice(functionInvoke{
 		Data: event,
 	}), 10*time.Second)
 	if err != nil {
@@ -123,8 +260,40 @@ func (eb *ClusterEventBus) InvokeFunction(name string, event interface{}) (inter
 	return respMsg.Data, nil
 }
 
+// SubscribeInvokeFunction handles invocations of the given function, in legacy mode those sent on the subject older
+// versions use as well
 func (eb *ClusterEventBus) SubscribeInvokeFunction(name string, callback func(interface{}) (interface{}, error)) (Subscription, error) {
-	return eb.queueSubscribe(fmt.Sprintf("function.%s", SafeNATSSubject(name)), fmt.Sprintf("function.%s.workers", SafeNATSSubject(name)), func(msg *nats.Msg) {
+	handler := invokeFunctionHandler(callback)
+	subject := fmt.Sprintf("function.%s", EncodeSubjectToken(name))
+	sub, err := eb.queueSubscribe(subject, fmt.Sprintf("%s.workers", subject), handler)
+	if err != nil || !eb.legacySubjects || eb.functionSubject(name) == subject {
+		return sub, err
+	}
+	legacySub, err := eb.queueSubscribe(eb.functionSubject(name), fmt.Sprintf("%s.workers", eb.functionSubject(name)), handler)
+	if err != nil {
+		if err := sub.Unsubscribe(); err != nil {
+			log.Errorf("Could not unsubscribe: %s", err)
+		}
+		return nil, err
+	}
+	return subscriptions{sub, legacySub}, nil
+}
+
+// subscriptions unsubscribes from all of its subscriptions at once
+type subscriptions []Subscription
+
+func (subs subscriptions) Unsubscribe() error {
+	var firstErr error
+	for _, sub := range subs {
+		if err := sub.Unsubscribe(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func invokeFunctionHandler(callback func(interface{}) (interface{}, error)) func(msg *nats.Msg) {
+	return func(msg *nats.Msg) {
 		var requestMessage functionInvoke
 		if err := json.Unmarshal(msg.Data, &requestMessage); err != nil {
 			log.Errorf("Could not unmarshal event data: %s", err)
@@ -152,21 +321,21 @@ func (eb *ClusterEventBus) SubscribeInvokeFunction(name string, callback func(in
 		}))); err != nil {
 			log.Errorf("Could not respond with response: %s", err)
 		}
-	})
+	}
 }
 
-func (eb *ClusterEventBus) SubscribeLogs(funcName string, callback func(funcName string, message string)) (Subscription, error) {
-	return eb.SubscribeEvent(fmt.Sprintf("%s.log", funcName), func(name string, data interface{}, msg *nats.Msg) {
-		var lm logMessage
+func (eb *ClusterEventBus) SubscribeLogs(funcName string, callback func(funcName string, message LogMessage)) (Subscription, error) {
+	return eb.SubscribeEvent(fmt.Sprintf("%s%s", funcName, logSubjectSuffix), func(name string, data interface{}, msg *nats.Msg) {
+		var lm LogMessage
 		if err := mapstructure.Decode(data, &lm); err != nil {
 			log.Errorf("Error unmarshaling log message: %s", err)
 			return
 		}
-		callback(lm.Function, lm.Message)
+		callback(lm.Function, lm)
 	})
 }
 
-func (eb *ClusterEventBus) SubscribeContainerLogs(callback func(appName, funcName, message string)) (Subscription, error) {
+func (eb *ClusterEventBus) SubscribeContainerLogs(callback func(appName, funcName string, message LogMessage)) (Subscription, error) {
 	return eb.subscribe("*.*.log", func(msg *nats.Msg) {
 		parts := strings.Split(msg.Subject, ".") // mls.myapp.MyFunction.log
 		var pe publishEvent
@@ -174,30 +343,42 @@ func (eb *ClusterEventBus) SubscribeContainerLogs(callback func(appName, funcNam
 			log.Errorf("Could not unmarshal event data: %s", err)
 			return
 		}
-		var lm logMessage
+		var lm LogMessage
 		if err := mapstructure.Decode(pe.Data, &lm); err != nil {
 			log.Errorf("Error unmarshaling log message: %s", err)
 			return
 		}
-		callback(parts[1], lm.Function, lm.Message)
+		callback(parts[1], lm.Function, lm)
 	})
 }
 
-func (eb *ClusterEventBus) PublishLog(funcName, message string) error {
-	return eb.PublishEvent(fmt.Sprintf("%s.log", SafeNATSSubject(funcName)), logMessage{
-		Function: funcName,
-		Message:  message,
-	})
+func (eb *ClusterEventBus) PublishLog(funcName string, message LogMessage) error {
+	message.Function = funcName
+	if message.Level == "" {
+		message.Level = LogLevelInfo
+	}
+	return eb.publish(logSubject(funcName), util.MustJsonByteSlice(publishEvent{
+		Name: fmt.Sprintf("%s%s", funcName, logSubjectSuffix),
+		Data: message,
+	}))
 }
 
-func (eb *ClusterEventBus) FetchClusterInfo(wait time.Duration) (*ClusterInfo, error) {
+// FetchClusterInfo asks all nodes for their info, and returns as soon as all expected nodes responded, or wait passed
+// Expected nodes that did not respond in time are listed in ClusterInfo.Unresponsive
+func (eb *ClusterEventBus) FetchClusterInfo(wait time.Duration, expected []NodeID) (*ClusterInfo, error) {
 	// TODO: Generate unique ID some other way
 	responseSubject := fmt.Sprintf("clusterinfo.%s", strings.ReplaceAll(uuid.NewString(), "-", ""))
 
 	ci := &ClusterInfo{
-		Nodes: map[uint64]*NodeInfo{},
+		Nodes:        map[uint64]*NodeInfo{},
+		Unresponsive: []NodeID{},
 	}
 	var mutex sync.Mutex
+	allResponded := make(chan struct{})
+	waitingFor := map[NodeID]bool{}
+	for _, id := range expected {
+		waitingFor[id] = true
+	}
 
 	sub, err := eb.subscribe(responseSubject, func(msg *nats.Msg) {
 		var ni NodeInfo
@@ -206,8 +387,14 @@ func (eb *ClusterEventBus) FetchClusterInfo(wait time.Duration) (*ClusterInfo, e
 			return
 		}
 		mutex.Lock()
-		ci.Nodes[ni.ID] = &ni
 		defer mutex.Unlock()
+		ci.Nodes[ni.ID] = &ni
+		if waitingFor[ni.ID] {
+			delete(waitingFor, ni.ID)
+			if len(waitingFor) == 0 {
+				close(allResponded)
+			}
+		}
 	})
 	if err != nil {
 		return nil, err
@@ -219,11 +406,30 @@ func (eb *ClusterEventBus) FetchClusterInfo(wait time.Duration) (*ClusterInfo, e
 		return nil, err
 	}
 
-	// Now give all nodes time to respond
-	time.Sleep(wait)
+	if len(expected) > 0 {
+		select {
+		case <-allResponded:
+		case <-time.After(wait):
+		}
+	} else {
+		// No idea who's out there, give all nodes time to respond
+		time.Sleep(wait)
+	}
 
-	// Enough already!
-	return ci, nil
+	mutex.Lock()
+	defer mutex.Unlock()
+	for id := range waitingFor {
+		ci.Unresponsive = append(ci.Unresponsive, id)
+	}
+	// Copy, since late responses may still come in until we unsubscribe
+	result := &ClusterInfo{
+		Nodes:        make(map[NodeID]*NodeInfo, len(ci.Nodes)),
+		Unresponsive: ci.Unresponsive,
+	}
+	for id, ni := range ci.Nodes {
+		result.Nodes[id] = ni
+	}
+	return result, nil
 }
 
 func (eb *ClusterEventBus) SubscribeFetchClusterInfo(callback func() *NodeInfo) (Subscription, error) {
@@ -239,28 +445,127 @@ func (eb *ClusterEventBus) SubscribeFetchClusterInfo(callback func() *NodeInfo)
 	})
 }
 
-func (eb *ClusterEventBus) SubscribeRequestJobWorker(callback func(jobName string)) (Subscription, error) {
-	return eb.queueSubscribe(EventStartJobWorker, fmt.Sprintf("%s.workers", EventStartJobWorker), func(msg *nats.Msg) {
+// SubscribeRequestJobWorker subscribes to requests to start job workers on the node with the given ID, errors returned
+// by callback (e.g. for a stale fencing token) are sent back to the requester
+func (eb *ClusterEventBus) SubscribeRequestJobWorker(nodeID NodeID, callback func(jobName string, fencingToken uint64) error) (Subscription, error) {
+	return eb.subscribe(fmt.Sprintf("%s.%d", EventStartJobWorker, nodeID), func(msg *nats.Msg) {
 		var sjw startJobWorker
 		if err := json.Unmarshal(msg.Data, &sjw); err != nil {
 			log.Errorf("Could not unmarshal start job worker: %s", err)
 			return
 		}
-		callback(sjw.Name)
+		if err := callback(sjw.Name, sjw.FencingToken); err != nil {
+			msg.Respond([]byte(err.Error()))
+			return
+		}
 		// Respond with empty reply
 		msg.Respond([]byte{})
 	})
 }
 
-func (eb *ClusterEventBus) RequestJobWorkers(name string, n int, timeout time.Duration) error {
+// RequestJobWorkers asks a specific node to start n workers for the given job, on behalf of the leader with fencingToken
+func (eb *ClusterEventBus) RequestJobWorkers(nodeID NodeID, name string, n int, fencingToken uint64, timeout time.Duration) error {
 	for i := 0; i < n; i++ {
-		if _, err := eb.request(EventStartJobWorker, util.MustJsonByteSlice(startJobWorker{name}), timeout); err != nil {
+		resp, err := eb.request(fmt.Sprintf("%s.%d", EventStartJobWorker, nodeID), util.MustJsonByteSlice(startJobWorker{name, fencingToken}), timeout)
+		if err != nil {
 			return err
 		}
+		if len(resp.Data) > 0 {
+			return fmt.Errorf("node %d: %s", nodeID, resp.Data)
+		}
 	}
 	return nil
 }
 
+// SubscribeStopJobWorker subscribes to requests to stop job workers on the node with the given ID, errors returned
+// by callback are sent back to the requester
+func (eb *ClusterEventBus) SubscribeStopJobWorker(nodeID NodeID, callback func(jobName string, n int, fencingToken uint64) error) (Subscription, error) {
+	return eb.subscribe(fmt.Sprintf("%s.%d", EventStopJobWorker, nodeID), func(msg *nats.Msg) {
+		var sjw stopJobWorker
+		if err := json.Unmarshal(msg.Data, &sjw); err != nil {
+			log.Errorf("Could not unmarshal stop job worker: %s", err)
+			return
+		}
+		if err := callback(sjw.Name, sjw.N, sjw.FencingToken); err != nil {
+			msg.Respond([]byte(err.Error()))
+			return
+		}
+		// Respond with empty reply
+		msg.Respond([]byte{})
+	})
+}
+
+// RequestStopJobWorkers asks a specific node to stop n of its workers for the given job, on behalf of the leader with
+// fencingToken
+func (eb *ClusterEventBus) RequestStopJobWorkers(nodeID NodeID, name string, n int, fencingToken uint64, timeout time.Duration) error {
+	resp, err := eb.request(fmt.Sprintf("%s.%d", EventStopJobWorker, nodeID), util.MustJsonByteSlice(stopJobWorker{name, n, fencingToken}), timeout)
+	if err != nil {
+		return err
+	}
+	if len(resp.Data) > 0 {
+		return fmt.Errorf("node %d: %s", nodeID, resp.Data)
+	}
+	return nil
+}
+
+func (eb *ClusterEventBus) PublishJobExited(jobExit JobExit) error {
+	return eb.publish(EventJobExited, util.MustJsonByteSlice(jobExit))
+}
+
+// SubscribeJobExited subscribes to job exits, every node receives all of them so the leader can act on them
+func (eb *ClusterEventBus) SubscribeJobExited(callback func(jobExit JobExit)) (Subscription, error) {
+	return eb.subscribe(EventJobExited, func(msg *nats.Msg) {
+		var jobExit JobExit
+		if err := json.Unmarshal(msg.Data, &jobExit); err != nil {
+			log.Errorf("Could not decode job exited message: %s", err)
+			return
+		}
+		callback(jobExit)
+	})
+}
+
+// RequestRebalance asks the leader to rebalance job workers across the cluster
+func (eb *ClusterEventBus) RequestRebalance() error {
+	return eb.publish(EventRebalance, []byte{})
+}
+
+func (eb *ClusterEventBus) SubscribeRebalance(callback func()) (Subscription, error) {
+	return eb.subscribe(EventRebalance, func(msg *nats.Msg) {
+		callback()
+	})
+}
+
+// CordonNode (un)cordons the node with the given ID, uncordoning a draining node also stops it from draining
+func (eb *ClusterEventBus) CordonNode(nodeID NodeID, cordoned bool, timeout time.Duration) error {
+	_, err := eb.request(fmt.Sprintf("%s.%d", EventCordonNode, nodeID), util.MustJsonByteSlice(cordonNode{cordoned}), timeout)
+	return err
+}
+
+func (eb *ClusterEventBus) SubscribeCordonNode(nodeID NodeID, callback func(cordoned bool)) (Subscription, error) {
+	return eb.subscribe(fmt.Sprintf("%s.%d", EventCordonNode, nodeID), func(msg *nats.Msg) {
+		var cn cordonNode
+		if err := json.Unmarshal(msg.Data, &cn); err != nil {
+			log.Errorf("Could not unmarshal cordon node: %s", err)
+			return
+		}
+		callback(cn.Cordoned)
+		msg.Respond([]byte{})
+	})
+}
+
+// DrainNode asks the node with the given ID to drain
+func (eb *ClusterEventBus) DrainNode(nodeID NodeID, timeout time.Duration) error {
+	_, err := eb.request(fmt.Sprintf("%s.%d", EventDrainNode, nodeID), []byte{}, timeout)
+	return err
+}
+
+func (eb *ClusterEventBus) SubscribeDrainNode(nodeID NodeID, callback func()) (Subscription, error) {
+	return eb.subscribe(fmt.Sprintf("%s.%d", EventDrainNode, nodeID), func(msg *nats.Msg) {
+		callback()
+		msg.Respond([]byte{})
+	})
+}
+
 func (eb *ClusterEventBus) RestartApp(appName string) error {
 	return eb.publish(EventRestartApp, util.MustJsonByteSlice(restartApp{appName}))
 }
@@ -277,48 +582,155 @@ func (eb *ClusterEventBus) SubscribeRestartApp(callback func(appName string)) (S
 }
 
 func (eb *ClusterEventBus) PublishEvent(name string, event interface{}) error {
-	return eb.publish(SafeNATSSubject(name), util.MustJsonByteSlice(publishEvent{
+	data := util.MustJsonByteSlice(publishEvent{
 		Name: name,
 		Data: event,
-	}))
+	})
+	if err := eb.publish(eventSubject(name), data); err != nil {
+		return err
+	}
+	if eb.legacySubjects && SafeNATSSubject(name) != eventSubject(name) {
+		msg := nats.NewMsg(fmt.Sprintf("%s.%s", eb.prefix, SafeNATSSubject(name)))
+		msg.Header.Set(legacySubjectHeader, "true")
+		msg.Data = data
+		return eb.conn.PublishMsg(msg)
+	}
+	return nil
 }
 
-func (eb *ClusterEventBus) SubscribeEvent(pattern string, callback func(name string, data interface{}, msg *nats.Msg)) (Subscription, error) {
-	return eb.subscribe(SafeNATSSubject(pattern), func(msg *nats.Msg) {
+// eventHandler decodes events received for the given pattern, skipping legacy copies and events not matching the pattern
+func eventHandler(pattern EventPattern, callback func(name string, data interface{}, msg *nats.Msg)) func(msg *nats.Msg) {
+	return func(msg *nats.Msg) {
+		if msg.Header.Get(legacySubjectHeader) != "" {
+			return
+		}
 		var eventData publishEvent
 		if err := json.Unmarshal(msg.Data, &eventData); err != nil {
 			log.Errorf("Could not unmarshal event: %s - %s", err, string(msg.Data))
 			return
 		}
+		if !pattern.Matches(eventData.Name) {
+			return
+		}
 		callback(eventData.Name, eventData.Data, msg)
+	}
+}
+
+// subscribeEventPattern subscribes to the events matching the pattern with subscribe, in legacy mode also to the ones
+// nodes using legacy subjects publish
+func (eb *ClusterEventBus) subscribeEventPattern(pattern string, subscribe func(ep EventPattern) (Subscription, error)) (Subscription, error) {
+	ep := NewEventPattern(pattern)
+	if !eb.legacySubjects {
+		return subscribe(ep)
+	}
+	legacyEP := legacyEventPattern(pattern)
+	if legacyEP.Subject == ep.Subject {
+		// Old nodes publish other names on this subject too
+		return subscribe(legacyEP)
+	}
+	sub, err := subscribe(ep)
+	if err != nil {
+		return nil, err
+	}
+	legacySub, err := subscribe(legacyEP)
+	if err != nil {
+		if err := sub.Unsubscribe(); err != nil {
+			log.Errorf("Could not unsubscribe: %s", err)
+		}
+		return nil, err
+	}
+	return subscriptions{sub, legacySub}, nil
+}
+
+// SubscribeEvent subscribes to all events matching the pattern, see NewEventPattern
+func (eb *ClusterEventBus) SubscribeEvent(pattern string, callback func(name string, data interface{}, msg *nats.Msg)) (Subscription, error) {
+	return eb.subscribeEventPattern(pattern, func(ep EventPattern) (Subscription, error) {
+		return eb.subscribe(ep.Subject, eventHandler(ep, callback))
 	})
 }
 
 func (eb *ClusterEventBus) QueueSubscribeEvent(pattern string, callback func(name string, data interface{}, msg *nats.Msg)) (Subscription, error) {
-	return eb.queueSubscribe(SafeNATSSubject(pattern), fmt.Sprintf("%s.workers", SafeNATSSubject(pattern)), func(msg *nats.Msg) {
-		var eventData publishEvent
-		if err := json.Unmarshal(msg.Data, &eventData); err != nil {
-			log.Errorf("Could not unmarshal event: %s - %s", err, string(msg.Data))
+	return eb.subscribeEventPattern(pattern, func(ep EventPattern) (Subscription, error) {
+		return eb.queueSubscribe(ep.Subject, fmt.Sprintf("%s.workers", ep.Subject), eventHandler(ep, callback))
+	})
+}
+
+// QueueSubscribeEventGroup is like QueueSubscribeEvent, but in a queue group of its own, so it receives the events in
+// addition to other queue subscribers
+func (eb *ClusterEventBus) QueueSubscribeEventGroup(pattern string, queue string, callback func(name string, data interface{}, msg *nats.Msg)) (Subscription, error) {
+	return eb.subscribeEventPattern(pattern, func(ep EventPattern) (Subscription, error) {
+		return eb.queueSubscribe(ep.Subject, queue, eventHandler(ep, callback))
+	})
+}
+
+// QueueSubscribeNATS subscribes to a raw NATS subject outside of the event bus prefix, every message is handled by one
+// member of the (prefixed) queue
+func (eb *ClusterEventBus) QueueSubscribeNATS(subject string, queue string, callback func(msg *nats.Msg)) (Subscription, error) {
+	return eb.conn.QueueSubscribe(subject, fmt.Sprintf("%s.%s", eb.prefix, queue), callback)
+}
+
+// Header identifying the event bus that published an MQTT message, so that it doesn't turn its own messages back into events
+const mqttOriginHeader = "Mls-Origin"
+
+// PublishMQTT publishes a message on the NATS subject an MQTT topic maps to, outside of the event bus prefix
+func (eb *ClusterEventBus) PublishMQTT(subject string, payload []byte) error {
+	msg := nats.NewMsg(subject)
+	msg.Header.Set(mqttOriginHeader, eb.prefix)
+	msg.Data = payload
+	return eb.conn.PublishMsg(msg)
+}
+
+// QueueSubscribeMQTT subscribes to the NATS subject an MQTT topic filter maps to, outside of the event bus prefix.
+// Every message is handled by one member of the (prefixed) queue, messages published by the event bus itself are skipped
+func (eb *ClusterEventBus) QueueSubscribeMQTT(subject string, queue string, callback func(subject string, payload []byte)) (Subscription, error) {
+	return eb.conn.QueueSubscribe(subject, fmt.Sprintf("%s.%s", eb.prefix, queue), func(msg *nats.Msg) {
+		if msg.Header.Get(mqttOriginHeader) == eb.prefix {
 			return
 		}
-		callback(eventData.Name, eventData.Data, msg)
+		callback(msg.Subject, msg.Data)
 	})
 }
 
-//func (eb *ClusterEventBus) SubscribeEvent(pattern string, callback func(name string, data interface{}, msg *nats.Msg)) (Subscription, error) {
-//	return eb.subscribe(SafeNATSSubject(pattern), func(msg *nats.Msg) {
-//		var eventData publishEvent
-//		if err := json.Unmarshal(msg.Data, &eventData); err != nil {
-//			log.Errorf("Could not unmarshal event: %s - %s", err, string(msg.Data))
-//			return
-//		}
-//		callback(eventData.Name, eventData.Data, msg)
-//	})
-//}
+// QueueSubscribeAppEvents subscribes to all events of the given app, on an event bus with the container-wide prefix.
+// Every event is handled by one member of the queue
+func (eb *ClusterEventBus) QueueSubscribeAppEvents(appName string, queue string, callback func(name string, data interface{}, msg *nats.Msg)) (Subscription, error) {
+	ep := NewEventPattern("*")
+	return eb.queueSubscribe(fmt.Sprintf("%s.%s", appName, ep.Subject), queue, eventHandler(ep, callback))
+}
 
+// RequestEvent publishes an event and waits for the first response to it, in legacy mode the event is also published
+// on its legacy subject, so that old nodes can respond as well
 func (eb *ClusterEventBus) RequestEvent(name string, event interface{}, timeout time.Duration) (*nats.Msg, error) {
-	return eb.request(SafeNATSSubject(name), util.MustJsonByteSlice(publishEvent{
+	data := util.MustJsonByteSlice(publishEvent{
 		Name: name,
 		Data: event,
-	}), timeout)
+	})
+	if !eb.legacySubjects || SafeNATSSubject(name) == eventSubject(name) {
+		return eb.request(eventSubject(name), data, timeout)
+	}
+	inbox := nats.NewInbox()
+	sub, err := eb.conn.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	if err := eb.conn.PublishRequest(fmt.Sprintf("%s.%s", eb.prefix, eventSubject(name)), inbox, data); err != nil {
+		return nil, err
+	}
+	msg := nats.NewMsg(fmt.Sprintf("%s.%s", eb.prefix, SafeNATSSubject(name)))
+	msg.Reply = inbox
+	msg.Header.Set(legacySubjectHeader, "true")
+	msg.Data = data
+	if err := eb.conn.PublishMsg(msg); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for noResponders := 0; ; noResponders++ {
+		resp, err := sub.NextMsg(time.Until(deadline))
+		// Wait for a response to the other copy, unless neither had responders
+		if err == nats.ErrNoResponders && noResponders == 0 {
+			continue
+		}
+		return resp, err
+	}
 }
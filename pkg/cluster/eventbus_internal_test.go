@@ -0,0 +1,65 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/config"
+)
+
+func TestNatsServerOptions(t *testing.T) {
+	a := assert.New(t)
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+
+	// Standalone without credentials: only local connections
+	opts, err := natsServerOptions(cfg, 4222)
+	a.NoError(err)
+	a.Equal(4222, opts.Port)
+	a.Equal("127.0.0.1", opts.Host)
+	a.True(opts.JetStream)
+	a.Equal(path.Join(cfg.DataDir, ".nats"), opts.StoreDir)
+	a.Equal(0, opts.Cluster.Port)
+	a.Empty(opts.Routes)
+
+	// Clustered, routes to peers authenticate with the NATS credentials
+	cfg.ClusterNatsUser = "mls"
+	cfg.ClusterNatsPassword = "secret"
+	cfg.ClusterListen = ":6222"
+	cfg.ClusterPeers = []string{"node2:6222", "nats-route://node3:7222"}
+	opts, err = natsServerOptions(cfg, 4222)
+	a.NoError(err)
+	a.Equal("0.0.0.0", opts.Host)
+	a.Equal(natsClusterName, opts.Cluster.Name)
+	a.Equal("0.0.0.0", opts.Cluster.Host)
+	a.Equal(6222, opts.Cluster.Port)
+	a.Equal("mls", opts.Cluster.Username)
+	a.Equal("secret", opts.Cluster.Password)
+	hostname, err := os.Hostname()
+	a.NoError(err)
+	a.Equal(fmt.Sprintf("%s-6222", hostname), opts.ServerName)
+	if a.Len(opts.Routes, 2) {
+		a.Equal("node2:6222", opts.Routes[0].Host)
+		a.Equal("node3:7222", opts.Routes[1].Host)
+		for _, route := range opts.Routes {
+			a.Equal("nats-route", route.Scheme)
+			a.Equal("mls", route.User.Username())
+			password, _ := route.User.Password()
+			a.Equal("secret", password)
+		}
+	}
+
+	// A configured server name takes precedence
+	cfg.ClusterServerName = "node1"
+	cfg.ClusterListen = "10.0.0.1:6222"
+	opts, err = natsServerOptions(cfg, 4222)
+	a.NoError(err)
+	a.Equal("node1", opts.ServerName)
+	a.Equal("10.0.0.1", opts.Cluster.Host)
+
+	_, err = natsServerOptions(&config.Config{ClusterListen: "no-port"}, 4222)
+	a.Error(err)
+}
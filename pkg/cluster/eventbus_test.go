@@ -16,7 +16,7 @@ func TestNatsCluster(t *testing.T) {
 	log.SetLevel(log.DebugLevel)
 	a := assert.New(t)
 	eb, err := cluster.ConnectOrBoot(&config.Config{
-		DataDir:        "nats-data",
+		DataDir:        t.TempDir(),
 		ClusterNatsUrl: "nats://localhost:4222",
 	})
 	a.Nil(err)
@@ -56,10 +56,19 @@ func TestNatsCluster(t *testing.T) {
 		}
 	})
 
-	inf, err := ceb.FetchClusterInfo(1 * time.Second)
+	inf, err := ceb.FetchClusterInfo(1*time.Second, []cluster.NodeID{1, 2, 3})
 	a.NoError(err)
 	a.Equal(cluster.NodeID(1), inf.Nodes[1].ID)
 	a.Equal(cluster.NodeID(2), inf.Nodes[2].ID)
+	a.Equal([]cluster.NodeID{3}, inf.Unresponsive)
+
+	// Returns as soon as all expected nodes responded
+	start := time.Now()
+	inf, err = ceb.FetchClusterInfo(1*time.Second, []cluster.NodeID{1, 2})
+	a.NoError(err)
+	a.Len(inf.Nodes, 2)
+	a.Empty(inf.Unresponsive)
+	a.Less(time.Since(start), 500*time.Millisecond)
 
 	// t.Fail()
 }
@@ -0,0 +1,160 @@
+package cluster
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/util"
+)
+
+// Nodes not heard from for this many heartbeat intervals are considered down
+const memberTimeoutIntervals = 3
+
+// Nodes not heard from for this many heartbeat intervals are forgotten altogether
+const memberForgetIntervals = 30
+
+// MemberInfo describes a node in the cluster as advertised through its heartbeats
+type MemberInfo struct {
+	ID        NodeID    `json:"id"`
+	Address   string    `json:"address"`
+	Version   string    `json:"version"`
+	StartTime time.Time `json:"start_time"`
+	LastSeen  time.Time `json:"last_seen"`
+	Leaving   bool      `json:"leaving,omitempty"` // Sent in the last heartbeat of a node that shuts down cleanly
+}
+
+// Membership keeps a registry of cluster nodes, based on the heartbeats every node broadcasts
+type Membership struct {
+	conn         *nats.Conn
+	subject      string
+	interval     time.Duration
+	self         MemberInfo
+	subscription *nats.Subscription
+	done         chan struct{}
+
+	mutex   sync.Mutex
+	members map[NodeID]*MemberInfo
+}
+
+func NewMembership(conn *nats.Conn, subject string, interval time.Duration, self MemberInfo) (*Membership, error) {
+	var err error
+	m := &Membership{
+		conn:     conn,
+		subject:  subject,
+		interval: interval,
+		self:     self,
+		done:     make(chan struct{}),
+		members:  map[NodeID]*MemberInfo{},
+	}
+	m.self.StartTime = time.Now()
+	m.self.Version = config.Version
+	m.members[self.ID] = &m.self
+
+	m.subscription, err = conn.Subscribe(subject, func(msg *nats.Msg) {
+		var mi MemberInfo
+		if err := json.Unmarshal(msg.Data, &mi); err != nil {
+			log.Errorf("Could not unmarshal heartbeat: %s", err)
+			return
+		}
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		if mi.Leaving {
+			log.Infof("Node %d left the cluster", mi.ID)
+			delete(m.members, mi.ID)
+			return
+		}
+		if _, ok := m.members[mi.ID]; !ok {
+			log.Infof("Node %d joined the cluster", mi.ID)
+		}
+		// Use our own clock, so clock skew between nodes doesn't matter
+		mi.LastSeen = time.Now()
+		m.members[mi.ID] = &mi
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "heartbeat subscribe")
+	}
+
+	go m.broadcaster()
+
+	return m, nil
+}
+
+func (m *Membership) broadcaster() {
+	for {
+		if err := m.conn.Publish(m.subject, util.MustJsonByteSlice(m.self)); err != nil {
+			log.Errorf("Could not broadcast heartbeat: %s", err)
+		}
+		m.forgetDeadMembers()
+		select {
+		case <-m.done:
+			return
+		case <-time.After(m.interval):
+		}
+	}
+}
+
+func (m *Membership) forgetDeadMembers() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id, mi := range m.members {
+		if id != m.self.ID && time.Since(mi.LastSeen) > memberForgetIntervals*m.interval {
+			log.Infof("Forgetting about node %d", id)
+			delete(m.members, id)
+		}
+	}
+}
+
+// Members returns all known nodes, including ones that recently stopped responding
+func (m *Membership) Members() map[NodeID]*MemberInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	members := make(map[NodeID]*MemberInfo, len(m.members))
+	for id, mi := range m.members {
+		miCopy := *mi
+		if id == m.self.ID {
+			miCopy.LastSeen = time.Now()
+		}
+		members[id] = &miCopy
+	}
+	return members
+}
+
+// LiveNodes returns the IDs of all nodes heard from recently, sorted
+func (m *Membership) LiveNodes() []NodeID {
+	return m.nodes(true)
+}
+
+// DownNodes returns the IDs of all known nodes whose heartbeats stopped, but that haven't been forgotten yet, sorted
+func (m *Membership) DownNodes() []NodeID {
+	return m.nodes(false)
+}
+
+func (m *Membership) nodes(live bool) []NodeID {
+	ids := []NodeID{}
+	for id, mi := range m.Members() {
+		if (time.Since(mi.LastSeen) <= memberTimeoutIntervals*m.interval) == live {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// Close announces this node is leaving the cluster and stops broadcasting heartbeats
+func (m *Membership) Close() error {
+	close(m.done)
+	leaving := m.self
+	leaving.Leaving = true
+	if err := m.conn.Publish(m.subject, util.MustJsonByteSlice(leaving)); err != nil {
+		return errors.Wrap(err, "leave")
+	}
+	return m.subscription.Unsubscribe()
+}
@@ -0,0 +1,57 @@
+package cluster_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/config"
+)
+
+func TestMembership(t *testing.T) {
+	a := assert.New(t)
+	conn, err := cluster.ConnectOrBoot(&config.Config{
+		DataDir:        t.TempDir(),
+		ClusterNatsUrl: "nats://localhost:4222",
+	})
+	a.NoError(err)
+	defer conn.Close()
+
+	m1, err := cluster.NewMembership(conn, "membership.heartbeat", 100*time.Millisecond, cluster.MemberInfo{
+		ID:      1,
+		Address: "node1:8222",
+	})
+	a.NoError(err)
+	defer m1.Close()
+	m2, err := cluster.NewMembership(conn, "membership.heartbeat", 100*time.Millisecond, cluster.MemberInfo{
+		ID:      2,
+		Address: "node2:8222",
+	})
+	a.NoError(err)
+
+	time.Sleep(250 * time.Millisecond)
+	a.Equal([]cluster.NodeID{1, 2}, m1.LiveNodes())
+	a.Equal([]cluster.NodeID{1, 2}, m2.LiveNodes())
+	members := m1.Members()
+	a.Equal("node2:8222", members[2].Address)
+	a.Equal(config.Version, members[2].Version)
+	a.False(members[2].StartTime.IsZero())
+
+	a.Empty(m1.DownNodes())
+
+	// A node leaving cleanly is removed right away
+	a.NoError(m2.Close())
+	time.Sleep(50 * time.Millisecond)
+	a.Equal([]cluster.NodeID{1}, m1.LiveNodes())
+	a.Empty(m1.DownNodes())
+
+	// A node whose heartbeats stop is down, but still known
+	a.NoError(conn.Publish("membership.heartbeat", []byte(`{"id": 3, "address": "node3:8222"}`)))
+	time.Sleep(50 * time.Millisecond)
+	a.Equal([]cluster.NodeID{1, 3}, m1.LiveNodes())
+	time.Sleep(350 * time.Millisecond)
+	a.Equal([]cluster.NodeID{1}, m1.LiveNodes())
+	a.Equal([]cluster.NodeID{3}, m1.DownNodes())
+	a.Equal("node3:8222", m1.Members()[3].Address)
+}
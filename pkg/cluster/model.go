@@ -1,13 +1,18 @@
 package cluster
 
 import (
-	"regexp"
+	"time"
 )
 
 const (
 	EventRestartApp     = "$restart"
 	EventFetchNodeInfo  = "$nodeinfo"
 	EventStartJobWorker = "$startjob"
+	EventJobExited      = "$jobexited"
+	EventStopJobWorker  = "$stopjob"
+	EventRebalance      = "$rebalance"
+	EventCordonNode     = "$cordon"
+	EventDrainNode      = "$drain"
 )
 
 type NodeID = uint64
@@ -32,7 +37,18 @@ type functionResult struct {
 }
 
 type startJobWorker struct {
-	Name string `json:"name"`
+	Name         string `json:"name"`
+	FencingToken uint64 `json:"fencing_token"`
+}
+
+type stopJobWorker struct {
+	Name         string `json:"name"`
+	N            int    `json:"n"`
+	FencingToken uint64 `json:"fencing_token"`
+}
+
+type cordonNode struct {
+	Cordoned bool `json:"cordoned"`
 }
 
 type startFunctionWorker struct {
@@ -44,28 +60,93 @@ type FetchNodeInfo struct {
 }
 
 type ClusterInfo struct {
-	Nodes map[NodeID]*NodeInfo
+	Nodes        map[NodeID]*NodeInfo
+	Members      map[NodeID]*MemberInfo  `json:",omitempty"` // All known nodes according to the membership registry
+	Unresponsive []NodeID                `json:",omitempty"` // Known live nodes that didn't respond in time
+	Down         []NodeID                `json:",omitempty"` // Known nodes whose heartbeats stopped
+	CrossApp     []*CrossAppSubscription `json:",omitempty"` // Apps subscribing to events of other apps
+}
+
+// CrossAppSubscription describes functions of App listening to events of SourceApp matching Pattern
+type CrossAppSubscription struct {
+	App       string
+	SourceApp string
+	Pattern   string
+	Functions []string
+	Grants    []string // Patterns SourceApp exports to App, events not matching any of these are not delivered
 }
 
 type NodeInfo struct {
-	ID   NodeID
-	Apps map[string]*AppInfo
+	ID         NodeID
+	Apps       map[string]*AppInfo
+	Labels     map[string]string
+	FreeMemory uint64 // In bytes, 0 when unknown
+	Cordoned   bool   // Cordoned nodes receive no new job placements
+	Draining   bool   // Draining nodes are cordoned and have their jobs moved elsewhere and function workers stopped
 }
 
 type AppInfo struct {
 	FunctionWorkers map[string]int
 	JobWorkers      map[string]int
+	FunctionErrors  map[string]*ErrorInfo // Most recent invocation error per function
+	JobStates       map[string][]JobState // State of every job worker
+	JobRestarts     map[string]int
+	JobExits        map[string]int // Number of times a job instance exited without being asked to stop
+}
+
+type JobState string
+
+const (
+	JobStateRunning    JobState = "running"
+	JobStateRestarting JobState = "restarting" // Waiting for backoff to pass before restarting
+	JobStateCrashLoop  JobState = "crash-loop" // Exceeded the maximum number of consecutive restarts, given up
+	JobStateExited     JobState = "exited"     // Exited, and the restart policy says not to restart
+)
+
+// JobExit is sent to the leader when a job instance exits without being asked to stop
+type JobExit struct {
+	Name     string   `json:"name"`
+	ExitCode int      `json:"exit_code"`
+	Stderr   []string `json:"stderr,omitempty"`
+	Restarts int      `json:"restarts"`
+	State    JobState `json:"state"`
+}
+
+type ErrorInfo struct {
+	Message string
+	Time    time.Time
 }
 
-type logMessage struct {
-	Message  string `json:"message"`
-	Function string `json:"function"`
+type LogLevel string
+
+const (
+	LogLevelDebug LogLevel = "debug"
+	LogLevelInfo  LogLevel = "info"
+	LogLevelWarn  LogLevel = "warn"
+	LogLevelError LogLevel = "error"
+)
+
+var logLevelOrder = map[LogLevel]int{
+	LogLevelDebug: 0,
+	LogLevelInfo:  1,
+	LogLevelWarn:  2,
+	LogLevelError: 3,
 }
 
-var safeSubjectRE = regexp.MustCompile("[^A-Za-z0-9_\\*\\.>]")
+// AtLeast returns whether this level is at least as severe as min, unknown levels are treated as info
+func (l LogLevel) AtLeast(min LogLevel) bool {
+	order, ok := logLevelOrder[l]
+	if !ok {
+		order = logLevelOrder[LogLevelInfo]
+	}
+	return order >= logLevelOrder[min]
+}
 
-// SafeNATSSubject turns an event name into a safe to use NATS subject
-// TODO: add safer handling of e.g. colons
-func SafeNATSSubject(eventName string) string {
-	return safeSubjectRE.ReplaceAllString(eventName, "_")
+// LogMessage is a single (potentially multi-line) log record emitted by a function or job instance
+type LogMessage struct {
+	Function     string                 `json:"function"`
+	Level        LogLevel               `json:"level"`
+	Message      string                 `json:"message"`
+	Fields       map[string]interface{} `json:"fields,omitempty"`
+	InvocationID string                 `json:"invocation_id,omitempty" mapstructure:"invocation_id"`
 }
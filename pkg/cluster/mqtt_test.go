@@ -0,0 +1,165 @@
+package cluster_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/util"
+)
+
+func TestMQTTListener(t *testing.T) {
+	a := assert.New(t)
+	mqttAddress := "127.0.0.1:18830"
+	cfg := config.NewConfig()
+	cfg.DataDir = mqttDataDir(t)
+	cfg.ClusterNatsUrl = "nats://localhost:4326"
+	cfg.MQTTListen = mqttAddress
+	conn, err := cluster.ConnectOrBoot(cfg)
+	a.NoError(err)
+	defer conn.Close()
+
+	received := make(chan *nats.Msg, 1)
+	_, err = conn.ChanSubscribe("apps.home.light", received)
+	a.NoError(err)
+
+	mqttConn, err := net.Dial("tcp", mqttAddress)
+	a.NoError(err)
+	defer mqttConn.Close()
+
+	// CONNECT with MQTT 3.1.1, clean session and client ID "t"
+	_, err = mqttConn.Write([]byte{0x10, 13, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 60, 0, 1, 't'})
+	a.NoError(err)
+	connAck := make([]byte, 4)
+	mqttConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = mqttConn.Read(connAck)
+	a.NoError(err)
+	a.Equal([]byte{0x20, 2, 0, 0}, connAck)
+
+	// PUBLISH "on" to apps/home/light with QoS 0
+	_, err = mqttConn.Write(append([]byte{0x30, 19, 0, 15}, []byte("apps/home/lighton")...))
+	a.NoError(err)
+	select {
+	case msg := <-received:
+		a.Equal("on", string(msg.Data))
+	case <-time.After(5 * time.Second):
+		a.Fail("MQTT message not received")
+	}
+
+	// Apps publish back on MQTT topics
+	ceb := cluster.NewClusterEventBus(conn, "mls.test")
+	mqttReceived := make(chan string, 1)
+	_, err = ceb.QueueSubscribeMQTT("apps.home.light", "mqtt.subscribe.0", func(subject string, payload []byte) {
+		mqttReceived <- string(payload)
+	})
+	a.NoError(err)
+	a.NoError(ceb.PublishMQTT("apps.home.light", util.MustJsonByteSlice("off")))
+	select {
+	case payload := <-mqttReceived:
+		a.Fail("received own message", payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMQTTAuthentication(t *testing.T) {
+	a := assert.New(t)
+	mqttAddress := "127.0.0.1:18831"
+	cfg := config.NewConfig()
+	cfg.DataDir = mqttDataDir(t)
+	cfg.ClusterNatsUrl = "nats://localhost:4328"
+	cfg.ClusterNatsUser = "mls"
+	cfg.ClusterNatsPassword = "secret"
+	cfg.MQTTListen = mqttAddress
+	cfg.MQTTUser = "devices"
+	cfg.MQTTPassword = "devicesecret"
+	conn, err := cluster.ConnectOrBoot(cfg)
+	a.NoError(err)
+	defer conn.Close()
+
+	// The NATS credentials cannot be used over MQTT, nor the other way around
+	_, returnCode := mqttConnect(t, mqttAddress, "mls", "secret")
+	a.NotEqual(byte(0), returnCode)
+	_, err = nats.Connect(cfg.ClusterNatsUrl, nats.UserInfo("devices", "devicesecret"))
+	a.Error(err)
+
+	mqttConn, returnCode := mqttConnect(t, mqttAddress, "devices", "devicesecret")
+	a.Equal(byte(0), returnCode)
+	defer mqttConn.Close()
+
+	// Topics of apps can be used
+	received := make(chan *nats.Msg, 1)
+	_, err = conn.ChanSubscribe("apps.home.light", received)
+	a.NoError(err)
+	_, err = mqttConn.Write(append([]byte{0x30, 19, 0, 15}, []byte("apps/home/lighton")...))
+	a.NoError(err)
+	select {
+	case msg := <-received:
+		a.Equal("on", string(msg.Data))
+	case <-time.After(5 * time.Second):
+		a.Fail("MQTT message not received")
+	}
+	a.Equal(byte(1), mqttSubscribe(t, mqttConn, "apps/home/#", 1))
+
+	// Subjects of Matterless itself cannot
+	a.Equal(byte(0x80), mqttSubscribe(t, mqttConn, "mls/#", 0))
+}
+
+func TestMQTTRequiresUserWithCredentials(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.ClusterNatsUrl = "nats://localhost:4329"
+	cfg.ClusterNatsUser = "mls"
+	cfg.ClusterNatsPassword = "secret"
+	cfg.MQTTListen = "127.0.0.1:18832"
+	_, err := cluster.ConnectOrBoot(cfg)
+	assert.Error(t, err)
+}
+
+// mqttConnect connects with MQTT 3.1.1, a clean session, client ID "t" and the given credentials, returning the
+// connection and the return code of the CONNACK
+func mqttConnect(t *testing.T, address, username, password string) (net.Conn, byte) {
+	mqttConn, err := net.Dial("tcp", address)
+	assert.NoError(t, err)
+	payload := []byte{0, 1, 't', 0, byte(len(username))}
+	payload = append(payload, username...)
+	payload = append(append(payload, 0, byte(len(password))), password...)
+	packet := append([]byte{0x10, byte(10 + len(payload)), 0, 4, 'M', 'Q', 'T', 'T', 4, 0xc2, 0, 60}, payload...)
+	_, err = mqttConn.Write(packet)
+	assert.NoError(t, err)
+	connAck := make([]byte, 4)
+	mqttConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(mqttConn, connAck); err != nil {
+		// Refused connections may be closed right away
+		mqttConn.Close()
+		return nil, 0xff
+	}
+	return mqttConn, connAck[3]
+}
+
+// mqttSubscribe subscribes to a topic filter, returning the granted QoS (or 0x80 on failure) from the SUBACK
+func mqttSubscribe(t *testing.T, mqttConn net.Conn, filter string, qos byte) byte {
+	packet := append([]byte{0x82, byte(5 + len(filter)), 0, 1, 0, byte(len(filter))}, filter...)
+	_, err := mqttConn.Write(append(packet, qos))
+	assert.NoError(t, err)
+	subAck := make([]byte, 5)
+	mqttConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(mqttConn, subAck)
+	assert.NoError(t, err)
+	return subAck[4]
+}
+
+// mqttDataDir creates a data dir that's left behind, the embedded server keeps writing the MQTT streams to it after
+// the test finishes
+func mqttDataDir(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "mls-mqtt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
@@ -0,0 +1,231 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zefhemel/matterless/pkg/config"
+)
+
+// MQTTAppsTopic is the MQTT topic level the MQTT topics of all apps live under, the only topics MQTT clients can use
+const MQTTAppsTopic = "apps"
+
+// Connection types of NATS users, keeping MQTT clients and nodes from using each other's credentials
+const (
+	natsConnectionTypeStandard = "STANDARD"
+	natsConnectionTypeMQTT     = "MQTT"
+)
+
+// natsPassword returns the configured NATS password, read from the password file if one is configured
+func natsPassword(config *config.Config) (string, error) {
+	return readPassword(config.ClusterNatsPassword, config.ClusterNatsPasswordFile)
+}
+
+// readPassword returns password, or the content of passwordFile if set
+func readPassword(password, passwordFile string) (string, error) {
+	if passwordFile == "" {
+		return password, nil
+	}
+	content, err := os.ReadFile(passwordFile)
+	if err != nil {
+		return "", errors.Wrap(err, "read password file")
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// natsConnectOptions builds the authentication and TLS options to connect to NATS with
+func natsConnectOptions(config *config.Config) ([]nats.Option, error) {
+	opts := []nats.Option{}
+	if config.ClusterNatsUser != "" {
+		password, err := natsPassword(config)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.UserInfo(config.ClusterNatsUser, password))
+	}
+	if config.ClusterNatsNKeySeedFile != "" {
+		opt, err := nats.NkeyOptionFromSeed(config.ClusterNatsNKeySeedFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "nkey seed")
+		}
+		opts = append(opts, opt)
+	}
+	if config.ClusterNatsCredsFile != "" {
+		opts = append(opts, nats.UserCredentials(config.ClusterNatsCredsFile))
+	}
+	if config.ClusterNatsTLSCA != "" {
+		opts = append(opts, nats.RootCAs(config.ClusterNatsTLSCA))
+	}
+	if config.ClusterNatsTLSCert != "" {
+		opts = append(opts, nats.ClientCert(config.ClusterNatsTLSCert, config.ClusterNatsTLSKey))
+	}
+	return opts, nil
+}
+
+// configureServerSecurity applies the configured credentials and TLS settings to the embedded NATS server, so that
+// clients need the same credentials the node itself connects with
+func configureServerSecurity(config *config.Config, opts *server.Options) error {
+	if config.ClusterNatsCredsFile != "" {
+		return errors.New("creds file authentication requires a separately run NATS server with an operator configured")
+	}
+
+	if config.ClusterNatsUser != "" {
+		password, err := natsPassword(config)
+		if err != nil {
+			return err
+		}
+		opts.Users = []*server.User{{
+			Username:               config.ClusterNatsUser,
+			Password:               password,
+			AllowedConnectionTypes: map[string]struct{}{natsConnectionTypeStandard: {}},
+		}}
+		// Routes between embedded servers authenticate with the same credentials
+		setRouteCredentials(opts, config.ClusterNatsUser, password)
+	}
+	if config.ClusterNatsNKeySeedFile != "" {
+		seed, err := os.ReadFile(config.ClusterNatsNKeySeedFile)
+		if err != nil {
+			return errors.Wrap(err, "read nkey seed")
+		}
+		kp, err := nkeys.ParseDecoratedNKey(seed)
+		if err != nil {
+			return errors.Wrap(err, "parse nkey seed")
+		}
+		publicKey, err := kp.PublicKey()
+		if err != nil {
+			return errors.Wrap(err, "nkey public key")
+		}
+		opts.Nkeys = []*server.NkeyUser{{
+			Nkey:                   publicKey,
+			AllowedConnectionTypes: map[string]struct{}{natsConnectionTypeStandard: {}},
+		}}
+		if config.ClusterNatsUser == "" {
+			// Routes don't support nkeys, they authenticate with a password derived from the seed all nodes share
+			seed, err := kp.Seed()
+			if err != nil {
+				return errors.Wrap(err, "nkey seed")
+			}
+			routePassword := sha256.Sum256(append([]byte("mls-route:"), seed...))
+			setRouteCredentials(opts, publicKey, hex.EncodeToString(routePassword[:]))
+		}
+	}
+
+	if config.ClusterNatsTLSCert != "" {
+		tlsConfig, err := server.GenTLSConfig(&server.TLSConfigOpts{
+			CertFile: config.ClusterNatsTLSCert,
+			KeyFile:  config.ClusterNatsTLSKey,
+			CaFile:   config.ClusterNatsTLSCA,
+		})
+		if err != nil {
+			return errors.Wrap(err, "tls config")
+		}
+		opts.TLS = true
+		opts.TLSConfig = tlsConfig
+
+		if opts.Cluster.Port != 0 {
+			// Servers verify each other's certificates, acting as both client and server on routes
+			routeTLSConfig, err := server.GenTLSConfig(&server.TLSConfigOpts{
+				CertFile: config.ClusterNatsTLSCert,
+				KeyFile:  config.ClusterNatsTLSKey,
+				CaFile:   config.ClusterNatsTLSCA,
+				Verify:   true,
+			})
+			if err != nil {
+				return errors.Wrap(err, "route tls config")
+			}
+			routeTLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			routeTLSConfig.RootCAs = routeTLSConfig.ClientCAs
+			opts.Cluster.TLSConfig = routeTLSConfig
+		}
+		if opts.MQTT.Port != 0 {
+			opts.MQTT.TLSConfig = tlsConfig
+		}
+	}
+
+	authenticated := len(opts.Users) > 0 || len(opts.Nkeys) > 0
+	if opts.MQTT.Port != 0 {
+		if err := configureMQTTSecurity(config, opts, authenticated); err != nil {
+			return err
+		}
+	}
+
+	if !authenticated {
+		opts.Host = localHost(opts.Host, "NATS")
+		log.Warn("No NATS credentials configured, the embedded NATS server only accepts local connections")
+		if opts.Cluster.Port != 0 {
+			log.Warn("Cluster routes of the embedded NATS server are not authenticated, configure NATS credentials to secure them")
+		}
+	} else if opts.Host == "" {
+		opts.Host = "0.0.0.0"
+	}
+	return nil
+}
+
+// configureMQTTSecurity makes MQTT clients authenticate as the MQTT user, which can only use the MQTT topics of apps.
+// Without NATS credentials there is no MQTT user either, and MQTT clients are only accepted from localhost
+func configureMQTTSecurity(config *config.Config, opts *server.Options, authenticated bool) error {
+	if !authenticated {
+		if config.MQTTUser != "" {
+			return errors.New("an MQTT user requires NATS credentials to be configured as well")
+		}
+		opts.MQTT.Host = localHost(opts.MQTT.Host, "MQTT")
+		log.Warn("No NATS credentials configured, the embedded NATS server only accepts local MQTT connections")
+		return nil
+	}
+	if config.MQTTUser == "" {
+		return errors.New("accepting MQTT connections with NATS credentials configured requires an MQTT user")
+	}
+	if config.MQTTUser == config.ClusterNatsUser {
+		return errors.New("the MQTT user has to differ from the NATS user")
+	}
+	if config.ClusterNatsPrefix == MQTTAppsTopic {
+		return errors.Errorf("the NATS prefix cannot be %s, MQTT clients have access to it", MQTTAppsTopic)
+	}
+	password, err := readPassword(config.MQTTPassword, config.MQTTPasswordFile)
+	if err != nil {
+		return errors.Wrap(err, "mqtt password")
+	}
+	if password == "" {
+		return errors.New("no MQTT password configured")
+	}
+	appTopics := fmt.Sprintf("%s.>", MQTTAppsTopic)
+	opts.Users = append(opts.Users, &server.User{
+		Username: config.MQTTUser,
+		Password: password,
+		Permissions: &server.Permissions{
+			Publish: &server.SubjectPermission{Allow: []string{appTopics}},
+			// QoS 1 subscriptions are delivered through an inbox of the MQTT listener
+			Subscribe: &server.SubjectPermission{Allow: []string{appTopics, "$MQTT.sub.>"}},
+		},
+		AllowedConnectionTypes: map[string]struct{}{natsConnectionTypeMQTT: {}},
+	})
+	return nil
+}
+
+// localHost returns the host to bind to when only local connections should be accepted, warning when this overrides
+// a configured one
+func localHost(host string, what string) string {
+	if host != "" && host != "127.0.0.1" && host != "localhost" {
+		log.Warnf("Binding the %s listener of the embedded NATS server to 127.0.0.1 rather than %s, as no NATS credentials are configured", what, host)
+	}
+	return "127.0.0.1"
+}
+
+// setRouteCredentials makes the embedded server require the given credentials from routes, and use them on its own
+func setRouteCredentials(opts *server.Options, username, password string) {
+	opts.Cluster.Username = username
+	opts.Cluster.Password = password
+	for _, route := range opts.Routes {
+		route.User = url.UserPassword(username, password)
+	}
+}
@@ -0,0 +1,199 @@
+package cluster
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/config"
+)
+
+func TestNKeyRouteCredentials(t *testing.T) {
+	a := assert.New(t)
+	kp, err := nkeys.CreateUser()
+	a.NoError(err)
+	seed, err := kp.Seed()
+	a.NoError(err)
+	publicKey, err := kp.PublicKey()
+	a.NoError(err)
+	seedFile := filepath.Join(t.TempDir(), "node.nk")
+	a.NoError(os.WriteFile(seedFile, seed, 0600))
+
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.ClusterNatsNKeySeedFile = seedFile
+	cfg.ClusterListen = ":6222"
+	cfg.ClusterPeers = []string{"node2:6222"}
+	opts, err := natsServerOptions(cfg, 4222)
+	a.NoError(err)
+	a.Equal("0.0.0.0", opts.Host)
+	if a.Len(opts.Nkeys, 1) {
+		a.Equal(publicKey, opts.Nkeys[0].Nkey)
+	}
+
+	// Routes authenticate with a password every node derives from the shared seed
+	routePassword := sha256.Sum256(append([]byte("mls-route:"), seed...))
+	a.Equal(publicKey, opts.Cluster.Username)
+	a.Equal(hex.EncodeToString(routePassword[:]), opts.Cluster.Password)
+	if a.Len(opts.Routes, 1) {
+		a.Equal(publicKey, opts.Routes[0].User.Username())
+		password, _ := opts.Routes[0].User.Password()
+		a.Equal(opts.Cluster.Password, password)
+	}
+	otherNodeCfg := config.NewConfig()
+	otherNodeCfg.DataDir = t.TempDir()
+	otherNodeCfg.ClusterNatsNKeySeedFile = seedFile
+	otherNodeCfg.ClusterListen = ":7222"
+	otherNodeOpts, err := natsServerOptions(otherNodeCfg, 4222)
+	a.NoError(err)
+	a.Equal(opts.Cluster.Password, otherNodeOpts.Cluster.Password)
+
+	// With a NATS user as well, routes use the user's credentials
+	cfg.ClusterNatsUser = "mls"
+	cfg.ClusterNatsPassword = "secret"
+	opts, err = natsServerOptions(cfg, 4222)
+	a.NoError(err)
+	a.Equal("mls", opts.Cluster.Username)
+	a.Equal("secret", opts.Cluster.Password)
+
+	cfg.ClusterNatsNKeySeedFile = filepath.Join(t.TempDir(), "missing.nk")
+	_, err = natsServerOptions(cfg, 4222)
+	a.Error(err)
+}
+
+func TestServerTLS(t *testing.T) {
+	a := assert.New(t)
+	caFile, certFile, keyFile := writeTestCertificates(t, t.TempDir())
+
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.ClusterNatsUser = "mls"
+	cfg.ClusterNatsPassword = "secret"
+	cfg.ClusterNatsTLSCA = caFile
+	cfg.ClusterNatsTLSCert = certFile
+	cfg.ClusterNatsTLSKey = keyFile
+	cfg.ClusterListen = ":6222"
+	cfg.MQTTListen = ":1883"
+	cfg.MQTTUser = "device"
+	cfg.MQTTPassword = "device-secret"
+	opts, err := natsServerOptions(cfg, 4222)
+	a.NoError(err)
+	a.True(opts.TLS)
+	if a.NotNil(opts.TLSConfig) {
+		a.Len(opts.TLSConfig.Certificates, 1)
+	}
+	a.Equal(opts.TLSConfig, opts.MQTT.TLSConfig)
+
+	// Servers verify each other's certificates on routes, in both directions
+	if a.NotNil(opts.Cluster.TLSConfig) {
+		a.Equal(tls.RequireAndVerifyClientCert, opts.Cluster.TLSConfig.ClientAuth)
+		a.NotNil(opts.Cluster.TLSConfig.ClientCAs)
+		a.Equal(opts.Cluster.TLSConfig.ClientCAs, opts.Cluster.TLSConfig.RootCAs)
+		a.Len(opts.Cluster.TLSConfig.Certificates, 1)
+	}
+
+	// Without a cluster there are no route TLS settings
+	cfg.ClusterListen = ""
+	cfg.MQTTListen = ""
+	opts, err = natsServerOptions(cfg, 4333)
+	a.NoError(err)
+	a.True(opts.TLS)
+	a.Nil(opts.Cluster.TLSConfig)
+
+	// Nodes connect with the CA and certificate configured, clients without them are refused
+	ns, err := server.NewServer(opts)
+	a.NoError(err)
+	go ns.Start()
+	defer ns.Shutdown()
+	a.True(ns.ReadyForConnections(5 * time.Second))
+	connectOpts, err := natsConnectOptions(cfg)
+	a.NoError(err)
+	nc, err := nats.Connect("tls://localhost:4333", connectOpts...)
+	if a.NoError(err) {
+		a.True(nc.TLSRequired())
+		nc.Close()
+	}
+	_, err = nats.Connect("tls://localhost:4333", nats.UserInfo("mls", "secret"))
+	a.Error(err)
+
+	cfg.ClusterNatsTLSKey = filepath.Join(t.TempDir(), "missing.key")
+	_, err = natsServerOptions(cfg, 4333)
+	a.Error(err)
+}
+
+// writeTestCertificates writes a CA and a certificate it signed for localhost, usable by servers and clients alike
+func writeTestCertificates(t *testing.T, dir string) (caFile, certFile, keyFile string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Matterless Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile = filepath.Join(dir, "ca.pem")
+	certFile = filepath.Join(dir, "node.pem")
+	keyFile = filepath.Join(dir, "node-key.pem")
+	for file, block := range map[string]*pem.Block{
+		caFile:   {Type: "CERTIFICATE", Bytes: caDER},
+		certFile: {Type: "CERTIFICATE", Bytes: certDER},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return caFile, certFile, keyFile
+}
@@ -0,0 +1,53 @@
+package cluster_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/config"
+)
+
+func TestNatsAuthentication(t *testing.T) {
+	a := assert.New(t)
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.ClusterNatsUrl = "nats://localhost:4322"
+	cfg.ClusterNatsUser = "mls"
+	cfg.ClusterNatsPassword = "secret"
+	conn, err := cluster.ConnectOrBoot(cfg)
+	a.NoError(err)
+	defer conn.Close()
+
+	// Without credentials
+	_, err = nats.Connect(cfg.ClusterNatsUrl)
+	a.Error(err)
+
+	// Wrong credentials
+	_, err = nats.Connect(cfg.ClusterNatsUrl, nats.UserInfo("mls", "wrong"))
+	a.Error(err)
+
+	// Connecting again with the right credentials
+	conn2, err := cluster.ConnectOrBoot(cfg)
+	a.NoError(err)
+	conn2.Close()
+
+	// Password read from a file
+	passwordFile := filepath.Join(t.TempDir(), "nats-password")
+	a.NoError(os.WriteFile(passwordFile, []byte("secret\n"), 0600))
+	cfg.ClusterNatsPassword = ""
+	cfg.ClusterNatsPasswordFile = passwordFile
+	conn3, err := cluster.ConnectOrBoot(cfg)
+	a.NoError(err)
+	conn3.Close()
+
+	// Creds files need a separately run server
+	cfg.ClusterNatsUrl = "nats://localhost:4323"
+	cfg.ClusterNatsUser = ""
+	cfg.ClusterNatsCredsFile = "user.creds"
+	_, err = cluster.ConnectOrBoot(cfg)
+	a.Error(err)
+}
@@ -0,0 +1,123 @@
+package cluster
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zefhemel/matterless/pkg/util"
+)
+
+// Suffix of the subjects log events are published on, log event names follow the same <function>.log convention
+const logSubjectSuffix = ".log"
+
+// EncodeSubjectToken losslessly encodes a name (e.g. of an event or function) into a single NATS subject token.
+// Characters NATS gives a meaning to (. * >), whitespace, control characters, non-ASCII bytes and the % escape
+// character itself are percent-encoded, everything else is kept as is. The empty name is encoded as a lone %
+func EncodeSubjectToken(name string) string {
+	if name == "" {
+		return "%"
+	}
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || c == '.' || c == '*' || c == '>' || c == '%' {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// DecodeSubjectToken reverses EncodeSubjectToken
+func DecodeSubjectToken(token string) (string, error) {
+	if token == "%" {
+		return "", nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(token); i++ {
+		c := token[i]
+		if c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(token) {
+			return "", fmt.Errorf("truncated escape sequence in subject token: %s", token)
+		}
+		b, err := strconv.ParseUint(token[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence in subject token: %s", token)
+		}
+		sb.WriteByte(byte(b))
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+// EventPattern is an event name pattern translated to a NATS subject to subscribe to
+type EventPattern struct {
+	Subject string
+	matcher *regexp.Regexp // nil when all names received on Subject match
+}
+
+// Matches checks if an event name received on the pattern's subject matches the pattern
+func (ep EventPattern) Matches(name string) bool {
+	return ep.matcher == nil || ep.matcher.MatchString(name)
+}
+
+// NewEventPattern translates an event name pattern, in which * matches any sequence of characters, to a subject.
+// Patterns that are * or contain no * translate to a subject exactly, others to a wildcard subject along with a
+// matcher on the event name. Patterns ending in .log match log events of the functions matching the part before it
+func NewEventPattern(pattern string) EventPattern {
+	if strings.HasSuffix(pattern, logSubjectSuffix) {
+		ep := newSingleTokenPattern(strings.TrimSuffix(pattern, logSubjectSuffix))
+		ep.Subject += logSubjectSuffix
+		if ep.matcher != nil {
+			ep.matcher = util.GlobRegexp(pattern)
+		}
+		return ep
+	}
+	return newSingleTokenPattern(pattern)
+}
+
+func newSingleTokenPattern(pattern string) EventPattern {
+	switch {
+	case pattern == "*":
+		return EventPattern{Subject: "*"}
+	case !strings.Contains(pattern, "*"):
+		return EventPattern{Subject: EncodeSubjectToken(pattern)}
+	default:
+		return EventPattern{Subject: "*", matcher: util.GlobRegexp(pattern)}
+	}
+}
+
+// legacyEventPattern translates an event name pattern to the subject nodes using legacy subjects publish matching
+// events on, see SafeNATSSubject. As different names share legacy subjects, names are always matched
+func legacyEventPattern(pattern string) EventPattern {
+	return EventPattern{Subject: SafeNATSSubject(pattern), matcher: util.GlobRegexp(pattern)}
+}
+
+// eventSubject returns the subject to publish an event with the given name on, names ending in .log are log events of
+// the function named by the part before it, like subscriptions to them assume
+func eventSubject(name string) string {
+	if strings.HasSuffix(name, logSubjectSuffix) {
+		return logSubject(strings.TrimSuffix(name, logSubjectSuffix))
+	}
+	return EncodeSubjectToken(name)
+}
+
+// logSubject returns the subject to publish log events of the given function on
+func logSubject(funcName string) string {
+	return EncodeSubjectToken(funcName) + logSubjectSuffix
+}
+
+var safeSubjectRE = regexp.MustCompile("[^A-Za-z0-9_\\*\\.>]")
+
+// SafeNATSSubject turns an event name into the subject used before subjects were encoded losslessly, it maps
+// different names to the same subject and splits names containing dots into multiple tokens.
+// Events are still published on these subjects as well when legacy subjects are enabled, for existing subscribers
+func SafeNATSSubject(eventName string) string {
+	return safeSubjectRE.ReplaceAllString(eventName, "_")
+}
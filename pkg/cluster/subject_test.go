@@ -0,0 +1,220 @@
+package cluster_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/config"
+)
+
+func TestSubjectTokenEncoding(t *testing.T) {
+	a := assert.New(t)
+	names := []string{
+		"",
+		"simple",
+		"http:GET:/a-b",
+		"http:GET:/a_b",
+		"store:put:user:1",
+		"store_put_user_1",
+		"user.created",
+		"user_created",
+		"with space",
+		"100%",
+		"wild*card>",
+		"ünïcødé",
+		"%",
+	}
+	seen := map[string]string{}
+	for _, name := range names {
+		token := cluster.EncodeSubjectToken(name)
+		a.NotContains(token, ".")
+		a.NotContains(token, "*")
+		a.NotContains(token, ">")
+		a.NotContains(token, " ")
+		a.NotEmpty(token)
+		if other, ok := seen[token]; ok {
+			a.Failf("collision", "%q and %q both encode to %q", name, other, token)
+		}
+		seen[token] = name
+		decoded, err := cluster.DecodeSubjectToken(token)
+		a.NoError(err)
+		a.Equal(name, decoded)
+	}
+	a.Equal("http:GET:/a-b", cluster.EncodeSubjectToken("http:GET:/a-b"))
+
+	_, err := cluster.DecodeSubjectToken("abc%2")
+	a.Error(err)
+	_, err = cluster.DecodeSubjectToken("abc%zz")
+	a.Error(err)
+}
+
+func TestEventPattern(t *testing.T) {
+	a := assert.New(t)
+	ep := cluster.NewEventPattern("*")
+	a.Equal("*", ep.Subject)
+	a.True(ep.Matches("anything.at:all"))
+
+	ep = cluster.NewEventPattern("user.created")
+	a.Equal("user%2Ecreated", ep.Subject)
+
+	ep = cluster.NewEventPattern("store:put:*")
+	a.Equal("*", ep.Subject)
+	a.True(ep.Matches("store:put:user:1"))
+	a.False(ep.Matches("store:del:user:1"))
+	a.False(ep.Matches("mystore:put:user"))
+
+	ep = cluster.NewEventPattern("*.log")
+	a.Equal("*.log", ep.Subject)
+	a.True(ep.Matches("MyFunction.log"))
+
+	ep = cluster.NewEventPattern("My*.log")
+	a.Equal("*.log", ep.Subject)
+	a.True(ep.Matches("MyFunction.log"))
+	a.False(ep.Matches("OtherFunction.log"))
+}
+
+func TestEventDelivery(t *testing.T) {
+	a := assert.New(t)
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.ClusterNatsUrl = "nats://localhost:4325"
+	conn, err := cluster.ConnectOrBoot(cfg)
+	a.NoError(err)
+	defer conn.Close()
+
+	ceb := cluster.NewClusterEventBus(conn, "test").WithLegacySubjects(true)
+	received := make(chan string, 10)
+	_, err = ceb.SubscribeEvent("*", func(name string, data interface{}, msg *nats.Msg) {
+		received <- name
+	})
+	a.NoError(err)
+	legacyReceived := make(chan string, 10)
+	_, err = conn.Subscribe("test.http_GET__a_b", func(msg *nats.Msg) {
+		legacyReceived <- msg.Subject
+	})
+	a.NoError(err)
+
+	for _, name := range []string{"http:GET:/a-b", "http:GET:/a_b", "user.created"} {
+		a.NoError(ceb.PublishEvent(name, nil))
+	}
+	// Each event is received once under its own name, legacy copies are skipped
+	for _, name := range []string{"http:GET:/a-b", "http:GET:/a_b", "user.created"} {
+		select {
+		case receivedName := <-received:
+			a.Equal(name, receivedName)
+		case <-time.After(time.Second):
+			a.Fail("event not received", name)
+		}
+	}
+	// Legacy subscribers get both colliding events
+	for i := 0; i < 2; i++ {
+		select {
+		case <-legacyReceived:
+		case <-time.After(time.Second):
+			a.Fail("legacy event not received")
+		}
+	}
+	select {
+	case name := <-received:
+		a.Fail("unexpected event", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLegacyFunctionInvocation(t *testing.T) {
+	a := assert.New(t)
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.ClusterNatsUrl = "nats://localhost:4326"
+	conn, err := cluster.ConnectOrBoot(cfg)
+	a.NoError(err)
+	defer conn.Close()
+
+	ceb := cluster.NewClusterEventBus(conn, "test").WithLegacySubjects(true)
+	sub, err := ceb.SubscribeInvokeFunction("My-Function", func(event interface{}) (interface{}, error) {
+		return "new", nil
+	})
+	a.NoError(err)
+
+	// Older versions invoke on the legacy subject
+	resp, err := conn.Request("test.function.My_Function", []byte(`{"data": null}`), time.Second)
+	a.NoError(err)
+	a.Contains(string(resp.Data), "new")
+	a.NoError(sub.Unsubscribe())
+
+	// Workers of older versions handle invocations from legacy mode nodes
+	_, err = conn.QueueSubscribe("test.function.My_Function", "test.function.My_Function.workers", func(msg *nats.Msg) {
+		a.NoError(msg.Respond([]byte(`{"data": "old"}`)))
+	})
+	a.NoError(err)
+	result, err := ceb.InvokeFunction("My-Function", nil)
+	a.NoError(err)
+	a.Equal("old", result)
+}
+
+func TestLegacyEventDelivery(t *testing.T) {
+	a := assert.New(t)
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.ClusterNatsUrl = "nats://localhost:4331"
+	conn, err := cluster.ConnectOrBoot(cfg)
+	a.NoError(err)
+	defer conn.Close()
+
+	ceb := cluster.NewClusterEventBus(conn, "test").WithLegacySubjects(true)
+	received := make(chan string, 10)
+	for _, pattern := range []string{"user.created", "http:GET:/a-b", "MyFunction.log"} {
+		_, err = ceb.SubscribeEvent(pattern, func(name string, data interface{}, msg *nats.Msg) {
+			received <- name
+		})
+		a.NoError(err)
+	}
+
+	// Events published by older versions on legacy subjects, of which only the subscribed names are received
+	a.NoError(conn.Publish("test.user.created", []byte(`{"name": "user.created"}`)))
+	a.NoError(conn.Publish("test.http_GET__a_b", []byte(`{"name": "http:GET:/a_b"}`)))
+	a.NoError(conn.Publish("test.http_GET__a_b", []byte(`{"name": "http:GET:/a-b"}`)))
+	// Events named like log events are published on the log subject
+	a.NoError(ceb.PublishEvent("MyFunction.log", nil))
+	receivedNames := []string{}
+	for i := 0; i < 3; i++ {
+		select {
+		case name := <-received:
+			receivedNames = append(receivedNames, name)
+		case <-time.After(time.Second):
+			a.Fail("event not received")
+		}
+	}
+	a.ElementsMatch([]string{"user.created", "http:GET:/a-b", "MyFunction.log"}, receivedNames)
+
+	// Requests are published on legacy subjects too, for older versions to respond to
+	_, err = conn.Subscribe("test.http_GET__old", func(msg *nats.Msg) {
+		a.NoError(msg.Respond([]byte("old")))
+	})
+	a.NoError(err)
+	resp, err := ceb.RequestEvent("http:GET:/old", nil, time.Second)
+	a.NoError(err)
+	a.Equal("old", string(resp.Data))
+
+	// Subscribers to the encoded subject respond to requests of new versions, skipping the legacy copy
+	var responses int32
+	_, err = ceb.SubscribeEvent("http:GET:/new", func(name string, data interface{}, msg *nats.Msg) {
+		atomic.AddInt32(&responses, 1)
+		a.NoError(msg.Respond([]byte("new")))
+	})
+	a.NoError(err)
+	resp, err = ceb.RequestEvent("http:GET:/new", nil, time.Second)
+	a.NoError(err)
+	a.Equal("new", string(resp.Data))
+	a.Equal(int32(1), atomic.LoadInt32(&responses))
+
+	select {
+	case name := <-received:
+		a.Fail("unexpected event", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"time"
 )
 
+// Version of Matterless, set at build time with -ldflags "-X github.com/zefhemel/matterless/pkg/config.Version=..."
+var Version = "dev"
+
 type Config struct {
 	APIBindPort int
 	DataDir     string
@@ -12,9 +15,39 @@ type Config struct {
 	ClusterNatsUrl           string
 	ClusterNatsPrefix        string
 	ClusterHeartbeatInterval time.Duration
+	ClusterLeaderLeaseTTL    time.Duration     // How long a leader lease is valid without being renewed
+	NodeLabels               map[string]string // Labels advertised by this node, used for function and job placement
+	ClusterListen            string            // Address (host:port) the embedded NATS server accepts cluster routes on, enables clustering
+	ClusterPeers             []string          // Route addresses (host:port) of the embedded NATS servers of other nodes
+	ClusterServerName        string            // Unique and stable name of the embedded NATS server, derived from the hostname if empty
+	ClusterReplicas          int               // Number of replicas for JetStream streams
+	ClusterLegacySubjects    bool              // Also use the lossy subjects used before for events and function invocations
+	MQTTListen               string            // Address (host:port) for the embedded NATS server to accept MQTT connections on
+
+	// NATS authentication and TLS, used both to connect and to secure the embedded server
+	ClusterNatsUser         string
+	ClusterNatsPassword     string
+	ClusterNatsPasswordFile string // Path to a file holding the NATS password, takes precedence over ClusterNatsPassword
+	ClusterNatsNKeySeedFile string // Path to an nkey seed file
+	ClusterNatsCredsFile    string // Path to a user credentials (JWT) file, only supported with a separately run NATS server
+	ClusterNatsTLSCert      string // Path to the certificate, used as server certificate by the embedded server and client certificate otherwise
+	ClusterNatsTLSKey       string
+	ClusterNatsTLSCA        string // Path to the CA to verify certificates with
+
+	// Credentials MQTT clients authenticate with, they can only use the MQTT topics of apps
+	MQTTUser         string
+	MQTTPassword     string
+	MQTTPasswordFile string // Path to a file holding the MQTT password, takes precedence over MQTTPassword
 
-	LoadApps      bool
-	UseSystemDeno bool // Use the system installed deno rather than the version downloaded automatically
+	LoadApps            bool
+	UseSystemDeno       bool              // Use the system installed deno rather than the version downloaded automatically
+	DenoVersion         string            // Deno version to download and run functions with, unless they ask for a specific one
+	DenoMirror          string            // URL or local directory to download deno archives from, laid out like deno's GitHub releases
+	DenoSHA256          string            // Expected SHA-256 checksum of the archive of the configured deno version
+	DenoChecksums       map[string]string // Expected SHA-256 checksums of the archives of other deno versions for this platform, per version
+	DenoAllowUnverified bool              // Install deno archives no checksum is known for
+	DenoVendor          bool              // Vendor the remote modules deno code imports into the cluster on deploy, and run deno with only those
+	EnableExecRuntime   bool              // Allow the exec runtime, which runs any command on the node
 
 	FunctionRunTimeout         time.Duration
 	HTTPGatewayResponseTimeout time.Duration
@@ -23,9 +56,12 @@ type Config struct {
 	SandboxFunctionKeepAlive   time.Duration
 	SandboxJobStartTimeout     time.Duration
 	SandboxJobStopTimeout      time.Duration
+	AppShutdownGracePeriod     time.Duration // Time given to shutdown event handlers before an app is stopped
 	DatastoreSyncTimeout       time.Duration
 	ClusterMonitorInterval     time.Duration
 	ClusterFetchInfoTimeout    time.Duration
+	ClusterJetStreamTimeout    time.Duration // Time to wait for a clustered JetStream to become available on boot
+	ClusterRebalanceMaxMoves   int           // Maximum number of job instances to move per cluster monitor interval when rebalancing
 }
 
 func NewConfig() *Config {
@@ -33,14 +69,21 @@ func NewConfig() *Config {
 		LoadApps:                   true,
 		ClusterNatsUrl:             "nats://localhost:4222",
 		ClusterNatsPrefix:          "mls",
+		NodeLabels:                 map[string]string{},
+		ClusterPeers:               []string{},
+		ClusterReplicas:            1,
+		ClusterJetStreamTimeout:    1 * time.Minute,
 		ClusterHeartbeatInterval:   2 * time.Second,
+		ClusterLeaderLeaseTTL:      6 * time.Second,
 		ClusterMonitorInterval:     10 * time.Second,
 		ClusterFetchInfoTimeout:    1 * time.Second,
+		ClusterRebalanceMaxMoves:   1,
 		FunctionRunTimeout:         1 * time.Minute,
 		HTTPGatewayResponseTimeout: 10 * time.Second,
 		SanboxJobInitTimeout:       10 * time.Second,
 		SandboxJobStartTimeout:     10 * time.Second,
 		SandboxJobStopTimeout:      2 * time.Second,
+		AppShutdownGracePeriod:     2 * time.Second,
 		SandboxCleanupInterval:     1 * time.Minute,
 		SandboxFunctionKeepAlive:   2 * time.Minute,
 		DatastoreSyncTimeout:       1 * time.Minute,
@@ -0,0 +1,21 @@
+package definition
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DenoVersionRE matches deno versions, major.minor.patch optionally prefixed with a v
+var DenoVersionRE = regexp.MustCompile(`^v?\d+\.\d+\.\d+$`)
+
+// IsDenoRuntime checks if the runtime name refers to deno, the default runtime
+func IsDenoRuntime(runtime string) bool {
+	return runtime == "" || runtime == "deno"
+}
+
+func validateDenoVersion(version string) error {
+	if version != "" && !DenoVersionRE.MatchString(version) {
+		return fmt.Errorf("invalid deno_version: '%s', expected major.minor.patch", version)
+	}
+	return nil
+}
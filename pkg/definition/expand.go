@@ -84,6 +84,9 @@ func (defs *Definitions) MergeFrom(moreDefs *Definitions) error {
 		defs.Config[name] = schema
 	}
 
+	defs.Exports = append(defs.Exports, moreDefs.Exports...)
+	defs.mergeMQTT(moreDefs.MQTT)
+
 	for eventName, newFns := range moreDefs.Events {
 		if existingFns, ok := defs.Events[eventName]; ok {
 			// Already has other listeners, add additional ones
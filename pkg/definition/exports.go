@@ -0,0 +1,95 @@
+package definition
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/zefhemel/matterless/pkg/util"
+	"gopkg.in/yaml.v3"
+)
+
+// ExportDef grants other apps the right to subscribe to this app's events matching Pattern
+type ExportDef struct {
+	Pattern string   `yaml:"pattern" json:"pattern"`
+	Apps    []string `yaml:"apps,omitempty" json:"apps,omitempty"` // Apps the events are exported to, all apps when empty
+
+	matcher *regexp.Regexp // Compiled Pattern, set when validated
+}
+
+// Matches checks if the event name matches the export's pattern
+func (ed *ExportDef) Matches(eventName string) bool {
+	if ed.matcher == nil {
+		return util.GlobRegexp(ed.Pattern).MatchString(eventName)
+	}
+	return ed.matcher.MatchString(eventName)
+}
+
+// UnmarshalYAML accepts both a plain pattern (exported to all apps) and a {pattern, apps} object
+func (ed *ExportDef) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		ed.Pattern = value.Value
+		return nil
+	}
+	type rawExportDef ExportDef
+	return value.Decode((*rawExportDef)(ed))
+}
+
+// MarshalYAML renders exports to all apps as a plain pattern again
+func (ed *ExportDef) MarshalYAML() (interface{}, error) {
+	if len(ed.Apps) == 0 {
+		return ed.Pattern, nil
+	}
+	type rawExportDef ExportDef
+	return (*rawExportDef)(ed), nil
+}
+
+// Event name prefixes of events and triggers built into Matterless, these are never interpreted as app names
+var builtinEventNamespaces = map[string]bool{
+	"http":     true,
+	"store":    true,
+	"config":   true,
+	"job":      true,
+	"function": true,
+	"nats":     true,
+}
+
+var appNameRE = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+// SplitCrossAppEvent splits an events key of the form app-name:event-pattern into the app name and event pattern
+// Every such key still also matches this app's own events with the full key as name
+func SplitCrossAppEvent(key string) (appName string, pattern string, ok bool) {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) != 2 || parts[1] == "" || builtinEventNamespaces[parts[0]] || !appNameRE.MatchString(parts[0]) {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// ExportsEvent checks if the app exports events with the given name to the app named toApp
+func (defs *Definitions) ExportsEvent(eventName string, toApp string) bool {
+	for _, export := range defs.Exports {
+		if !export.Matches(eventName) {
+			continue
+		}
+		if len(export.Apps) == 0 {
+			return true
+		}
+		for _, app := range export.Apps {
+			if app == toApp {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func validateExports(exports []*ExportDef) error {
+	for _, export := range exports {
+		if export.Pattern == "" {
+			return fmt.Errorf("exports need a pattern")
+		}
+		export.matcher = util.GlobRegexp(export.Pattern)
+	}
+	return nil
+}
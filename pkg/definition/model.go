@@ -23,6 +23,16 @@ var rerenderTemplate string
 
 type LibraryMap = map[FunctionID]*LibraryDef
 
+// Lifecycle events published by Matterless itself, apps can subscribe to these in their events definitions
+const (
+	EventInit            = "init"             // After the app has been (re)loaded
+	EventDeployed        = "deployed"         // After a new version of the app has been deployed
+	EventShutdown        = "shutdown"         // Before the app is stopped or reloaded
+	EventConfigChanged   = "config:changed"   // When the store value of a config key changes
+	EventJobExited       = "job:exited"       // When a job instance exits without being asked to stop
+	EventFunctionCrashed = "function:crashed" // When a function instance exits without being asked to stop
+)
+
 type Definitions struct {
 	Imports        []string                     `json:"imports,omitempty"`
 	Config         map[string]*TypeSchema       `json:"config,omitempty"`
@@ -30,16 +40,27 @@ type Definitions struct {
 	Jobs           map[FunctionID]*JobDef       `json:"jobs"`
 	Libraries      LibraryMap                   `json:"libraries"`
 	Events         map[string][]FunctionID      `json:"events"`
+	Exports        []*ExportDef                 `json:"exports,omitempty"` // Event patterns other apps may subscribe to
+	MQTT           *MQTTDef                     `json:"mqtt,omitempty"`    // Mapping between app events and MQTT topics
 	Macros         map[MacroID]*MacroDef        `json:"macros"`
 	MacroInstances map[string]*MacroInstanceDef `json:"macro_instances,omitempty"`
 }
 
 type FunctionConfig struct {
-	Init        interface{} `yaml:"init" json:"init,omitempty"`
-	Runtime     string      `yaml:"runtime" json:"runtime,omitempty"`
-	Hot         bool        `yaml:"hot,omitempty" json:"hot,omitempty"`              // Boot runtime immediately and don't clean it up
-	Instances   int         `yaml:"instances,omitempty"  json:"instances,omitempty"` // Number of workers to start PER NODE
-	DockerImage string      `yaml:"docker_image" json:"docker_image,omitempty" mapstructure:"docker_image"`
+	Language     string            `yaml:"-" json:"language,omitempty"` // Language of the code block, set by the parser
+	Init         interface{}       `yaml:"init" json:"init,omitempty"`
+	InitSchema   *TypeSchema       `yaml:"init_schema,omitempty" json:"init_schema,omitempty" mapstructure:"init_schema"`    // Type of init, used to type check typescript
+	EventSchema  *TypeSchema       `yaml:"event_schema,omitempty" json:"event_schema,omitempty" mapstructure:"event_schema"` // Type of the events handled, used to type check typescript
+	Runtime      string            `yaml:"runtime" json:"runtime,omitempty"`
+	Hot          bool              `yaml:"hot,omitempty" json:"hot,omitempty"`              // Boot runtime immediately and don't clean it up
+	Instances    int               `yaml:"instances,omitempty"  json:"instances,omitempty"` // Number of workers to start PER NODE
+	DockerImage  string            `yaml:"docker_image" json:"docker_image,omitempty" mapstructure:"docker_image"`
+	WasmModule   string            `yaml:"wasm_module,omitempty" json:"wasm_module,omitempty" mapstructure:"wasm_module"`       // Path to the module for the wasm runtime, when not given inline
+	Command      []string          `yaml:"command,omitempty" json:"command,omitempty"`                                          // Command (and arguments) for the exec runtime to run
+	Persistent   bool              `yaml:"persistent,omitempty" json:"persistent,omitempty"`                                    // Keep the exec runtime's process running across invocations
+	Permissions  *Permissions      `yaml:"permissions,omitempty" json:"permissions,omitempty"`                                  // What the deno runtime has access to
+	DenoVersion  string            `yaml:"deno_version,omitempty" json:"deno_version,omitempty" mapstructure:"deno_version"`    // Deno version to run with, the configured one when empty
+	NodeSelector map[string]string `yaml:"node_selector,omitempty" json:"node_selector,omitempty" mapstructure:"node_selector"` // Only start workers on nodes with these labels
 }
 
 type FunctionDef struct {
@@ -50,10 +71,19 @@ type FunctionDef struct {
 }
 
 type JobConfig struct {
-	Init        interface{} `yaml:"init" json:"init,omitempty"`
-	Runtime     string      `yaml:"runtime" json:"runtime,omitempty"`
-	Instances   int         `yaml:"instances,omitempty"  json:"instances,omitempty"` // Number of instances globally for the whole cluster
-	DockerImage string      `yaml:"docker_image" json:"docker_image,omitempty" mapstructure:"docker_image"`
+	Language     string            `yaml:"-" json:"language,omitempty"` // Language of the code block, set by the parser
+	Init         interface{}       `yaml:"init" json:"init,omitempty"`
+	InitSchema   *TypeSchema       `yaml:"init_schema,omitempty" json:"init_schema,omitempty" mapstructure:"init_schema"` // Type of init, used to type check typescript
+	Runtime      string            `yaml:"runtime" json:"runtime,omitempty"`
+	Instances    int               `yaml:"instances,omitempty"  json:"instances,omitempty"` // Number of instances globally for the whole cluster
+	DockerImage  string            `yaml:"docker_image" json:"docker_image,omitempty" mapstructure:"docker_image"`
+	WasmModule   string            `yaml:"wasm_module,omitempty" json:"wasm_module,omitempty" mapstructure:"wasm_module"`    // Path to the module for the wasm runtime, when not given inline
+	Command      []string          `yaml:"command,omitempty" json:"command,omitempty"`                                       // Command (and arguments) for the exec runtime to run
+	Permissions  *Permissions      `yaml:"permissions,omitempty" json:"permissions,omitempty"`                               // What the deno runtime has access to
+	DenoVersion  string            `yaml:"deno_version,omitempty" json:"deno_version,omitempty" mapstructure:"deno_version"` // Deno version to run with, the configured one when empty
+	Restart      *RestartPolicy    `yaml:"restart,omitempty" json:"restart,omitempty"`
+	NodeSelector map[string]string `yaml:"node_selector,omitempty" json:"node_selector,omitempty" mapstructure:"node_selector"` // Only place instances on nodes with these labels
+	AntiAffinity []string          `yaml:"anti_affinity,omitempty" json:"anti_affinity,omitempty" mapstructure:"anti_affinity"` // Never place instances on a node running any of these jobs
 }
 
 type JobDef struct {
@@ -65,7 +95,7 @@ type JobDef struct {
 
 type LibraryDef struct {
 	Name     string `json:"name"`
-	Runtime  string `json:"runtime"`
+	Runtime  string `json:"runtime"` // Runtime the library is for, deno when empty
 	Language string `json:"language,omitempty"`
 	Code     string `json:"code,omitempty"`
 }
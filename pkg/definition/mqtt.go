@@ -0,0 +1,101 @@
+package definition
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MQTTDef maps app events to MQTT topics and back
+type MQTTDef struct {
+	Publish   []*MQTTPublishDef   `yaml:"publish,omitempty" json:"publish,omitempty"`     // App events to publish as MQTT messages
+	Subscribe []*MQTTSubscribeDef `yaml:"subscribe,omitempty" json:"subscribe,omitempty"` // MQTT messages to turn into app events
+}
+
+// MQTTPublishDef publishes the data of app events matching Event (* matches anything) to an MQTT topic
+type MQTTPublishDef struct {
+	Event string `yaml:"event" json:"event"`
+	Topic string `yaml:"topic" json:"topic"`
+}
+
+// MQTTSubscribeDef publishes MQTT messages on topics matching Topic (which may use + and # wildcards) as app event Event
+type MQTTSubscribeDef struct {
+	Topic string `yaml:"topic" json:"topic"`
+	Event string `yaml:"event" json:"event"`
+}
+
+// Validate checks the topics are valid MQTT topics (or filters, for subscriptions) that can be mapped onto NATS
+func (md *MQTTDef) Validate() error {
+	for _, pub := range md.Publish {
+		if pub.Event == "" {
+			return fmt.Errorf("publish to %s: event required", pub.Topic)
+		}
+		if err := validateMQTTTopic(pub.Topic, false); err != nil {
+			return fmt.Errorf("publish %s: %s", pub.Event, err)
+		}
+	}
+	for _, sub := range md.Subscribe {
+		if sub.Event == "" {
+			return fmt.Errorf("subscribe to %s: event required", sub.Topic)
+		}
+		if err := validateMQTTTopic(sub.Topic, true); err != nil {
+			return fmt.Errorf("subscribe %s: %s", sub.Event, err)
+		}
+	}
+	return nil
+}
+
+func validateMQTTTopic(topic string, wildcardsAllowed bool) error {
+	switch {
+	case topic == "":
+		return fmt.Errorf("topic required")
+	case strings.HasPrefix(topic, "$"):
+		return fmt.Errorf("topic %s: $ topics are reserved", topic)
+	case strings.ContainsAny(topic, ". \t\n"):
+		return fmt.Errorf("topic %s: dots and whitespace are not supported", topic)
+	case strings.HasPrefix(topic, "/") || strings.HasSuffix(topic, "/") || strings.Contains(topic, "//"):
+		return fmt.Errorf("topic %s: empty topic levels are not supported", topic)
+	}
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		if !strings.ContainsAny(level, "+#") {
+			continue
+		}
+		if !wildcardsAllowed {
+			return fmt.Errorf("topic %s: wildcards are only allowed when subscribing", topic)
+		}
+		if level != "+" && level != "#" || level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("topic %s: invalid use of wildcards", topic)
+		}
+	}
+	return nil
+}
+
+func (defs *Definitions) mergeMQTT(mqttDef *MQTTDef) {
+	if mqttDef == nil {
+		return
+	}
+	if defs.MQTT == nil {
+		defs.MQTT = &MQTTDef{}
+	}
+	defs.MQTT.Publish = append(defs.MQTT.Publish, mqttDef.Publish...)
+	defs.MQTT.Subscribe = append(defs.MQTT.Subscribe, mqttDef.Subscribe...)
+}
+
+// MQTTTopicSubject converts a (validated) MQTT topic or topic filter to the NATS subject the NATS MQTT listener uses
+func MQTTTopicSubject(topic string) string {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		switch level {
+		case "+":
+			levels[i] = "*"
+		case "#":
+			levels[i] = ">"
+		}
+	}
+	return strings.Join(levels, ".")
+}
+
+// SubjectMQTTTopic converts a NATS subject back to the MQTT topic
+func SubjectMQTTTopic(subject string) string {
+	return strings.ReplaceAll(subject, ".", "/")
+}
@@ -0,0 +1,33 @@
+package definition
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Prefix of events keys that subscribe to a raw NATS subject, e.g. nats:sensors.>
+const natsTriggerPrefix = "nats:"
+
+// NATSTriggerSubject returns the NATS subject of an events key of the form nats:<subject>
+func NATSTriggerSubject(key string) (string, bool) {
+	if !strings.HasPrefix(key, natsTriggerPrefix) {
+		return "", false
+	}
+	return key[len(natsTriggerPrefix):], true
+}
+
+func validateNATSSubject(subject string) error {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return fmt.Errorf("invalid NATS subject: %q", subject)
+	}
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		if token == "" || token == ">" && i != len(tokens)-1 {
+			return fmt.Errorf("invalid NATS subject: %s", subject)
+		}
+		if len(token) > 1 && strings.ContainsAny(token, "*>") {
+			return fmt.Errorf("invalid NATS subject: %s, wildcards should be full tokens", subject)
+		}
+	}
+	return nil
+}
@@ -61,6 +61,13 @@ func Parse(code string) (*Definitions, error) {
 			if funcDef.Config.Instances == 0 {
 				funcDef.Config.Instances = 1
 			}
+			funcDef.Config.Language = currentLanguage
+			if err := funcDef.Config.Permissions.Validate(); err != nil {
+				return fmt.Errorf("Function %s: %s", currentDeclarationName, err)
+			}
+			if err := validateDenoVersion(funcDef.Config.DenoVersion); err != nil {
+				return fmt.Errorf("Function %s: %s", currentDeclarationName, err)
+			}
 			if currentDeclarationName == "" {
 				return fmt.Errorf("functions should have a name")
 			}
@@ -85,6 +92,16 @@ func Parse(code string) (*Definitions, error) {
 			if jobDef.Config.Instances == 0 {
 				jobDef.Config.Instances = 1
 			}
+			jobDef.Config.Language = currentLanguage
+			if err := jobDef.Config.Restart.Validate(); err != nil {
+				return fmt.Errorf("Job %s: %s", currentDeclarationName, err)
+			}
+			if err := jobDef.Config.Permissions.Validate(); err != nil {
+				return fmt.Errorf("Job %s: %s", currentDeclarationName, err)
+			}
+			if err := validateDenoVersion(jobDef.Config.DenoVersion); err != nil {
+				return fmt.Errorf("Job %s: %s", currentDeclarationName, err)
+			}
 			if currentDeclarationName == "" {
 				return fmt.Errorf("jobs should have a name")
 			}
@@ -95,6 +112,17 @@ func Parse(code string) (*Definitions, error) {
 				Language: currentLanguage,
 				Code:     currentBody,
 			}
+			if currentBody2 != "" {
+				// Optional configuration block, selecting the runtime the library is for
+				var libraryConfig struct {
+					Runtime string `yaml:"runtime"`
+				}
+				if err := util.StrictYamlUnmarshal(currentBody, &libraryConfig); err != nil {
+					return fmt.Errorf("Library %s: %s", currentDeclarationName, err)
+				}
+				libraryDef.Runtime = libraryConfig.Runtime
+				libraryDef.Code = currentBody2
+			}
 			if currentDeclarationName == "" {
 				return fmt.Errorf("libraries should have a filename")
 			}
@@ -111,6 +139,11 @@ func Parse(code string) (*Definitions, error) {
 			}
 			// Merge into other Events blocks
 			for eventName, newFns := range def {
+				if subject, ok := NATSTriggerSubject(eventName); ok {
+					if err := validateNATSSubject(subject); err != nil {
+						return fmt.Errorf("Events: %s", err)
+					}
+				}
 				if existingFns, ok := decls.Events[eventName]; ok {
 					// Already has other listeners, add additional ones
 					decls.Events[eventName] = append(existingFns, newFns...)
@@ -118,6 +151,24 @@ func Parse(code string) (*Definitions, error) {
 					decls.Events[eventName] = newFns
 				}
 			}
+		case "export", "exports":
+			var exports []*ExportDef
+			if err := util.StrictYamlUnmarshal(currentBody, &exports); err != nil {
+				return fmt.Errorf("Exports: %s", err)
+			}
+			if err := validateExports(exports); err != nil {
+				return fmt.Errorf("Exports: %s", err)
+			}
+			decls.Exports = append(decls.Exports, exports...)
+		case "mqtt":
+			var mqttDef MQTTDef
+			if err := util.StrictYamlUnmarshal(currentBody, &mqttDef); err != nil {
+				return fmt.Errorf("MQTT: %s", err)
+			}
+			if err := mqttDef.Validate(); err != nil {
+				return fmt.Errorf("MQTT: %s", err)
+			}
+			decls.mergeMQTT(&mqttDef)
 		case "macro":
 			var config MacroConfig
 			if len(currentBody) > 0 {
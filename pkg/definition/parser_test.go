@@ -305,3 +305,126 @@ function handle() {
 	fmt.Println(defs1.Markdown())
 
 }
+
+func TestExportsParser(t *testing.T) {
+	a := assert.New(t)
+	defs, err := definition.Parse(strings.ReplaceAll(`# export
+|||yaml
+- order:*
+- pattern: payment:*
+  apps:
+  - billing
+|||
+
+# events
+|||yaml
+"shop:order:created":
+- MyFunc
+|||
+`, "|||", "```"))
+	a.NoError(err)
+	a.Len(defs.Exports, 2)
+	a.Equal("order:*", defs.Exports[0].Pattern)
+	a.Empty(defs.Exports[0].Apps)
+	a.Equal([]string{"billing"}, defs.Exports[1].Apps)
+
+	a.True(defs.ExportsEvent("order:created", "newsletter"))
+	a.True(defs.ExportsEvent("payment:received", "billing"))
+	a.False(defs.ExportsEvent("payment:received", "newsletter"))
+	a.False(defs.ExportsEvent("user:created", "billing"))
+
+	appName, pattern, ok := definition.SplitCrossAppEvent("shop:order:created")
+	a.True(ok)
+	a.Equal("shop", appName)
+	a.Equal("order:created", pattern)
+	_, _, ok = definition.SplitCrossAppEvent("store:put:config:*")
+	a.False(ok)
+	_, _, ok = definition.SplitCrossAppEvent("init")
+	a.False(ok)
+
+	// Round trip through markdown
+	defs2, err := definition.Parse(defs.Markdown())
+	a.NoError(err)
+	a.Equal(defs.Exports, defs2.Exports)
+}
+
+func TestMQTTParser(t *testing.T) {
+	a := assert.New(t)
+	defs, err := definition.Parse(strings.ReplaceAll(`# mqtt
+|||yaml
+publish:
+- event: light:*
+  topic: home/living/light
+subscribe:
+- topic: sensors/+/temperature
+  event: temperature
+|||
+`, "|||", "```"))
+	a.NoError(err)
+	a.Equal("home/living/light", defs.MQTT.Publish[0].Topic)
+	a.Equal("sensors.*.temperature", definition.MQTTTopicSubject(defs.MQTT.Subscribe[0].Topic))
+	a.Equal("sensors/kitchen/temperature", definition.SubjectMQTTTopic("sensors.kitchen.temperature"))
+
+	defs2, err := definition.Parse(defs.Markdown())
+	a.NoError(err)
+	a.Equal(defs.MQTT, defs2.MQTT)
+
+	for _, invalid := range []string{
+		"publish:\n- event: light\n  topic: home/+/light",
+		"subscribe:\n- event: light\n  topic: home/#/light",
+		"subscribe:\n- event: light\n  topic: home.light",
+		"subscribe:\n- event: light\n  topic: $SYS/stats",
+		"subscribe:\n- topic: home/light",
+	} {
+		_, err := definition.Parse("# mqtt\n```yaml\n" + invalid + "\n```\n")
+		a.Error(err, invalid)
+	}
+}
+
+func TestNATSTriggerParser(t *testing.T) {
+	a := assert.New(t)
+	defs, err := definition.Parse(strings.ReplaceAll(`# events
+|||yaml
+"nats:sensors.*.temperature":
+- RecordTemperature
+|||
+`, "|||", "```"))
+	a.NoError(err)
+	subject, ok := definition.NATSTriggerSubject("nats:sensors.*.temperature")
+	a.True(ok)
+	a.Equal("sensors.*.temperature", subject)
+	a.Len(defs.Events["nats:sensors.*.temperature"], 1)
+	_, ok = definition.NATSTriggerSubject("sensors")
+	a.False(ok)
+
+	for _, invalid := range []string{"nats:", "nats:a..b", "nats:a.>.b", "nats:a.b*", "nats:a b"} {
+		_, err := definition.Parse("# events\n```yaml\n\"" + invalid + "\":\n- Fn\n```\n")
+		a.Error(err, invalid)
+	}
+}
+
+func TestLibraryRuntimeParser(t *testing.T) {
+	a := assert.New(t)
+	defs, err := definition.Parse(strings.ReplaceAll(`# library greeting.py
+|||yaml
+runtime: python
+|||
+|||python
+def greet(name):
+    return "Hello " + name
+|||
+
+# library util.js
+|||javascript
+export const answer = 42;
+|||
+`, "|||", "```"))
+	a.NoError(err)
+	a.Equal("python", defs.Libraries["greeting.py"].Runtime)
+	a.Contains(defs.Libraries["greeting.py"].Code, "def greet")
+	a.Equal("", defs.Libraries["util.js"].Runtime)
+
+	defs2, err := definition.Parse(defs.Markdown())
+	a.NoError(err)
+	a.Equal(defs.Libraries, defs2.Libraries)
+}
@@ -0,0 +1,103 @@
+package definition
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Stands for the host (and port) of the Matterless API in allow_net, deno functions and jobs can always reach it
+const PermissionAPIHost = "<matterless-api>"
+
+// In allow_net, allows access to any host
+const PermissionAnyHost = "*"
+
+// Environment variables deno functions and jobs can always read, the Matterless APIs need them
+var permissionAPIEnv = []string{"API_URL", "API_TOKEN"}
+
+// Permissions restricts what deno functions and jobs have access to
+type Permissions struct {
+	AllowNet   []string `yaml:"allow_net,omitempty" json:"allow_net,omitempty" mapstructure:"allow_net"`       // Hosts (optionally with port) that can be reached
+	AllowRead  []string `yaml:"allow_read,omitempty" json:"allow_read,omitempty" mapstructure:"allow_read"`    // Paths relative to the scratch directory that can be read
+	AllowWrite []string `yaml:"allow_write,omitempty" json:"allow_write,omitempty" mapstructure:"allow_write"` // Paths relative to the scratch directory that can be written
+	AllowEnv   []string `yaml:"allow_env,omitempty" json:"allow_env,omitempty" mapstructure:"allow_env"`       // Environment variables that can be read
+}
+
+// Effective returns the permissions with the defaults added: access to the Matterless API host and environment
+func (p *Permissions) Effective() *Permissions {
+	eff := &Permissions{
+		AllowNet: []string{PermissionAPIHost},
+		AllowEnv: append([]string{}, permissionAPIEnv...),
+	}
+	if p == nil {
+		return eff
+	}
+	eff.AllowNet = appendMissing(eff.AllowNet, p.AllowNet)
+	eff.AllowEnv = appendMissing(eff.AllowEnv, p.AllowEnv)
+	eff.AllowRead = append(eff.AllowRead, p.AllowRead...)
+	eff.AllowWrite = append(eff.AllowWrite, p.AllowWrite...)
+	return eff
+}
+
+func appendMissing(list []string, items []string) []string {
+	for _, item := range items {
+		found := false
+		for _, existing := range list {
+			if existing == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (p *Permissions) Validate() error {
+	if p == nil {
+		return nil
+	}
+	for _, host := range p.AllowNet {
+		if host == "" || strings.Contains(host, "/") || strings.Contains(host, ",") {
+			return fmt.Errorf("invalid allow_net host: '%s'", host)
+		}
+	}
+	for _, paths := range [][]string{p.AllowRead, p.AllowWrite} {
+		for _, p := range paths {
+			if !isScratchPath(p) {
+				return fmt.Errorf("allow_read and allow_write paths should be relative and inside the scratch directory: '%s'", p)
+			}
+		}
+	}
+	for _, name := range p.AllowEnv {
+		if name == "" || strings.ContainsAny(name, "=,") {
+			return fmt.Errorf("invalid allow_env variable: '%s'", name)
+		}
+	}
+	return nil
+}
+
+// isScratchPath checks if p is a relative path that doesn't escape the directory it's relative to
+func isScratchPath(p string) bool {
+	if p == "" || path.IsAbs(p) || strings.Contains(p, ",") {
+		return false
+	}
+	cleaned := path.Clean(p)
+	return cleaned != ".." && !strings.HasPrefix(cleaned, "../")
+}
+
+// ExpandPermissions replaces the permissions of all deno functions and jobs with their effective permissions
+func (defs *Definitions) ExpandPermissions() {
+	for _, def := range defs.Functions {
+		if IsDenoRuntime(def.Config.Runtime) {
+			def.Config.Permissions = def.Config.Permissions.Effective()
+		}
+	}
+	for _, def := range defs.Jobs {
+		if IsDenoRuntime(def.Config.Runtime) {
+			def.Config.Permissions = def.Config.Permissions.Effective()
+		}
+	}
+}
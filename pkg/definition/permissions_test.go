@@ -0,0 +1,75 @@
+package definition_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/definition"
+)
+
+func TestPermissionsParser(t *testing.T) {
+	a := assert.New(t)
+	defs, err := definition.Parse(strings.ReplaceAll(`# function Fetch
+|||yaml
+permissions:
+  allow_net:
+  - api.github.com
+  allow_write:
+  - cache
+  allow_env:
+  - DEBUG
+|||
+|||javascript
+function handle() {}
+|||
+
+# job Worker
+|||javascript
+function start() {}
+|||
+
+# function Wasm
+|||yaml
+runtime: wasm
+|||
+|||base64
+AGFzbQ==
+|||
+`, "|||", "```"))
+	a.NoError(err)
+	perms := defs.Functions["Fetch"].Config.Permissions
+	a.Equal([]string{"api.github.com"}, perms.AllowNet)
+	a.Equal([]string{"cache"}, perms.AllowWrite)
+
+	defs.ExpandPermissions()
+	a.Equal(&definition.Permissions{
+		AllowNet:   []string{definition.PermissionAPIHost, "api.github.com"},
+		AllowWrite: []string{"cache"},
+		AllowEnv:   []string{"API_URL", "API_TOKEN", "DEBUG"},
+	}, defs.Functions["Fetch"].Config.Permissions)
+	a.Equal([]string{definition.PermissionAPIHost}, defs.Jobs["Worker"].Config.Permissions.AllowNet)
+	a.Nil(defs.Functions["Wasm"].Config.Permissions)
+
+	// Expanding is idempotent, and survives rendering
+	defs2, err := definition.Parse(defs.Markdown())
+	a.NoError(err)
+	defs2.ExpandPermissions()
+	a.Equal(defs.Functions["Fetch"].Config.Permissions, defs2.Functions["Fetch"].Config.Permissions)
+
+	_, err = definition.Parse(strings.ReplaceAll(`# function Escape
+|||yaml
+permissions:
+  allow_read:
+  - ../../etc
+|||
+|||javascript
+function handle() {}
+|||
+`, "|||", "```"))
+	a.Error(err)
+
+	a.Error((&definition.Permissions{AllowWrite: []string{"/tmp"}}).Validate())
+	a.Error((&definition.Permissions{AllowNet: []string{"http://example.com"}}).Validate())
+	a.NoError((&definition.Permissions{AllowRead: []string{"a/../b"}, AllowNet: []string{"*", "example.com:443"}}).Validate())
+}
@@ -0,0 +1,11 @@
+package definition
+
+// MatchesNodeSelector returns whether a node with the given labels satisfies all key/value pairs in selector
+func MatchesNodeSelector(selector map[string]string, labels map[string]string) bool {
+	for key, value := range selector {
+		if labelValue, ok := labels[key]; !ok || labelValue != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package definition
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
+// RestartPolicy determines what happens when a job instance exits without being asked to stop
+type RestartPolicy struct {
+	Policy      string `yaml:"policy,omitempty" json:"policy,omitempty"`                                         // always | on-failure | never
+	MaxRestarts *int   `yaml:"max_restarts,omitempty" json:"max_restarts,omitempty" mapstructure:"max_restarts"` // Consecutive restarts before giving up, 0 never restarts
+	Backoff     string `yaml:"backoff,omitempty" json:"backoff,omitempty"`                                       // Initial delay before restarting, doubled on every consecutive restart
+	MaxBackoff  string `yaml:"max_backoff,omitempty" json:"max_backoff,omitempty" mapstructure:"max_backoff"`    // Upper bound on the delay between restarts
+}
+
+const DefaultMaxRestarts = 5
+
+var DefaultRestartPolicy = RestartPolicy{
+	Policy:     RestartAlways,
+	Backoff:    "1s",
+	MaxBackoff: "1m",
+}
+
+// RestartPolicy returns the job's restart policy with defaults filled in
+func (jc *JobConfig) RestartPolicy() *RestartPolicy {
+	rp := DefaultRestartPolicy
+	maxRestarts := DefaultMaxRestarts
+	rp.MaxRestarts = &maxRestarts
+	if jc.Restart == nil {
+		return &rp
+	}
+	if jc.Restart.Policy != "" {
+		rp.Policy = jc.Restart.Policy
+	}
+	if jc.Restart.MaxRestarts != nil {
+		maxRestarts = *jc.Restart.MaxRestarts
+	}
+	if jc.Restart.Backoff != "" {
+		rp.Backoff = jc.Restart.Backoff
+	}
+	if jc.Restart.MaxBackoff != "" {
+		rp.MaxBackoff = jc.Restart.MaxBackoff
+	}
+	return &rp
+}
+
+func (rp *RestartPolicy) Validate() error {
+	if rp == nil {
+		return nil
+	}
+	switch rp.Policy {
+	case "", RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return fmt.Errorf("invalid restart policy: %s", rp.Policy)
+	}
+	if rp.MaxRestarts != nil && *rp.MaxRestarts < 0 {
+		return errors.New("max_restarts should be positive")
+	}
+	if rp.Backoff != "" {
+		if _, err := time.ParseDuration(rp.Backoff); err != nil {
+			return errors.Wrap(err, "backoff")
+		}
+	}
+	if rp.MaxBackoff != "" {
+		if _, err := time.ParseDuration(rp.MaxBackoff); err != nil {
+			return errors.Wrap(err, "max_backoff")
+		}
+	}
+	return nil
+}
+
+// MaxRestartCount returns the number of consecutive restarts before giving up
+func (rp *RestartPolicy) MaxRestartCount() int {
+	if rp.MaxRestarts == nil {
+		return DefaultMaxRestarts
+	}
+	return *rp.MaxRestarts
+}
+
+// ShouldRestart returns whether a job that exited with the given exit code should be restarted
+func (rp *RestartPolicy) ShouldRestart(exitCode int) bool {
+	switch rp.Policy {
+	case RestartNever:
+		return false
+	case RestartOnFailure:
+		return exitCode != 0
+	default:
+		return true
+	}
+}
+
+// BackoffFor returns how long to wait before the n-th consecutive restart (starting at 0)
+func (rp *RestartPolicy) BackoffFor(n int) time.Duration {
+	backoff, err := time.ParseDuration(rp.Backoff)
+	if err != nil {
+		backoff = time.Second
+	}
+	maxBackoff, err := time.ParseDuration(rp.MaxBackoff)
+	if err != nil {
+		maxBackoff = time.Minute
+	}
+	for i := 0; i < n && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
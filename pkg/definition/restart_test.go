@@ -0,0 +1,44 @@
+package definition_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/definition"
+)
+
+func TestRestartPolicy(t *testing.T) {
+	jc := &definition.JobConfig{}
+	rp := jc.RestartPolicy()
+	assert.Equal(t, definition.RestartAlways, rp.Policy)
+	assert.True(t, rp.ShouldRestart(0))
+	assert.Equal(t, time.Second, rp.BackoffFor(0))
+	assert.Equal(t, 4*time.Second, rp.BackoffFor(2))
+	assert.Equal(t, time.Minute, rp.BackoffFor(20))
+
+	jc.Restart = &definition.RestartPolicy{
+		Policy:     definition.RestartOnFailure,
+		MaxBackoff: "3s",
+	}
+	rp = jc.RestartPolicy()
+	assert.False(t, rp.ShouldRestart(0))
+	assert.True(t, rp.ShouldRestart(1))
+	assert.Equal(t, 5, rp.MaxRestartCount())
+	assert.Equal(t, 3*time.Second, rp.BackoffFor(5))
+
+	// Zero means never restart, rather than the default
+	jc.Restart.MaxRestarts = new(int)
+	assert.Equal(t, 0, jc.RestartPolicy().MaxRestartCount())
+	assert.NoError(t, jc.Restart.Validate())
+	*jc.Restart.MaxRestarts = -1
+	assert.Error(t, jc.Restart.Validate())
+	jc.Restart.MaxRestarts = nil
+
+	assert.NoError(t, jc.Restart.Validate())
+	jc.Restart.Policy = "sometimes"
+	assert.Error(t, jc.Restart.Validate())
+	jc.Restart.Policy = definition.RestartNever
+	jc.Restart.Backoff = "soon"
+	assert.Error(t, jc.Restart.Validate())
+}
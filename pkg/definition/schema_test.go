@@ -106,3 +106,25 @@ func checkSchemaAgainstWrongValue(t *testing.T, schemaYaml, valueYaml string, er
 	assert.NoError(t, yaml.Unmarshal([]byte(valueYaml), &val))
 	assert.Contains(t, ts.Validate(val).Error(), errorContains)
 }
+
+func TestTypeScriptType(t *testing.T) {
+	schema := definition.MustNewSchema(`
+type: object
+properties:
+  name:
+    type: string
+  tags:
+    type: array
+    items:
+      type: string
+  meta:
+    type: object
+    additionalProperties:
+      type: number
+required:
+- name
+`)
+	assert.Equal(t, `{ "meta"?: { [key: string]: number }; "name": string; "tags"?: Array<string> }`, schema.TypeScriptType())
+	assert.Equal(t, "any", (*definition.TypeSchema)(nil).TypeScriptType())
+	assert.Equal(t, "Array<any>", definition.MustNewSchema("type: array").TypeScriptType())
+}
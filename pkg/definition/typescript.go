@@ -0,0 +1,56 @@
+package definition
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IsTypeScript checks if a code block language is typescript
+func IsTypeScript(language string) bool {
+	return language == "typescript" || language == "ts"
+}
+
+// TypeScriptType renders the schema as a typescript type, any when there's no schema
+func (ts *TypeSchema) TypeScriptType() string {
+	if ts == nil {
+		return "any"
+	}
+	switch ts.Type {
+	case "string":
+		return "string"
+	case "number":
+		return "number"
+	case "bool", "boolean":
+		return "boolean"
+	case "array":
+		return fmt.Sprintf("Array<%s>", ts.Items.TypeScriptType())
+	case "object":
+		if len(ts.Properties) == 0 && ts.AdditionalProperties == nil {
+			return "Record<string, any>"
+		}
+		required := map[string]bool{}
+		for _, name := range ts.Required {
+			required[name] = true
+		}
+		names := make([]string, 0, len(ts.Properties))
+		for name := range ts.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		members := make([]string, 0, len(names)+1)
+		for _, name := range names {
+			optional := "?"
+			if required[name] {
+				optional = ""
+			}
+			members = append(members, fmt.Sprintf("%q%s: %s", name, optional, ts.Properties[name].TypeScriptType()))
+		}
+		if ts.AdditionalProperties != nil {
+			members = append(members, fmt.Sprintf("[key: string]: %s", ts.AdditionalProperties.TypeScriptType()))
+		}
+		return fmt.Sprintf("{ %s }", strings.Join(members, "; "))
+	default:
+		return "any"
+	}
+}
@@ -1,20 +1,15 @@
 package sandbox
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"crypto/sha1"
 	"embed"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net"
-	"net/http"
 	"os"
 	"os/exec"
-	"strings"
-	"sync"
+	"path"
 	"syscall"
 	"text/template"
 	"time"
@@ -31,9 +26,8 @@ type denoFunctionInstance struct {
 	config      *config.Config
 	name        string
 	cmd         *exec.Cmd
-	lastInvoked time.Time
-	runLock     sync.Mutex
-	serverURL   string
+	lastInvoked invocationTime
+	rpc         *rpcChannel
 	tempDir     string
 	denoExited  chan error
 }
@@ -45,7 +39,7 @@ func (inst *denoFunctionInstance) Name() string {
 }
 
 func (inst *denoFunctionInstance) LastInvoked() time.Time {
-	return inst.lastInvoked
+	return inst.lastInvoked.get()
 }
 
 func (inst *denoFunctionInstance) DidExit() chan error {
@@ -73,7 +67,10 @@ func copyDenoFiles(destDir string) error {
 //go:embed deno/template.js
 var denoFunctionTemplate string
 
-func wrapScript(initData interface{}, code string) string {
+//go:embed deno/template.ts.tmpl
+var denoTypeScriptFunctionTemplate string
+
+func wrapScript(sourceTemplate string, initData interface{}, code string) string {
 	data := struct {
 		Code     string
 		InitData string
@@ -81,7 +78,7 @@ func wrapScript(initData interface{}, code string) string {
 		Code:     code,
 		InitData: util.MustJsonString(initData),
 	}
-	tmpl, err := template.New("sourceTemplate").Parse(denoFunctionTemplate)
+	tmpl, err := template.New("sourceTemplate").Parse(sourceTemplate)
 	if err != nil {
 		log.Fatal("Could not render javascript:", err)
 	}
@@ -92,6 +89,25 @@ func wrapScript(initData interface{}, code string) string {
 	return out.String()
 }
 
+// denoTypeDeclarations renders the matterless.d.ts typescript functions and jobs are type checked with
+func denoTypeDeclarations(functionConfig *definition.FunctionConfig) string {
+	return fmt.Sprintf(`// Generated by Matterless from the init_schema and event_schema of the function or job
+declare type InitConfig = %s;
+declare type EventPayload = %s;
+declare function init(config: InitConfig): unknown;
+declare function handle(event: EventPayload, ...args: any[]): unknown;
+`, functionConfig.InitSchema.TypeScriptType(), functionConfig.EventSchema.TypeScriptType())
+}
+
+// denoLibraryFilename returns the filename a library is written to, typescript libraries without extension get .ts
+func denoLibraryFilename(libName definition.FunctionID, libDef *definition.LibraryDef) string {
+	filename := util.SafeFilename(string(libName))
+	if definition.IsTypeScript(libDef.Language) && path.Ext(filename) == "" {
+		filename = filename + ".ts"
+	}
+	return filename
+}
+
 type functionHash string
 
 // Generates a content-based hash to be used as unique identifier for this function
@@ -103,7 +119,42 @@ func newFunctionHash(name string, code string) functionHash {
 	return functionHash(fmt.Sprintf("%x", bs))
 }
 
-func newDenoFunctionInstance(ctx context.Context, config *config.Config, apiURL string, apiToken string, runMode RunMode, name string, logCallback func(funcName, message string), functionConfig *definition.FunctionConfig, code string, libs definition.LibraryMap) (FunctionInstance, error) {
+// writeDenoProject writes the function and job servers, the wrapped function code and libraries into denoDir
+// Typescript code is written to function.ts along with its type declarations, function.js then re-exports it
+func writeDenoProject(denoDir string, functionConfig *definition.FunctionConfig, code string, libs definition.LibraryMap) error {
+	if err := os.MkdirAll(denoDir, 0700); err != nil {
+		return errors.Wrap(err, "create deno dir")
+	}
+
+	if err := copyDenoFiles(denoDir); err != nil {
+		return errors.Wrap(err, "copy deno files")
+	}
+
+	functionJS := wrapScript(denoFunctionTemplate, functionConfig.Init, code)
+	if definition.IsTypeScript(functionConfig.Language) {
+		if err := os.WriteFile(fmt.Sprintf("%s/function.ts", denoDir), []byte(wrapScript(denoTypeScriptFunctionTemplate, functionConfig.Init, code)), 0600); err != nil {
+			return errors.Wrap(err, "write TS function file")
+		}
+		if err := os.WriteFile(fmt.Sprintf("%s/matterless.d.ts", denoDir), []byte(denoTypeDeclarations(functionConfig)), 0600); err != nil {
+			return errors.Wrap(err, "write type declarations")
+		}
+		functionJS = "export * from \"./function.ts\";\n"
+	}
+	if err := os.WriteFile(fmt.Sprintf("%s/function.js", denoDir), []byte(functionJS), 0600); err != nil {
+		return errors.Wrap(err, "write JS function file")
+	}
+
+	// Write library files
+	for libName, libDef := range librariesForRuntime(libs, "deno") {
+		// TOOD: Secure enough?
+		if err := os.WriteFile(fmt.Sprintf("%s/%s", denoDir, denoLibraryFilename(libName, libDef)), []byte(libDef.Code), 0600); err != nil {
+			return errors.Wrap(err, "write JS library file")
+		}
+	}
+	return nil
+}
+
+func newDenoFunctionInstance(ctx context.Context, config *config.Config, apiURL string, apiToken string, runMode RunMode, name string, logCallback LogCallback, functionConfig *definition.FunctionConfig, code string, libs definition.LibraryMap) (FunctionInstance, error) {
 	inst := &denoFunctionInstance{
 		name:   name,
 		config: config,
@@ -114,34 +165,48 @@ func newDenoFunctionInstance(ctx context.Context, config *config.Config, apiURL
 		runModeString = "job"
 	}
 
-	// Create deno project for function
-	denoDir := fmt.Sprintf("%s/.deno/%s-%s", config.DataDir, runModeString, newFunctionHash(name, code))
-	if err := os.MkdirAll(denoDir, 0700); err != nil {
+	// Create deno project for function, every instance gets its own directory as it is removed when the instance is killed
+	denoParentDir := fmt.Sprintf("%s/.deno", config.DataDir)
+	if err := os.MkdirAll(denoParentDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create deno dir")
+	}
+	denoDir, err := os.MkdirTemp(denoParentDir, fmt.Sprintf("%s-%s-", runModeString, newFunctionHash(name, code)))
+	if err != nil {
 		return nil, errors.Wrap(err, "create deno dir")
 	}
 	inst.tempDir = denoDir
 
-	if err := copyDenoFiles(denoDir); err != nil {
-		return nil, errors.Wrap(err, "copy deno files")
-	}
+	// This will be set to true at the end, if it's not set, some error occured along the way
+	everythingOk := false
+	defer func() {
+		if !everythingOk {
+			os.RemoveAll(denoDir)
+		}
+	}()
 
-	if err := os.WriteFile(fmt.Sprintf("%s/function.js", denoDir), []byte(wrapScript(functionConfig.Init, code)), 0600); err != nil {
-		return nil, errors.Wrap(err, "write JS function file")
+	if err := writeDenoProject(denoDir, functionConfig, code, libs); err != nil {
+		return nil, err
 	}
 
-	// Write library files
-	for libName, libDef := range libs {
-		// TOOD: Secure enough?
-		if err := os.WriteFile(fmt.Sprintf("%s/%s", denoDir, util.SafeFilename(string(libName))), []byte(libDef.Code), 0600); err != nil {
-			return nil, errors.Wrap(err, "write JS library file")
-		}
+	// Scratch directory the function can be granted read and write access to, relative paths resolve against it
+	scratchDir := fmt.Sprintf("%s/scratch", denoDir)
+	if err := os.MkdirAll(scratchDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create scratch dir")
 	}
 
-	// Find an available TCP port to bind the function server to
-	listenPort := util.FindFreePort(8000)
-
-	// Run deno as child process with only network and environment variable access
-	inst.cmd = exec.Command(denoBinPath(config), "run", "--allow-net", "--allow-env", fmt.Sprintf("%s/%s_server.ts", denoDir, runModeString), fmt.Sprintf("%d", listenPort))
+	// Run deno as child process with only the permissions granted to the function, requests are sent over stdin
+	// Types are checked with mls check --types, rather than on every boot
+	args := append([]string{"run", "--no-check"}, denoPermissionFlags(functionConfig.Permissions, apiURL, scratchDir)...)
+	if config.DenoVendor {
+		// All modules have been vendored into the cluster at deploy time
+		args = append(args, "--cached-only")
+	}
+	denoPath, err := denoCommandPath(config, functionConfig.DenoVersion)
+	if err != nil {
+		return nil, errors.Wrap(err, "deno install")
+	}
+	inst.cmd = exec.Command(denoPath, append(args, fmt.Sprintf("%s/%s_server.ts", denoDir, runModeString))...)
+	inst.cmd.Dir = scratchDir
 
 	// Don't propagate Ctrl-c to children
 	inst.cmd.SysProcAttr = &syscall.SysProcAttr{
@@ -149,30 +214,15 @@ func newDenoFunctionInstance(ctx context.Context, config *config.Config, apiURL
 	}
 	inst.cmd.Env = append(inst.cmd.Env,
 		"NO_COLOR=1",
-		fmt.Sprintf("DENO_DIR=%s/.deno/cache", config.DataDir),
+		fmt.Sprintf("DENO_DIR=%s", denoCacheDir(config)),
 		fmt.Sprintf("API_URL=%s", fmt.Sprintf(apiURL, "localhost")),
 		fmt.Sprintf("API_TOKEN=%s", apiToken))
 
-	stdoutPipe, err := inst.cmd.StdoutPipe()
-	if err != nil {
-		return nil, errors.Wrap(err, "stdout pipe")
-	}
-	stderrPipe, err := inst.cmd.StderrPipe()
-	if err != nil {
-		return nil, errors.Wrap(err, "stderr pipe")
-	}
-
 	// Kick off the command in the background
 	// Making it buffered to prevent go-routine leak (we don't care for the result after initial start-up)
 	inst.denoExited = make(chan error, 1)
-	if err := inst.cmd.Start(); err != nil {
-		return nil, errors.Wrap(err, "deno run")
-	}
-	//log.Errorf("STARTING %s", name)
 
-	// This is the point where we have a subprocess running which we may want to kill if we don't boot successfully
-	// This will be set to true at the end, if it's not set, some error occured along the way
-	everythingOk := false
+	// This is the point where we may have a subprocess running which we want to kill if we don't boot successfully
 	defer func() {
 		if !everythingOk && inst.cmd.Process != nil {
 			log.Info("Hard killing deno process because of error")
@@ -180,37 +230,8 @@ func newDenoFunctionInstance(ctx context.Context, config *config.Config, apiURL
 		}
 	}()
 
-	go func() {
-		inst.denoExited <- inst.cmd.Wait()
-	}()
-
-	// Listen to the stderr and log pipes and ship everything to logChannel
-	bufferedStdout := bufio.NewReader(stdoutPipe)
-	bufferedStderr := bufio.NewReader(stderrPipe)
-
-	// Send stdout and stderr to the log channel
-	go pipeLogStreamToCallback(name, bufferedStdout, logCallback)
-	go pipeLogStreamToCallback(name, bufferedStderr, logCallback)
-
-	inst.serverURL = fmt.Sprintf("http://localhost:%d", listenPort)
-
-	// Wait for server to come up
-waitLoop:
-	for {
-		select {
-		case <-ctx.Done():
-			//log.Info("Case 1")
-			return nil, ctx.Err()
-		case <-inst.denoExited:
-			//log.Info("Case 2")
-			return nil, errors.New("deno exited on boot")
-		default:
-		}
-		_, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", listenPort))
-		if err == nil {
-			break waitLoop
-		}
-		time.Sleep(100 * time.Millisecond)
+	if inst.rpc, err = startRPCProcess(ctx, inst.cmd, name, logCallback, inst.denoExited); err != nil {
+		return nil, errors.Wrap(err, "deno run")
 	}
 
 	everythingOk = true
@@ -235,48 +256,21 @@ type InvocationError struct {
 
 var ProcessExitedError = errors.New("process exited")
 
+// Invoke calls the function over the RPC channel, calls may run concurrently
 func (inst *denoFunctionInstance) Invoke(ctx context.Context, event interface{}) (interface{}, error) {
-	// Instance can only be used sequentially for now
-	inst.runLock.Lock()
-	defer inst.runLock.Unlock()
-
-	inst.lastInvoked = time.Now()
-
-	if inst.cmd.ProcessState != nil && inst.cmd.ProcessState.Exited() {
-		return nil, ProcessExitedError
-	}
+	inst.lastInvoked.touch()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, inst.serverURL, strings.NewReader(util.MustJsonString(event)))
-	if err != nil {
-		return nil, errors.Wrap(err, "invoke call")
-	}
-	resp, err := http.DefaultClient.Do(req)
+	resultJSON, err := inst.rpc.Call(ctx, "invoke", rpcInvokeParams{
+		Event:        event,
+		InvocationID: InvocationID(ctx),
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "function http request")
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("HTTP Error: %s", body)
+		return nil, err
 	}
-
 	var result interface{}
-	jsonDecoder := json.NewDecoder(resp.Body)
-	if err := jsonDecoder.Decode(&result); err != nil {
+	if err := json.Unmarshal(resultJSON, &result); err != nil {
 		return nil, errors.Wrap(err, "unmarshall response")
 	}
-	if errorMap, ok := result.(map[string]interface{}); ok {
-		if errorObj, ok := errorMap["error"]; ok {
-			var jsError jsError
-			err = json.Unmarshal([]byte(util.MustJsonString(errorObj)), &jsError)
-			if err != nil {
-				return nil, fmt.Errorf("Runtime error: %s", util.MustJsonString(errorObj))
-			}
-			return nil, fmt.Errorf("Runtime error: %s\n%s", jsError.Message, jsError.Stack)
-
-		}
-	}
-
 	return result, nil
 }
 
@@ -284,66 +278,41 @@ func (inst *denoFunctionInstance) Invoke(ctx context.Context, event interface{})
 
 type denoJobInstance struct {
 	// Jobs are mostly functions with only a few differences
-	denoFunctionInstance
+	*denoFunctionInstance
 }
 
 var _ JobInstance = &denoJobInstance{}
 
-func (inst *denoJobInstance) Name() string {
-	return inst.name
-}
-
-func newDenoJobInstance(ctx context.Context, config *config.Config, apiURL string, apiToken string, name string, logCallback func(funcName, message string), jobConfig *definition.JobConfig, code string, libs definition.LibraryMap) (JobInstance, error) {
-	inst := &denoJobInstance{}
-
+func newDenoJobInstance(ctx context.Context, config *config.Config, apiURL string, apiToken string, name string, logCallback LogCallback, jobConfig *definition.JobConfig, code string, libs definition.LibraryMap) (JobInstance, error) {
 	functionInstance, err := newDenoFunctionInstance(ctx, config, apiURL, apiToken, RunModeJob, name, logCallback, &definition.FunctionConfig{
+		Language:    jobConfig.Language,
 		Init:        jobConfig.Init,
+		InitSchema:  jobConfig.InitSchema,
 		Runtime:     jobConfig.Runtime,
 		Hot:         false,
 		Instances:   jobConfig.Instances,
 		DockerImage: jobConfig.DockerImage,
+		Permissions: jobConfig.Permissions,
+		DenoVersion: jobConfig.DenoVersion,
 	}, code, libs)
 	if err != nil {
 		return nil, err
 	}
 
-	inst.denoFunctionInstance = *(functionInstance.(*denoFunctionInstance))
-
-	return inst, nil
+	return &denoJobInstance{denoFunctionInstance: functionInstance.(*denoFunctionInstance)}, nil
 }
 
 func (inst *denoJobInstance) Start(ctx context.Context) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/start", inst.serverURL), nil)
-	if err != nil {
-		return errors.Wrap(err, "invoke call")
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("could not make HTTP invocation: %s", err.Error()))
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("HTTP Error: %s", body)
-	}
-
-	return nil
+	_, err := inst.rpc.Call(ctx, "start", nil)
+	return err
 }
 
 func (inst *denoJobInstance) Stop(ctx context.Context) error {
 	defer inst.Kill()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/stop", inst.serverURL), nil)
-	if err != nil {
-		return errors.Wrap(err, "stop call")
+	_, err := inst.rpc.Call(ctx, "stop", nil)
+	if err == ProcessExitedError {
+		// Exiting is what we asked for
+		return nil
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("could not make HTTP invocation: %s", err.Error()))
-	}
-	resp.Body.Close()
-	return nil
-}
-
-func (inst *denoJobInstance) DidExit() chan error {
-	return inst.denoExited
+	return err
 }
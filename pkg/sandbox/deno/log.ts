@@ -0,0 +1,68 @@
+// Replaces the console methods with versions that emit structured log records, prefixed with an ASCII record
+// separator so the runtime can tell them apart from other output
+const recordSeparator = "\x1e";
+const textEncoder = new TextEncoder();
+
+type LogLevel = "debug" | "info" | "warn" | "error";
+
+// IDs of the invocations being handled, console output can only be attributed to an invocation while it's the only one
+const runningInvocations = new Set<string>();
+
+// Runs fn as the handling of an invocation
+export async function withInvocation<T>(id: string, fn: () => T): Promise<T> {
+    runningInvocations.add(id);
+    try {
+        return await fn();
+    } finally {
+        runningInvocations.delete(id);
+    }
+}
+
+function currentInvocationId(): string | undefined {
+    if (runningInvocations.size === 1) {
+        return runningInvocations.values().next().value;
+    }
+    return undefined;
+}
+
+function formatArgs(args: any[]): string {
+    return args.map(arg => typeof arg === "string" ? arg : Deno.inspect(arg)).join(" ");
+}
+
+export function log(level: LogLevel, message: string, fields?: object, invocationId?: string) {
+    const record = {
+        level: level,
+        message: message,
+        fields: fields,
+        invocation_id: invocationId || currentInvocationId()
+    };
+    const out = level === "error" || level === "warn" ? Deno.stderr : Deno.stdout;
+    out.writeSync(textEncoder.encode(recordSeparator + JSON.stringify(record) + "\n"));
+}
+
+const consoleLevels: [string, LogLevel][] = [
+    ["debug", "debug"],
+    ["log", "info"],
+    ["info", "info"],
+    ["warn", "warn"],
+    ["error", "error"],
+    ["trace", "debug"],
+];
+
+for (const [method, level] of consoleLevels) {
+    // @ts-ignore
+    console[method] = (...args: any[]) => {
+        log(level, formatArgs(args));
+    };
+}
+
+// invocationConsole returns console methods tagging their log records with an invocation, also when it overlaps others
+export function invocationConsole(invocationId: string) {
+    const invocationConsole: { [method: string]: (...args: any[]) => void } = {};
+    for (const [method, level] of consoleLevels) {
+        invocationConsole[method] = (...args: any[]) => {
+            log(level, formatArgs(args), undefined, invocationId);
+        };
+    }
+    return invocationConsole;
+}
@@ -1,3 +1,5 @@
+import {log} from "./log.ts";
+
 class API {
     url: string;
     token: string;
@@ -143,12 +145,31 @@ class Application {
     }
 }
 
+class Logger {
+    debug(message: string, fields?: object) {
+        log("debug", message, fields);
+    }
+
+    info(message: string, fields?: object) {
+        log("info", message, fields);
+    }
+
+    warn(message: string, fields?: object) {
+        log("warn", message, fields);
+    }
+
+    error(message: string, fields?: object) {
+        log("error", message, fields);
+    }
+}
+
 // @ts-ignore
 const defaultApi = new API(Deno.env.get("API_URL")!, Deno.env.get("API_TOKEN")!),
     store = defaultApi.getStore(),
     events = defaultApi.getEvents(),
     functions = defaultApi.getFunctions(),
-    application = defaultApi.getApplication();
+    application = defaultApi.getApplication(),
+    logger = new Logger();
 
 
 export {
@@ -156,5 +177,6 @@ export {
     events,
     functions,
     application,
+    logger,
     API
 }
@@ -0,0 +1,92 @@
+// JSON-RPC 2.0 over stdin and stdout: requests are read from stdin one per line, responses and notifications are
+// written to stdout one per line, prefixed with an ASCII group separator so the runtime can tell them apart from
+// other output
+const framePrefix = "\x1d";
+const textEncoder = new TextEncoder();
+const textDecoder = new TextDecoder();
+
+export type RequestHandler = (params: any, signal: AbortSignal) => any;
+
+function writeFrame(message: object) {
+    const buf = textEncoder.encode(framePrefix + JSON.stringify(message) + "\n");
+    let written = 0;
+    while (written < buf.length) {
+        written += Deno.stdout.writeSync(buf.subarray(written));
+    }
+}
+
+function errorObject(e: any) {
+    if (e instanceof Error) {
+        return {
+            code: -32000,
+            message: e.message,
+            data: JSON.parse(JSON.stringify(e, Object.getOwnPropertyNames(e)))
+        };
+    }
+    return {code: -32000, message: String(e)};
+}
+
+export function notify(method: string, params?: any) {
+    writeFrame({jsonrpc: "2.0", method: method, params: params});
+}
+
+async function* readLines() {
+    const buf = new Uint8Array(64 * 1024);
+    let buffered = "";
+    while (true) {
+        const n = await Deno.stdin.read(buf);
+        if (n === null) {
+            return;
+        }
+        buffered += textDecoder.decode(buf.subarray(0, n), {stream: true});
+        let idx;
+        while ((idx = buffered.indexOf("\n")) !== -1) {
+            const line = buffered.substring(0, idx);
+            buffered = buffered.substring(idx + 1);
+            if (line.trim()) {
+                yield line;
+            }
+        }
+    }
+}
+
+// Handles requests concurrently until stdin is closed, requests can be cancelled with a cancel notification, which
+// aborts the signal passed to the handler
+export async function serve(handlers: { [method: string]: RequestHandler }) {
+    const running = new Map<number, AbortController>();
+    for await (const line of readLines()) {
+        let message: any;
+        try {
+            message = JSON.parse(line);
+        } catch (e) {
+            writeFrame({jsonrpc: "2.0", id: null, error: {code: -32700, message: "Parse error"}});
+            continue;
+        }
+        if (message.method === "cancel") {
+            const controller = running.get(message.params && message.params.id);
+            if (controller) {
+                controller.abort();
+            }
+            continue;
+        }
+        const id = message.id;
+        const handler = handlers[message.method];
+        if (!handler) {
+            writeFrame({jsonrpc: "2.0", id: id, error: {code: -32601, message: `Method not found: ${message.method}`}});
+            continue;
+        }
+        const controller = new AbortController();
+        running.set(id, controller);
+        Promise.resolve().then(() => handler(message.params, controller.signal)).then(result => {
+            if (!controller.signal.aborted) {
+                writeFrame({jsonrpc: "2.0", id: id, result: result || {}});
+            }
+        }).catch(e => {
+            if (!controller.signal.aborted) {
+                writeFrame({jsonrpc: "2.0", id: id, error: errorObject(e)});
+            }
+        }).finally(() => {
+            running.delete(id);
+        });
+    }
+}
@@ -2,93 +2,352 @@ package sandbox
 
 import (
 	"archive/zip"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"path"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/definition"
 )
 
+// Deno version used unless configured otherwise
+const DefaultDenoVersion = "1.13.2"
+
+// Mirror to download deno from unless configured otherwise, archives are fetched from <mirror>/v<version>/<archive>
+const DefaultDenoMirror = "https://github.com/denoland/deno/releases/download"
+
+// Archive names of deno builds per platform
 // TODO: Add windows versions
-var denoDownloadUrls = map[string]string{
-	"linux-arm64":  "https://matterless-releases.s3.eu-central-1.amazonaws.com/deno-linux-arm64.zip",
-	"linux-amd64":  "https://github.com/denoland/deno/releases/download/v1.13.2/deno-x86_64-unknown-linux-gnu.zip",
-	"darwin-arm64": "https://github.com/denoland/deno/releases/download/v1.13.2/deno-aarch64-apple-darwin.zip",
-	"darwin-amd64": "https://github.com/denoland/deno/releases/download/v1.13.2/deno-x86_64-apple-darwin.zip",
+var denoArchiveNames = map[string]string{
+	"linux-amd64":  "deno-x86_64-unknown-linux-gnu.zip",
+	"linux-arm64":  "deno-aarch64-unknown-linux-gnu.zip",
+	"darwin-arm64": "deno-aarch64-apple-darwin.zip",
+	"darwin-amd64": "deno-x86_64-apple-darwin.zip",
+}
+
+// Builds not available from the default mirror
+var denoDownloadOverrides = map[string]string{
+	"1.13.2/linux-arm64": "https://matterless-releases.s3.eu-central-1.amazonaws.com/deno-linux-arm64.zip",
+}
+
+// SHA-256 checksums of the deno archives Matterless trusts out of the box, per <version>/<platform>. Other versions
+// need a checksum configured with --deno-sha256 or --deno-checksum
+// TODO: Add the checksums of the DefaultDenoVersion archives for all platforms in denoArchiveNames
+var denoKnownChecksums = map[string]string{}
+
+// Name of the file next to an installed deno binary holding the SHA-256 checksum of the archive it came from
+const denoChecksumFilename = "archive.sha256"
+
+// Guards installs, so concurrently booting functions don't install the same version twice
+var denoInstallLock sync.Mutex
+
+// DenoInstall is a version of deno installed in the data directory
+type DenoInstall struct {
+	Version string
+	Path    string // Path to the deno binary
+	SHA256  string // Checksum of the archive it was installed from
 }
 
-func denoBinPath(config *config.Config) string {
-	if config.UseSystemDeno {
+// denoVersion returns the deno version to use when asked for requested, which may be empty for the default
+func denoVersion(cfg *config.Config, requested string) string {
+	if requested != "" {
+		return strings.TrimPrefix(requested, "v")
+	}
+	if cfg.DenoVersion != "" {
+		return strings.TrimPrefix(cfg.DenoVersion, "v")
+	}
+	return DefaultDenoVersion
+}
+
+func denoVersionsDir(cfg *config.Config) string {
+	return filepath.Join(cfg.DataDir, ".deno", "versions")
+}
+
+func denoBinPath(cfg *config.Config, requestedVersion string) string {
+	if cfg.UseSystemDeno && requestedVersion == "" {
 		return "deno"
-	} else {
-		return fmt.Sprintf("%s/.deno/deno", config.DataDir)
 	}
+	return filepath.Join(denoVersionsDir(cfg), denoVersion(cfg, requestedVersion), "deno")
 }
 
-// Automatically download deno executable into the data folder if it's not there
-func EnsureDeno(config *config.Config) error {
-	denoPath := denoBinPath(config)
-	buildToGet := fmt.Sprintf("%s-%s", runtime.GOOS, runtime.GOARCH)
-	if _, err := os.Stat(denoPath); err != nil {
-		url, ok := denoDownloadUrls[buildToGet]
-		if !ok {
-			return fmt.Errorf("No deno download ready for %s", buildToGet)
-		}
-		downloadTo := fmt.Sprintf("%s/deno.gz", os.TempDir())
-		log.Infof("Downloading deno from %s", url)
-		if err := downloadFile(url, downloadTo); err != nil {
-			return errors.Wrap(err, "deno download")
-		}
-		r, err := zip.OpenReader(downloadTo)
-		if err != nil {
-			return errors.Wrap(err, "open deno zip")
-		}
-		defer r.Close()
+// denoCommandPath returns the deno binary to run for the requested version, installing it first if necessary
+func denoCommandPath(cfg *config.Config, requestedVersion string) (string, error) {
+	if cfg.UseSystemDeno && requestedVersion == "" {
+		return "deno", nil
+	}
+	if err := EnsureDenoVersion(cfg, requestedVersion); err != nil {
+		return "", err
+	}
+	return denoBinPath(cfg, requestedVersion), nil
+}
 
-		if len(r.File) != 1 {
-			return fmt.Errorf("Expected just one file in zip, but got %d", len(r.File))
-		}
+// EnsureDeno installs the configured deno version into the data folder if it's not there
+func EnsureDeno(cfg *config.Config) error {
+	return EnsureDenoVersion(cfg, "")
+}
 
-		rc, err := r.File[0].Open()
-		if err != nil {
-			log.Fatal(err)
+// EnsureDenoVersion installs a deno version (the configured one when empty) from the configured mirror if it's not
+// installed yet
+func EnsureDenoVersion(cfg *config.Config, requestedVersion string) error {
+	version := denoVersion(cfg, requestedVersion)
+
+	denoInstallLock.Lock()
+	defer denoInstallLock.Unlock()
+
+	if _, err := os.Stat(denoBinPath(cfg, version)); err == nil {
+		return nil
+	}
+	archive, err := DenoArchiveLocation(cfg.DenoMirror, version)
+	if err != nil {
+		return err
+	}
+	_, err = installDeno(cfg, version, archive, "")
+	return err
+}
+
+// trustedDenoChecksum returns the SHA-256 checksum the archive of a deno version for this platform should have: the
+// pinned one for the configured version, a configured one, or a known one. Empty when there is none
+func trustedDenoChecksum(cfg *config.Config, version string) string {
+	if version == denoVersion(cfg, "") && cfg.DenoSHA256 != "" {
+		return cfg.DenoSHA256
+	}
+	for checksumVersion, checksum := range cfg.DenoChecksums {
+		if strings.TrimPrefix(checksumVersion, "v") == version {
+			return checksum
 		}
-		if err := os.MkdirAll(path.Dir(denoPath), 0700); err != nil {
-			return errors.Wrap(err, "create deno dir")
+	}
+	return denoKnownChecksums[fmt.Sprintf("%s/%s-%s", version, runtime.GOOS, runtime.GOARCH)]
+}
+
+// DenoArchiveLocation returns the URL or path of the archive of a deno version for this platform on mirror
+func DenoArchiveLocation(mirror string, version string) (string, error) {
+	platform := fmt.Sprintf("%s-%s", runtime.GOOS, runtime.GOARCH)
+	archiveName, ok := denoArchiveNames[platform]
+	if !ok {
+		return "", fmt.Errorf("No deno download ready for %s", platform)
+	}
+	if mirror == "" {
+		if override, ok := denoDownloadOverrides[fmt.Sprintf("%s/%s", version, platform)]; ok {
+			return override, nil
 		}
-		ft, err := os.Create(denoPath)
-		if err != nil {
-			return errors.Wrap(err, "write deno bin")
+		mirror = DefaultDenoMirror
+	}
+	return fmt.Sprintf("%s/v%s/%s", strings.TrimSuffix(mirror, "/"), version, archiveName), nil
+}
+
+// InstallDeno installs a deno version from a zip archive, located at a URL or a local path. The archive is verified
+// against expectedSHA256, or when that's empty, against the configured or known checksum of the version. Archives
+// without any are only installed when the configuration allows unverified installs
+func InstallDeno(cfg *config.Config, version string, archive string, expectedSHA256 string) (*DenoInstall, error) {
+	denoInstallLock.Lock()
+	defer denoInstallLock.Unlock()
+
+	return installDeno(cfg, version, archive, expectedSHA256)
+}
+
+func installDeno(cfg *config.Config, version string, archive string, expectedSHA256 string) (*DenoInstall, error) {
+	version = strings.TrimPrefix(version, "v")
+	if !definition.DenoVersionRE.MatchString(version) {
+		return nil, fmt.Errorf("invalid deno version: %s", version)
+	}
+
+	versionsDir := denoVersionsDir(cfg)
+	if err := os.MkdirAll(versionsDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create deno dir")
+	}
+
+	// Fetch the archive, computing its checksum along the way
+	archiveFile, err := os.CreateTemp(versionsDir, ".download-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create archive file")
+	}
+	defer os.Remove(archiveFile.Name())
+	defer archiveFile.Close()
+	log.Infof("Fetching deno %s from %s", version, archive)
+	hash := sha256.New()
+	if err := fetchArchive(archive, io.MultiWriter(archiveFile, hash)); err != nil {
+		return nil, errors.Wrap(err, "deno download")
+	}
+	checksum := fmt.Sprintf("%x", hash.Sum(nil))
+
+	if expectedSHA256 == "" {
+		expectedSHA256 = trustedDenoChecksum(cfg, version)
+	}
+	if expectedSHA256 == "" {
+		// A checksum published on the mirror itself wouldn't protect against a compromised mirror, so there's no
+		// falling back to that
+		if !cfg.DenoAllowUnverified {
+			return nil, fmt.Errorf("no checksum known for deno %s (archive SHA-256 %s), pin one with --deno-sha256 or --deno-checksum, or allow unverified installs", version, checksum)
 		}
-		_, err = io.Copy(ft, rc)
+		log.Warnf("No checksum known for %s, installing unverified deno %s with SHA-256 %s", archive, version, checksum)
+	} else if !strings.EqualFold(expectedSHA256, checksum) {
+		return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", archive, expectedSHA256, checksum)
+	}
+
+	// Extract into a temporary directory first, so a failed install never leaves a broken version behind
+	installDir, err := os.MkdirTemp(versionsDir, ".install-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create install dir")
+	}
+	defer os.RemoveAll(installDir)
+	if err := extractDenoBinary(archiveFile.Name(), filepath.Join(installDir, "deno")); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(installDir, denoChecksumFilename), []byte(checksum+"\n"), 0600); err != nil {
+		return nil, errors.Wrap(err, "write checksum")
+	}
+
+	versionDir := filepath.Join(versionsDir, version)
+	if err := os.RemoveAll(versionDir); err != nil {
+		return nil, errors.Wrap(err, "remove previous install")
+	}
+	if err := os.Rename(installDir, versionDir); err != nil {
+		return nil, errors.Wrap(err, "move install")
+	}
+	return &DenoInstall{
+		Version: version,
+		Path:    filepath.Join(versionDir, "deno"),
+		SHA256:  checksum,
+	}, nil
+}
+
+func isURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// fetchArchive copies the archive at a URL or local path to w
+func fetchArchive(location string, w io.Writer) error {
+	if !isURL(location) {
+		f, err := os.Open(strings.TrimPrefix(location, "file://"))
 		if err != nil {
-			return errors.Wrap(err, "copy deno bin")
+			return err
 		}
-		ft.Close()
-		rc.Close()
-		os.Chmod(denoPath, 0755)
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	}
+	resp, err := http.Get(location)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP Error: %s", resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func extractDenoBinary(archivePath string, destPath string) error {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return errors.Wrap(err, "open deno zip")
+	}
+	defer r.Close()
+
+	if len(r.File) != 1 {
+		return fmt.Errorf("Expected just one file in zip, but got %d", len(r.File))
+	}
 
+	rc, err := r.File[0].Open()
+	if err != nil {
+		return errors.Wrap(err, "open deno bin")
+	}
+	defer rc.Close()
+	ft, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return errors.Wrap(err, "write deno bin")
+	}
+	defer ft.Close()
+	if _, err := io.Copy(ft, rc); err != nil {
+		return errors.Wrap(err, "copy deno bin")
 	}
 	return nil
 }
 
-func downloadFile(url string, toPath string) error {
-	resp, err := http.Get(url)
+// ListDenoInstalls lists the deno versions installed in the data directory, oldest version first
+func ListDenoInstalls(cfg *config.Config) ([]*DenoInstall, error) {
+	entries, err := os.ReadDir(denoVersionsDir(cfg))
+	if os.IsNotExist(err) {
+		return []*DenoInstall{}, nil
+	}
 	if err != nil {
-		return err
+		return nil, errors.Wrap(err, "list deno dir")
 	}
-	defer resp.Body.Close()
+	installs := []*DenoInstall{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !definition.DenoVersionRE.MatchString(entry.Name()) {
+			continue
+		}
+		versionDir := filepath.Join(denoVersionsDir(cfg), entry.Name())
+		if _, err := os.Stat(filepath.Join(versionDir, "deno")); err != nil {
+			continue
+		}
+		checksum, _ := os.ReadFile(filepath.Join(versionDir, denoChecksumFilename))
+		installs = append(installs, &DenoInstall{
+			Version: entry.Name(),
+			Path:    filepath.Join(versionDir, "deno"),
+			SHA256:  strings.TrimSpace(string(checksum)),
+		})
+	}
+	sort.Slice(installs, func(i, j int) bool {
+		return compareDenoVersions(installs[i].Version, installs[j].Version) < 0
+	})
+	return installs, nil
+}
 
-	out, err := os.Create(toPath)
+// PruneDenoInstalls removes all installed deno versions but the configured one and those in keep, as well as the
+// binary older Matterless versions downloaded, and returns the versions removed
+func PruneDenoInstalls(cfg *config.Config, keep []string) ([]string, error) {
+	keepVersions := map[string]bool{
+		denoVersion(cfg, ""): true,
+	}
+	for _, version := range keep {
+		keepVersions[strings.TrimPrefix(version, "v")] = true
+	}
+	installs, err := ListDenoInstalls(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer out.Close()
-	_, err = io.Copy(out, resp.Body)
-	return err
+	removed := []string{}
+	for _, install := range installs {
+		if keepVersions[install.Version] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Dir(install.Path)); err != nil {
+			return removed, errors.Wrap(err, "remove deno install")
+		}
+		removed = append(removed, install.Version)
+	}
+	if err := os.Remove(filepath.Join(cfg.DataDir, ".deno", "deno")); err != nil && !os.IsNotExist(err) {
+		return removed, errors.Wrap(err, "remove legacy deno bin")
+	}
+	return removed, nil
+}
+
+// compareDenoVersions compares two versions of the form major.minor.patch, returning a negative number, zero or a positive number
+func compareDenoVersions(a string, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aNum, _ := strconv.Atoi(aParts[i])
+		bNum, _ := strconv.Atoi(bParts[i])
+		if aNum != bNum {
+			if aNum < bNum {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(aParts) - len(bParts)
 }
@@ -0,0 +1,91 @@
+package sandbox_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/sandbox"
+)
+
+func denoArchive(t *testing.T, content string) ([]byte, string) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("deno")
+	assert.NoError(t, err)
+	w.Write([]byte(content))
+	assert.NoError(t, zw.Close())
+	return buf.Bytes(), fmt.Sprintf("%x", sha256.Sum256(buf.Bytes()))
+}
+
+func TestDenoInstalls(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.DenoVersion = "1.2.3"
+
+	// From a local archive
+	archive, checksum := denoArchive(t, "deno 1.2.3")
+	archivePath := filepath.Join(t.TempDir(), "deno.zip")
+	assert.NoError(t, os.WriteFile(archivePath, archive, 0600))
+	_, err := sandbox.InstallDeno(cfg, "1.2.3", archivePath, strings.Repeat("0", 64))
+	assert.Error(t, err)
+	install, err := sandbox.InstallDeno(cfg, "v1.2.3", archivePath, checksum)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3", install.Version)
+	buf, err := os.ReadFile(install.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, "deno 1.2.3", string(buf))
+	assert.NoError(t, sandbox.EnsureDeno(cfg))
+
+	// From a mirror, only with a configured checksum
+	archive2, checksum2 := denoArchive(t, "deno 1.10.0")
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1.10.0/") && strings.HasSuffix(r.URL.Path, ".zip"):
+			w.Write(archive2)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mirror.Close()
+	cfg.DenoMirror = mirror.URL
+	assert.Error(t, sandbox.EnsureDenoVersion(cfg, "1.10.0"))
+	cfg.DenoChecksums = map[string]string{"1.10.0": checksum}
+	assert.Error(t, sandbox.EnsureDenoVersion(cfg, "1.10.0"))
+	cfg.DenoChecksums = map[string]string{"v1.10.0": checksum2}
+	assert.NoError(t, sandbox.EnsureDenoVersion(cfg, "1.10.0"))
+	assert.Error(t, sandbox.EnsureDenoVersion(cfg, "1.11.0"))
+
+	// From a local mirror directory, without a checksum when explicitly allowed
+	mirrorDir := t.TempDir()
+	archivePath, err = sandbox.DenoArchiveLocation(mirrorDir, "1.9.0")
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(archivePath), 0700))
+	assert.NoError(t, os.WriteFile(archivePath, archive, 0600))
+	cfg.DenoMirror = mirrorDir
+	assert.Error(t, sandbox.EnsureDenoVersion(cfg, "1.9.0"))
+	cfg.DenoAllowUnverified = true
+	assert.NoError(t, sandbox.EnsureDenoVersion(cfg, "1.9.0"))
+
+	installs, err := sandbox.ListDenoInstalls(cfg)
+	assert.NoError(t, err)
+	assert.Len(t, installs, 3)
+	assert.Equal(t, []string{"1.2.3", "1.9.0", "1.10.0"}, []string{installs[0].Version, installs[1].Version, installs[2].Version})
+	assert.Equal(t, checksum2, installs[2].SHA256)
+
+	removed, err := sandbox.PruneDenoInstalls(cfg, []string{"1.9.0"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1.10.0"}, removed)
+	installs, err = sandbox.ListDenoInstalls(cfg)
+	assert.NoError(t, err)
+	assert.Len(t, installs, 2)
+}
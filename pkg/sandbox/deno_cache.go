@@ -0,0 +1,268 @@
+package sandbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/definition"
+	"github.com/zefhemel/matterless/pkg/util"
+)
+
+// denoCacheDir is the DENO_DIR shared by all deno processes, remote modules are cached in it
+func denoCacheDir(cfg *config.Config) string {
+	return fmt.Sprintf("%s/.deno/cache", cfg.DataDir)
+}
+
+// denoCacheEntry is a module to cache the imports of, the entry point of a function or job, or a library
+type denoCacheEntry struct {
+	description string
+	denoVersion string
+	path        string
+	// The typescript module to type check, empty for javascript
+	typeScriptPath string
+}
+
+// writeDenoProjects writes a deno project for every deno function and job, and one with all libraries, into
+// projectsDir, returning the modules to cache for them
+func writeDenoProjects(projectsDir string, defs *definition.Definitions) ([]denoCacheEntry, error) {
+	var entries []denoCacheEntry
+	for name, def := range defs.Functions {
+		if !definition.IsDenoRuntime(def.Config.Runtime) {
+			continue
+		}
+		projectDir := fmt.Sprintf("%s/function-%s", projectsDir, util.SafeFilename(string(name)))
+		if err := writeDenoProject(projectDir, def.Config, def.Code, defs.Libraries); err != nil {
+			return nil, err
+		}
+		entry := denoCacheEntry{description: fmt.Sprintf("function %s", name), denoVersion: def.Config.DenoVersion, path: fmt.Sprintf("%s/function_server.ts", projectDir)}
+		if definition.IsTypeScript(def.Config.Language) {
+			entry.typeScriptPath = fmt.Sprintf("%s/function.ts", projectDir)
+		}
+		entries = append(entries, entry)
+	}
+	for name, def := range defs.Jobs {
+		if !definition.IsDenoRuntime(def.Config.Runtime) {
+			continue
+		}
+		projectDir := fmt.Sprintf("%s/job-%s", projectsDir, util.SafeFilename(string(name)))
+		functionConfig := &definition.FunctionConfig{
+			Language:   def.Config.Language,
+			Init:       def.Config.Init,
+			InitSchema: def.Config.InitSchema,
+		}
+		if err := writeDenoProject(projectDir, functionConfig, def.Code, defs.Libraries); err != nil {
+			return nil, err
+		}
+		entry := denoCacheEntry{description: fmt.Sprintf("job %s", name), denoVersion: def.Config.DenoVersion, path: fmt.Sprintf("%s/job_server.ts", projectDir)}
+		if definition.IsTypeScript(def.Config.Language) {
+			entry.typeScriptPath = fmt.Sprintf("%s/function.ts", projectDir)
+		}
+		entries = append(entries, entry)
+	}
+	// Libraries are cached on their own as well, they may not be imported by any function or job
+	libraries := librariesForRuntime(defs.Libraries, "deno")
+	if len(libraries) > 0 {
+		projectDir := fmt.Sprintf("%s/libraries", projectsDir)
+		if err := writeDenoProject(projectDir, &definition.FunctionConfig{}, "", defs.Libraries); err != nil {
+			return nil, err
+		}
+		for name, def := range libraries {
+			entry := denoCacheEntry{description: fmt.Sprintf("library %s", name), path: fmt.Sprintf("%s/%s", projectDir, denoLibraryFilename(name, def))}
+			if definition.IsTypeScript(def.Language) {
+				entry.typeScriptPath = entry.path
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// CacheDenoDefinitions fetches the remote modules imported by all deno functions, jobs and libraries into the deno
+// cache, the equivalent of deno cache, so they're not fetched on first invocation. Import errors are returned as an
+// error listing every failing function, job and library. When vendoring, the paths of all cached remote module files
+// (relative to the deno cache) are returned
+func CacheDenoDefinitions(ctx context.Context, cfg *config.Config, defs *definition.Definitions) ([]string, error) {
+	projectsDir, err := denoProjectsDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(projectsDir)
+
+	entries, err := writeDenoProjects(projectsDir, defs)
+	if err != nil {
+		return nil, err
+	}
+
+	errorMessages := []string{}
+	modulePaths := map[string]bool{}
+	for _, entry := range entries {
+		denoPath, err := denoCommandPath(cfg, entry.denoVersion)
+		if err != nil {
+			return nil, errors.Wrap(err, "deno install")
+		}
+		if output, err := denoCacheCommand(ctx, cfg, denoPath, "cache", "--no-check", entry.path).CombinedOutput(); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			errorMessages = append(errorMessages, fmt.Sprintf("%s: %s", entry.description, strings.TrimSpace(string(output))))
+			continue
+		}
+		if cfg.DenoVendor {
+			paths, err := cachedModulePaths(ctx, cfg, denoPath, entry.path)
+			if err != nil {
+				return nil, errors.Wrap(err, entry.description)
+			}
+			for _, path := range paths {
+				modulePaths[path] = true
+			}
+		}
+	}
+	if len(errorMessages) > 0 {
+		sort.Strings(errorMessages)
+		return nil, errors.New(strings.Join(errorMessages, "\n"))
+	}
+
+	paths := make([]string, 0, len(modulePaths))
+	for path := range modulePaths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// CheckDenoTypes type checks all typescript functions, jobs and libraries, returning an error listing every type error
+func CheckDenoTypes(ctx context.Context, cfg *config.Config, defs *definition.Definitions) error {
+	projectsDir, err := denoProjectsDir(cfg)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(projectsDir)
+
+	entries, err := writeDenoProjects(projectsDir, defs)
+	if err != nil {
+		return err
+	}
+
+	errorMessages := []string{}
+	for _, entry := range entries {
+		if entry.typeScriptPath == "" {
+			continue
+		}
+		denoPath, err := denoCommandPath(cfg, entry.denoVersion)
+		if err != nil {
+			return errors.Wrap(err, "deno install")
+		}
+		// Unlike deno run, deno cache type checks the module
+		if output, err := denoCacheCommand(ctx, cfg, denoPath, "cache", entry.typeScriptPath).CombinedOutput(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			errorMessages = append(errorMessages, fmt.Sprintf("%s: %s", entry.description, strings.ReplaceAll(strings.TrimSpace(string(output)), projectsDir, "")))
+		}
+	}
+	if len(errorMessages) > 0 {
+		sort.Strings(errorMessages)
+		return errors.New(strings.Join(errorMessages, "\n"))
+	}
+	return nil
+}
+
+// denoProjectsDir creates a temporary directory to write deno projects into
+func denoProjectsDir(cfg *config.Config) (string, error) {
+	if err := os.MkdirAll(fmt.Sprintf("%s/.deno", cfg.DataDir), 0700); err != nil {
+		return "", errors.Wrap(err, "create deno dir")
+	}
+	projectsDir, err := os.MkdirTemp(fmt.Sprintf("%s/.deno", cfg.DataDir), "prepare-")
+	if err != nil {
+		return "", errors.Wrap(err, "create deno dir")
+	}
+	return projectsDir, nil
+}
+
+func denoCacheCommand(ctx context.Context, cfg *config.Config, denoPath string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, denoPath, args...)
+	cmd.Env = append(os.Environ(),
+		"NO_COLOR=1",
+		fmt.Sprintf("DENO_DIR=%s", denoCacheDir(cfg)))
+	return cmd
+}
+
+// cachedModulePaths lists the files in the deno cache of the remote modules entryPath (transitively) imports
+func cachedModulePaths(ctx context.Context, cfg *config.Config, denoPath string, entryPath string) ([]string, error) {
+	output, err := denoCacheCommand(ctx, cfg, denoPath, "info", "--json", entryPath).Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "deno info")
+	}
+	var info struct {
+		Modules []struct {
+			Specifier string `json:"specifier"`
+			Local     string `json:"local"`
+		} `json:"modules"`
+	}
+	if err := json.Unmarshal(output, &info); err != nil {
+		return nil, errors.Wrap(err, "decode deno info")
+	}
+	cacheDir, err := filepath.Abs(denoCacheDir(cfg))
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, module := range info.Modules {
+		if module.Local == "" || strings.HasPrefix(module.Specifier, "file:") {
+			continue
+		}
+		rel, err := filepath.Rel(cacheDir, module.Local)
+		if err != nil || !isCachePath(rel) {
+			continue
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+		// Deno keeps the headers the module was served with next to it
+		if _, err := os.Stat(module.Local + ".metadata.json"); err == nil {
+			paths = append(paths, filepath.ToSlash(rel)+".metadata.json")
+		}
+	}
+	return paths, nil
+}
+
+// isCachePath checks if path is relative, and doesn't escape the deno cache
+func isCachePath(path string) bool {
+	cleaned := filepath.Clean(filepath.FromSlash(path))
+	return path != "" && !filepath.IsAbs(cleaned) && cleaned != ".." && !strings.HasPrefix(cleaned, ".."+string(filepath.Separator))
+}
+
+// ReadDenoCacheFile reads a file from the deno cache, path is relative to the cache directory
+func ReadDenoCacheFile(cfg *config.Config, path string) ([]byte, error) {
+	if !isCachePath(path) {
+		return nil, fmt.Errorf("invalid deno cache path: %s", path)
+	}
+	return os.ReadFile(filepath.Join(denoCacheDir(cfg), filepath.FromSlash(path)))
+}
+
+// HasDenoCacheFile checks if a file exists in the deno cache, path is relative to the cache directory
+func HasDenoCacheFile(cfg *config.Config, path string) bool {
+	if !isCachePath(path) {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(denoCacheDir(cfg), filepath.FromSlash(path)))
+	return err == nil
+}
+
+// WriteDenoCacheFile writes a file into the deno cache, path is relative to the cache directory
+func WriteDenoCacheFile(cfg *config.Config, path string, content []byte) error {
+	if !isCachePath(path) {
+		return fmt.Errorf("invalid deno cache path: %s", path)
+	}
+	fullPath := filepath.Join(denoCacheDir(cfg), filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0700); err != nil {
+		return errors.Wrap(err, "create deno cache dir")
+	}
+	return os.WriteFile(fullPath, content, 0600)
+}
@@ -0,0 +1,108 @@
+package sandbox_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/definition"
+	"github.com/zefhemel/matterless/pkg/sandbox"
+)
+
+// Stands in for deno: caching fails for code importing a broken module, info reports a single cached remote module
+const fakeDeno = `#!/bin/sh
+case "$1" in
+cache)
+  if grep -q broken.ts "$(dirname "$3")/function.js"; then
+    echo "error: Import 'https://example.com/broken.ts' failed: 404 Not Found" >&2
+    exit 1
+  fi
+  mkdir -p "$DENO_DIR/deps/https/example.com"
+  echo "export const x = 1;" > "$DENO_DIR/deps/https/example.com/abc123"
+  echo "{}" > "$DENO_DIR/deps/https/example.com/abc123.metadata.json"
+  ;;
+info)
+  echo "{\"modules\": [{\"specifier\": \"file://$3\", \"local\": \"$3\"}, {\"specifier\": \"https://example.com/mod.ts\", \"local\": \"$DENO_DIR/deps/https/example.com/abc123\"}]}"
+  ;;
+esac
+`
+
+func TestCacheDenoDefinitions(t *testing.T) {
+	binDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(binDir, "deno"), []byte(fakeDeno), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.UseSystemDeno = true
+	cfg.DenoVendor = true
+
+	defs := definition.NewDefinitions()
+	defs.Functions["Good"] = &definition.FunctionDef{
+		Config: &definition.FunctionConfig{},
+		Code:   `import {x} from "https://example.com/mod.ts"; function handle() { return x; }`,
+	}
+	defs.Functions["Other"] = &definition.FunctionDef{
+		Config: &definition.FunctionConfig{Runtime: "python"},
+		Code:   `import broken.ts`,
+	}
+	paths, err := sandbox.CacheDenoDefinitions(context.Background(), cfg, defs)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"deps/https/example.com/abc123", "deps/https/example.com/abc123.metadata.json"}, paths)
+	content, err := sandbox.ReadDenoCacheFile(cfg, paths[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "export const x = 1;\n", string(content))
+
+	// Restoring into the cache of another node
+	cfg2 := config.NewConfig()
+	cfg2.DataDir = t.TempDir()
+	assert.False(t, sandbox.HasDenoCacheFile(cfg2, paths[0]))
+	assert.NoError(t, sandbox.WriteDenoCacheFile(cfg2, paths[0], content))
+	assert.True(t, sandbox.HasDenoCacheFile(cfg2, paths[0]))
+	assert.Error(t, sandbox.WriteDenoCacheFile(cfg2, "../escape", content))
+
+	defs.Functions["Bad"] = &definition.FunctionDef{
+		Config: &definition.FunctionConfig{},
+		Code:   `import "https://example.com/broken.ts";`,
+	}
+	_, err = sandbox.CacheDenoDefinitions(context.Background(), cfg, defs)
+	assert.EqualError(t, err, "function Bad: error: Import 'https://example.com/broken.ts' failed: 404 Not Found")
+}
+
+// Stands in for deno type checking: fails on code assigning a string to a number, and reports the declarations
+const fakeDenoCheck = `#!/bin/sh
+if grep -q 'number = "' "$2"; then
+  echo "error: TS2322 [ERROR]: Type 'string' is not assignable to type 'number'." >&2
+  exit 1
+fi
+mkdir -p "$DENO_DIR"
+if [ -f "$(dirname "$2")/matterless.d.ts" ]; then
+  cat "$(dirname "$2")/matterless.d.ts" >> "$DENO_DIR/../checked.d.ts"
+fi
+`
+
+func TestCheckDenoTypes(t *testing.T) {
+	binDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(binDir, "deno"), []byte(fakeDenoCheck), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.UseSystemDeno = true
+
+	defs, err := definition.Parse("# function Typed\n```yaml\ninit_schema:\n  type: object\n  properties:\n    name:\n      type: string\n  required: [name]\n```\n\n```typescript\nfunction init(config: InitConfig) {}\n```\n\n# function Untyped\n```javascript\nfunction handle() { let x: number = \"\"; }\n```\n")
+	assert.NoError(t, err)
+	assert.NoError(t, sandbox.CheckDenoTypes(context.Background(), cfg, defs))
+	declarations, err := os.ReadFile(filepath.Join(cfg.DataDir, ".deno", "checked.d.ts"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(declarations), `declare type InitConfig = { "name": string };`)
+	assert.Contains(t, string(declarations), `declare type EventPayload = any;`)
+	assert.Contains(t, string(declarations), `declare function init(config: InitConfig): unknown;`)
+
+	defs.Libraries["util"] = &definition.LibraryDef{Language: "ts", Code: `export const x: number = "";`}
+	err = sandbox.CheckDenoTypes(context.Background(), cfg, defs)
+	assert.EqualError(t, err, "library util: error: TS2322 [ERROR]: Type 'string' is not assignable to type 'number'.")
+}
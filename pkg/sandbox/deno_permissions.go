@@ -0,0 +1,56 @@
+package sandbox
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/zefhemel/matterless/pkg/definition"
+)
+
+// denoPermissionFlags translates the effective permissions into deno run flags, granting read and write access only
+// within scratchDir
+func denoPermissionFlags(permissions *definition.Permissions, apiURL string, scratchDir string) []string {
+	eff := permissions.Effective()
+	var flags []string
+
+	allowAnyHost := false
+	hosts := make([]string, 0, len(eff.AllowNet))
+	for _, host := range eff.AllowNet {
+		switch host {
+		case definition.PermissionAnyHost:
+			allowAnyHost = true
+		case definition.PermissionAPIHost:
+			if u, err := url.Parse(fmt.Sprintf(apiURL, "localhost")); err == nil && u.Host != "" {
+				hosts = append(hosts, u.Host)
+			}
+		default:
+			hosts = append(hosts, host)
+		}
+	}
+	if allowAnyHost {
+		flags = append(flags, "--allow-net")
+	} else if len(hosts) > 0 {
+		flags = append(flags, fmt.Sprintf("--allow-net=%s", strings.Join(hosts, ",")))
+	}
+
+	if len(eff.AllowRead) > 0 {
+		flags = append(flags, fmt.Sprintf("--allow-read=%s", strings.Join(scratchPaths(scratchDir, eff.AllowRead), ",")))
+	}
+	if len(eff.AllowWrite) > 0 {
+		flags = append(flags, fmt.Sprintf("--allow-write=%s", strings.Join(scratchPaths(scratchDir, eff.AllowWrite), ",")))
+	}
+	if len(eff.AllowEnv) > 0 {
+		flags = append(flags, fmt.Sprintf("--allow-env=%s", strings.Join(eff.AllowEnv, ",")))
+	}
+	return flags
+}
+
+func scratchPaths(scratchDir string, paths []string) []string {
+	result := make([]string, len(paths))
+	for i, p := range paths {
+		result[i] = filepath.Join(scratchDir, filepath.FromSlash(p))
+	}
+	return result
+}
@@ -0,0 +1,34 @@
+package sandbox
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/definition"
+)
+
+func TestDenoPermissionFlags(t *testing.T) {
+	assert.Equal(t, []string{
+		"--allow-net=localhost:8222",
+		"--allow-env=API_URL,API_TOKEN",
+	}, denoPermissionFlags(nil, "http://%s:8222", "/data/scratch"))
+
+	assert.Equal(t, []string{
+		"--allow-net=localhost:8222,api.github.com",
+		"--allow-read=/data/scratch,/data/scratch/in",
+		"--allow-write=/data/scratch/out/today",
+		"--allow-env=API_URL,API_TOKEN,DEBUG",
+	}, denoPermissionFlags(&definition.Permissions{
+		AllowNet:   []string{"api.github.com"},
+		AllowRead:  []string{".", "in/"},
+		AllowWrite: []string{"out/./today"},
+		AllowEnv:   []string{"DEBUG", "API_URL"},
+	}, "http://%s:8222", "/data/scratch"))
+
+	assert.Equal(t, []string{
+		"--allow-net",
+		"--allow-env=API_URL,API_TOKEN",
+	}, denoPermissionFlags(&definition.Permissions{
+		AllowNet: []string{"*"},
+	}, "http://%s:8222", "/data/scratch"))
+}
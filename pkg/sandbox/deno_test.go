@@ -36,8 +36,8 @@ func TestDenoSandboxFunction(t *testing.T) {
 	ceb := cluster.NewClusterEventBus(conn, "test")
 
 	// Listen to logs
-	ceb.SubscribeLogs("*", func(funcName, message string) {
-		log.Infof("Got log (func) %s", message)
+	ceb.SubscribeLogs("*", func(funcName string, message cluster.LogMessage) {
+		log.Infof("Got log (func) %s", message.Message)
 	})
 
 	// Boot worker
@@ -84,10 +84,10 @@ function stop() {
 
 	// Listen to logs
 	allLogs := ""
-	ceb.SubscribeLogs("*", func(funcName, message string) {
-		log.Infof("Got log (job) %s", message)
+	ceb.SubscribeLogs("*", func(funcName string, message cluster.LogMessage) {
+		log.Infof("Got log (job) %s", message.Message)
 
-		allLogs = allLogs + string(message)
+		allLogs = allLogs + message.Message
 	})
 
 	// Boot worker
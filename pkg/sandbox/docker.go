@@ -17,6 +17,7 @@ import (
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/zefhemel/matterless/pkg/cluster"
 	"github.com/zefhemel/matterless/pkg/config"
 	"github.com/zefhemel/matterless/pkg/definition"
 	"github.com/zefhemel/matterless/pkg/util"
@@ -47,7 +48,7 @@ func (inst *dockerFunctionInstance) DidExit() chan error {
 	return inst.procExit
 }
 
-func newDockerFunctionInstance(ctx context.Context, cfg *config.Config, apiURL string, apiToken string, runMode RunMode, name string, logCallback func(funcName, message string), functionConfig *definition.FunctionConfig, code string, libs definition.LibraryMap) (FunctionInstance, error) {
+func newDockerFunctionInstance(ctx context.Context, cfg *config.Config, apiURL string, apiToken string, runMode RunMode, name string, logCallback LogCallback, functionConfig *definition.FunctionConfig, code string, libs definition.LibraryMap) (FunctionInstance, error) {
 	//funcHash := newFunctionHash(name, code)
 	inst := &dockerFunctionInstance{
 		name:          name,
@@ -91,8 +92,8 @@ func newDockerFunctionInstance(ctx context.Context, cfg *config.Config, apiURL s
 	bufferedStderr := bufio.NewReader(stderrPipe)
 
 	// Send stdout and stderr to the log channel
-	go pipeLogStreamToCallback(name, bufferedStdout, logCallback)
-	go pipeLogStreamToCallback(name, bufferedStderr, logCallback)
+	go pipeLogStreamToCallback(name, bufferedStdout, cluster.LogLevelInfo, logCallback)
+	go pipeLogStreamToCallback(name, bufferedStderr, cluster.LogLevelError, logCallback)
 
 	if code != "" {
 		if _, err := stdInPipe.Write([]byte(code)); err != nil {
@@ -155,6 +156,9 @@ func (inst *dockerFunctionInstance) Kill() {
 	log.Debug("Killed function instance.")
 }
 
+// HTTP header used to pass on the invocation ID to the function server, so it can tag log records with it
+const invocationIDHeader = "X-Matterless-Invocation-Id"
+
 type jsError struct {
 	Message string `json:"message"`
 	Stack   string `json:"stack"`
@@ -171,6 +175,7 @@ func (inst *dockerFunctionInstance) Invoke(ctx context.Context, event interface{
 	if err != nil {
 		return nil, errors.Wrap(err, "invoke call")
 	}
+	req.Header.Set(invocationIDHeader, InvocationID(ctx))
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("could not make HTTP invocation: %s", err.Error()))
@@ -209,7 +214,7 @@ type dockerJobInstance struct {
 	name          string
 	cmd           *exec.Cmd
 	code          string
-	logCallback   func(funcName string, message string)
+	logCallback   LogCallback
 	apiURL        string
 	containerName string
 	procExit      chan error
@@ -221,7 +226,7 @@ func (inst *dockerJobInstance) Name() string {
 	return inst.name
 }
 
-func newDockerJobInstance(ctx context.Context, cfg *config.Config, apiURL string, apiToken string, name string, logCallback func(funcName, message string), jobConfig *definition.JobConfig, code string, libs definition.LibraryMap) (JobInstance, error) {
+func newDockerJobInstance(ctx context.Context, cfg *config.Config, apiURL string, apiToken string, name string, logCallback LogCallback, jobConfig *definition.JobConfig, code string, libs definition.LibraryMap) (JobInstance, error) {
 	//funcHash := newFunctionHash(name, code)
 	inst := &dockerJobInstance{
 		apiURL:        apiURL,
@@ -277,8 +282,8 @@ func (inst *dockerJobInstance) Start(ctx context.Context) error {
 	bufferedStderr := bufio.NewReader(stderrPipe)
 
 	// Send stdout and stderr to the log channel
-	go pipeLogStreamToCallback(inst.name, bufferedStdout, inst.logCallback)
-	go pipeLogStreamToCallback(inst.name, bufferedStderr, inst.logCallback)
+	go pipeLogStreamToCallback(inst.name, bufferedStdout, cluster.LogLevelInfo, inst.logCallback)
+	go pipeLogStreamToCallback(inst.name, bufferedStderr, cluster.LogLevelError, inst.logCallback)
 
 	if inst.code != "" {
 		if _, err := stdInPipe.Write([]byte(inst.code)); err != nil {
@@ -290,7 +295,7 @@ func (inst *dockerJobInstance) Start(ctx context.Context) error {
 	}
 
 	go func() {
-		inst.cmd.Wait()
+		inst.procExit <- inst.cmd.Wait()
 		close(inst.procExit)
 	}()
 
@@ -44,7 +44,7 @@ func TestDockerSandboxFunction(t *testing.T) {
 	ceb := cluster.NewClusterEventBus(conn, "test")
 
 	// Listen to logs
-	ceb.SubscribeLogs("*", func(funcName, message string) {
+	ceb.SubscribeLogs("*", func(funcName string, message cluster.LogMessage) {
 		log.Infof("Got log: %s", funcName)
 	})
 
@@ -91,9 +91,9 @@ for i in range(10):
 
 	// Listen to logs
 	allLogs := ""
-	ceb.SubscribeLogs("*", func(funcName, message string) {
-		log.Infof("Got log: %s", message)
-		allLogs = allLogs + string(message)
+	ceb.SubscribeLogs("*", func(funcName string, message cluster.LogMessage) {
+		log.Infof("Got log: %s", message.Message)
+		allLogs = allLogs + message.Message
 	})
 
 	// Boot worker
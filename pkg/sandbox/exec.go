@@ -0,0 +1,293 @@
+package sandbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/definition"
+	"github.com/zefhemel/matterless/pkg/util"
+)
+
+// How long to wait for an exec job to exit after asking it to, before killing it
+const execStopTimeout = 5 * time.Second
+
+// ======= Functions ============
+
+// execFunctionInstance runs a command speaking JSON over stdio: the event goes to stdin as a JSON line, the result is
+// read from stdout. Either a process is spawned per invocation, or (persistent) one process handles one line at a time
+type execFunctionInstance struct {
+	name        string
+	command     []string
+	env         []string
+	persistent  bool
+	logCallback LogCallback
+	lastInvoked time.Time
+	runLock     sync.Mutex
+	exited      chan error
+
+	// The running process, in persistent mode and for jobs
+	cmd         *exec.Cmd
+	processDone chan struct{}
+	stdin       io.WriteCloser
+	stdout      *bufio.Reader
+}
+
+var _ FunctionInstance = &execFunctionInstance{}
+
+func (inst *execFunctionInstance) Name() string {
+	return inst.name
+}
+
+func (inst *execFunctionInstance) LastInvoked() time.Time {
+	return inst.lastInvoked
+}
+
+func (inst *execFunctionInstance) DidExit() chan error {
+	return inst.exited
+}
+
+// execCommand builds the command with the same Matterless environment the deno runtime sets, stderr goes to the logs
+func (inst *execFunctionInstance) execCommand(ctx context.Context, logCallback LogCallback) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, inst.command[0], inst.command[1:]...)
+	cmd.Env = inst.env
+
+	// Don't propagate Ctrl-c to children
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+
+	cmd.Stderr = inst.logWriter(cluster.LogLevelError, logCallback)
+	return cmd
+}
+
+// logWriter returns a writer shipping lines written to it to the log callback, until closed
+// Used rather than StderrPipe/StdoutPipe, so that Wait only returns once all output has been copied
+func (inst *execFunctionInstance) logWriter(level cluster.LogLevel, logCallback LogCallback) io.WriteCloser {
+	reader, writer := io.Pipe()
+	go pipeLogStreamToCallback(inst.name, bufio.NewReader(reader), level, logCallback)
+	return writer
+}
+
+// closeOutputs closes the writers (pipes) the command's output was copied to
+func closeOutputs(cmd *exec.Cmd) {
+	for _, w := range []io.Writer{cmd.Stdout, cmd.Stderr} {
+		if closer, ok := w.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// startProcess starts cmd as the instance's running process
+func (inst *execFunctionInstance) startProcess(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		closeOutputs(cmd)
+		return errors.Wrap(err, "exec")
+	}
+	inst.cmd = cmd
+	inst.processDone = make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		closeOutputs(cmd)
+		inst.exited <- err
+		close(inst.processDone)
+	}()
+	return nil
+}
+
+func newExecFunctionInstance(ctx context.Context, cfg *config.Config, apiURL string, apiToken string, runMode RunMode, name string, logCallback LogCallback, functionConfig *definition.FunctionConfig, code string, libs definition.LibraryMap) (FunctionInstance, error) {
+	if len(functionConfig.Command) == 0 {
+		return nil, errors.New("exec runtime needs a command")
+	}
+	inst := &execFunctionInstance{
+		name:        name,
+		command:     functionConfig.Command,
+		persistent:  functionConfig.Persistent,
+		logCallback: logCallback,
+		exited:      make(chan error, 1),
+		env: append(os.Environ(),
+			fmt.Sprintf("INIT_CONFIG=%s", util.MustJsonString(functionConfig.Init)),
+			fmt.Sprintf("API_URL=%s", fmt.Sprintf(apiURL, "localhost")),
+			fmt.Sprintf("API_TOKEN=%s", apiToken)),
+	}
+
+	if !inst.persistent {
+		return inst, nil
+	}
+
+	// The persistent process outlives the boot context
+	cmd := inst.execCommand(context.Background(), inst.logCallback)
+	var err error
+	inst.stdin, err = cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "stdin pipe")
+	}
+	stdoutReader, stdoutWriter := io.Pipe()
+	cmd.Stdout = stdoutWriter
+	inst.stdout = bufio.NewReader(stdoutReader)
+	if err := inst.startProcess(cmd); err != nil {
+		return nil, err
+	}
+
+	return inst, nil
+}
+
+func (inst *execFunctionInstance) Invoke(ctx context.Context, event interface{}) (interface{}, error) {
+	// Instance can only be used sequentially
+	inst.runLock.Lock()
+	defer inst.runLock.Unlock()
+
+	inst.lastInvoked = time.Now()
+
+	var (
+		output []byte
+		err    error
+	)
+	if inst.persistent {
+		output, err = inst.invokePersistent(ctx, event)
+	} else {
+		output, err = inst.invokeProcess(ctx, event)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeExecResult(output)
+}
+
+// invokeProcess runs the command for just this invocation, and reads all of its output
+func (inst *execFunctionInstance) invokeProcess(ctx context.Context, event interface{}) ([]byte, error) {
+	// The process only runs for this invocation, so all of its logs belong to it
+	cmd := inst.execCommand(ctx, inst.logCallback.withInvocationID(InvocationID(ctx)))
+	cmd.Stdin = bytes.NewReader(append(util.MustJsonByteSlice(event), '\n'))
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := cmd.Run()
+	closeOutputs(cmd)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("Runtime error: %s", err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// invokePersistent writes the event to the running process, and reads a single line of output
+func (inst *execFunctionInstance) invokePersistent(ctx context.Context, event interface{}) ([]byte, error) {
+	select {
+	case <-inst.processDone:
+		return nil, ProcessExitedError
+	default:
+	}
+	if _, err := inst.stdin.Write(append(util.MustJsonByteSlice(event), '\n')); err != nil {
+		return nil, errors.Wrap(err, "write event")
+	}
+
+	type lineResult struct {
+		line []byte
+		err  error
+	}
+	lineChan := make(chan lineResult, 1)
+	go func() {
+		line, err := inst.stdout.ReadBytes('\n')
+		lineChan <- lineResult{line, err}
+	}()
+	select {
+	case <-ctx.Done():
+		// The process is now out of sync with the protocol, so it has to go
+		inst.Kill()
+		return nil, ctx.Err()
+	case result := <-lineChan:
+		if result.err != nil && len(result.line) == 0 {
+			return nil, errors.Wrap(result.err, "read result")
+		}
+		return result.line, nil
+	}
+}
+
+// decodeExecResult decodes the JSON output of a command, an object with an error key is turned into an error
+func decodeExecResult(output []byte) (interface{}, error) {
+	if len(bytes.TrimSpace(output)) == 0 {
+		return nil, nil
+	}
+	var result interface{}
+	if err := json.NewDecoder(bytes.NewReader(output)).Decode(&result); err != nil {
+		return nil, errors.Wrap(err, "unmarshall response")
+	}
+	if errorMap, ok := result.(map[string]interface{}); ok {
+		if errorObj, ok := errorMap["error"]; ok {
+			if message, ok := errorObj.(string); ok {
+				return nil, fmt.Errorf("Runtime error: %s", message)
+			}
+			return nil, fmt.Errorf("Runtime error: %s", util.MustJsonString(errorObj))
+		}
+	}
+	return result, nil
+}
+
+// Kill kills the command along with anything it started, which is in its process group
+func (inst *execFunctionInstance) Kill() {
+	if inst.cmd != nil && inst.cmd.Process != nil {
+		if err := syscall.Kill(-inst.cmd.Process.Pid, syscall.SIGKILL); err != nil {
+			inst.cmd.Process.Kill()
+		}
+	}
+}
+
+// ======= Jobs ============
+
+type execJobInstance struct {
+	*execFunctionInstance
+}
+
+var _ JobInstance = &execJobInstance{}
+
+func newExecJobInstance(ctx context.Context, cfg *config.Config, apiURL string, apiToken string, name string, logCallback LogCallback, jobConfig *definition.JobConfig, code string, libs definition.LibraryMap) (JobInstance, error) {
+	functionInstance, err := newExecFunctionInstance(ctx, cfg, apiURL, apiToken, RunModeJob, name, logCallback, &definition.FunctionConfig{
+		Init:      jobConfig.Init,
+		Runtime:   jobConfig.Runtime,
+		Instances: jobConfig.Instances,
+		Command:   jobConfig.Command,
+	}, code, libs)
+	if err != nil {
+		return nil, err
+	}
+	return &execJobInstance{execFunctionInstance: functionInstance.(*execFunctionInstance)}, nil
+}
+
+// Start runs the command in the background, its stdout is logged as well
+func (inst *execJobInstance) Start(ctx context.Context) error {
+	cmd := inst.execCommand(context.Background(), inst.logCallback)
+	cmd.Stdout = inst.logWriter(cluster.LogLevelInfo, inst.logCallback)
+	return inst.startProcess(cmd)
+}
+
+// Stop asks the command and its process group to terminate, and kills them if they don't in time
+func (inst *execJobInstance) Stop(ctx context.Context) error {
+	if inst.cmd == nil {
+		return nil
+	}
+	if err := syscall.Kill(-inst.cmd.Process.Pid, syscall.SIGTERM); err != nil {
+		log.Debugf("Could not signal job %s: %s", inst.name, err)
+	}
+	select {
+	case <-inst.processDone:
+	case <-time.After(execStopTimeout):
+		inst.Kill()
+	case <-ctx.Done():
+		inst.Kill()
+	}
+	return nil
+}
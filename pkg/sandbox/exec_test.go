@@ -0,0 +1,113 @@
+package sandbox_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/definition"
+	"github.com/zefhemel/matterless/pkg/sandbox"
+)
+
+func TestExecSandboxFunction(t *testing.T) {
+	a := assert.New(t)
+	r, ok := sandbox.LookupRuntime("exec")
+	a.True(ok)
+
+	// Echoes the event back along with the API URL, logging to stderr and failing for empty events
+	script := `while read -r line; do
+  echo "got $line" >&2
+  if [ "$line" = "{}" ]; then
+    echo '{"error": "empty event"}'
+  else
+    echo "{\"event\": $line, \"api_url\": \"$API_URL\"}"
+  fi
+done`
+
+	for _, persistent := range []bool{false, true} {
+		logs := make(chan cluster.LogMessage, 10)
+		inst, err := r.FunctionInstantiator(context.Background(), config.NewConfig(), "http://%s:8222/test", "secret", sandbox.RunModeFunction, "Echo", func(funcName string, message cluster.LogMessage) {
+			logs <- message
+		}, &definition.FunctionConfig{
+			Command:    []string{"sh", "-c", script},
+			Persistent: persistent,
+		}, "", definition.LibraryMap{})
+		a.NoError(err)
+
+		for i := 0; i < 3; i++ {
+			result, err := inst.Invoke(sandbox.WithInvocationID(context.Background(), "invocation"), map[string]interface{}{"n": i})
+			a.NoError(err)
+			a.Equal(map[string]interface{}{
+				"event":   map[string]interface{}{"n": float64(i)},
+				"api_url": "http://localhost:8222/test",
+			}, result)
+			message := <-logs
+			a.Equal(cluster.LogLevelError, message.Level)
+			a.Contains(message.Message, "got {")
+			if !persistent {
+				// A process per invocation, so its logs are tagged right away
+				a.Equal("invocation", message.InvocationID)
+			}
+		}
+
+		_, err = inst.Invoke(context.Background(), map[string]interface{}{})
+		a.EqualError(err, "Runtime error: empty event")
+		inst.Kill()
+	}
+
+	_, err := r.FunctionInstantiator(context.Background(), config.NewConfig(), "", "", sandbox.RunModeFunction, "NoCommand", nil, &definition.FunctionConfig{}, "", definition.LibraryMap{})
+	a.Error(err)
+}
+
+func TestExecSandboxJob(t *testing.T) {
+	a := assert.New(t)
+	r, _ := sandbox.LookupRuntime("exec")
+	logs := make(chan cluster.LogMessage, 10)
+	inst, err := r.JobInstantiator(context.Background(), config.NewConfig(), "http://%s:8222/test", "secret", "Job", func(funcName string, message cluster.LogMessage) {
+		logs <- message
+	}, &definition.JobConfig{
+		Command: []string{"sh", "-c", `trap 'echo stopping; exit 0' TERM; echo started; while true; do sleep 0.1; done`},
+	}, "", definition.LibraryMap{})
+	a.NoError(err)
+	a.NoError(inst.Start(context.Background()))
+	a.Equal("started", (<-logs).Message)
+
+	start := time.Now()
+	a.NoError(inst.Stop(context.Background()))
+	a.NoError(<-inst.DidExit())
+	a.Less(int64(time.Since(start)), int64(4*time.Second))
+}
+
+func TestExecSandboxJobStopsChildren(t *testing.T) {
+	a := assert.New(t)
+	r, _ := sandbox.LookupRuntime("exec")
+	logs := make(chan cluster.LogMessage, 10)
+	inst, err := r.JobInstantiator(context.Background(), config.NewConfig(), "http://%s:8222/test", "secret", "Job", func(funcName string, message cluster.LogMessage) {
+		logs <- message
+	}, &definition.JobConfig{
+		// The background sleep keeps stdout open, so the job is only done once it is stopped as well
+		Command: []string{"sh", "-c", `sleep 30 & echo started; wait`},
+	}, "", definition.LibraryMap{})
+	a.NoError(err)
+	a.NoError(inst.Start(context.Background()))
+	a.Equal("started", (<-logs).Message)
+
+	start := time.Now()
+	a.NoError(inst.Stop(context.Background()))
+	<-inst.DidExit()
+	a.Less(int64(time.Since(start)), int64(4*time.Second))
+}
+
+func TestExecRuntimeDisabled(t *testing.T) {
+	a := assert.New(t)
+	_, err := sandbox.NewJobExecutionWorker(config.NewConfig(), "", "", nil, "Job", &definition.JobConfig{
+		Runtime: "exec",
+		Command: []string{"true"},
+	}, "", definition.LibraryMap{})
+	if a.Error(err) {
+		a.Contains(err.Error(), "not available")
+	}
+}
@@ -3,6 +3,7 @@ package sandbox
 import (
 	"context"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"sync"
 	"time"
@@ -29,9 +30,18 @@ type FunctionExecutionWorker struct {
 
 	functionExecutionLock sync.Mutex
 	runningInstance       FunctionInstance
+	tagsInvocations       bool // Whether the running instance tags the log records of its invocations itself
 	invocationCount       int
+	invocationIDLock      sync.Mutex
+	currentInvocationID   string // Fallback for log records of runtimes that don't tag them with their invocation
+	stateLock             sync.Mutex
+	lastError             *cluster.ErrorInfo
 	libs                  definition.LibraryMap
+	ctx                   context.Context // Invocations are cancelled when the worker closes
 	cancelFn              context.CancelFunc
+	closed                bool
+	unsubscribeOnce       sync.Once
+	closeOnce             sync.Once
 }
 
 func NewFunctionExecutionWorker(
@@ -50,6 +60,7 @@ func NewFunctionExecutionWorker(
 		code:           code,
 		done:           make(chan struct{}),
 	}
+	fm.ctx, fm.cancelFn = context.WithCancel(context.Background())
 
 	if fm.subscription, err = ceb.SubscribeInvokeFunction(name, fm.invoke); err != nil {
 		return nil, err
@@ -70,7 +81,7 @@ func NewFunctionExecutionWorker(
 	}
 
 	if functionConfig.Hot {
-		if err := fm.warmup(context.Background()); err != nil {
+		if err := fm.warmup(fm.ctx); err != nil {
 			return nil, err
 		}
 	}
@@ -78,7 +89,10 @@ func NewFunctionExecutionWorker(
 	return fm, err
 }
 
-func (fm *FunctionExecutionWorker) log(funcName, message string) {
+func (fm *FunctionExecutionWorker) log(funcName string, message cluster.LogMessage) {
+	if message.InvocationID == "" {
+		message.InvocationID = fm.invocationID()
+	}
 	if err := fm.ceb.PublishLog(fm.name, message); err != nil {
 		log.Errorf("Error publishing log: %s", err)
 	}
@@ -96,32 +110,93 @@ func (fm *FunctionExecutionWorker) cleanupJob() {
 }
 
 func (fm *FunctionExecutionWorker) cleanup() {
+	fm.functionExecutionLock.Lock()
+	defer fm.functionExecutionLock.Unlock()
 	if fm.runningInstance == nil {
 		return
 	}
 	now := time.Now()
 	if fm.runningInstance.LastInvoked().Add(fm.config.SandboxFunctionKeepAlive).Before(now) {
-		log.Debugf("Killing function '%s'.", fm.runningInstance.Name())
-		fm.runningInstance.Kill()
+		inst := fm.runningInstance
+		log.Debugf("Killing function '%s'.", inst.Name())
 		fm.runningInstance = nil
+		inst.Kill()
 	}
 }
 
 var FunctionStoppedErr = errors.New("function stopped")
 
+type invocationIDKey struct{}
+
+// WithInvocationID attaches an invocation ID to ctx, runtimes pass it on to their instances to tag log records
+func WithInvocationID(ctx context.Context, invocationID string) context.Context {
+	return context.WithValue(ctx, invocationIDKey{}, invocationID)
+}
+
+// InvocationID returns the invocation ID attached to ctx, if any
+func InvocationID(ctx context.Context) string {
+	if id, ok := ctx.Value(invocationIDKey{}).(string); ok {
+		return id
+	}
+	return ""
+}
+
 func (fm *FunctionExecutionWorker) invoke(event interface{}) (interface{}, error) {
 	// One invoke at a time per worker
 	fm.functionExecutionLock.Lock()
 	defer fm.functionExecutionLock.Unlock()
-	var ctx context.Context
-	ctx, fm.cancelFn = context.WithCancel(context.Background())
+	if fm.closed {
+		return nil, FunctionStoppedErr
+	}
+	invocationID := uuid.NewString()
+	fm.setInvocationID(invocationID)
+	defer fm.setInvocationID("")
+	ctx := WithInvocationID(fm.ctx, invocationID)
 
 	if err := fm.warmup(ctx); err != nil {
+		fm.recordError(err)
 		return nil, err
 	}
+	if fm.tagsInvocations {
+		// Untagged output may come from a cancelled invocation the instance is still handling
+		fm.setInvocationID("")
+	}
 	//log.Infof("Now actually locally invoking %s", fm.name)
 	fm.invocationCount++
-	return fm.runningInstance.Invoke(ctx, event)
+	result, err := fm.runningInstance.Invoke(ctx, event)
+	if err != nil {
+		fm.recordError(err)
+	}
+	return result, err
+}
+
+// invocationID returns the ID of the invocation in progress, if any
+func (fm *FunctionExecutionWorker) invocationID() string {
+	fm.invocationIDLock.Lock()
+	defer fm.invocationIDLock.Unlock()
+	return fm.currentInvocationID
+}
+
+func (fm *FunctionExecutionWorker) setInvocationID(invocationID string) {
+	fm.invocationIDLock.Lock()
+	defer fm.invocationIDLock.Unlock()
+	fm.currentInvocationID = invocationID
+}
+
+func (fm *FunctionExecutionWorker) recordError(err error) {
+	fm.stateLock.Lock()
+	defer fm.stateLock.Unlock()
+	fm.lastError = &cluster.ErrorInfo{
+		Message: err.Error(),
+		Time:    time.Now(),
+	}
+}
+
+// LastError returns the last error an invocation of the worker failed with, or nil
+func (fm *FunctionExecutionWorker) LastError() *cluster.ErrorInfo {
+	fm.stateLock.Lock()
+	defer fm.stateLock.Unlock()
+	return fm.lastError
 }
 
 func (fm *FunctionExecutionWorker) warmup(ctx context.Context) error {
@@ -133,37 +208,82 @@ func (fm *FunctionExecutionWorker) warmup(ctx context.Context) error {
 			fm.functionConfig.Runtime = DefaultRuntime
 		}
 
-		builder, ok := runtimeFunctionInstantiators[fm.functionConfig.Runtime]
+		r, ok := LookupRuntime(fm.functionConfig.Runtime)
 		if !ok {
 			return fmt.Errorf("unsupported runtime: %s", fm.functionConfig.Runtime)
 		}
+		if !r.IsAvailable(fm.config) {
+			return fmt.Errorf("runtime %s is not available on this node", fm.functionConfig.Runtime)
+		}
 
-		inst, err = builder(ctx, fm.config, fm.apiURL, fm.apiToken, RunModeFunction, fm.name, fm.log, fm.functionConfig, fm.code, fm.libs)
+		inst, err = r.FunctionInstantiator(ctx, fm.config, fm.apiURL, fm.apiToken, RunModeFunction, fm.name, fm.log, fm.functionConfig, fm.code, fm.libs)
 
 		if err != nil {
 			return err
 		}
 		fm.runningInstance = inst
+		fm.tagsInvocations = r.Capabilities.ConcurrentInvocations
 
 		go func() {
-			<-inst.DidExit()
+			exitErr := <-inst.DidExit()
+			fm.functionExecutionLock.Lock()
+			killed := fm.runningInstance != inst
+			if !killed {
+				fm.runningInstance = nil
+			}
+			fm.functionExecutionLock.Unlock()
+			if killed {
+				// Killed on purpose
+				return
+			}
 			log.Info("Process exited, resetting running instance")
-			fm.runningInstance = nil
+			crashEvent := map[string]interface{}{
+				"function": fm.name,
+			}
+			if exitErr != nil {
+				crashEvent["error"] = exitErr.Error()
+			}
+			if err := fm.ceb.PublishEvent(definition.EventFunctionCrashed, crashEvent); err != nil {
+				log.Errorf("Could not publish %s event: %s", definition.EventFunctionCrashed, err)
+			}
 		}()
 	}
 	return nil
 }
 
+// Drain stops accepting new invocations, waits for the in-flight invocation (if any) to finish and then closes the worker
+func (fm *FunctionExecutionWorker) Drain() {
+	fm.unsubscribe()
+	fm.functionExecutionLock.Lock()
+	fm.functionExecutionLock.Unlock()
+	fm.Close()
+}
+
+func (fm *FunctionExecutionWorker) unsubscribe() {
+	fm.unsubscribeOnce.Do(func() {
+		if fm.subscription == nil {
+			return
+		}
+		if err := fm.subscription.Unsubscribe(); err != nil {
+			log.Errorf("Could not unsubscribe function %s: %s", fm.name, err)
+		}
+	})
+}
+
+// Close stops the worker right away, it may be called more than once (e.g. by a drain and a flush)
 func (fm *FunctionExecutionWorker) Close() {
+	fm.closeOnce.Do(fm.shutdown)
+}
+
+func (fm *FunctionExecutionWorker) shutdown() {
 	//log.Errorf("Closing worker %s", fm.name)
-	if fm.cancelFn != nil {
-		fm.cancelFn()
-	}
+	fm.cancelFn()
+	fm.functionExecutionLock.Lock()
+	defer fm.functionExecutionLock.Unlock()
+	fm.closed = true
 
 	// Unsubscribe from queue
-	if err := fm.subscription.Unsubscribe(); err != nil {
-		log.Errorf("Could not unsubscribe function %s: %s", fm.name, err)
-	}
+	fm.unsubscribe()
 
 	// Close the cleanup ticker
 	if fm.ticker != nil {
@@ -173,7 +293,8 @@ func (fm *FunctionExecutionWorker) Close() {
 
 	// Stop running instance if any
 	if fm.runningInstance != nil {
-		fm.runningInstance.Kill()
+		inst := fm.runningInstance
 		fm.runningInstance = nil
+		inst.Kill()
 	}
 }
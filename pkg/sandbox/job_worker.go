@@ -8,14 +8,24 @@ import (
 	"github.com/zefhemel/matterless/pkg/cluster"
 	"github.com/zefhemel/matterless/pkg/config"
 	"github.com/zefhemel/matterless/pkg/definition"
+	"os/exec"
+	"strings"
 	"sync"
+	"time"
 )
 
+// Number of stderr lines to keep around to ship along with job exit notifications
+const jobStderrTailSize = 20
+
+// A job that has been running for at least this long is considered stable, resetting its consecutive restart count
+const jobStableRunTime = time.Minute
+
 type JobExecutionWorker struct {
 	apiURL   string
 	apiToken string
 	config   *config.Config
 	done     chan struct{}
+	doneOnce sync.Once
 
 	ceb *cluster.ClusterEventBus
 
@@ -26,6 +36,14 @@ type JobExecutionWorker struct {
 	functionExecutionLock sync.Mutex
 	runningInstance       JobInstance
 	libs                  definition.LibraryMap
+
+	stateLock           sync.Mutex
+	state               cluster.JobState
+	startedAt           time.Time
+	restarts            int
+	consecutiveRestarts int
+	exits               int
+	stderrTail          []string
 }
 
 func NewJobExecutionWorker(
@@ -35,15 +53,16 @@ func NewJobExecutionWorker(
 	var err error
 
 	ew := &JobExecutionWorker{
-		config:    cfg,
-		ceb:       ceb,
-		apiURL:    apiURL,
-		apiToken:  apiToken,
-		name:      name,
-		jobConfig: jobConfig,
-		code:      code,
-		libs:      libs,
-		done:      make(chan struct{}, 1),
+		config:     cfg,
+		ceb:        ceb,
+		apiURL:     apiURL,
+		apiToken:   apiToken,
+		name:       name,
+		jobConfig:  jobConfig,
+		code:       code,
+		libs:       libs,
+		done:       make(chan struct{}),
+		stderrTail: []string{},
 	}
 
 	if err := ew.start(); err != nil {
@@ -53,10 +72,23 @@ func NewJobExecutionWorker(
 	return ew, err
 }
 
-func (ew *JobExecutionWorker) log(funcName, message string) {
-	ew.ceb.PublishLog(ew.name, message)
+func (ew *JobExecutionWorker) log(funcName string, message cluster.LogMessage) {
+	if message.Level == cluster.LogLevelError {
+		ew.stateLock.Lock()
+		ew.stderrTail = append(ew.stderrTail, strings.Split(message.Message, "\n")...)
+		if len(ew.stderrTail) > jobStderrTailSize {
+			ew.stderrTail = ew.stderrTail[len(ew.stderrTail)-jobStderrTailSize:]
+		}
+		ew.stateLock.Unlock()
+	}
+	if err := ew.ceb.PublishLog(ew.name, message); err != nil {
+		log.Errorf("Error publishing log: %s", err)
+	}
 }
 
+// errJobWorkerClosed is returned when starting a job whose worker was closed in the mean time
+var errJobWorkerClosed = errors.New("job worker closed")
+
 func (ew *JobExecutionWorker) start() error {
 	var (
 		err error
@@ -68,6 +100,13 @@ func (ew *JobExecutionWorker) start() error {
 	ew.functionExecutionLock.Lock()
 	defer ew.functionExecutionLock.Unlock()
 
+	// Close may have run while waiting for a restart, it would not have seen a running instance to stop
+	select {
+	case <-ew.done:
+		return errJobWorkerClosed
+	default:
+	}
+
 	if ew.runningInstance != nil {
 		return errors.New("job already running")
 	}
@@ -76,37 +115,151 @@ func (ew *JobExecutionWorker) start() error {
 		ew.jobConfig.Runtime = DefaultRuntime
 	}
 
-	builder, ok := runtimeJobInstantiators[ew.jobConfig.Runtime]
+	r, ok := LookupRuntime(ew.jobConfig.Runtime)
 	if !ok {
 		return fmt.Errorf("unsupported runtime: %s", ew.jobConfig.Runtime)
 	}
+	if !r.IsAvailable(ew.config) {
+		return fmt.Errorf("runtime %s is not available on this node", ew.jobConfig.Runtime)
+	}
+	if r.JobInstantiator == nil {
+		return fmt.Errorf("runtime %s does not support jobs", ew.jobConfig.Runtime)
+	}
 
-	ew.runningInstance, err = builder(ctx, ew.config, ew.apiURL, ew.apiToken, ew.name, ew.log, ew.jobConfig, ew.code, ew.libs)
+	inst, err := r.JobInstantiator(ctx, ew.config, ew.apiURL, ew.apiToken, ew.name, ew.log, ew.jobConfig, ew.code, ew.libs)
 
 	if err != nil {
 		return err
 	}
 
-	go func() {
-		select {
-		case <-ew.done:
+	ew.stateLock.Lock()
+	ew.startedAt = time.Now()
+	ew.stderrTail = []string{}
+	ew.stateLock.Unlock()
+
+	if err := inst.Start(ctx); err != nil {
+		// Not monitored yet, so this exit is only handled by whoever restarts the job
+		stopCtx, cancel := context.WithTimeout(context.Background(), ew.config.SandboxJobStopTimeout)
+		defer cancel()
+		if err := inst.Stop(stopCtx); err != nil {
+			log.Errorf("Could not stop job %s that failed to start: %s", ew.name, err)
+		}
+		return err
+	}
+	ew.runningInstance = inst
+
+	ew.stateLock.Lock()
+	ew.state = cluster.JobStateRunning
+	ew.stateLock.Unlock()
+
+	go ew.monitor(inst)
+
+	return nil
+}
+
+// monitor waits for the job instance to exit, and if it wasn't asked to, handles the exit
+func (ew *JobExecutionWorker) monitor(inst JobInstance) {
+	select {
+	case <-ew.done:
+		return
+	case exitErr := <-inst.DidExit():
+		log.Infof("Job process exited")
+		ew.handleExit(exitErr)
+	}
+}
+
+func (ew *JobExecutionWorker) handleExit(exitErr error) {
+	policy := ew.jobConfig.RestartPolicy()
+	exitCode := exitCodeFromError(exitErr)
+
+	ew.functionExecutionLock.Lock()
+	ew.runningInstance = nil
+	ew.functionExecutionLock.Unlock()
+
+	ew.stateLock.Lock()
+	ew.exits++
+	if time.Since(ew.startedAt) >= jobStableRunTime {
+		ew.consecutiveRestarts = 0
+	}
+	restart := policy.ShouldRestart(exitCode)
+	switch {
+	case !restart:
+		ew.state = cluster.JobStateExited
+	case ew.consecutiveRestarts >= policy.MaxRestartCount():
+		ew.state = cluster.JobStateCrashLoop
+		restart = false
+	default:
+		ew.state = cluster.JobStateRestarting
+	}
+	backoff := policy.BackoffFor(ew.consecutiveRestarts)
+	jobExit := cluster.JobExit{
+		Name:     ew.name,
+		ExitCode: exitCode,
+		Stderr:   ew.stderrTail,
+		Restarts: ew.restarts,
+		State:    ew.state,
+	}
+	ew.stateLock.Unlock()
+
+	// Let the leader know
+	if err := ew.ceb.PublishJobExited(jobExit); err != nil {
+		log.Errorf("Could not publish job exit: %s", err)
+	}
+
+	if !restart {
+		log.Infof("Not restarting job %s (%s)", ew.name, jobExit.State)
+		return
+	}
+
+	log.Infof("Restarting job %s in %s", ew.name, backoff)
+	select {
+	case <-ew.done:
+		return
+	case <-time.After(backoff):
+	}
+
+	ew.stateLock.Lock()
+	ew.restarts++
+	ew.consecutiveRestarts++
+	ew.stateLock.Unlock()
+
+	if err := ew.start(); err != nil {
+		if err == errJobWorkerClosed {
 			return
-		case <-ew.runningInstance.DidExit():
-			log.Infof("Job process exited")
-			ew.runningInstance = nil
-			close(ew.done)
 		}
-	}()
+		log.Errorf("Could not restart job %s: %s", ew.name, err)
+		ew.handleExit(err)
+	}
+}
 
-	return ew.runningInstance.Start(ctx)
+func exitCodeFromError(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// State returns the current state of the worker, along with its number of restarts and exits
+func (ew *JobExecutionWorker) State() (state cluster.JobState, restarts int, exits int) {
+	ew.stateLock.Lock()
+	defer ew.stateLock.Unlock()
+	return ew.state, ew.restarts, ew.exits
 }
 
 func (ew *JobExecutionWorker) Close() error {
+	ew.doneOnce.Do(func() {
+		close(ew.done)
+	})
+	ew.functionExecutionLock.Lock()
+	defer ew.functionExecutionLock.Unlock()
 	if ew.runningInstance == nil {
-		// Already closed
+		// Already closed, or not running
 		return nil
 	}
-	close(ew.done)
 	ctx, cancel := context.WithTimeout(context.Background(), ew.config.SandboxJobStopTimeout)
 	defer cancel()
 	if err := ew.runningInstance.Stop(ctx); err != nil {
@@ -0,0 +1,214 @@
+package sandbox
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/definition"
+	"github.com/zefhemel/matterless/pkg/util"
+)
+
+// The python runtime runs the system's python3
+const pythonBinary = "python3"
+
+// ======= Function ============
+type pythonFunctionInstance struct {
+	name         string
+	cmd          *exec.Cmd
+	lastInvoked  invocationTime
+	rpc          *rpcChannel
+	tempDir      string
+	pythonExited chan error
+}
+
+var _ FunctionInstance = &pythonFunctionInstance{}
+
+func (inst *pythonFunctionInstance) Name() string {
+	return inst.name
+}
+
+func (inst *pythonFunctionInstance) LastInvoked() time.Time {
+	return inst.lastInvoked.get()
+}
+
+func (inst *pythonFunctionInstance) DidExit() chan error {
+	return inst.pythonExited
+}
+
+// All these files will be copied into the function directory python is run in, along with the function and libraries
+//
+//go:embed python/*.py
+var pythonFiles embed.FS
+
+func copyPythonFiles(destDir string) error {
+	dirEntries, _ := pythonFiles.ReadDir("python")
+	for _, file := range dirEntries {
+		buf, err := pythonFiles.ReadFile(fmt.Sprintf("python/%s", file.Name()))
+		if err != nil {
+			return errors.Wrap(err, "read file")
+		}
+		if err := os.WriteFile(fmt.Sprintf("%s/%s", destDir, file.Name()), buf, 0600); err != nil {
+			return errors.Wrap(err, "write file")
+		}
+	}
+	return nil
+}
+
+// pythonModuleFilename turns a library name into the filename of the module it can be imported as
+func pythonModuleFilename(libName definition.FunctionID) string {
+	filename := util.SafeFilename(string(libName))
+	if !strings.HasSuffix(filename, ".py") {
+		filename = filename + ".py"
+	}
+	return filename
+}
+
+func newPythonFunctionInstance(ctx context.Context, config *config.Config, apiURL string, apiToken string, runMode RunMode, name string, logCallback LogCallback, functionConfig *definition.FunctionConfig, code string, libs definition.LibraryMap) (FunctionInstance, error) {
+	inst := &pythonFunctionInstance{
+		name: name,
+	}
+
+	runModeString := "function"
+	if runMode == RunModeJob {
+		runModeString = "job"
+	}
+
+	// Create python project for function, libraries are importable modules next to it
+	// Every instance gets its own directory, as it is removed when the instance is killed
+	pythonParentDir := fmt.Sprintf("%s/.python", config.DataDir)
+	if err := os.MkdirAll(pythonParentDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create python dir")
+	}
+	pythonDir, err := os.MkdirTemp(pythonParentDir, fmt.Sprintf("%s-%s-", runModeString, newFunctionHash(name, code)))
+	if err != nil {
+		return nil, errors.Wrap(err, "create python dir")
+	}
+	inst.tempDir = pythonDir
+
+	// If we don't boot successfully, clean up again
+	everythingOk := false
+	defer func() {
+		if !everythingOk {
+			os.RemoveAll(pythonDir)
+		}
+	}()
+
+	if err := copyPythonFiles(pythonDir); err != nil {
+		return nil, errors.Wrap(err, "copy python files")
+	}
+	if err := os.WriteFile(fmt.Sprintf("%s/function.py", pythonDir), []byte(code), 0600); err != nil {
+		return nil, errors.Wrap(err, "write python function file")
+	}
+	for libName, libDef := range librariesForRuntime(libs, "python") {
+		if err := os.WriteFile(fmt.Sprintf("%s/%s", pythonDir, pythonModuleFilename(libName)), []byte(libDef.Code), 0600); err != nil {
+			return nil, errors.Wrap(err, "write python library file")
+		}
+	}
+
+	// Requests are sent over stdin, see rpc.go
+	inst.cmd = exec.Command(pythonBinary, "-u", fmt.Sprintf("%s/%s_server.py", pythonDir, runModeString))
+	inst.cmd.Dir = pythonDir
+
+	// Don't propagate Ctrl-c to children
+	inst.cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+	inst.cmd.Env = append(os.Environ(),
+		"PYTHONDONTWRITEBYTECODE=1",
+		fmt.Sprintf("PYTHONPATH=%s", pythonDir),
+		fmt.Sprintf("INIT_CONFIG=%s", util.MustJsonString(functionConfig.Init)),
+		fmt.Sprintf("API_URL=%s", fmt.Sprintf(apiURL, "localhost")),
+		fmt.Sprintf("API_TOKEN=%s", apiToken))
+
+	// Buffered to prevent go-routine leak (we don't care for the result after initial start-up)
+	inst.pythonExited = make(chan error, 1)
+
+	// If we don't boot successfully, kill the process again
+	defer func() {
+		if !everythingOk && inst.cmd.Process != nil {
+			log.Info("Hard killing python process because of error")
+			inst.Kill()
+		}
+	}()
+
+	if inst.rpc, err = startRPCProcess(ctx, inst.cmd, name, logCallback, inst.pythonExited); err != nil {
+		return nil, errors.Wrap(err, "python run")
+	}
+
+	everythingOk = true
+
+	return inst, nil
+}
+
+func (inst *pythonFunctionInstance) Kill() {
+	if inst.cmd.Process != nil {
+		inst.cmd.Process.Kill()
+	}
+
+	if err := os.RemoveAll(inst.tempDir); err != nil {
+		log.Errorf("Could not delete directory %s: %s", inst.tempDir, err)
+	}
+}
+
+// Invoke calls the function over the RPC channel
+func (inst *pythonFunctionInstance) Invoke(ctx context.Context, event interface{}) (interface{}, error) {
+	inst.lastInvoked.touch()
+
+	resultJSON, err := inst.rpc.Call(ctx, "invoke", rpcInvokeParams{
+		Event:        event,
+		InvocationID: InvocationID(ctx),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result interface{}
+	if err := json.Unmarshal(resultJSON, &result); err != nil {
+		return nil, errors.Wrap(err, "unmarshall response")
+	}
+	return result, nil
+}
+
+// ======= Jobs ============
+
+type pythonJobInstance struct {
+	*pythonFunctionInstance
+}
+
+var _ JobInstance = &pythonJobInstance{}
+
+func newPythonJobInstance(ctx context.Context, config *config.Config, apiURL string, apiToken string, name string, logCallback LogCallback, jobConfig *definition.JobConfig, code string, libs definition.LibraryMap) (JobInstance, error) {
+	functionInstance, err := newPythonFunctionInstance(ctx, config, apiURL, apiToken, RunModeJob, name, logCallback, &definition.FunctionConfig{
+		Init:      jobConfig.Init,
+		Runtime:   jobConfig.Runtime,
+		Instances: jobConfig.Instances,
+	}, code, libs)
+	if err != nil {
+		return nil, err
+	}
+	return &pythonJobInstance{pythonFunctionInstance: functionInstance.(*pythonFunctionInstance)}, nil
+}
+
+func (inst *pythonJobInstance) Start(ctx context.Context) error {
+	_, err := inst.rpc.Call(ctx, "start", nil)
+	return err
+}
+
+func (inst *pythonJobInstance) Stop(ctx context.Context) error {
+	defer inst.Kill()
+	_, err := inst.rpc.Call(ctx, "stop", nil)
+	if err == ProcessExitedError {
+		// Exiting is what we asked for
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,21 @@
+# Runs function.py as a function: every invoke request calls handle() with the event
+import matterless
+import rpc
+import server_util
+
+
+def invoke(params):
+    matterless.set_invocation_id(params.get("invocation_id"))
+    try:
+        return server_util.call("handle", params.get("event"))
+    finally:
+        matterless.set_invocation_id(None)
+
+
+if __name__ == "__main__":
+    # Invocations are handled concurrently, each in a thread of its own, so printed lines are tagged per thread
+    rpc.format_line = matterless.tag_line
+    print("Starting python function runtime.", flush=True)
+    server_util.init()
+    rpc.notify("ready")
+    rpc.serve({"invoke": invoke})
@@ -0,0 +1,41 @@
+# Runs function.py as a job: start calls start() and kicks off run() in the background, stop calls stop() and exits
+import os
+import sys
+import threading
+import traceback
+
+import rpc
+import server_util
+
+
+def run():
+    try:
+        server_util.call("run")
+    except Exception:
+        traceback.print_exc()
+
+
+def start(params):
+    result = server_util.call("start")
+    threading.Thread(target=run, daemon=True).start()
+    return result
+
+
+def stop(params):
+    result = server_util.call("stop")
+
+    # Exit once the response has been sent
+    def exit_soon():
+        sys.stdout.flush()
+        sys.stderr.flush()
+        os._exit(0)
+
+    threading.Timer(0.1, exit_soon).start()
+    return result
+
+
+if __name__ == "__main__":
+    print("Starting python job runtime.", flush=True)
+    server_util.init()
+    rpc.notify("ready")
+    rpc.serve({"start": start, "stop": stop})
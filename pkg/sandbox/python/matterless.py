@@ -0,0 +1,137 @@
+# Client for the Matterless APIs, the Python equivalent of matterless.ts
+import json
+import os
+import sys
+import threading
+import urllib.parse
+import urllib.request
+
+# Lines prefixed with this (ASCII record separator) character contain a JSON encoded structured log record
+_RECORD_SEPARATOR = "\x1e"
+
+# Invocations are handled in threads of their own
+_invocation = threading.local()
+
+
+def set_invocation_id(invocation_id):
+    _invocation.id = invocation_id or None
+
+
+def tag_line(line):
+    """Turns a printed line into a log record tagged with the invocation the printing thread handles, if any"""
+    invocation_id = getattr(_invocation, "id", None)
+    if invocation_id is None or line.startswith(_RECORD_SEPARATOR):
+        return line
+    return _RECORD_SEPARATOR + json.dumps({"level": "info", "message": line.rstrip("\n"),
+                                           "invocation_id": invocation_id}) + "\n"
+
+
+class MatterlessError(Exception):
+    pass
+
+
+class API:
+    def __init__(self, url, token):
+        self.url = url
+        self.token = token
+
+    def request(self, path, body):
+        req = urllib.request.Request(
+            self.url + path,
+            data=json.dumps(body if body is not None else {}).encode("utf-8"),
+            method="POST",
+            headers={
+                "Content-Type": "application/json",
+                "Authorization": "bearer %s" % self.token,
+            },
+        )
+        try:
+            with urllib.request.urlopen(req) as resp:
+                result = json.loads(resp.read() or b"null")
+        except urllib.error.HTTPError as e:
+            raise MatterlessError("HTTP request not ok: %s" % e.read().decode("utf-8", "replace"))
+        if isinstance(result, dict) and result.get("status") == "error":
+            raise MatterlessError(result.get("error"))
+        return result
+
+
+class Store:
+    def __init__(self, api):
+        self.api = api
+
+    def get(self, key):
+        return self.perform_op("get", key).get("value")
+
+    def put(self, key, value):
+        self.perform_op("put", key, value)
+
+    def delete(self, key):
+        self.perform_op("del", key)
+
+    def query_prefix(self, prefix):
+        return self.perform_op("query-prefix", prefix).get("results") or []
+
+    def perform_op(self, *args):
+        result = self.api.request("/_store", [list(args)])[0]
+        if result.get("status") == "error":
+            raise MatterlessError(result.get("error"))
+        return result
+
+
+class Events:
+    def __init__(self, api):
+        self.api = api
+
+    def publish(self, event_name, event_data=None):
+        self.api.request("/_event/%s" % urllib.parse.quote(event_name, safe=""), event_data)
+
+
+class Functions:
+    def __init__(self, api):
+        self.api = api
+
+    def invoke(self, name, event_data=None):
+        return self.api.request("/_function/%s" % urllib.parse.quote(name, safe=""), event_data)
+
+
+class Application:
+    def __init__(self, api):
+        self.api = api
+
+    def restart(self):
+        req = urllib.request.Request(self.api.url + "/_restart", method="POST",
+                                     headers={"Authorization": "bearer %s" % self.api.token})
+        urllib.request.urlopen(req).close()
+
+
+class Logger:
+    def log(self, level, message, fields=None):
+        record = {
+            "level": level,
+            "message": message,
+            "fields": fields,
+            "invocation_id": getattr(_invocation, "id", None),
+        }
+        out = sys.stderr if level in ("warn", "error") else sys.stdout
+        out.write(_RECORD_SEPARATOR + json.dumps(record) + "\n")
+        out.flush()
+
+    def debug(self, message, fields=None):
+        self.log("debug", message, fields)
+
+    def info(self, message, fields=None):
+        self.log("info", message, fields)
+
+    def warn(self, message, fields=None):
+        self.log("warn", message, fields)
+
+    def error(self, message, fields=None):
+        self.log("error", message, fields)
+
+
+default_api = API(os.environ.get("API_URL", ""), os.environ.get("API_TOKEN", ""))
+store = Store(default_api)
+events = Events(default_api)
+functions = Functions(default_api)
+application = Application(default_api)
+logger = Logger()
@@ -0,0 +1,118 @@
+# JSON-RPC 2.0 over stdin and stdout, the Python equivalent of rpc.ts: requests are read from stdin one per line,
+# responses and notifications are written to stdout one per line, prefixed with an ASCII group separator so the
+# runtime can tell them apart from other output
+import io
+import json
+import sys
+import threading
+import traceback
+
+_FRAME_PREFIX = "\x1d"
+
+_write_lock = threading.Lock()
+_stdout = sys.stdout
+
+
+# Turns a line written to stdout into what's written instead, e.g. a log record tagged with the invocation the writing
+# thread handles, when set
+format_line = None
+
+
+class _LineWriter(io.TextIOBase):
+    """Replaces stdout, only writing whole lines so that other output never ends up in the middle of a frame. Every
+    thread has its own buffer, so lines printed by concurrently handled requests don't get mixed up"""
+
+    def __init__(self):
+        self._local = threading.local()
+
+    def writable(self):
+        return True
+
+    def _write_line(self, line):
+        _stdout.write(format_line(line) if format_line else line)
+
+    def write(self, s):
+        # Not splitlines(), that also splits on the record and group separators
+        lines = (getattr(self._local, "buffered", "") + s).split("\n")
+        self._local.buffered = lines.pop()
+        if lines:
+            with _write_lock:
+                for line in lines:
+                    self._write_line(line + "\n")
+                _stdout.flush()
+        return len(s)
+
+    def flush(self):
+        buffered = getattr(self._local, "buffered", "")
+        self._local.buffered = ""
+        with _write_lock:
+            if buffered:
+                self._write_line(buffered + "\n")
+            _stdout.flush()
+
+
+sys.stdout = _LineWriter()
+
+
+def _write_frame(message):
+    with _write_lock:
+        _stdout.write(_FRAME_PREFIX + json.dumps(message) + "\n")
+        _stdout.flush()
+
+
+def _error_object(e):
+    return {
+        "code": -32000,
+        "message": str(e),
+        "data": {
+            "message": str(e),
+            "stack": "".join(traceback.format_exception(type(e), e, e.__traceback__)),
+        },
+    }
+
+
+def notify(method, params=None):
+    _write_frame({"jsonrpc": "2.0", "method": method, "params": params})
+
+
+def respond(request_id, result):
+    _write_frame({"jsonrpc": "2.0", "id": request_id, "result": result if result is not None else {}})
+
+
+def serve(handlers):
+    """Handles requests, each in a thread of its own, until stdin is closed. Python threads can't be interrupted, so
+    a cancel notification only drops the response of the request it refers to"""
+    cancelled = set()
+    cancelled_lock = threading.Lock()
+
+    def handle(request_id, handler, params):
+        try:
+            result = handler(params)
+            message = {"jsonrpc": "2.0", "id": request_id, "result": result if result is not None else {}}
+        except Exception as e:
+            message = {"jsonrpc": "2.0", "id": request_id, "error": _error_object(e)}
+        with cancelled_lock:
+            if request_id in cancelled:
+                cancelled.discard(request_id)
+                return
+        _write_frame(message)
+
+    for line in sys.stdin:
+        if not line.strip():
+            continue
+        try:
+            message = json.loads(line)
+        except ValueError:
+            _write_frame({"jsonrpc": "2.0", "id": None, "error": {"code": -32700, "message": "Parse error"}})
+            continue
+        if message.get("method") == "cancel":
+            with cancelled_lock:
+                cancelled.add((message.get("params") or {}).get("id"))
+            continue
+        request_id = message.get("id")
+        handler = handlers.get(message.get("method"))
+        if handler is None:
+            _write_frame({"jsonrpc": "2.0", "id": request_id,
+                          "error": {"code": -32601, "message": "Method not found: %s" % message.get("method")}})
+            continue
+        threading.Thread(target=handle, args=(request_id, handler, message.get("params")), daemon=True).start()
@@ -0,0 +1,23 @@
+# Shared helpers of the function and job servers
+import asyncio
+import inspect
+import json
+import os
+
+import function
+
+
+def call(name, *args):
+    """Calls the function's callback with the given name if it's defined, awaiting coroutines"""
+    fn = getattr(function, name, None)
+    if fn is None:
+        return None
+    result = fn(*args)
+    if inspect.isawaitable(result):
+        result = asyncio.run(result)
+    return result
+
+
+def init():
+    config = json.loads(os.environ.get("INIT_CONFIG") or "null")
+    call("init", config)
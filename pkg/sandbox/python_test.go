@@ -0,0 +1,195 @@
+package sandbox_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/definition"
+	"github.com/zefhemel/matterless/pkg/sandbox"
+)
+
+func TestPythonSandboxFunction(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available")
+	}
+	a := assert.New(t)
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+
+	// Fake API to serve the store calls
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.Equal("/_store", r.URL.Path)
+		a.Equal("bearer secret", r.Header.Get("Authorization"))
+		var ops [][]interface{}
+		a.NoError(json.NewDecoder(r.Body).Decode(&ops))
+		w.Write([]byte(`[{"status": "ok", "value": "hello"}]`))
+	}))
+	defer apiServer.Close()
+
+	defs, err := definition.Parse(strings.ReplaceAll(`# library greeting
+|||yaml
+runtime: python
+|||
+|||python
+def greet(greeting, name):
+    return "%s %s" % (greeting, name)
+|||
+
+# function Greet
+|||yaml
+runtime: python
+init:
+  punctuation: "!"
+|||
+|||python
+from matterless import store, logger
+from greeting import greet
+
+def init(config):
+    global punctuation
+    punctuation = config["punctuation"]
+
+async def handle(event):
+    logger.info("Greeting", {"name": event["name"]})
+    if event["name"] == "nobody":
+        raise ValueError("nobody to greet")
+    return {"greeting": greet(store.get("greeting"), event["name"]) + punctuation}
+|||
+`, "|||", "```"))
+	a.NoError(err)
+	a.NoError(sandbox.ValidateDefinitions(defs))
+	fn := defs.Functions["Greet"]
+
+	r, ok := sandbox.LookupRuntime("python")
+	a.True(ok)
+	logs := make(chan cluster.LogMessage, 10)
+	inst, err := r.FunctionInstantiator(context.Background(), cfg, strings.Replace(apiServer.URL, "127.0.0.1", "%s", 1), "secret", sandbox.RunModeFunction, "Greet", func(funcName string, message cluster.LogMessage) {
+		logs <- message
+	}, fn.Config, fn.Code, defs.Libraries)
+	a.NoError(err)
+	defer inst.Kill()
+
+	result, err := inst.Invoke(sandbox.WithInvocationID(context.Background(), "abc"), map[string]interface{}{"name": "Zef"})
+	a.NoError(err)
+	a.Equal(map[string]interface{}{"greeting": "hello Zef!"}, result)
+
+	_, err = inst.Invoke(context.Background(), map[string]interface{}{"name": "nobody"})
+	a.Error(err)
+	a.Contains(err.Error(), "nobody to greet")
+
+	message := waitForLog(t, logs, "Greeting")
+	a.Equal("abc", message.InvocationID)
+	a.Equal("Zef", message.Fields["name"])
+
+	// Jobs run run() in the background after start() and exit when stopped
+	jobInst, err := r.JobInstantiator(context.Background(), cfg, strings.Replace(apiServer.URL, "127.0.0.1", "%s", 1), "secret", "Job", func(funcName string, message cluster.LogMessage) {
+		logs <- message
+	}, &definition.JobConfig{Runtime: "python"}, "import time\n\ndef run():\n    print('running')\n    time.sleep(60)\n", definition.LibraryMap{})
+	a.NoError(err)
+	a.NoError(jobInst.Start(context.Background()))
+	waitForLog(t, logs, "running")
+	a.NoError(jobInst.Stop(context.Background()))
+	select {
+	case <-jobInst.DidExit():
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not exit")
+	}
+}
+
+// waitForLog waits for a log message with the given text to be received, any message when text is empty
+func waitForLog(t *testing.T, logs chan cluster.LogMessage, text string) cluster.LogMessage {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message := <-logs:
+			if text == "" || message.Message == text {
+				return message
+			}
+		case <-timeout:
+			t.Fatalf("log message %q not received", text)
+		}
+	}
+}
+
+func TestPythonSandboxConcurrentInvocations(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available")
+	}
+	a := assert.New(t)
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+
+	r, ok := sandbox.LookupRuntime("python")
+	a.True(ok)
+	logs := make(chan cluster.LogMessage, 10)
+	inst, err := r.FunctionInstantiator(context.Background(), cfg, "http://%s", "", sandbox.RunModeFunction, "Slow", func(funcName string, message cluster.LogMessage) {
+		logs <- message
+	}, &definition.FunctionConfig{Runtime: "python"}, "import time\n\ndef handle(event):\n    print('handling %d' % event['n'])\n    time.sleep(0.5)\n    return event['n']\n", definition.LibraryMap{})
+	a.NoError(err)
+	defer inst.Kill()
+
+	// Overlapping invocations are handled at the same time
+	start := time.Now()
+	results := make(chan interface{}, 2)
+	for n := 1; n <= 2; n++ {
+		go func(n int) {
+			result, err := inst.Invoke(sandbox.WithInvocationID(context.Background(), fmt.Sprintf("call-%d", n)), map[string]interface{}{"n": n})
+			a.NoError(err)
+			results <- result
+		}(n)
+	}
+	a.ElementsMatch([]interface{}{float64(1), float64(2)}, []interface{}{<-results, <-results})
+	a.Less(time.Since(start), 900*time.Millisecond)
+
+	// Printed lines are tagged with the invocation printing them
+	invocationIDs := map[string]string{}
+	for len(invocationIDs) < 2 {
+		if message := waitForLog(t, logs, ""); strings.HasPrefix(message.Message, "handling") {
+			invocationIDs[message.Message] = message.InvocationID
+		}
+	}
+	a.Equal(map[string]string{"handling 1": "call-1", "handling 2": "call-2"}, invocationIDs)
+}
+
+func TestPythonSandboxInstancesOfSameCode(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available")
+	}
+	a := assert.New(t)
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+
+	r, ok := sandbox.LookupRuntime("python")
+	a.True(ok)
+	code := "def handle(event):\n    return event\n"
+	logCallback := func(funcName string, message cluster.LogMessage) {}
+	first, err := r.FunctionInstantiator(context.Background(), cfg, "http://%s", "", sandbox.RunModeFunction, "Echo", logCallback, &definition.FunctionConfig{Runtime: "python"}, code, definition.LibraryMap{})
+	a.NoError(err)
+	second, err := r.FunctionInstantiator(context.Background(), cfg, "http://%s", "", sandbox.RunModeFunction, "Echo", logCallback, &definition.FunctionConfig{Runtime: "python"}, code, definition.LibraryMap{})
+	a.NoError(err)
+	defer second.Kill()
+	dirs, err := os.ReadDir(filepath.Join(cfg.DataDir, ".python"))
+	a.NoError(err)
+	a.Len(dirs, 2)
+
+	// Killing one instance leaves the files of the other alone
+	first.Kill()
+	dirs, err = os.ReadDir(filepath.Join(cfg.DataDir, ".python"))
+	a.NoError(err)
+	a.Len(dirs, 1)
+	result, err := second.Invoke(context.Background(), map[string]interface{}{"n": 1})
+	a.NoError(err)
+	a.Equal(map[string]interface{}{"n": float64(1)}, result)
+}
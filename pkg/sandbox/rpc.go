@@ -0,0 +1,273 @@
+package sandbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zefhemel/matterless/pkg/cluster"
+)
+
+// The deno and python runtimes talk JSON-RPC 2.0 with their process over stdin and stdout: requests are written to stdin one per
+// line, responses and notifications are written to stdout one per line prefixed with this (ASCII group separator)
+// character, so they can be told apart from other output, which is logged
+const rpcFramePrefix = "\x1d"
+
+// Notification sent by the process once it has initialized and is ready to handle requests
+const rpcReadyNotification = "ready"
+
+// Notification sent to the process to cancel a request it is still handling
+const rpcCancelNotification = "cancel"
+
+// rpcInvokeParams are the params of the invoke call of function runtimes
+type rpcInvokeParams struct {
+	Event        interface{} `json:"event"`
+	InvocationID string      `json:"invocation_id"`
+}
+
+type rpcRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      *int64      `json:"id,omitempty"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+// rpcMessage is a response or notification received from the process
+type rpcMessage struct {
+	ID     *int64          `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+type rpcError struct {
+	Code    int      `json:"code"`
+	Message string   `json:"message"`
+	Data    *jsError `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string {
+	if e.Data != nil {
+		return fmt.Sprintf("Runtime error: %s\n%s", e.Message, e.Data.Stack)
+	}
+	return fmt.Sprintf("Runtime error: %s", e.Message)
+}
+
+// rpcChannel multiplexes concurrent calls over a single JSON-RPC connection to a process
+type rpcChannel struct {
+	writer    io.Writer
+	writeLock sync.Mutex
+	nextID    int64
+
+	pendingLock sync.Mutex
+	pending     map[int64]chan *rpcMessage
+
+	ready     chan struct{}
+	readyOnce sync.Once
+	closed    chan struct{}
+}
+
+// newRPCChannel sends requests to writer and reads messages from reader, lines not carrying a message are copied to
+// logWriter, which is closed once reader is exhausted
+func newRPCChannel(writer io.Writer, reader io.Reader, logWriter io.WriteCloser) *rpcChannel {
+	c := &rpcChannel{
+		writer:  writer,
+		pending: map[int64]chan *rpcMessage{},
+		ready:   make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go c.readLoop(bufio.NewReader(reader), logWriter)
+	return c
+}
+
+func (c *rpcChannel) readLoop(reader *bufio.Reader, logWriter io.WriteCloser) {
+	defer func() {
+		logWriter.Close()
+		close(c.closed)
+	}()
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.HasPrefix(line, rpcFramePrefix) {
+			c.handleFrame(line[len(rpcFramePrefix):])
+		} else if line != "" {
+			if _, err := io.WriteString(logWriter, line); err != nil {
+				log.Errorf("Could not write log line: %s", err)
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("RPC read error: %s", err)
+			}
+			return
+		}
+	}
+}
+
+func (c *rpcChannel) handleFrame(frame string) {
+	var msg rpcMessage
+	if err := json.Unmarshal([]byte(frame), &msg); err != nil {
+		log.Errorf("Could not decode RPC message: %s", err)
+		return
+	}
+	if msg.ID == nil {
+		if msg.Method == rpcReadyNotification {
+			c.readyOnce.Do(func() {
+				close(c.ready)
+			})
+		}
+		return
+	}
+	c.pendingLock.Lock()
+	respChan, ok := c.pending[*msg.ID]
+	c.pendingLock.Unlock()
+	if !ok {
+		// Response to a cancelled call
+		return
+	}
+	respChan <- &msg
+}
+
+func (c *rpcChannel) send(req rpcRequest) error {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "marshal request")
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err = c.writer.Write(append(buf, '\n'))
+	return err
+}
+
+// Ready is closed once the process has signaled it's ready to handle requests
+func (c *rpcChannel) Ready() <-chan struct{} {
+	return c.ready
+}
+
+// Closed is closed once the process' output has ended, usually because it exited
+func (c *rpcChannel) Closed() <-chan struct{} {
+	return c.closed
+}
+
+// Notify sends a notification, which gets no response
+func (c *rpcChannel) Notify(method string, params interface{}) error {
+	return c.send(rpcRequest{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+	})
+}
+
+// Call sends a request and waits for its response, when ctx is done the process is asked to cancel the request
+func (c *rpcChannel) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	id := atomic.AddInt64(&c.nextID, 1)
+	respChan := make(chan *rpcMessage, 1)
+	c.pendingLock.Lock()
+	c.pending[id] = respChan
+	c.pendingLock.Unlock()
+	defer func() {
+		c.pendingLock.Lock()
+		delete(c.pending, id)
+		c.pendingLock.Unlock()
+	}()
+
+	if err := c.send(rpcRequest{
+		JSONRPC: "2.0",
+		ID:      &id,
+		Method:  method,
+		Params:  params,
+	}); err != nil {
+		return nil, errors.Wrap(err, "send request")
+	}
+
+	select {
+	case resp := <-respChan:
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+		return resp.Result, nil
+	case <-ctx.Done():
+		if err := c.Notify(rpcCancelNotification, map[string]interface{}{"id": id}); err != nil {
+			log.Debugf("Could not cancel request %d: %s", id, err)
+		}
+		return nil, ctx.Err()
+	case <-c.closed:
+		// The response may have been the last thing read
+		select {
+		case resp := <-respChan:
+			if resp.Error != nil {
+				return nil, resp.Error
+			}
+			return resp.Result, nil
+		default:
+			return nil, ProcessExitedError
+		}
+	}
+}
+
+// startRPCProcess starts cmd and waits for it to signal it's ready on an RPC channel over its stdin and stdout, other
+// output is sent to logCallback. The process' exit error is sent to exited, callers kill the process if this fails
+func startRPCProcess(ctx context.Context, cmd *exec.Cmd, name string, logCallback LogCallback, exited chan error) (*rpcChannel, error) {
+	stdinPipe, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "stdin pipe")
+	}
+	// Pipes rather than StdoutPipe/StderrPipe, so that Wait only returns once all output has been copied
+	stdoutReader, stdoutWriter := io.Pipe()
+	cmd.Stdout = stdoutWriter
+	stderrReader, stderrWriter := io.Pipe()
+	cmd.Stderr = stderrWriter
+
+	if err := cmd.Start(); err != nil {
+		closeOutputs(cmd)
+		return nil, err
+	}
+
+	// Output that's not an RPC message, and stderr, is sent to the log channel
+	logReader, logWriter := io.Pipe()
+	go pipeLogStreamToCallback(name, bufio.NewReader(logReader), cluster.LogLevelInfo, logCallback)
+	go pipeLogStreamToCallback(name, bufio.NewReader(stderrReader), cluster.LogLevelError, logCallback)
+	rpc := newRPCChannel(stdinPipe, stdoutReader, logWriter)
+
+	go func() {
+		err := cmd.Wait()
+		closeOutputs(cmd)
+		exited <- err
+	}()
+
+	// Wait for the runtime to initialize
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-rpc.Closed():
+		return nil, errors.New("exited on boot")
+	case <-rpc.Ready():
+	}
+	return rpc, nil
+}
+
+// invocationTime records when an instance was last invoked, invocations may overlap
+type invocationTime struct {
+	lock sync.Mutex
+	time time.Time
+}
+
+func (it *invocationTime) touch() {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	it.time = time.Now()
+}
+
+func (it *invocationTime) get() time.Time {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	return it.time
+}
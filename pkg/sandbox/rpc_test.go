@@ -0,0 +1,130 @@
+package sandbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRPCProcess answers requests the way the deno servers do: echo requests are answered in reverse order once
+// two of them came in, fail requests with an error, block requests never, cancellations are reported on cancelled
+type fakeRPCProcess struct {
+	requests  *bufio.Reader
+	output    io.WriteCloser
+	writeLock sync.Mutex
+	cancelled chan int64
+}
+
+func (p *fakeRPCProcess) write(line string) {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	io.WriteString(p.output, line+"\n")
+}
+
+func (p *fakeRPCProcess) run() {
+	p.write("Booting")
+	p.write(rpcFramePrefix + `{"jsonrpc":"2.0","method":"ready"}`)
+	var echoes []rpcRequest
+	for {
+		line, err := p.requests.ReadString('\n')
+		if err != nil {
+			p.output.Close()
+			return
+		}
+		var req struct {
+			rpcRequest
+			Params map[string]interface{} `json:"params"`
+		}
+		json.Unmarshal([]byte(line), &req)
+		switch req.Method {
+		case "echo":
+			req.rpcRequest.Params = req.Params
+			echoes = append(echoes, req.rpcRequest)
+			if len(echoes) == 2 {
+				for i := len(echoes) - 1; i >= 0; i-- {
+					p.write(fmt.Sprintf(`%s{"jsonrpc":"2.0","id":%d,"result":%s}`, rpcFramePrefix, *echoes[i].ID, mustJSON(echoes[i].Params)))
+				}
+				echoes = nil
+			}
+		case "fail":
+			p.write(fmt.Sprintf(`%s{"jsonrpc":"2.0","id":%d,"error":{"code":-32000,"message":"Boom","data":{"message":"Boom","stack":"at handle"}}}`, rpcFramePrefix, *req.ID))
+		case "cancel":
+			p.cancelled <- int64(req.Params["id"].(float64))
+		case "exit":
+			p.output.Close()
+			return
+		}
+	}
+}
+
+func mustJSON(v interface{}) string {
+	buf, _ := json.Marshal(v)
+	return string(buf)
+}
+
+func TestRPCChannel(t *testing.T) {
+	requestReader, requestWriter := io.Pipe()
+	outputReader, outputWriter := io.Pipe()
+	logReader, logWriter := io.Pipe()
+	process := &fakeRPCProcess{
+		requests:  bufio.NewReader(requestReader),
+		output:    outputWriter,
+		cancelled: make(chan int64, 1),
+	}
+	go process.run()
+
+	logLines := make(chan string, 10)
+	go func() {
+		scanner := bufio.NewScanner(logReader)
+		for scanner.Scan() {
+			logLines <- scanner.Text()
+		}
+		close(logLines)
+	}()
+
+	c := newRPCChannel(requestWriter, outputReader, logWriter)
+	select {
+	case <-c.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not ready")
+	}
+	assert.Equal(t, "Booting", <-logLines)
+
+	// Concurrent calls, answered out of order
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result, err := c.Call(context.Background(), "echo", map[string]interface{}{"n": i})
+			assert.NoError(t, err)
+			assert.JSONEq(t, fmt.Sprintf(`{"n": %d}`, i), string(result))
+		}(i)
+	}
+	wg.Wait()
+
+	// Errors
+	_, err := c.Call(context.Background(), "fail", nil)
+	assert.EqualError(t, err, "Runtime error: Boom\nat handle")
+
+	// Cancellation
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.Call(ctx, "block", nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, int64(4), <-process.cancelled)
+
+	// Process exiting
+	_, err = c.Call(context.Background(), "exit", nil)
+	assert.Equal(t, ProcessExitedError, err)
+	<-c.Closed()
+	_, ok := <-logLines
+	assert.False(t, ok)
+}
@@ -0,0 +1,229 @@
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/definition"
+)
+
+// FunctionInstantiator boots a function (or, in RunModeJob, job) instance for a runtime
+type FunctionInstantiator func(ctx context.Context, cfg *config.Config, apiURL string, apiToken string, runMode RunMode, name string, logCallback LogCallback, functionConfig *definition.FunctionConfig, code string, libs definition.LibraryMap) (FunctionInstance, error)
+
+// JobInstantiator boots a job instance for a runtime
+type JobInstantiator func(ctx context.Context, cfg *config.Config, apiURL string, apiToken string, name string, logCallback LogCallback, jobConfig *definition.JobConfig, code string, libs definition.LibraryMap) (JobInstance, error)
+
+// RuntimeFunctionInstantiator is the former name of FunctionInstantiator
+type RuntimeFunctionInstantiator = FunctionInstantiator
+
+// RuntimeJobInstantiator is the former name of JobInstantiator
+type RuntimeJobInstantiator = JobInstantiator
+
+// RuntimeCapabilities describes what a runtime supports, definitions asking for more are rejected at deploy time
+type RuntimeCapabilities struct {
+	Jobs      bool                          // Can run jobs, requires a JobInstantiator
+	Libraries bool                          // Makes library definitions available to function and job code
+	Languages []string                      // Code block languages accepted, any language when empty
+	Available func(cfg *config.Config) bool // Whether the runtime can be used on this node, always when nil
+
+	// Function instances handle overlapping invocations, tagging their log records with the invocation themselves
+	ConcurrentInvocations bool
+}
+
+// Runtime is a registered runtime
+type Runtime struct {
+	Name                 string
+	FunctionInstantiator FunctionInstantiator
+	JobInstantiator      JobInstantiator
+	Capabilities         RuntimeCapabilities
+}
+
+// SupportsLanguage checks if code in the given code block language can be run, code without language always can
+func (r *Runtime) SupportsLanguage(language string) bool {
+	if language == "" || len(r.Capabilities.Languages) == 0 {
+		return true
+	}
+	for _, l := range r.Capabilities.Languages {
+		if l == language {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	runtimesLock sync.RWMutex
+	runtimes     = map[string]*Runtime{}
+)
+
+// RegisterRuntime makes a runtime available under name, for use in the runtime field of function and job configs
+// Like database/sql.Register, it's meant to be called from init functions and panics on invalid or duplicate registrations
+func RegisterRuntime(name string, functionInstantiator FunctionInstantiator, jobInstantiator JobInstantiator, capabilities RuntimeCapabilities) {
+	runtimesLock.Lock()
+	defer runtimesLock.Unlock()
+	if name == "" || functionInstantiator == nil {
+		panic("sandbox: RegisterRuntime needs a name and function instantiator")
+	}
+	if capabilities.Jobs && jobInstantiator == nil {
+		panic(fmt.Sprintf("sandbox: runtime %s supports jobs, but has no job instantiator", name))
+	}
+	if _, ok := runtimes[name]; ok {
+		panic(fmt.Sprintf("sandbox: runtime %s registered twice", name))
+	}
+	runtimes[name] = &Runtime{
+		Name:                 name,
+		FunctionInstantiator: functionInstantiator,
+		JobInstantiator:      jobInstantiator,
+		Capabilities:         capabilities,
+	}
+}
+
+// LookupRuntime returns the runtime registered under name, the default runtime when name is empty
+func LookupRuntime(name string) (*Runtime, bool) {
+	if name == "" {
+		name = DefaultRuntime
+	}
+	runtimesLock.RLock()
+	defer runtimesLock.RUnlock()
+	r, ok := runtimes[name]
+	return r, ok
+}
+
+// RegisteredRuntimes returns the names of all registered runtimes, sorted
+func RegisteredRuntimes() []string {
+	runtimesLock.RLock()
+	defer runtimesLock.RUnlock()
+	names := make([]string, 0, len(runtimes))
+	for name := range runtimes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsAvailable checks if the runtime can be used on this node
+func (r *Runtime) IsAvailable(cfg *config.Config) bool {
+	return r.Capabilities.Available == nil || r.Capabilities.Available(cfg)
+}
+
+// AvailableRuntimes returns the names of the runtimes that can be used on this node
+func AvailableRuntimes(cfg *config.Config) []string {
+	available := []string{}
+	for _, name := range RegisteredRuntimes() {
+		r, _ := LookupRuntime(name)
+		if r.IsAvailable(cfg) {
+			available = append(available, name)
+		}
+	}
+	return available
+}
+
+// ValidateDefinitions checks that all functions, jobs and libraries use registered runtimes that support them
+func ValidateDefinitions(defs *definition.Definitions) error {
+	errs := []string{}
+	for name, def := range defs.Functions {
+		if err := validateRuntimeUse(def.Config.Runtime, def.Language, false); err != nil {
+			errs = append(errs, fmt.Sprintf("function %s: %s", name, err))
+		}
+	}
+	for name, def := range defs.Jobs {
+		if err := validateRuntimeUse(def.Config.Runtime, def.Language, true); err != nil {
+			errs = append(errs, fmt.Sprintf("job %s: %s", name, err))
+		}
+	}
+	for name, def := range defs.Libraries {
+		if def.Runtime == "" {
+			continue
+		}
+		r, ok := LookupRuntime(def.Runtime)
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Sprintf("library %s: unsupported runtime: %s", name, def.Runtime))
+		case !r.Capabilities.Libraries:
+			errs = append(errs, fmt.Sprintf("library %s: runtime %s does not support libraries", name, def.Runtime))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// librariesForRuntime selects the libraries meant for the given runtime, libraries without a runtime are for deno
+func librariesForRuntime(libs definition.LibraryMap, runtimeName string) definition.LibraryMap {
+	selected := definition.LibraryMap{}
+	for name, lib := range libs {
+		libRuntime := lib.Runtime
+		if libRuntime == "" {
+			libRuntime = DefaultRuntime
+		}
+		if libRuntime == runtimeName {
+			selected[name] = lib
+		}
+	}
+	return selected
+}
+
+func validateRuntimeUse(runtimeName string, language string, job bool) error {
+	r, ok := LookupRuntime(runtimeName)
+	if !ok {
+		return fmt.Errorf("unsupported runtime: %s", runtimeName)
+	}
+	if job && !r.Capabilities.Jobs {
+		return fmt.Errorf("runtime %s does not support jobs", r.Name)
+	}
+	if !r.SupportsLanguage(language) {
+		return fmt.Errorf("runtime %s does not support %s code", r.Name, language)
+	}
+	return nil
+}
+
+func init() {
+	RegisterRuntime("deno", newDenoFunctionInstance, newDenoJobInstance, RuntimeCapabilities{
+		Jobs:      true,
+		Libraries: true,
+		Languages: []string{"javascript", "js", "typescript", "ts"},
+		Available: func(cfg *config.Config) bool {
+			// Unless configured to use the system deno, deno is downloaded automatically
+			_, err := exec.LookPath("deno")
+			return err == nil || !cfg.UseSystemDeno
+		},
+		ConcurrentInvocations: true,
+	})
+	RegisterRuntime("docker", newDockerFunctionInstance, newDockerJobInstance, RuntimeCapabilities{
+		Jobs: true,
+		Available: func(cfg *config.Config) bool {
+			_, err := exec.LookPath("docker")
+			return err == nil
+		},
+	})
+	RegisterRuntime("python", newPythonFunctionInstance, newPythonJobInstance, RuntimeCapabilities{
+		Jobs:      true,
+		Libraries: true,
+		Languages: []string{"python", "py"},
+		Available: func(cfg *config.Config) bool {
+			_, err := exec.LookPath(pythonBinary)
+			return err == nil
+		},
+		ConcurrentInvocations: true,
+	})
+	// Runs the configured command, code blocks are ignored. Anybody deploying apps could run anything on the node with
+	// it, so it has to be enabled explicitly
+	RegisterRuntime("exec", newExecFunctionInstance, newExecJobInstance, RuntimeCapabilities{
+		Jobs: true,
+		Available: func(cfg *config.Config) bool {
+			return cfg.EnableExecRuntime
+		},
+	})
+	// Code blocks contain the base64 encoded module, unless a wasm_module path is configured
+	RegisterRuntime("wasm", newWasmFunctionInstance, newWasmJobInstance, RuntimeCapabilities{
+		Jobs:      true,
+		Languages: []string{"wasm", "base64"},
+	})
+}
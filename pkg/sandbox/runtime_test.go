@@ -0,0 +1,63 @@
+package sandbox_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/definition"
+	"github.com/zefhemel/matterless/pkg/sandbox"
+)
+
+func TestRegisterRuntime(t *testing.T) {
+	a := assert.New(t)
+	sandbox.RegisterRuntime("test-functions-only", func(ctx context.Context, cfg *config.Config, apiURL string, apiToken string, runMode sandbox.RunMode, name string, logCallback sandbox.LogCallback, functionConfig *definition.FunctionConfig, code string, libs definition.LibraryMap) (sandbox.FunctionInstance, error) {
+		return nil, nil
+	}, nil, sandbox.RuntimeCapabilities{
+		Languages: []string{"lua"},
+	})
+	a.Panics(func() {
+		sandbox.RegisterRuntime("test-functions-only", nil, nil, sandbox.RuntimeCapabilities{})
+	})
+	a.Contains(sandbox.RegisteredRuntimes(), "test-functions-only")
+	a.Contains(sandbox.AvailableRuntimes(config.NewConfig()), "test-functions-only")
+
+	r, ok := sandbox.LookupRuntime("")
+	a.True(ok)
+	a.Equal(sandbox.DefaultRuntime, r.Name)
+
+	defs, err := definition.Parse(strings.ReplaceAll(`# function Lua
+|||yaml
+runtime: test-functions-only
+|||
+|||lua
+print("hello")
+|||
+
+# function JS
+|||javascript
+function handle() {}
+|||
+`, "|||", "```"))
+	a.NoError(err)
+	a.NoError(sandbox.ValidateDefinitions(defs))
+
+	defs.Jobs["LuaJob"] = &definition.JobDef{
+		Name:     "LuaJob",
+		Config:   &definition.JobConfig{Runtime: "test-functions-only"},
+		Language: "lua",
+	}
+	defs.Functions["Python"] = &definition.FunctionDef{
+		Name:     "Python",
+		Config:   &definition.FunctionConfig{Runtime: "cobol"},
+		Language: "python",
+	}
+	defs.Functions["JS"].Language = "lua"
+	err = sandbox.ValidateDefinitions(defs)
+	a.Error(err)
+	a.Contains(err.Error(), "job LuaJob: runtime test-functions-only does not support jobs")
+	a.Contains(err.Error(), "function Python: unsupported runtime: cobol")
+	a.Contains(err.Error(), "function JS: runtime deno does not support lua code")
+}
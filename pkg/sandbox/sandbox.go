@@ -20,20 +20,6 @@ const (
 	RunModeJob      RunMode = iota
 )
 
-type RuntimeFunctionInstantiator func(ctx context.Context, cfg *config.Config, apiURL string, apiToken string, runMode RunMode, name string, logCallback func(funcName, message string), functionConfig *definition.FunctionConfig, code string, libs definition.LibraryMap) (FunctionInstance, error)
-
-var runtimeFunctionInstantiators = map[string]RuntimeFunctionInstantiator{
-	"deno":   newDenoFunctionInstance,
-	"docker": newDockerFunctionInstance,
-}
-
-type RuntimeJobInstantiator func(ctx context.Context, cfg *config.Config, apiURL string, apiToken string, name string, logCallback func(funcName, message string), jobConfig *definition.JobConfig, code string, libs definition.LibraryMap) (JobInstance, error)
-
-var runtimeJobInstantiators = map[string]RuntimeJobInstantiator{
-	"deno":   newDenoJobInstance,
-	"docker": newDockerJobInstance,
-}
-
 const DefaultRuntime = "deno"
 
 type FunctionInstance interface {
@@ -52,12 +38,14 @@ type JobInstance interface {
 }
 
 type Sandbox struct {
-	config          *config.Config
-	apiURL          string
-	apiToken        string
-	ceb             *cluster.ClusterEventBus
-	functionWorkers []*FunctionExecutionWorker
-	jobWorkers      []*JobExecutionWorker
+	config              *config.Config
+	apiURL              string
+	apiToken            string
+	ceb                 *cluster.ClusterEventBus
+	functionWorkers     []*FunctionExecutionWorker
+	functionWorkersLock sync.Mutex
+	jobWorkers          []*JobExecutionWorker
+	jobWorkersLock      sync.Mutex
 }
 
 func NewSandbox(cfg *config.Config, apiURL string, apiToken string, ceb *cluster.ClusterEventBus) (*Sandbox, error) {
@@ -84,7 +72,9 @@ func (s *Sandbox) StartFunctionWorker(name string, functionConfig *definition.Fu
 	if err != nil {
 		return err
 	}
+	s.functionWorkersLock.Lock()
 	s.functionWorkers = append(s.functionWorkers, worker)
+	s.functionWorkersLock.Unlock()
 	return nil
 }
 
@@ -93,24 +83,89 @@ func (s *Sandbox) StartJobWorker(name definition.FunctionID, jobConfig *definiti
 	if err != nil {
 		return err
 	}
+	// Workers stick around after their job exits (restarting or not) until the sandbox is flushed, so that they
+	// keep being accounted for and the leader won't start replacements for crash looping jobs
+	s.jobWorkersLock.Lock()
 	s.jobWorkers = append(s.jobWorkers, worker)
-	go func() {
-		<-worker.done
-		workers := make([]*JobExecutionWorker, 0, len(s.jobWorkers))
-		for _, w := range s.jobWorkers {
-			if w != worker {
-				workers = append(workers, w)
+	s.jobWorkersLock.Unlock()
+	return nil
+}
+
+// StopJobWorkers stops up to n workers of the given job, workers whose job is not currently running are stopped first
+// returns the number of workers stopped
+func (s *Sandbox) StopJobWorkers(name definition.FunctionID, n int) int {
+	s.jobWorkersLock.Lock()
+	toStop := []*JobExecutionWorker{}
+	for _, preferNotRunning := range []bool{true, false} {
+		for _, worker := range s.jobWorkers {
+			if len(toStop) == n {
+				break
+			}
+			if worker.name != string(name) || containsJobWorker(toStop, worker) {
+				continue
+			}
+			if state, _, _ := worker.State(); preferNotRunning && state == cluster.JobStateRunning {
+				continue
 			}
+			toStop = append(toStop, worker)
 		}
-		s.jobWorkers = workers
-	}()
-	return nil
+	}
+	workers := make([]*JobExecutionWorker, 0, len(s.jobWorkers))
+	for _, worker := range s.jobWorkers {
+		if !containsJobWorker(toStop, worker) {
+			workers = append(workers, worker)
+		}
+	}
+	s.jobWorkers = workers
+	s.jobWorkersLock.Unlock()
+
+	for _, worker := range toStop {
+		log.Infof("Stopping surplus job worker %s", worker.name)
+		if err := worker.Close(); err != nil {
+			log.Errorf("Error closing job worker: %s", err)
+		}
+	}
+	return len(toStop)
+}
+
+func containsJobWorker(workers []*JobExecutionWorker, worker *JobExecutionWorker) bool {
+	for _, w := range workers {
+		if w == worker {
+			return true
+		}
+	}
+	return false
+}
+
+// takeFunctionWorkers removes all function workers from the sandbox, returning them
+func (s *Sandbox) takeFunctionWorkers() []*FunctionExecutionWorker {
+	s.functionWorkersLock.Lock()
+	defer s.functionWorkersLock.Unlock()
+	workers := s.functionWorkers
+	s.functionWorkers = []*FunctionExecutionWorker{}
+	return workers
+}
+
+// DrainFunctionWorkers stops all function workers once their in-flight invocations have finished, workers started
+// while draining are left alone
+func (s *Sandbox) DrainFunctionWorkers() {
+	var wg sync.WaitGroup
+	for _, worker := range s.takeFunctionWorkers() {
+		wg.Add(1)
+		worker2 := worker
+		go func() {
+			log.Infof("Draining function worker %s", worker2.name)
+			worker2.Drain()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
 }
 
 func (s *Sandbox) Flush() {
 	log.Info("Flushing the sandbox")
 	var wg sync.WaitGroup
-	for _, worker := range s.functionWorkers {
+	for _, worker := range s.takeFunctionWorkers() {
 		wg.Add(1)
 		worker2 := worker
 		go func() {
@@ -120,6 +175,8 @@ func (s *Sandbox) Flush() {
 		}()
 	}
 
+	s.jobWorkersLock.Lock()
+	defer s.jobWorkersLock.Unlock()
 	for _, worker := range s.jobWorkers {
 		wg.Add(1)
 		worker2 := worker
@@ -132,20 +189,58 @@ func (s *Sandbox) Flush() {
 	}
 	wg.Wait()
 	log.Info("Fully flushed")
-	s.functionWorkers = []*FunctionExecutionWorker{}
 	s.jobWorkers = []*JobExecutionWorker{}
 }
 
+// WaitForInvocations waits for the invocations in flight on the function workers to finish, or until ctx is done
+func (s *Sandbox) WaitForInvocations(ctx context.Context) {
+	s.functionWorkersLock.Lock()
+	functionWorkers := s.functionWorkers
+	s.functionWorkersLock.Unlock()
+	idle := make(chan struct{})
+	go func() {
+		for _, worker := range functionWorkers {
+			// Held for the duration of an invocation
+			worker.functionExecutionLock.Lock()
+			worker.functionExecutionLock.Unlock()
+		}
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+	}
+}
+
 func (s *Sandbox) AppInfo() *cluster.AppInfo {
 	si := &cluster.AppInfo{
 		FunctionWorkers: map[string]int{},
 		JobWorkers:      map[string]int{},
+		FunctionErrors:  map[string]*cluster.ErrorInfo{},
+		JobStates:       map[string][]cluster.JobState{},
+		JobRestarts:     map[string]int{},
+		JobExits:        map[string]int{},
 	}
-	for _, functionWorker := range s.functionWorkers {
+	s.functionWorkersLock.Lock()
+	functionWorkers := s.functionWorkers
+	s.functionWorkersLock.Unlock()
+	for _, functionWorker := range functionWorkers {
 		si.FunctionWorkers[functionWorker.name]++
+		lastError := functionWorker.LastError()
+		if lastError != nil {
+			if existing, ok := si.FunctionErrors[functionWorker.name]; !ok || existing.Time.Before(lastError.Time) {
+				si.FunctionErrors[functionWorker.name] = lastError
+			}
+		}
 	}
+	s.jobWorkersLock.Lock()
+	defer s.jobWorkersLock.Unlock()
 	for _, jobWorker := range s.jobWorkers {
 		si.JobWorkers[jobWorker.name]++
+		state, restarts, exits := jobWorker.State()
+		si.JobStates[jobWorker.name] = append(si.JobStates[jobWorker.name], state)
+		si.JobRestarts[jobWorker.name] += restarts
+		si.JobExits[jobWorker.name] += exits
 	}
 	return si
 }
@@ -0,0 +1,100 @@
+package sandbox_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/definition"
+	"github.com/zefhemel/matterless/pkg/sandbox"
+)
+
+func TestSandboxDrainAndFlush(t *testing.T) {
+	a := assert.New(t)
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.UseSystemDeno = true
+	cfg.EnableExecRuntime = true
+	cfg.ClusterNatsUrl = "nats://localhost:4227"
+
+	conn, err := cluster.ConnectOrBoot(cfg)
+	a.NoError(err)
+	defer conn.Close()
+	ceb := cluster.NewClusterEventBus(conn, "test-drain")
+
+	s, err := sandbox.NewSandbox(cfg, "http://%s", "", ceb)
+	a.NoError(err)
+	functionConfig := &definition.FunctionConfig{
+		Runtime: "exec",
+		Command: []string{"sh", "-c", "read -r line; echo $line"},
+	}
+	for i := 0; i < 3; i++ {
+		a.NoError(s.StartFunctionWorker("Echo", functionConfig, "", definition.LibraryMap{}))
+	}
+	result, err := ceb.InvokeFunction("Echo", map[string]interface{}{"n": 1})
+	a.NoError(err)
+	a.Equal(map[string]interface{}{"n": float64(1)}, result)
+
+	// A redeploy flushing the sandbox while it drains closes workers only once, workers started meanwhile are kept
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		s.DrainFunctionWorkers()
+		wg.Done()
+	}()
+	go func() {
+		s.Flush()
+		wg.Done()
+	}()
+	go func() {
+		a.NoError(s.StartFunctionWorker("Echo", functionConfig, "", definition.LibraryMap{}))
+		wg.Done()
+	}()
+	wg.Wait()
+	s.DrainFunctionWorkers()
+	s.Flush()
+	a.Empty(s.AppInfo().FunctionWorkers)
+
+	_, err = ceb.InvokeFunction("Echo", map[string]interface{}{"n": 2})
+	a.Error(err)
+}
+
+func TestSandboxWaitForInvocations(t *testing.T) {
+	a := assert.New(t)
+	cfg := config.NewConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.UseSystemDeno = true
+	cfg.EnableExecRuntime = true
+	cfg.ClusterNatsUrl = "nats://localhost:4228"
+
+	conn, err := cluster.ConnectOrBoot(cfg)
+	a.NoError(err)
+	defer conn.Close()
+	ceb := cluster.NewClusterEventBus(conn, "test-wait")
+
+	s, err := sandbox.NewSandbox(cfg, "http://%s", "", ceb)
+	a.NoError(err)
+	defer s.Flush()
+	a.NoError(s.StartFunctionWorker("Slow", &definition.FunctionConfig{
+		Runtime: "exec",
+		Command: []string{"sh", "-c", "read -r line; sleep 0.5; echo $line"},
+	}, "", definition.LibraryMap{}))
+
+	go ceb.InvokeFunction("Slow", map[string]interface{}{})
+	time.Sleep(100 * time.Millisecond)
+
+	// Gives up at the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	s.WaitForInvocations(ctx)
+	a.Less(time.Since(start), 300*time.Millisecond)
+
+	// Returns once the invocation finished
+	s.WaitForInvocations(context.Background())
+	a.Greater(time.Since(start), 300*time.Millisecond)
+}
@@ -0,0 +1,226 @@
+;; Test function for the wasm runtime, function.wasm is this module in binary format (wat2wasm function.wat)
+;; It logs to stderr, reads the event from stdin, gets the greeting from the store with a host call, and writes
+;; {"event": <event>, "init": <INIT_CONFIG>, "value": <greeting>} to stdout
+(module
+  (import "wasi_snapshot_preview1" "fd_read" (func $fd_read (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "environ_sizes_get" (func $environ_sizes_get (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "environ_get" (func $environ_get (param i32 i32) (result i32)))
+  (import "matterless" "call" (func $call (param i32 i32 i32 i32) (result i32)))
+  (import "matterless" "response" (func $response (param i32)))
+
+  ;; 0-127: constants, 128-255: scratch, 256-1023: output iovecs, 1024-2047: environment pointers,
+  ;; 2048-16383: environment strings, 16384-32767: host call response, 32768-65535: stdin
+  (memory (export "memory") 1)
+  (data (i32.const 0) "store.get")
+  (data (i32.const 16) "[\"greeting\"]")
+  (data (i32.const 32) "Log message\n")
+  (data (i32.const 48) "INIT_CONFIG=")
+  (data (i32.const 64) "{\"event\":")
+  (data (i32.const 80) ",\"init\":")
+  (data (i32.const 96) ",\"value\":")
+  (data (i32.const 112) "}")
+  (data (i32.const 120) "null")
+
+  (func $main (export "_start")
+    (local $stdin_len i32) (local $n i32) (local $env_count i32) (local $i i32) (local $j i32) (local $p i32)
+    (local $init_ptr i32) (local $init_len i32) (local $response_len i32)
+
+    ;; Log a message to stderr
+    i32.const 128
+    i32.const 32
+    i32.store
+    i32.const 132
+    i32.const 12
+    i32.store
+    i32.const 2
+    i32.const 128
+    i32.const 1
+    i32.const 136
+    call $fd_write
+    drop
+
+    ;; Read the event from stdin until EOF
+    block $read_done
+      loop $read
+        i32.const 128
+        i32.const 32768
+        local.get $stdin_len
+        i32.add
+        i32.store
+        i32.const 132
+        i32.const 32768
+        local.get $stdin_len
+        i32.sub
+        i32.store
+        i32.const 0
+        i32.const 128
+        i32.const 1
+        i32.const 136
+        call $fd_read
+        br_if $read_done
+        i32.const 136
+        i32.load
+        local.tee $n
+        i32.eqz
+        br_if $read_done
+        local.get $stdin_len
+        local.get $n
+        i32.add
+        local.set $stdin_len
+        br $read
+      end
+    end
+
+    ;; Look up INIT_CONFIG in the environment, null when not set
+    i32.const 120
+    local.set $init_ptr
+    i32.const 4
+    local.set $init_len
+    i32.const 140
+    i32.const 144
+    call $environ_sizes_get
+    drop
+    i32.const 1024
+    i32.const 2048
+    call $environ_get
+    drop
+    i32.const 140
+    i32.load
+    local.set $env_count
+    block $env_done
+      loop $env
+        local.get $i
+        local.get $env_count
+        i32.ge_u
+        br_if $env_done
+        i32.const 1024
+        local.get $i
+        i32.const 4
+        i32.mul
+        i32.add
+        i32.load
+        local.set $p
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        block $next
+          ;; Compare the variable with the INIT_CONFIG= prefix
+          i32.const 0
+          local.set $j
+          loop $compare
+            local.get $p
+            local.get $j
+            i32.add
+            i32.load8_u
+            i32.const 48
+            local.get $j
+            i32.add
+            i32.load8_u
+            i32.ne
+            br_if $next
+            local.get $j
+            i32.const 1
+            i32.add
+            local.tee $j
+            i32.const 12
+            i32.lt_u
+            br_if $compare
+          end
+          ;; The value runs from the prefix to the terminating NUL
+          local.get $p
+          i32.const 12
+          i32.add
+          local.set $init_ptr
+          i32.const 0
+          local.set $init_len
+          loop $length
+            local.get $init_ptr
+            local.get $init_len
+            i32.add
+            i32.load8_u
+            i32.eqz
+            br_if $env_done
+            local.get $init_len
+            i32.const 1
+            i32.add
+            local.set $init_len
+            br $length
+          end
+        end
+        br $env
+      end
+    end
+
+    ;; Get the greeting from the store, a negative length is that of an error message
+    i32.const 0
+    i32.const 9
+    i32.const 16
+    i32.const 12
+    call $call
+    local.set $response_len
+    block $positive
+      local.get $response_len
+      i32.const 0
+      i32.ge_s
+      br_if $positive
+      i32.const 0
+      local.get $response_len
+      i32.sub
+      local.set $response_len
+    end
+    i32.const 16384
+    call $response
+
+    ;; Write the result to stdout
+    i32.const 256
+    i32.const 64
+    i32.store
+    i32.const 260
+    i32.const 9
+    i32.store
+    i32.const 264
+    i32.const 32768
+    i32.store
+    i32.const 268
+    local.get $stdin_len
+    i32.store
+    i32.const 272
+    i32.const 80
+    i32.store
+    i32.const 276
+    i32.const 8
+    i32.store
+    i32.const 280
+    local.get $init_ptr
+    i32.store
+    i32.const 284
+    local.get $init_len
+    i32.store
+    i32.const 288
+    i32.const 96
+    i32.store
+    i32.const 292
+    i32.const 9
+    i32.store
+    i32.const 296
+    i32.const 16384
+    i32.store
+    i32.const 300
+    local.get $response_len
+    i32.store
+    i32.const 304
+    i32.const 112
+    i32.store
+    i32.const 308
+    i32.const 1
+    i32.store
+    i32.const 1
+    i32.const 256
+    i32.const 7
+    i32.const 136
+    call $fd_write
+    drop
+  )
+)
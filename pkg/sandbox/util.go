@@ -2,22 +2,112 @@ package sandbox
 
 import (
 	"bufio"
+	"encoding/json"
 	"io"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/zefhemel/matterless/pkg/cluster"
 )
 
-func pipeLogStreamToCallback(functionName string, bufferedReader *bufio.Reader, callback func(funcName string, message string)) {
-readLoop:
+// LogCallback receives log records from function and job instances
+type LogCallback func(funcName string, message cluster.LogMessage)
+
+// withInvocationID tags the log records passed on to callback with invocationID, unless they already carry one
+func (callback LogCallback) withInvocationID(invocationID string) LogCallback {
+	if invocationID == "" {
+		return callback
+	}
+	return func(funcName string, message cluster.LogMessage) {
+		if message.InvocationID == "" {
+			message.InvocationID = invocationID
+		}
+		callback(funcName, message)
+	}
+}
+
+// Lines prefixed with this (ASCII record separator) character contain a JSON encoded structured log record
+const structuredLogPrefix = "\x1e"
+
+// How long to wait for continuation lines (e.g. stack traces) before emitting a log record
+const logGroupTimeout = 50 * time.Millisecond
+
+// pipeLogStreamToCallback reads lines from bufferedReader and ships them as log records to callback
+// Structured records are passed on as is, other lines get defaultLevel assigned, continuation lines (indented lines
+// such as stack trace entries) are grouped with the line preceding them
+func pipeLogStreamToCallback(functionName string, bufferedReader *bufio.Reader, defaultLevel cluster.LogLevel, callback LogCallback) {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for {
+			line, err := bufferedReader.ReadString('\n')
+			if line != "" {
+				lines <- strings.TrimRight(line, "\r\n")
+			}
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				log.Error("log read error", err)
+				return
+			}
+		}
+	}()
+
+	var current *cluster.LogMessage
+	flush := func() {
+		if current != nil {
+			callback(functionName, *current)
+			current = nil
+		}
+	}
 	for {
-		line, err := bufferedReader.ReadString('\n')
-		if err == io.EOF {
-			break readLoop
+		var timeout <-chan time.Time
+		if current != nil {
+			timeout = time.After(logGroupTimeout)
 		}
-		if err != nil {
-			log.Error("log read error", err)
-			break readLoop
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				flush()
+				return
+			}
+			if strings.HasPrefix(line, structuredLogPrefix) {
+				flush()
+				callback(functionName, parseStructuredLogLine(line[len(structuredLogPrefix):], defaultLevel))
+				continue
+			}
+			if current != nil && isContinuationLine(line) {
+				current.Message = current.Message + "\n" + line
+				continue
+			}
+			flush()
+			current = &cluster.LogMessage{
+				Level:   defaultLevel,
+				Message: line,
+			}
+		case <-timeout:
+			flush()
 		}
-		callback(functionName, line)
 	}
 }
+
+func parseStructuredLogLine(line string, defaultLevel cluster.LogLevel) cluster.LogMessage {
+	var lm cluster.LogMessage
+	if err := json.Unmarshal([]byte(line), &lm); err != nil {
+		// Not valid after all, pass on as is
+		return cluster.LogMessage{
+			Level:   defaultLevel,
+			Message: line,
+		}
+	}
+	if lm.Level == "" {
+		lm.Level = defaultLevel
+	}
+	return lm
+}
+
+func isContinuationLine(line string) bool {
+	return strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+}
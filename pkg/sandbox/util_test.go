@@ -0,0 +1,37 @@
+package sandbox
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/cluster"
+)
+
+func TestPipeLogStreamToCallback(t *testing.T) {
+	input := strings.Join([]string{
+		"Starting up",
+		"error: Uncaught Error: boom",
+		"    at handle (file:///function.js:3:11)",
+		"    at server.ts:20:13",
+		structuredLogPrefix + `{"level":"warn","message":"Careful","fields":{"count":3},"invocation_id":"abc"}`,
+		"Done",
+	}, "\n")
+	messages := []cluster.LogMessage{}
+	pipeLogStreamToCallback("TestFunction", bufio.NewReader(strings.NewReader(input)), cluster.LogLevelError, func(funcName string, message cluster.LogMessage) {
+		assert.Equal(t, "TestFunction", funcName)
+		messages = append(messages, message)
+	})
+	assert.Len(t, messages, 4)
+	assert.Equal(t, "Starting up", messages[0].Message)
+	assert.Equal(t, cluster.LogLevelError, messages[1].Level)
+	assert.Contains(t, messages[1].Message, "at server.ts:20:13")
+	assert.Equal(t, cluster.LogLevelWarn, messages[2].Level)
+	assert.Equal(t, "abc", messages[2].InvocationID)
+	assert.Equal(t, float64(3), messages[2].Fields["count"])
+	assert.Equal(t, "Done", messages[3].Message)
+
+	assert.True(t, cluster.LogLevelError.AtLeast(cluster.LogLevelWarn))
+	assert.False(t, cluster.LogLevelDebug.AtLeast(cluster.LogLevelInfo))
+}
@@ -0,0 +1,392 @@
+package sandbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/definition"
+	"github.com/zefhemel/matterless/pkg/util"
+)
+
+// Compiled modules are cached across instances, so only the first instance of a module pays for compilation
+var wasmCompilationCache = wazero.NewCompilationCache()
+
+// Name of the host module exposing the Matterless APIs to wasm code
+const wasmHostModuleName = "matterless"
+
+// ======= Functions ============
+
+type wasmFunctionInstance struct {
+	name        string
+	runtime     wazero.Runtime
+	module      wazero.CompiledModule
+	apiClient   *wasmAPIClient
+	initData    string
+	logCallback LogCallback
+	lastInvoked time.Time
+	exited      chan error
+}
+
+var _ FunctionInstance = &wasmFunctionInstance{}
+
+func (inst *wasmFunctionInstance) Name() string {
+	return inst.name
+}
+
+func (inst *wasmFunctionInstance) LastInvoked() time.Time {
+	return inst.lastInvoked
+}
+
+func (inst *wasmFunctionInstance) DidExit() chan error {
+	return inst.exited
+}
+
+// wasmModuleBinary loads the module from modulePath if set, or decodes it from the (base64 encoded) code otherwise
+func wasmModuleBinary(modulePath string, code string) ([]byte, error) {
+	if modulePath != "" {
+		buf, err := os.ReadFile(modulePath)
+		if err != nil {
+			return nil, errors.Wrap(err, "read wasm module")
+		}
+		return buf, nil
+	}
+	buf, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(code), ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "base64 decode wasm module")
+	}
+	return buf, nil
+}
+
+func newWasmFunctionInstance(ctx context.Context, cfg *config.Config, apiURL string, apiToken string, runMode RunMode, name string, logCallback LogCallback, functionConfig *definition.FunctionConfig, code string, libs definition.LibraryMap) (FunctionInstance, error) {
+	binary, err := wasmModuleBinary(functionConfig.WasmModule, code)
+	if err != nil {
+		return nil, err
+	}
+
+	inst := &wasmFunctionInstance{
+		name: name,
+		apiClient: &wasmAPIClient{
+			url:   fmt.Sprintf(apiURL, "localhost"),
+			token: apiToken,
+		},
+		initData:    util.MustJsonString(functionConfig.Init),
+		logCallback: logCallback,
+		exited:      make(chan error, 1),
+	}
+
+	// Closing the module on context cancellation allows timeouts to interrupt running code
+	inst.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCompilationCache(wasmCompilationCache).
+		WithCloseOnContextDone(true))
+
+	everythingOk := false
+	defer func() {
+		if !everythingOk {
+			inst.Kill()
+		}
+	}()
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, inst.runtime); err != nil {
+		return nil, errors.Wrap(err, "instantiate wasi")
+	}
+	if err := instantiateWasmHostModule(ctx, inst.runtime, inst.apiClient); err != nil {
+		return nil, errors.Wrap(err, "instantiate host module")
+	}
+	inst.module, err = inst.runtime.CompileModule(ctx, binary)
+	if err != nil {
+		return nil, errors.Wrap(err, "compile wasm module")
+	}
+
+	everythingOk = true
+	return inst, nil
+}
+
+// moduleConfig configures a module instance with the Matterless environment, stderr is shipped to logCallback until
+// the returned writer is closed
+func (inst *wasmFunctionInstance) moduleConfig(stdin io.Reader, stdout io.Writer, logCallback LogCallback) (wazero.ModuleConfig, io.Closer) {
+	stderrReader, stderrWriter := io.Pipe()
+	go pipeLogStreamToCallback(inst.name, bufio.NewReader(stderrReader), cluster.LogLevelError, logCallback)
+	return wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(inst.name).
+		WithEnv("API_URL", inst.apiClient.url).
+		WithEnv("API_TOKEN", inst.apiClient.token).
+		WithEnv("INIT_CONFIG", inst.initData).
+		WithStdin(stdin).
+		WithStdout(stdout).
+		WithStderr(stderrWriter).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithSysNanosleep(), stderrWriter
+}
+
+// run instantiates the module, which runs it to completion, treating exit code 0 as success
+func (inst *wasmFunctionInstance) run(ctx context.Context, moduleConfig wazero.ModuleConfig) error {
+	ctx = context.WithValue(ctx, wasmCallStateKey{}, &wasmCallState{})
+	mod, err := inst.runtime.InstantiateModule(ctx, inst.module, moduleConfig)
+	if mod != nil {
+		mod.Close(ctx)
+	}
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 0 {
+		return nil
+	}
+	return err
+}
+
+// Invoke runs a fresh instance of the module with the JSON encoded event on stdin, and decodes its stdout as result
+func (inst *wasmFunctionInstance) Invoke(ctx context.Context, event interface{}) (interface{}, error) {
+	inst.lastInvoked = time.Now()
+
+	var stdout bytes.Buffer
+	// Every invocation runs its own module instance, so all of its logs belong to it
+	moduleConfig, stderr := inst.moduleConfig(strings.NewReader(util.MustJsonString(event)), &stdout, inst.logCallback.withInvocationID(InvocationID(ctx)))
+	err := inst.run(ctx, moduleConfig)
+	stderr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Runtime error: %s", err)
+	}
+
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return nil, nil
+	}
+	var result interface{}
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		return nil, errors.Wrap(err, "unmarshall response")
+	}
+	return result, nil
+}
+
+func (inst *wasmFunctionInstance) Kill() {
+	if err := inst.runtime.Close(context.Background()); err != nil {
+		log.Errorf("Could not close wasm runtime: %s", err)
+	}
+}
+
+// ======= Jobs ============
+
+type wasmJobInstance struct {
+	*wasmFunctionInstance
+	cancel context.CancelFunc
+}
+
+var _ JobInstance = &wasmJobInstance{}
+
+func newWasmJobInstance(ctx context.Context, cfg *config.Config, apiURL string, apiToken string, name string, logCallback LogCallback, jobConfig *definition.JobConfig, code string, libs definition.LibraryMap) (JobInstance, error) {
+	functionInstance, err := newWasmFunctionInstance(ctx, cfg, apiURL, apiToken, RunModeJob, name, logCallback, &definition.FunctionConfig{
+		Init:       jobConfig.Init,
+		Runtime:    jobConfig.Runtime,
+		Instances:  jobConfig.Instances,
+		WasmModule: jobConfig.WasmModule,
+	}, code, libs)
+	if err != nil {
+		return nil, err
+	}
+	return &wasmJobInstance{wasmFunctionInstance: functionInstance.(*wasmFunctionInstance)}, nil
+}
+
+// Start runs the module's main function in the background, the job exits when it returns
+func (inst *wasmJobInstance) Start(ctx context.Context) error {
+	// The job outlives the start context
+	runCtx, cancel := context.WithCancel(context.Background())
+	inst.cancel = cancel
+
+	stdoutReader, stdoutWriter := io.Pipe()
+	go pipeLogStreamToCallback(inst.name, bufio.NewReader(stdoutReader), cluster.LogLevelInfo, inst.logCallback)
+	moduleConfig, stderr := inst.moduleConfig(strings.NewReader(""), stdoutWriter, inst.logCallback)
+	go func() {
+		err := inst.run(runCtx, moduleConfig)
+		stdoutWriter.Close()
+		stderr.Close()
+		inst.exited <- err
+	}()
+	return nil
+}
+
+func (inst *wasmJobInstance) Stop(ctx context.Context) error {
+	if inst.cancel != nil {
+		inst.cancel()
+	}
+	inst.Kill()
+	return nil
+}
+
+// ======= Host module ============
+
+type wasmCallStateKey struct{}
+
+// wasmCallState holds the response of the last host call of a module instance, until the module reads it
+type wasmCallState struct {
+	sync.Mutex
+	response []byte
+}
+
+// instantiateWasmHostModule exposes the Matterless APIs to wasm code as two functions in the matterless module:
+//
+//	call(op_ptr, op_len, args_ptr, args_len i32) i32: performs the operation named op with JSON encoded array args,
+//	  returns the length of the JSON encoded result, or the negated length of the error message on failure
+//	response(ptr i32): copies the result (or error message) of the last call into memory at ptr
+func instantiateWasmHostModule(ctx context.Context, r wazero.Runtime, apiClient *wasmAPIClient) error {
+	_, err := r.NewHostModuleBuilder(wasmHostModuleName).
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, mod api.Module, opPtr, opLen, argsPtr, argsLen uint32) int32 {
+			state := ctx.Value(wasmCallStateKey{}).(*wasmCallState)
+			state.Lock()
+			defer state.Unlock()
+			result, err := wasmHostCall(ctx, mod, apiClient, opPtr, opLen, argsPtr, argsLen)
+			if err != nil {
+				state.response = []byte(err.Error())
+				return -int32(len(state.response))
+			}
+			state.response = util.MustJsonByteSlice(result)
+			return int32(len(state.response))
+		}).
+		Export("call").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, mod api.Module, ptr uint32) {
+			state := ctx.Value(wasmCallStateKey{}).(*wasmCallState)
+			state.Lock()
+			defer state.Unlock()
+			if !mod.Memory().Write(ptr, state.response) {
+				panic("response out of memory range")
+			}
+		}).
+		Export("response").
+		Instantiate(ctx)
+	return err
+}
+
+func wasmHostCall(ctx context.Context, mod api.Module, apiClient *wasmAPIClient, opPtr, opLen, argsPtr, argsLen uint32) (interface{}, error) {
+	op, ok := mod.Memory().Read(opPtr, opLen)
+	if !ok {
+		return nil, errors.New("op out of memory range")
+	}
+	argsBuf, ok := mod.Memory().Read(argsPtr, argsLen)
+	if !ok {
+		return nil, errors.New("args out of memory range")
+	}
+	var args []interface{}
+	if err := json.Unmarshal(argsBuf, &args); err != nil {
+		return nil, errors.Wrap(err, "decode args")
+	}
+	return apiClient.call(ctx, string(op), args)
+}
+
+// wasmAPIClient performs host calls against the Matterless API, the same way matterless.ts does
+type wasmAPIClient struct {
+	url   string
+	token string
+}
+
+func (c *wasmAPIClient) call(ctx context.Context, op string, args []interface{}) (interface{}, error) {
+	argString := func(i int) string {
+		if i < len(args) {
+			s, _ := args[i].(string)
+			return s
+		}
+		return ""
+	}
+	arg := func(i int) interface{} {
+		if i < len(args) {
+			return args[i]
+		}
+		return nil
+	}
+	switch op {
+	case "store.get":
+		result, err := c.storeOp(ctx, "get", argString(0))
+		if err != nil {
+			return nil, err
+		}
+		return result["value"], nil
+	case "store.put":
+		_, err := c.storeOp(ctx, "put", argString(0), arg(1))
+		return nil, err
+	case "store.del":
+		_, err := c.storeOp(ctx, "del", argString(0))
+		return nil, err
+	case "store.query_prefix":
+		result, err := c.storeOp(ctx, "query-prefix", argString(0))
+		if err != nil {
+			return nil, err
+		}
+		if result["results"] == nil {
+			return []interface{}{}, nil
+		}
+		return result["results"], nil
+	case "events.publish":
+		_, err := c.post(ctx, fmt.Sprintf("/_event/%s", url.PathEscape(argString(0))), arg(1))
+		return nil, err
+	case "functions.invoke":
+		return c.post(ctx, fmt.Sprintf("/_function/%s", url.PathEscape(argString(0))), arg(1))
+	default:
+		return nil, fmt.Errorf("unknown operation: %s", op)
+	}
+}
+
+func (c *wasmAPIClient) storeOp(ctx context.Context, op ...interface{}) (map[string]interface{}, error) {
+	result, err := c.post(ctx, "/_store", [][]interface{}{op})
+	if err != nil {
+		return nil, err
+	}
+	results, ok := result.([]interface{})
+	if !ok || len(results) == 0 {
+		return nil, errors.New("invalid store response")
+	}
+	resultObj, ok := results[0].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid store response")
+	}
+	if resultObj["status"] == "error" {
+		return nil, fmt.Errorf("%v", resultObj["error"])
+	}
+	return resultObj, nil
+}
+
+func (c *wasmAPIClient) post(ctx context.Context, path string, body interface{}) (interface{}, error) {
+	if body == nil {
+		body = map[string]interface{}{}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+path, bytes.NewReader(util.MustJsonByteSlice(body)))
+	if err != nil {
+		return nil, errors.Wrap(err, "api request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("bearer %s", c.token))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "api request")
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP Error (%d) %s", resp.StatusCode, respBody)
+	}
+	var result interface{}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, errors.Wrap(err, "decode api response")
+	}
+	if resultObj, ok := result.(map[string]interface{}); ok && resultObj["status"] == "error" {
+		return nil, fmt.Errorf("%v", resultObj["error"])
+	}
+	return result, nil
+}
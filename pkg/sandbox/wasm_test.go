@@ -0,0 +1,59 @@
+package sandbox_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/cluster"
+	"github.com/zefhemel/matterless/pkg/config"
+	"github.com/zefhemel/matterless/pkg/definition"
+	"github.com/zefhemel/matterless/pkg/sandbox"
+)
+
+func TestWasmSandboxFunction(t *testing.T) {
+	a := assert.New(t)
+
+	// Prebuilt from testdata/wasm/function.wat
+	binary, err := os.ReadFile("testdata/wasm/function.wasm")
+	a.NoError(err)
+
+	// Fake API to serve the host store calls
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.Equal("/_store", r.URL.Path)
+		a.Equal("bearer secret", r.Header.Get("Authorization"))
+		var ops [][]interface{}
+		a.NoError(json.NewDecoder(r.Body).Decode(&ops))
+		a.Equal([]interface{}{"get", "greeting"}, ops[0])
+		w.Write([]byte(`[{"status": "ok", "value": "hello"}]`))
+	}))
+	defer apiServer.Close()
+
+	r, ok := sandbox.LookupRuntime("wasm")
+	a.True(ok)
+	logs := make(chan string, 10)
+	inst, err := r.FunctionInstantiator(context.Background(), config.NewConfig(), strings.Replace(apiServer.URL, "127.0.0.1", "%s", 1), "secret", sandbox.RunModeFunction, "TestFunction", func(funcName string, message cluster.LogMessage) {
+		logs <- message.Message
+	}, &definition.FunctionConfig{
+		Init: map[string]interface{}{"greet": true},
+	}, base64.StdEncoding.EncodeToString(binary), definition.LibraryMap{})
+	a.NoError(err)
+	defer inst.Kill()
+
+	for i := 0; i < 3; i++ {
+		result, err := inst.Invoke(context.Background(), map[string]interface{}{"name": "Zef"})
+		a.NoError(err)
+		a.Equal(map[string]interface{}{
+			"event": map[string]interface{}{"name": "Zef"},
+			"init":  map[string]interface{}{"greet": true},
+			"value": "hello",
+		}, result)
+	}
+	a.Equal("Log message", <-logs)
+}
@@ -2,13 +2,14 @@ package store
 
 type EventedStore struct {
 	wrappedStore    Store
-	putCallback     func(key string, val interface{})
+	putCallback     func(key string, oldVal, newVal interface{})
 	deletedCallback func(key string)
+	oldValueFor     func(key string) bool
 }
 
 var _ Store = &EventedStore{}
 
-func NewEventedStore(wrappedStore Store, putCallback func(key string, val interface{}), deletedCallback func(key string)) *EventedStore {
+func NewEventedStore(wrappedStore Store, putCallback func(key string, oldVal, newVal interface{}), deletedCallback func(key string)) *EventedStore {
 	return &EventedStore{
 		wrappedStore:    wrappedStore,
 		putCallback:     putCallback,
@@ -16,11 +17,25 @@ func NewEventedStore(wrappedStore Store, putCallback func(key string, val interf
 	}
 }
 
+// WithOldValues makes puts of keys for which wanted returns true look up the value they replace, to be passed to the
+// put callback (at the cost of an extra read), other puts pass a nil old value
+func (s *EventedStore) WithOldValues(wanted func(key string) bool) *EventedStore {
+	s.oldValueFor = wanted
+	return s
+}
+
 func (s *EventedStore) Put(key string, val interface{}) error {
+	var oldVal interface{}
+	if s.oldValueFor != nil && s.oldValueFor(key) {
+		var err error
+		if oldVal, err = s.wrappedStore.Get(key); err != nil {
+			return err
+		}
+	}
 	if err := s.wrappedStore.Put(key, val); err != nil {
 		return err
 	} else {
-		s.putCallback(key, val)
+		s.putCallback(key, oldVal, val)
 		return nil
 	}
 }
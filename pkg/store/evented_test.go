@@ -0,0 +1,37 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zefhemel/matterless/pkg/store"
+)
+
+func TestEventedStore(t *testing.T) {
+	ls, err := store.NewLevelDBStore("test_evented")
+	assert.NoError(t, err)
+	defer ls.DeleteStore()
+
+	var oldValues, newValues []interface{}
+	deletedKeys := []string{}
+	s := store.NewEventedStore(ls, func(key string, oldVal, newVal interface{}) {
+		oldValues = append(oldValues, oldVal)
+		newValues = append(newValues, newVal)
+	}, func(key string) {
+		deletedKeys = append(deletedKeys, key)
+	}).WithOldValues(func(key string) bool {
+		return key == "name"
+	})
+
+	assert.NoError(t, s.Put("name", "John"))
+	assert.NoError(t, s.Put("name", "Jane"))
+	assert.NoError(t, s.Delete("name"))
+	assert.Equal(t, []interface{}{nil, "John"}, oldValues)
+	assert.Equal(t, []interface{}{"John", "Jane"}, newValues)
+	assert.Equal(t, []string{"name"}, deletedKeys)
+
+	// Old values are only looked up for keys that ask for them
+	assert.NoError(t, s.Put("age", 20))
+	assert.NoError(t, s.Put("age", 21))
+	assert.Equal(t, []interface{}{nil, "John", nil, nil}, oldValues)
+}
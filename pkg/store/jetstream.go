@@ -47,6 +47,7 @@ type JetstreamStore struct {
 	conn            *nats.Conn
 	js              nats.JetStreamContext
 	streamName      string
+	replicas        int
 	localCacheStore Store
 
 	// Event names
@@ -58,6 +59,7 @@ type JetstreamStore struct {
 	ackWaiting map[string]chan struct{}
 
 	// Sync
+	syncLock        sync.Mutex // Only one sync can be in flight at a time
 	syncMessageLock sync.Mutex
 	syncMessageSeq  string
 	syncMessageChan chan struct{}
@@ -67,11 +69,13 @@ type JetstreamStore struct {
 
 var _ Store = &JetstreamStore{}
 
-func NewJetstreamStore(conn *nats.Conn, streamName string, wrappedStore Store) (*JetstreamStore, error) {
+// NewJetstreamStore creates a store on the given stream, replicated across the given number of JetStream servers
+func NewJetstreamStore(conn *nats.Conn, streamName string, wrappedStore Store, replicas int) (*JetstreamStore, error) {
 	var err error
 	jss := &JetstreamStore{
 		conn:            conn,
 		streamName:      streamName,
+		replicas:        replicas,
 		localCacheStore: wrappedStore,
 		syncEvent:       fmt.Sprintf("%s.sync", streamName),
 		putEvent:        fmt.Sprintf("%s.put", streamName),
@@ -91,18 +95,28 @@ func NewJetstreamStore(conn *nats.Conn, streamName string, wrappedStore Store) (
 }
 
 func (jss *JetstreamStore) init() error {
-	_, err := jss.js.StreamInfo(jss.streamName)
+	info, err := jss.js.StreamInfo(jss.streamName)
 	if err != nil {
 		// Likely does not exist yet, let's create it
 		_, err = jss.js.AddStream(&nats.StreamConfig{
 			Name:     jss.streamName,
 			Subjects: []string{fmt.Sprintf("%s.*", jss.streamName)},
 			Storage:  nats.FileStorage,
+			Replicas: jss.replicas,
 		})
 
 		if err != nil {
 			return errors.Wrap(err, "stream create")
 		}
+		return nil
+	}
+	if info.Config.Replicas != jss.replicas {
+		log.Infof("Changing replicas of stream %s from %d to %d", jss.streamName, info.Config.Replicas, jss.replicas)
+		streamConfig := info.Config
+		streamConfig.Replicas = jss.replicas
+		if _, err := jss.js.UpdateStream(&streamConfig); err != nil {
+			log.Warnf("Could not change replicas of stream %s from %d to %d, keeping %d: %s", jss.streamName, info.Config.Replicas, jss.replicas, info.Config.Replicas, err)
+		}
 	}
 	return nil
 }
@@ -143,6 +157,8 @@ func (jss *JetstreamStore) Connect(timeout time.Duration) error {
 func (jss *JetstreamStore) Sync(timeout time.Duration) error {
 	// To figure out when we've processed the backlog of messages we're going to publish a dummy "sync" message
 	// and wait for it to come back to us
+	jss.syncLock.Lock()
+	defer jss.syncLock.Unlock()
 	sm := syncMessage{
 		ID: uuid.NewString(),
 	}
@@ -27,7 +27,7 @@ func TestJetstreamStore(t *testing.T) {
 		levelDBStore, err := store.NewLevelDBStore(fmt.Sprintf("lvldb-%d", i))
 		assert.Nil(t, err)
 		defer levelDBStore.DeleteStore()
-		jss, err := store.NewJetstreamStore(conn, "test", levelDBStore)
+		jss, err := store.NewJetstreamStore(conn, "test", levelDBStore, 1)
 		assert.Nil(t, err)
 		assert.NotNil(t, jss)
 		jetStreamStores = append(jetStreamStores, jss)
@@ -141,3 +141,26 @@ func TestJetstreamStore(t *testing.T) {
 
 	// assert.Fail(t, "fail")
 }
+
+func TestJetstreamStoreReplicas(t *testing.T) {
+	conn, err := cluster.ConnectOrBoot(&config.Config{
+		DataDir:        t.TempDir(),
+		ClusterNatsUrl: "nats://localhost:4327",
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+	levelDBStore, err := store.NewLevelDBStore(t.TempDir())
+	assert.NoError(t, err)
+	jss, err := store.NewJetstreamStore(conn, "replicas", levelDBStore, 1)
+	assert.NoError(t, err)
+	defer jss.DeleteStore()
+
+	// The replica count of the existing stream is changed to the configured one
+	_, err = store.NewJetstreamStore(conn, "replicas", levelDBStore, 3)
+	assert.NoError(t, err)
+	js, err := conn.JetStream()
+	assert.NoError(t, err)
+	info, err := js.StreamInfo("replicas")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, info.Config.Replicas)
+}
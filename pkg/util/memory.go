@@ -0,0 +1,31 @@
+package util
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FreeMemory returns the memory available for new processes in bytes, or 0 when this cannot be determined
+func FreeMemory() uint64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: MemAvailable:    1234567 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+		return kb * 1024
+	}
+	return 0
+}
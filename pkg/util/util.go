@@ -21,6 +21,11 @@ func SafeFilename(s string) string {
 	return safeFilenameRE.ReplaceAllString(s, "_")
 }
 
+// GlobRegexp compiles a pattern in which * matches any sequence of characters into a regular expression
+func GlobRegexp(pattern string) *regexp.Regexp {
+	return regexp.MustCompile(fmt.Sprintf("^%s$", strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*")))
+}
+
 func FlatStringMap(m map[string][]string) map[string]string {
 	m2 := map[string]string{}
 	for k, vs := range m {